@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matches the time, request and status of a Common or Combined Log Format
+// line, as written by nginx and Apache
+var accessLogRe = regexp.MustCompile(`\[([^\]]+)\] "([A-Z]+) (\S+)[^"]*" (\d{3})`)
+
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogSource returns a Source that yields the URLs of the successful GET
+// requests in the nginx/Apache access log read from r, most frequently
+// requested first. Paths are made absolute using base. If top is greater than
+// zero, only that many URLs are yielded; if since is greater than zero, only
+// requests made within that duration of now are counted. Priorities are set
+// relative to the most requested URL, so sorting preserves the ranking.
+func AccessLogSource(r io.Reader, base string, top int, since time.Duration) Source {
+	return &accessLogSource{r: r, base: strings.TrimSuffix(base, "/"), top: top, since: since}
+}
+
+type accessLogSource struct {
+	r     io.Reader
+	base  string
+	top   int
+	since time.Duration
+	urls  Source
+}
+
+func (s *accessLogSource) Next() (Url, error) {
+	if s.urls == nil {
+		urls, err := s.rank()
+		if err != nil {
+			return Url{}, err
+		}
+		s.urls = SliceSource(urls)
+	}
+	return s.urls.Next()
+}
+
+func (s *accessLogSource) rank() ([]Url, error) {
+	var (
+		counts  = make(map[string]float64)
+		scanner = bufio.NewScanner(s.r)
+		cutoff  time.Time
+	)
+	if s.since > 0 {
+		cutoff = time.Now().Add(-s.since)
+	}
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := accessLogRe.FindStringSubmatch(scanner.Text())
+		if m == nil || m[2] != "GET" {
+			continue
+		}
+		if status, _ := strconv.Atoi(m[4]); status < 200 || status >= 400 {
+			continue
+		}
+		if !cutoff.IsZero() {
+			t, err := time.Parse(accessLogTime, m[1])
+			if err != nil || t.Before(cutoff) {
+				continue
+			}
+		}
+		loc := m[3]
+		if !strings.HasPrefix(loc, "http://") && !strings.HasPrefix(loc, "https://") {
+			if s.base == "" {
+				return nil, fmt.Errorf("access log contains relative paths; use -log-base to set the site URL")
+			}
+			loc = s.base + loc
+		}
+		counts[loc]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rankedUrls(counts, s.top), nil
+}
+
+// Returns the URLs in counts ordered by descending count, limited to the top
+// if it is greater than zero, with priorities set relative to the highest
+// count
+func rankedUrls(counts map[string]float64, top int) []Url {
+	urls := make([]Url, 0, len(counts))
+	for loc := range counts {
+		urls = append(urls, Url{Loc: loc})
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		ci, cj := counts[urls[i].Loc], counts[urls[j].Loc]
+		if ci != cj {
+			return ci > cj
+		}
+		return urls[i].Loc < urls[j].Loc
+	})
+	if top > 0 && len(urls) > top {
+		urls = urls[:top]
+	}
+	if len(urls) > 0 && counts[urls[0].Loc] > 0 {
+		most := counts[urls[0].Loc]
+		for i := range urls {
+			urls[i].Priority = counts[urls[i].Loc] / most
+		}
+	}
+	return urls
+}
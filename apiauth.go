@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	apiTokens  stringsFlag
+	tlsCert    string
+	tlsKey     string
+	clientCA   string
+	clientRate float64
+)
+
+// Registers the flags that secure the serve API
+func apiFlags(fs *flag.FlagSet) {
+	fs.Var(&apiTokens, "api-token", "only serve the job API and dashboard to clients presenting this bearer token, or as the password of HTTP basic auth in browsers (may be repeated for several clients; default $OCP_API_TOKEN)")
+	fs.StringVar(&tlsCert, "tls-cert", "", "serve over HTTPS with this PEM certificate (chain)")
+	fs.StringVar(&tlsKey, "tls-key", "", "PEM private key of the -tls-cert")
+	fs.StringVar(&clientCA, "client-ca", "", "with -tls-cert, only accept clients presenting a certificate signed by a CA in this PEM file (mutual TLS)")
+	fs.Float64Var(&clientRate, "client-rate", 0, "maximum API requests per second from each client, identified by its token, certificate or IP address, answering those over it with 429 Too Many Requests (0: unlimited)")
+}
+
+// Returns the TLS configuration of the server per -tls-cert, -tls-key and
+// -client-ca, or nil if it serves plain HTTP
+func serverTLS() (*tls.Config, error) {
+	if tlsCert == "" {
+		if tlsKey != "" || clientCA != "" {
+			return nil, fmt.Errorf("-tls-key and -client-ca require -tls-cert")
+		}
+		return nil, nil
+	}
+	if tlsKey == "" {
+		return nil, fmt.Errorf("-tls-cert requires -tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCA)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// Authenticates clients of the API by -api-token or the tokens of the
+// tenants in the config, and rate limits them per -client-rate or the
+// api_rate of their tenant
+type apiGuard struct {
+	tokens   []string
+	tenants  []tenant
+	limiter  *clientLimiter
+	failures *clientLimiter // of each address, so tokens can't be guessed
+}
+
+// How many times a second an address may present an invalid token, after a
+// burst of maxAuthFailures
+const (
+	authFailureRate = 0.1
+	maxAuthFailures = 5
+)
+
+func newAPIGuard() (*apiGuard, error) {
+	g := &apiGuard{tokens: apiTokens, tenants: cfg.Tenants, limiter: newClientLimiter(), failures: newClientLimiter()}
+	g.failures.burst = maxAuthFailures
+	if len(g.tokens) == 0 && os.Getenv("OCP_API_TOKEN") != "" {
+		g.tokens = []string{os.Getenv("OCP_API_TOKEN")}
+	}
+	for _, token := range g.tokens {
+		// Would let in requests without a token
+		if token == "" {
+			return nil, fmt.Errorf("-api-token can't be empty")
+		}
+	}
+	return g, nil
+}
+
+// Returns the token presented with r as a bearer token or basic auth password
+func presentedToken(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Returns what identifies the client of r for rate limiting: its token or
+// tenant, its certificate or its IP address; the tenant that made r, if any;
+// and whether it presented a valid token
+func (g *apiGuard) identify(r *http.Request) (string, *tenant, bool) {
+	presented := []byte(presentedToken(r))
+	var (
+		client string
+		t      *tenant
+	)
+	for i, token := range g.tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			client = "token " + strconv.Itoa(i+1)
+		}
+	}
+	for i := range g.tenants {
+		if subtle.ConstantTimeCompare(presented, []byte(g.tenants[i].Token)) == 1 {
+			client, t = "tenant "+g.tenants[i].Name, &g.tenants[i]
+		}
+	}
+	if client != "" {
+		return client, t, true
+	}
+	return clientAddr(r), nil, false
+}
+
+// Returns the certificate or IP address of the client of r
+func clientAddr(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "certificate " + r.TLS.PeerCertificates[0].Subject.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Wraps h, which needs a token if auth is set and there are -api-token or
+// tenants, and which can tell the tenant of a request with requestTenant
+func (g *apiGuard) wrap(h http.Handler, auth bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		auth = auth && len(g.tokens)+len(g.tenants) > 0
+		addr := clientAddr(r)
+		if auth {
+			// Before checking the token, so a guess can't tell if it is right
+			if wait := g.failures.wait(addr, authFailureRate, now); wait > 0 {
+				tooMany(w, wait)
+				return
+			}
+		}
+		client, t, ok := g.identify(r)
+		if auth && !ok {
+			g.failures.take(addr, authFailureRate, now)
+			w.Header().Set("WWW-Authenticate", `Basic realm="ocp"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		rate := clientRate
+		if t != nil && t.APIRate > 0 {
+			rate = t.APIRate
+		}
+		if rate > 0 {
+			if wait := g.limiter.take(client, rate, now); wait > 0 {
+				tooMany(w, wait)
+				return
+			}
+		}
+		h.ServeHTTP(w, withTenant(r, t))
+	})
+}
+
+// Responds that the client must wait before trying again
+func tooMany(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// Limits the requests of each client to a rate per second, allowing bursts
+// of up to burst, or a second's worth if it is 0
+type clientLimiter struct {
+	mu      sync.Mutex
+	burst   float64
+	clients map[string]*bucket
+	swept   time.Time
+}
+
+// The requests a client may still make, as of when, and how many more it may
+// make per second, up to burst
+type bucket struct {
+	tokens float64
+	when   time.Time
+	rate   float64
+	burst  float64
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{clients: make(map[string]*bucket)}
+}
+
+// Returns the bucket of client, refilled as of now. l.mu must be held.
+func (l *clientLimiter) refill(client string, rate float64, now time.Time) *bucket {
+	if now.Sub(l.swept) > time.Minute {
+		// Forget clients that could make a full burst again, as they are
+		// the same as new ones
+		for c, b := range l.clients {
+			if b.tokens+now.Sub(b.when).Seconds()*b.rate >= b.burst {
+				delete(l.clients, c)
+			}
+		}
+		l.swept = now
+	}
+	burst := l.burst
+	if burst == 0 {
+		burst = math.Max(1, rate)
+	}
+	b := l.clients[client]
+	if b == nil {
+		b = &bucket{tokens: burst, when: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.when).Seconds()*rate)
+	b.when, b.rate, b.burst = now, rate, burst
+	return b
+}
+
+// Returns 0 if client, which may make rate requests per second, may make one
+// at now, or else how long until it may
+func (l *clientLimiter) wait(client string, rate float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.refill(client, rate, now); b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	return 0
+}
+
+// Takes a request of client, which may make rate per second, at now,
+// returning 0 if it is allowed, or else how long until it would be
+func (l *clientLimiter) take(client string, rate float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(client, rate, now)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// Warns if the API is served on a public address without authentication
+func warnExposed(addr string) {
+	if nowarn || len(apiTokens) > 0 || os.Getenv("OCP_API_TOKEN") != "" || len(cfg.Tenants) > 0 || clientCA != "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		return
+	}
+	log.Printf("Warning: serving the job API on %s without -api-token or -client-ca\n", addr)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Auth returns a Middleware that authenticates requests as user with
+// password using the given scheme: basic, digest or ntlm.
+func Auth(scheme, user, password string) (Middleware, error) {
+	switch strings.ToLower(scheme) {
+	case "", "basic":
+		return func(next Fetcher) Fetcher {
+			return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+				req.SetBasicAuth(user, password)
+				return next.Do(ctx, req)
+			})
+		}, nil
+	case "digest":
+		return func(next Fetcher) Fetcher {
+			return &digestFetcher{next: next, user: user, password: password, challenges: make(map[string]*digestChallenge)}
+		}, nil
+	case "ntlm":
+		return func(next Fetcher) Fetcher {
+			return &ntlmFetcher{next: next, user: user, password: password}
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown authentication type %q (expected basic, digest or ntlm)", scheme)
+}
+
+// Discards the rest of a response that is about to be retried, so its
+// connection can be reused
+func discard(res *http.Response) {
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+// Returns the parameters of the WWW-Authenticate challenge for scheme in res,
+// and whether there was one
+func authChallenge(res *http.Response, scheme string) (string, bool) {
+	for _, v := range res.Header["Www-Authenticate"] {
+		if len(v) >= len(scheme) && strings.EqualFold(v[:len(scheme)], scheme) {
+			return strings.TrimSpace(v[len(scheme):]), true
+		}
+	}
+	return "", false
+}
+
+// A Digest access authentication (RFC 7616) challenge
+type digestChallenge struct {
+	mu        sync.Mutex
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	nc        int
+}
+
+// Parses the comma-separated key="value" parameters of a challenge
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.Index(s, "=")
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			j := strings.Index(s[1:], `"`)
+			if j < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:j+1], s[j+2:]
+			}
+		} else {
+			j := strings.Index(s, ",")
+			if j < 0 {
+				j = len(s)
+			}
+			val, s = strings.TrimSpace(s[:j]), s[j:]
+		}
+		params[key] = val
+	}
+	return params
+}
+
+func (c *digestChallenge) hash() hash.Hash {
+	if strings.HasPrefix(strings.ToUpper(c.algorithm), "SHA-256") {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+func (c *digestChallenge) h(s string) string {
+	h := c.hash()
+	io.WriteString(h, s)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the Authorization header for a request
+func (c *digestChallenge) authorize(user, password, method, uri string) string {
+	c.mu.Lock()
+	c.nc++
+	nc := fmt.Sprintf("%08x", c.nc)
+	c.mu.Unlock()
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	ha1 := c.h(user + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(c.algorithm), "-sess") {
+		ha1 = c.h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := c.h(method + ":" + uri)
+	var response string
+	qop := ""
+	for _, v := range strings.Split(c.qop, ",") {
+		if strings.TrimSpace(v) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop != "" {
+		response = c.h(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = c.h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+	s := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, user, c.realm, c.nonce, uri, response)
+	if c.algorithm != "" {
+		s += ", algorithm=" + c.algorithm
+	}
+	if c.opaque != "" {
+		s += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	if qop != "" {
+		s += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	return s
+}
+
+// Authenticates requests with Digest authentication, reusing the last
+// challenge from each host so most requests need only one round trip
+type digestFetcher struct {
+	next       Fetcher
+	user       string
+	password   string
+	mu         sync.Mutex
+	challenges map[string]*digestChallenge
+}
+
+func (f *digestFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	c := f.challenges[req.URL.Host]
+	f.mu.Unlock()
+	if c != nil {
+		req = req.Clone(ctx)
+		req.Header.Set("Authorization", c.authorize(f.user, f.password, req.Method, req.URL.RequestURI()))
+	}
+	res, err := f.next.Do(ctx, req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	params, ok := authChallenge(res, "Digest")
+	if !ok {
+		return res, nil
+	}
+	p := parseAuthParams(params)
+	c = &digestChallenge{
+		realm:     p["realm"],
+		nonce:     p["nonce"],
+		opaque:    p["opaque"],
+		algorithm: p["algorithm"],
+		qop:       p["qop"],
+	}
+	f.mu.Lock()
+	f.challenges[req.URL.Host] = c
+	f.mu.Unlock()
+	discard(res)
+	retry := req.Clone(ctx)
+	retry.Header.Set("Authorization", c.authorize(f.user, f.password, req.Method, req.URL.RequestURI()))
+	return f.next.Do(ctx, retry)
+}
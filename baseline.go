@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The outcome of priming a URL in a baseline run
+type baselineUrl struct {
+	Status   int     `json:"status,omitempty"`
+	Duration float64 `json:"duration_ms"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func (b baselineUrl) failed() bool {
+	return b.Error != "" || b.Status >= 400
+}
+
+// The per-URL outcomes of a run, saved with -save-baseline
+type baseline struct {
+	Created time.Time              `json:"created"`
+	Urls    map[string]baselineUrl `json:"urls"`
+}
+
+// The baseline loaded with -baseline
+var base *baseline
+
+func loadBaseline(path string) (*baseline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &baseline{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return b, nil
+}
+
+// Returns the baseline of the results of this run. Only the URLs that were
+// given are included, not discovered pages or variants.
+func currentBaseline() *baseline {
+	b := &baseline{Created: time.Now(), Urls: make(map[string]baselineUrl)}
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	for _, r := range results {
+		if r.Url.depth > 0 {
+			continue
+		}
+		e := baselineUrl{Status: r.Status, Duration: millis(r.Duration)}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+		b.Urls[r.Url.Loc] = e
+	}
+	return b
+}
+
+func (b *baseline) save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// Returns the regressions of cur against the baseline b: URLs that fail now
+// but didn't, and those that are more than slowerPct percent and at least
+// minSlower slower
+func regressions(b, cur *baseline, slowerPct float64, minSlower time.Duration) []string {
+	var regs []string
+	for loc, c := range cur.Urls {
+		old, ok := b.Urls[loc]
+		if !ok {
+			continue
+		}
+		switch {
+		case c.failed() && !old.failed():
+			now := c.Error
+			if now == "" {
+				now = fmt.Sprint("HTTP ", c.Status)
+			}
+			regs = append(regs, fmt.Sprintf("new failure: %s (%s, was %d)", loc, now, old.Status))
+		case !c.failed() && !old.failed() && old.Duration > 0 &&
+			c.Duration > old.Duration*(1+slowerPct/100) && c.Duration-old.Duration >= millis(minSlower):
+			regs = append(regs, fmt.Sprintf("slower: %s (%s, was %s, +%.0f%%)", loc,
+				msDuration(c.Duration), msDuration(old.Duration), 100*(c.Duration/old.Duration-1)))
+		}
+	}
+	sort.Strings(regs)
+	return regs
+}
+
+func msDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Millisecond)
+}
+
+// Logs the regressions of this run against the -baseline, and returns
+// whether there were any
+func reportRegressions() bool {
+	regs := regressions(base, currentBaseline(), regressionPct, regressionMin)
+	if len(regs) == 0 {
+		if verbose {
+			log.Println("No regressions against", baselinePath)
+		}
+		return false
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Regressions against %s (%s):\n", baselinePath, base.Created.Format(time.RFC3339))
+	for _, r := range regs {
+		fmt.Fprintf(&b, "  %s\n", r)
+	}
+	log.Print(b.String())
+	return true
+}
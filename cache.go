@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a cache did with a request, as reported by its response headers
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheBypass = "BYPASS"
+)
+
+// A cache status header declared with -cache-header, and the cache status
+// each of its values stands for. Other values are misses.
+type cacheHeaderRule struct {
+	header string
+	values map[string]string // upper case
+}
+
+var cacheHeaders []cacheHeaderRule
+
+// Parses a -cache-header like "X-Proxy-Cache: HIT,STALE", listing the values
+// that are hits, or "X-Proxy-Cache: hit=HIT,STALE; bypass=BYPASS"
+func parseCacheHeader(s string) (cacheHeaderRule, error) {
+	i := strings.Index(s, ":")
+	if i < 1 {
+		return cacheHeaderRule{}, fmt.Errorf("invalid -cache-header %q (expected e.g. 'X-Proxy-Cache: HIT')", s)
+	}
+	r := cacheHeaderRule{header: strings.TrimSpace(s[:i]), values: make(map[string]string)}
+	spec := strings.TrimSpace(s[i+1:])
+	if !strings.Contains(spec, "=") {
+		spec = "hit=" + spec
+	}
+	for _, clause := range strings.Split(spec, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		j := strings.Index(clause, "=")
+		status := ""
+		if j > 0 {
+			status = strings.ToUpper(strings.TrimSpace(clause[:j]))
+		}
+		if status != cacheHit && status != cacheMiss && status != cacheBypass {
+			return cacheHeaderRule{}, fmt.Errorf("invalid -cache-header %q (expected hit=, miss= or bypass= before each list of values)", s)
+		}
+		for _, v := range strings.Split(clause[j+1:], ",") {
+			if v = strings.ToUpper(strings.TrimSpace(v)); v != "" {
+				r.values[v] = status
+			}
+		}
+	}
+	return r, nil
+}
+
+// Returns HIT, MISS or BYPASS according to the -cache-header rules or the
+// cache status header of a well-known cache, or "" if there is none
+func cacheStatus(h http.Header) string {
+	for _, r := range cacheHeaders {
+		if v := strings.ToUpper(strings.TrimSpace(h.Get(r.header))); v != "" {
+			if s, ok := r.values[v]; ok {
+				return s
+			}
+			return cacheMiss
+		}
+	}
+	// LiteSpeed Cache: hit, hit,private, miss or no-cache
+	if v := strings.ToLower(h.Get("X-LiteSpeed-Cache")); v != "" {
+		switch {
+		case strings.HasPrefix(v, "hit"):
+			return cacheHit
+		case strings.HasPrefix(v, "miss"):
+			return cacheMiss
+		}
+		return cacheBypass
+	}
+	// WP Rocket, when its static files are served by rocket-nginx
+	if v := strings.ToLower(h.Get("X-Rocket-Nginx-Serving-Static")); v != "" {
+		if v == "yes" {
+			return cacheHit
+		}
+		return cacheMiss
+	}
+	// RFC 9211, e.g. "ExampleCache; hit" or "ExampleCache; fwd=uri-miss"
+	if v := strings.ToLower(h.Get("Cache-Status")); v != "" {
+		switch {
+		case strings.Contains(v, "; hit") || strings.Contains(v, ";hit"):
+			return cacheHit
+		case strings.Contains(v, "fwd=bypass"):
+			return cacheBypass
+		case strings.Contains(v, "fwd="):
+			return cacheMiss
+		}
+	}
+	for _, k := range []string{"Cf-Cache-Status", "X-Cache-Status", "X-Proxy-Cache", "X-Cache"} {
+		v := strings.ToUpper(h.Get(k))
+		switch {
+		case v == "":
+			continue
+		case strings.Contains(v, "HIT"), v == "STALE", v == "UPDATING", v == "REVALIDATED":
+			return cacheHit
+		case strings.Contains(v, "MISS"), v == "EXPIRED":
+			return cacheMiss
+		case v == "BYPASS", v == "DYNAMIC", strings.Contains(v, "PASS"):
+			return cacheBypass
+		}
+	}
+	return ""
+}
+
+// Requests each URL of urlset again after priming, and logs how many the
+// cache served, listing those it didn't if -v is set. Returns whether every
+// URL was a hit.
+func verifyUrlset(ctx context.Context, urlset *Urlset) bool {
+	var (
+		mu     sync.Mutex
+		counts = make(map[string]int)
+		missed []string
+	)
+	for _, u := range urlset.Url {
+		sem <- true
+		wg.Add(1)
+		go func(u Url) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			status := "error"
+			res, err := get(ctx, u.Loc)
+			if err == nil {
+				discard(res)
+				if status = cacheStatus(res.Header); status == "" {
+					status = "unknown"
+				}
+			}
+			mu.Lock()
+			counts[status]++
+			if status != cacheHit {
+				missed = append(missed, fmt.Sprintf("%s (%s)", u.Loc, status))
+			}
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	var b strings.Builder
+	b.WriteString("Cache status after priming:\n")
+	for _, s := range byCount(counts) {
+		fmt.Fprintf(&b, "  %7d  %s\n", counts[s], s)
+	}
+	if verbose && len(missed) > 0 {
+		sort.Strings(missed)
+		b.WriteString("Not served from the cache:\n")
+		for _, m := range missed {
+			fmt.Fprintf(&b, "  %s\n", m)
+		}
+	}
+	log.Print(b.String())
+	return len(missed) == 0
+}
+
+// Returns how much longer a response with the headers h stays fresh in a
+// shared cache, from its Age and its Cache-Control s-maxage or max-age or
+// its Expires, and whether that is known. Without an Age header, the response
+// must be a cache hit.
+func freshness(h http.Header) (time.Duration, bool) {
+	var (
+		lifetime     time.Duration
+		haveLifetime bool
+	)
+	for _, d := range strings.Split(strings.ToLower(h.Get("Cache-Control")), ",") {
+		d = strings.TrimSpace(d)
+		switch {
+		case d == "no-store", d == "no-cache", d == "private":
+			return 0, true
+		case strings.HasPrefix(d, "s-maxage="):
+			if n, err := strconv.Atoi(strings.Trim(d[9:], `"`)); err == nil {
+				lifetime, haveLifetime = time.Duration(n)*time.Second, true
+			}
+		case strings.HasPrefix(d, "max-age=") && !haveLifetime:
+			if n, err := strconv.Atoi(strings.Trim(d[8:], `"`)); err == nil {
+				lifetime = time.Duration(n) * time.Second
+				haveLifetime = true
+			}
+		}
+	}
+	if !haveLifetime {
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = expires.Sub(date)
+	}
+	var age time.Duration
+	if v := h.Get("Age"); v != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, false
+		}
+		age = time.Duration(n) * time.Second
+	} else if cacheStatus(h) != cacheHit {
+		return 0, false
+	}
+	return lifetime - age, true
+}
+
+// The number of URLs skipped with -refresh-within
+var freshSkipped int64
+
+// Probes loc with a HEAD request and returns whether the cached response
+// stays fresh for longer than -refresh-within, so needn't be primed
+func stillFresh(ctx context.Context, loc string) bool {
+	req, err := http.NewRequest("HEAD", loc, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", userAgent)
+	res, err := fetcherOf(ctx).Do(ctx, req)
+	if err != nil {
+		return false
+	}
+	discard(res)
+	if res.StatusCode >= 300 {
+		return false
+	}
+	left, ok := freshness(res.Header)
+	if !ok || left <= refreshWithin {
+		return false
+	}
+	atomic.AddInt64(&freshSkipped, 1)
+	if verbose {
+		log.Printf("Fresh for %s: %s\n", left, loc)
+	}
+	return true
+}
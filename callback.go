@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A batch of the results of a job, POSTed to its callback URL
+type callbackBatch struct {
+	Job     int            `json:"job"`
+	Batch   int            `json:"batch"` // numbered from 1
+	Final   bool           `json:"final"` // the job has finished
+	State   string         `json:"state"`
+	Error   string         `json:"error,omitempty"`
+	Total   int            `json:"total"`
+	Primed  int            `json:"primed"` // so far
+	Failed  int            `json:"failed"`
+	Dropped int            `json:"dropped,omitempty"` // batches not sent as the callback was too slow
+	Results []resultRecord `json:"results"`
+}
+
+// Checks the callback URL of a job
+func checkCallback(loc string) error {
+	u, err := url.Parse(loc)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback URL %q", loc)
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); (ip != nil && internalIP(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("callback URL %q is on this machine or its link-local network", loc)
+	}
+	return nil
+}
+
+// Returns whether callbacks may not be sent to ip, unless
+// -allow-internal-callbacks is set
+func internalIP(ip net.IP) bool {
+	return !allowInternalCallbacks && (ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
+
+// Refuses connections to internal addresses, which a host name of a callback
+// URL may resolve to
+func refuseInternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return fmt.Errorf("callback to internal address %s refused", host)
+	}
+	return nil
+}
+
+var callbackClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{Timeout: 30 * time.Second, Control: refuseInternal}).DialContext,
+	},
+}
+
+// How many full batches may wait to be sent before more are dropped
+const maxCallbackBatches = 100
+
+// Collects the results of a job and POSTs them to its callback URL in
+// batches, in order, without ever waiting for the callback
+type callbacker struct {
+	mu       sync.Mutex
+	loc      string
+	size     int
+	next     callbackBatch
+	queued   []callbackBatch
+	finished bool
+	ready    chan struct{} // signalled when a batch is queued
+	done     chan struct{} // closed when every batch has been sent
+}
+
+func newCallbacker(j *job) *callbacker {
+	c := &callbacker{
+		loc:   j.Callback,
+		size:  j.Batch,
+		next:  callbackBatch{Job: j.Id, Batch: 1, State: jobRunning, Total: j.Total},
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	if c.size <= 0 {
+		c.size = callbackSize
+	}
+	go c.send()
+	return c
+}
+
+func (c *callbacker) send() {
+	for {
+		c.mu.Lock()
+		if len(c.queued) == 0 {
+			finished := c.finished
+			c.mu.Unlock()
+			if finished {
+				close(c.done)
+				return
+			}
+			<-c.ready
+			continue
+		}
+		b := c.queued[0]
+		c.queued = c.queued[1:]
+		c.mu.Unlock()
+		if err := sendWebhook(callbackClient, c.loc, b); err != nil && !nowarn {
+			log.Printf("Error sending batch %d of job %d to its callback: %v\n", b.Batch, b.Job, err)
+		}
+	}
+}
+
+// Adds r to the batch, sending it once it is full
+func (c *callbacker) add(r result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next.Results = append(c.next.Results, r.record())
+	c.next.Primed++
+	if r.failed() {
+		c.next.Failed++
+	}
+	if len(c.next.Results) >= c.size {
+		c.flush()
+	}
+}
+
+// Queues the batch and starts the next one, dropping it if too many are
+// waiting, unless it is the last. c.mu must be held.
+func (c *callbacker) flush() {
+	if len(c.queued) < maxCallbackBatches || c.next.Final {
+		c.queued = append(c.queued, c.next)
+		c.next.Dropped = 0
+	} else {
+		c.next.Dropped++
+		if !nowarn {
+			log.Printf("Dropped batch %d of job %d: its callback is too slow\n", c.next.Batch, c.next.Job)
+		}
+	}
+	c.next.Batch++
+	c.next.Results = nil
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Queues the last batch, with the outcome of the finished job j
+func (c *callbacker) finish(j *job) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next.Final = true
+	c.next.State = j.State
+	c.next.Error = j.Error
+	c.next.Total = j.Total
+	c.flush()
+	c.finished = true
+}
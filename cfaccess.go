@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// CloudflareAccess returns a Middleware that authenticates requests to sites
+// behind Cloudflare Access with a service token. If useCookie is true, the
+// CF_Authorization cookie Access issues in response is sent instead of the
+// token on later requests to the same host, completing the service token
+// flow as a browser would.
+func CloudflareAccess(clientId, clientSecret string, useCookie bool) Middleware {
+	return func(next Fetcher) Fetcher {
+		var (
+			mu      sync.Mutex
+			cookies = make(map[string]string)
+		)
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			cookie := cookies[req.URL.Host]
+			mu.Unlock()
+			if cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "CF_Authorization", Value: cookie})
+			} else {
+				req.Header.Set("CF-Access-Client-Id", clientId)
+				req.Header.Set("CF-Access-Client-Secret", clientSecret)
+			}
+			res, err := next.Do(ctx, req)
+			if err != nil || !useCookie {
+				return res, err
+			}
+			for _, c := range res.Cookies() {
+				if c.Name == "CF_Authorization" && c.Value != "" {
+					mu.Lock()
+					cookies[req.URL.Host] = c.Value
+					mu.Unlock()
+				}
+			}
+			return res, nil
+		})
+	}
+}
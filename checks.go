@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reports pages whose rel="canonical" URL differs from their sitemap URL
+func checkCanonical(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if res.StatusCode != http.StatusOK {
+		return
+	}
+	for _, loc := range relLinks(res, body, "canonical") {
+		if loc != u.Loc {
+			log.Printf("Canonical mismatch for %s: %s\n", u.Loc, loc)
+		}
+		return
+	}
+}
+
+// Returns whether the robots directives in v, e.g. "noindex, follow" or
+// "googlebot: none", exclude the page from indexing
+func hasNoindex(v string) bool {
+	for _, d := range strings.Split(v, ",") {
+		if i := strings.Index(d, ":"); i >= 0 {
+			d = d[i+1:]
+		}
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "noindex" || d == "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the page is excluded from indexing by an X-Robots-Tag header
+// or a robots <meta> tag
+func noindex(res *http.Response, body []byte) bool {
+	for _, v := range res.Header["X-Robots-Tag"] {
+		if hasNoindex(v) {
+			return true
+		}
+	}
+	if isHTML(res) {
+		for _, t := range htmlTags(body) {
+			name := strings.ToLower(t.Attrs["name"])
+			if t.Name == "meta" && (name == "robots" || name == "googlebot" || name == "bingbot") && hasNoindex(t.Attrs["content"]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports pages in the sitemap that are excluded from indexing
+func checkNoindex(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if noindex(res, body) {
+		log.Printf("Noindex page in sitemap: %s\n", u.Loc)
+	}
+}
+
+// Returns when the page was last modified according to its modification date
+// <meta> tags, its Last-Modified header or its publication date <meta> tag,
+// in that order, and which of them the date came from
+func pageModified(res *http.Response, body []byte) (time.Time, string, bool) {
+	props := make(map[string]string)
+	if isHTML(res) {
+		for _, t := range htmlTags(body) {
+			if t.Name == "meta" && t.Attrs["property"] != "" {
+				props[strings.ToLower(t.Attrs["property"])] = t.Attrs["content"]
+			}
+		}
+	}
+	for _, p := range []string{"article:modified_time", "og:updated_time"} {
+		if t, err := parseLastmod(props[p]); err == nil {
+			return t, p, true
+		}
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		return t, "Last-Modified", true
+	}
+	if t, err := parseLastmod(props["article:published_time"]); err == nil {
+		return t, "article:published_time", true
+	}
+	return time.Time{}, "", false
+}
+
+// Reports pages whose sitemap lastmod differs from when the page says it was
+// modified by more than -check-lastmod
+func checkLastmod(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if u.Lastmod == "" || res.StatusCode != http.StatusOK {
+		return
+	}
+	lastmod, err := parseLastmod(u.Lastmod)
+	if err != nil {
+		return
+	}
+	modified, from, ok := pageModified(res, body)
+	if !ok {
+		return
+	}
+	if d := lastmod.Sub(modified); d > lastmodTolerance || -d > lastmodTolerance {
+		log.Printf("Inaccurate lastmod for %s: %s in sitemap, %s per %s\n", u.Loc, u.Lastmod, modified.Format(time.RFC3339), from)
+	}
+}
+
+var (
+	bodyHashesMu sync.Mutex
+	bodyHashes   = make(map[[sha256.Size]byte][]string)
+)
+
+// Records the hash of the page's body, for reportDuplicates
+func hashBody(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if res.StatusCode != http.StatusOK || len(body) == 0 {
+		return
+	}
+	h := sha256.Sum256(body)
+	bodyHashesMu.Lock()
+	bodyHashes[h] = append(bodyHashes[h], u.Loc)
+	bodyHashesMu.Unlock()
+}
+
+// Returns the groups of URLs whose bodies were identical, largest first
+func duplicateBodies() [][]string {
+	bodyHashesMu.Lock()
+	defer bodyHashesMu.Unlock()
+	var clusters [][]string
+	for _, locs := range bodyHashes {
+		if len(locs) > 1 {
+			c := append([]string(nil), locs...)
+			sort.Strings(c)
+			clusters = append(clusters, c)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters
+}
+
+// Logs the groups of URLs whose bodies were identical
+func reportDuplicates() {
+	for _, c := range duplicateBodies() {
+		log.Printf("%d URLs have identical content:\n  %s\n", len(c), strings.Join(c, "\n  "))
+	}
+}
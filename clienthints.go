@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The Client Hints sent for each device with -client-hints
+var clientHintProfiles = map[string]http.Header{
+	"mobile": {
+		"Sec-Ch-Ua-Mobile":      {"?1"},
+		"Sec-Ch-Ua-Platform":    {`"Android"`},
+		"Sec-Ch-Viewport-Width": {"412"},
+		"Viewport-Width":        {"412"},
+		"Sec-Ch-Dpr":            {"2.625"},
+		"Dpr":                   {"2.625"},
+	},
+	"tablet": {
+		"Sec-Ch-Ua-Mobile":      {"?0"},
+		"Sec-Ch-Ua-Platform":    {`"Android"`},
+		"Sec-Ch-Viewport-Width": {"800"},
+		"Viewport-Width":        {"800"},
+		"Sec-Ch-Dpr":            {"2"},
+		"Dpr":                   {"2"},
+	},
+	"desktop": {
+		"Sec-Ch-Ua-Mobile":      {"?0"},
+		"Sec-Ch-Ua-Platform":    {`"Windows"`},
+		"Sec-Ch-Viewport-Width": {"1920"},
+		"Viewport-Width":        {"1920"},
+		"Sec-Ch-Dpr":            {"1"},
+		"Dpr":                   {"1"},
+	},
+}
+
+// The devices primed with -client-hints
+var clientHintDevices []string
+
+func parseClientHints(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if _, ok := clientHintProfiles[v]; !ok {
+			var names []string
+			for k := range clientHintProfiles {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("invalid -client-hints value %q (expected %s)", v, strings.Join(names, ", "))
+		}
+		clientHintDevices = append(clientHintDevices, v)
+	}
+	return nil
+}
+
+// Primes u again with the Client Hints of each -client-hints device
+func primeClientHints(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if u.device != "" || u.depth > 0 {
+		return
+	}
+	for _, d := range clientHintDevices {
+		if enqueue(ctx, u.Loc, Url{Loc: u.Loc, Priority: u.Priority, depth: 1, device: d}) && verbose {
+			log.Printf("Priming %s variant of %s\n", d, u.Loc)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// A subcommand, e.g. ocp print
+type command struct {
+	name  string
+	args  string
+	desc  string
+	flags []func(fs *flag.FlagSet)
+	run   func(args []string) int
+	// Whether the command keeps running until stopped, so it can be run as a
+	// service
+	daemon bool
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:  "prime",
+			args:  "<sitemap>",
+			desc:  "prime the URLs in a sitemap (the default)",
+			flags: []func(*flag.FlagSet){inputFlags, requestFlags, primeFlags},
+			run:   runPrime,
+		},
+		{
+			name:  "print",
+			args:  "<sitemap>",
+			desc:  "print the sorted URLs in a sitemap (can be used with xargs)",
+			flags: []func(*flag.FlagSet){inputFlags, requestFlags, printFlags},
+			run:   runPrint,
+		},
+		{
+			name:  "validate",
+			args:  "<sitemap>",
+			desc:  "check a sitemap for invalid and duplicate entries without priming it",
+			flags: []func(*flag.FlagSet){inputFlags, requestFlags},
+			run:   runValidate,
+		},
+		{
+			name:  "stats",
+			args:  "<sitemap>",
+			desc:  "summarize the hosts, sections, priorities and lastmod ages in a sitemap without priming it",
+			flags: []func(*flag.FlagSet){inputFlags, requestFlags, statsFlags},
+			run:   runStats,
+		},
+		{
+			name:  "crawl",
+			args:  "<url>...",
+			desc:  "prime pages by following links from the given URLs",
+			flags: []func(*flag.FlagSet){requestFlags, primeFlags, crawlFlags},
+			run:   runCrawl,
+		},
+		{
+			name:   "monitor",
+			args:   "<sitemap>",
+			desc:   "check a sample of the URLs in a sitemap at intervals, alerting when availability or latency breach thresholds",
+			flags:  []func(*flag.FlagSet){inputFlags, requestFlags, monitorFlags},
+			run:    runMonitor,
+			daemon: true,
+		},
+		{
+			name:   "serve",
+			args:   "",
+			desc:   "run an HTTP API that accepts priming jobs",
+			flags:  []func(*flag.FlagSet){requestFlags, serveFlags, apiFlags},
+			run:    runServe,
+			daemon: true,
+		},
+		{
+			name:  "history",
+			args:  "",
+			desc:  "list the runs recorded with -history-db, with the trend of their error rates and latencies",
+			flags: []func(*flag.FlagSet){historyFlags},
+			run:   runHistory,
+		},
+		{
+			name:  "show",
+			args:  "<run id>",
+			desc:  "show the failures and slowest URLs of a run recorded with -history-db, or compare it with an earlier run",
+			flags: []func(*flag.FlagSet){historyFlags},
+			run:   runShow,
+		},
+		{
+			name:  "ctl",
+			args:  "[status|pause|resume]",
+			desc:  "show or change the concurrency and rate of a running ocp serve, or pause or resume its requests",
+			flags: []func(*flag.FlagSet){ctlFlags},
+			run:   runCtl,
+		},
+		{
+			name:  "diff",
+			args:  "<old sitemap> <new sitemap>",
+			desc:  "print the URLs added to and removed from a sitemap",
+			flags: []func(*flag.FlagSet){requestFlags, diffFlags},
+			run:   runDiff,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Parses the command's flags from args and runs it, returning the exit code
+func (c *command) main(args []string) int {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	for _, f := range c.flags {
+		f(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n\n%s\n\nFlags:\n", os.Args[0], c.name, c.args, c.desc)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLog(); err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if c.daemon {
+		cacheSitemaps = true
+		if code, ok := runService(func() int { return c.run(fs.Args()) }); ok {
+			return code
+		}
+	}
+	return c.run(fs.Args())
+}
+
+func runPrime(args []string) int {
+	if !haveInput(args) {
+		fmt.Println("Error: no sitemap or URLs given")
+		return 2
+	}
+	// Loads the config and -sentry-dsn before setupPrime starts the heartbeat
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if err := setupPrime(); err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if replayPath != "" {
+		return replay(ctx, replayPath)
+	}
+	if err := beforeRun(ctx, args); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	// Child sitemaps are primed as they are read, unless the run must be
+	// confirmed first
+	if exportPath == "" && len(cfg.Scenario) == 0 && len(cfg.Tiers) == 0 && !confirming() {
+		streamChildren(ctx)
+	}
+	urlset, ok := loadUrlset(ctx, args)
+	if !ok {
+		stopProfiling()
+		runEnded(1)
+		return 1
+	}
+	if !confirmUrlset(ctx, urlset) {
+		stopProfiling()
+		return exitDeclined
+	}
+	return prime(ctx, urlset)
+}
+
+func runPrint(args []string) int {
+	if !haveInput(args) {
+		fmt.Println("Error: no sitemap or URLs given")
+		return 2
+	}
+	if err := setupPrint(); err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	urlset, ok := loadUrlset(ctx, args)
+	if !ok {
+		return 1
+	}
+	if err := printUrlset(os.Stdout, urlset); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Returns the compression of a file, by its name: gzip, zstd, br or ""
+func encodingFromName(name string) string {
+	if i := strings.IndexAny(name, "?#"); i >= 0 && strings.Contains(name, "://") {
+		name = name[:i]
+	}
+	switch path.Ext(name) {
+	case ".gz":
+		return "gzip"
+	case ".zst":
+		return "zstd"
+	case ".br":
+		return "br"
+	}
+	return ""
+}
+
+// Wraps f in a reader that decompresses data compressed with encoding (a
+// Content-Encoding value). As the standard library has no Zstandard or Brotli
+// decoders, those are decompressed by the zstd and brotli commands.
+func decompress(encoding string, f io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return f, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return &multiCloser{gz, []io.Closer{f, gz}}, nil
+	case "zstd":
+		return decompressCmd("zstd", f)
+	case "br":
+		return decompressCmd("brotli", f)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", encoding)
+}
+
+// Decompresses the body of res if the server compressed it even though
+// -no-compression asked it not to, so its uncompressed size is recorded
+func uncompressed(loc string, res *http.Response) {
+	enc := res.Header.Get("Content-Encoding")
+	if enc == "" || strings.EqualFold(enc, "identity") {
+		return
+	}
+	if !nowarn {
+		log.Printf("%s was compressed with %s despite Accept-Encoding: identity\n", loc, enc)
+	}
+	if body, err := decompress(enc, res.Body); err == nil {
+		res.Body = body
+	}
+}
+
+// A reader of the output of a decompression command
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+	in  io.Closer
+	eof bool
+}
+
+func (c *cmdReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// Returns the command's error if its output was read to the end, as the data
+// was then corrupt or truncated. Closing the output early makes it fail.
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	c.in.Close()
+	if err := c.cmd.Wait(); err != nil && c.eof {
+		return fmt.Errorf("%s: %v", c.cmd.Args[0], err)
+	}
+	return nil
+}
+
+func decompressCmd(name string, f io.ReadCloser) (io.ReadCloser, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("decompressing %s data requires the %s command: %v", name, name, err)
+	}
+	cmd := exec.Command(name, "-d", "-c")
+	cmd.Stdin = f
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{ReadCloser: out, cmd: cmd, in: f}, nil
+}
+
+// Magic numbers of the compression formats that can be sniffed. Brotli
+// streams have none.
+var magics = []struct {
+	encoding string
+	magic    []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// Returns the compression indicated by a Content-Type header, if any
+func encodingFromContentType(ct string) string {
+	switch strings.TrimSpace(strings.SplitN(strings.ToLower(ct), ";", 2)[0]) {
+	case "application/gzip", "application/x-gzip", "application/gzip-compressed", "application/x-gzip-compressed":
+		return "gzip"
+	case "application/zstd":
+		return "zstd"
+	case "application/x-brotli", "application/brotli":
+		return "br"
+	}
+	return ""
+}
+
+// A ReadCloser reading through a bufio.Reader
+type bufReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// Wraps f in a reader that decompresses it, detecting the compression by its
+// magic number. hint is the compression indicated by the Content-Encoding or
+// Content-Type header or the file name, which is only trusted for formats
+// that can't be sniffed. Data compressed more than once (e.g. a .gz file
+// served with Content-Encoding: gzip) is decompressed repeatedly.
+func sniffDecompress(f io.ReadCloser, hint string) (io.ReadCloser, error) {
+	for i := 0; i < 3; i++ {
+		br := bufio.NewReader(f)
+		f = &bufReadCloser{br, f}
+		head, _ := br.Peek(4)
+		encoding := ""
+		for _, m := range magics {
+			if bytes.HasPrefix(head, m.magic) {
+				encoding = m.encoding
+				break
+			}
+		}
+		if encoding == "" && hint == "br" && i == 0 {
+			encoding = hint
+		}
+		if encoding == "" {
+			return f, nil
+		}
+		if verbose {
+			log.Printf("Extracting %s compressed data\n", encoding)
+		}
+		d, err := decompress(encoding, f)
+		if err != nil {
+			return nil, err
+		}
+		f = d
+	}
+	return f, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Settings that are impractical to give as flags, read from the JSON file
+// given with -config
+type config struct {
+	OAuth2 *oauth2Config `json:"oauth2"`
+	Login  *loginConfig  `json:"login"`
+	// Credentials per host name (or host:port), used unless -auth is given
+	Credentials map[string]credentials `json:"credentials"`
+	// Expected latencies and statuses per URL pattern
+	SLA []slaRule `json:"sla"`
+	// Statuses URLs must respond with, e.g. 301 for moved pages
+	Expect []expectRule `json:"expect"`
+	// Groups of URLs to prime one after the other
+	Scenario []scenarioStep `json:"scenario"`
+	// Groups of URLs to prime at the same time, each at its own pace
+	Tiers []tierRule `json:"tiers"`
+	// Teams sharing the serve command
+	Tenants []tenant `json:"tenants"`
+	// Where failed runs and panics are reported
+	Sentry *sentryConfig `json:"sentry"`
+}
+
+var cfg config
+
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	return dec.Decode(&cfg)
+}
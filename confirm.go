@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The number of URLs sampled to estimate how long a run will take
+const confirmSample = 3
+
+// Returns whether ocp should ask before priming more than -confirm-over URLs:
+// unless -yes is set, when both stdin and stdout are terminals
+func confirming() bool {
+	if assumeYes || confirmOver == 0 {
+		return false
+	}
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the average time it takes to fetch the first few URLs of urlset
+func sampleDuration(ctx context.Context, urlset *Urlset) time.Duration {
+	var total time.Duration
+	n := 0
+	for _, u := range urlset.Url {
+		if n == confirmSample {
+			break
+		}
+		start := time.Now()
+		res, err := get(ctx, u.Loc)
+		if err != nil {
+			continue
+		}
+		discard(res)
+		total += time.Since(start)
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
+
+// Returns how long priming n URLs that each take perUrl will take, with -c
+// and -rate
+func estimateDuration(n int, perUrl time.Duration) time.Duration {
+	d := time.Duration(n) * perUrl / time.Duration(throttle)
+	if rateLimit > 0 {
+		if r := time.Duration(float64(n) / rateLimit * float64(time.Second)); r > d {
+			d = r
+		}
+	}
+	return d
+}
+
+// Describes the run and asks whether to go ahead, returning the answer
+func confirmRun(in io.Reader, out io.Writer, n int, perUrl time.Duration) bool {
+	pace := ""
+	if rateLimit > 0 {
+		pace = fmt.Sprintf(" (at most %g requests per second)", rateLimit)
+	}
+	fmt.Fprintf(out, "About to prime %d URLs, %d at a time%s.\n", n, throttle, pace)
+	if perUrl > 0 {
+		fmt.Fprintf(out, "At %s per URL, this will take about %s.\n", perUrl.Round(time.Millisecond), estimateDuration(n, perUrl).Round(time.Second))
+	}
+	fmt.Fprint(out, "Continue? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Asks before priming urlset if it has more than -confirm-over URLs and ocp
+// is run interactively, returning whether to go ahead
+func confirmUrlset(ctx context.Context, urlset *Urlset) bool {
+	n := len(urlset.Url)
+	if !confirming() || uint(n) <= confirmOver {
+		return true
+	}
+	return confirmRun(os.Stdin, os.Stdout, n, sampleDuration(ctx, urlset))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// The media types allowed with -content-types, e.g. text/html or text/*
+var allowedTypes []string
+
+// The number of URLs whose responses weren't downloaded or that weren't
+// requested with -content-types
+var typeSkipped int64
+
+// Parses a -content-types like text/html,application/json
+func parseContentTypes(s string) ([]string, error) {
+	var ts []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if i := strings.Index(t, "/"); i < 1 || i == len(t)-1 {
+			return nil, fmt.Errorf("invalid -content-types value %q (expected e.g. text/html or text/*)", t)
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// Returns whether the Content-Type of res is allowed by -content-types.
+// Responses without one are allowed.
+func typeAllowed(res *http.Response) bool {
+	ct := res.Header.Get("Content-Type")
+	if len(allowedTypes) == 0 || ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return true
+	}
+	for _, t := range allowedTypes {
+		if mt == t || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notes that the response of loc was not downloaded for its type
+func skipType(loc string, res *http.Response) {
+	atomic.AddInt64(&typeSkipped, 1)
+	if verbose {
+		log.Printf("Skipped %s (%s)\n", loc, res.Header.Get("Content-Type"))
+	}
+}
+
+// Probes loc with a HEAD request and returns whether its Content-Type is not
+// allowed by -content-types, so it needn't be primed
+func unwantedType(ctx context.Context, loc string) bool {
+	req, err := http.NewRequest("HEAD", loc, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", userAgent)
+	res, err := fetcherOf(ctx).Do(ctx, req)
+	if err != nil {
+		return false
+	}
+	discard(res)
+	if res.StatusCode >= 300 || typeAllowed(res) {
+		return false
+	}
+	skipType(loc, res)
+	return true
+}
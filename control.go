@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most URLs that can be primed at once when the concurrency is changed
+// with the control API
+const maxThrottle = 1000
+
+// Controls how fast URLs are primed: how many at once, how many requests are
+// sent per second, and whether requests are paused. The serve command lets
+// all three be changed while it runs, and the job it runs may lower the
+// first two further.
+type controller struct {
+	mu          sync.Mutex
+	limit       int           // URLs to prime at once
+	held        int           // slots of sem held back to enforce the limits
+	interval    time.Duration // between requests, or 0
+	jobLimit    int           // of the running job, or 0
+	jobInterval time.Duration
+	next        time.Time // when the next request may be sent
+	paused      bool
+	closed      bool          // outside the -window
+	resume      chan struct{} // closed when requests are resumed
+	wake        chan struct{}
+}
+
+// The controller of the run, set up from -c and -rate
+var ctl *controller
+
+func newController(limit uint, rate float64) *controller {
+	c := &controller{limit: int(limit), wake: make(chan struct{}, 1)}
+	c.setRate(rate)
+	return c
+}
+
+func (c *controller) setRate(rate float64) {
+	c.interval = 0
+	if rate > 0 {
+		c.interval = time.Duration(float64(time.Second) / rate)
+	}
+}
+
+// Makes the number of URLs primed at once adjustable by replacing sem with a
+// larger one, and holding back the slots above the limit
+func (c *controller) resizable() {
+	s := make(chan bool, maxThrottle)
+	sem = s
+	go func() {
+		for range c.wake {
+			c.reconcile(s)
+		}
+	}()
+	c.wake <- struct{}{}
+}
+
+// Holds back or releases slots of sem until limit URLs can be primed at once.
+// Holding one back waits for a prime to finish if all are in use.
+func (c *controller) reconcile(sem chan bool) {
+	for {
+		c.mu.Lock()
+		limit, _ := c.limits()
+		diff := cap(sem) - limit - c.held
+		c.mu.Unlock()
+		switch {
+		case diff > 0:
+			sem <- true
+		case diff < 0:
+			<-sem
+		default:
+			return
+		}
+		c.mu.Lock()
+		if diff > 0 {
+			c.held++
+		} else {
+			c.held--
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Sets whether requests are paused and whether they are outside the -window,
+// letting waiting requests through once neither is. c.mu must be held.
+func (c *controller) block(paused, closed bool) {
+	was := c.paused || c.closed
+	c.paused, c.closed = paused, closed
+	switch now := paused || closed; {
+	case now && !was:
+		c.resume = make(chan struct{})
+	case !now && was:
+		close(c.resume)
+	}
+}
+
+// Sets the number of URLs to prime at once, which takes effect if c is
+// resizable. c.mu must be held.
+func (c *controller) setLimit(n int) {
+	c.limit = n
+	c.reconcileLater()
+}
+
+// Wakes the goroutine of a resizable c to enforce its limits. c.mu must be
+// held.
+func (c *controller) reconcileLater() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Caps the concurrency and rate while a job runs, below those set with -c,
+// -rate or the control API, which are left as they are; 0 lifts a cap
+func (c *controller) setJobLimits(limit int, rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobLimit, c.jobInterval = limit, 0
+	if rate > 0 {
+		c.jobInterval = time.Duration(float64(time.Second) / rate)
+	}
+	c.reconcileLater()
+}
+
+// Returns the number of URLs to prime at once and the interval between
+// requests, the lower of the settings and the caps of the job. c.mu must be
+// held.
+func (c *controller) limits() (int, time.Duration) {
+	limit, interval := c.limit, c.interval
+	if c.jobLimit > 0 && c.jobLimit < limit {
+		limit = c.jobLimit
+	}
+	if c.jobInterval > interval {
+		interval = c.jobInterval
+	}
+	return limit, interval
+}
+
+// Waits until a request may be sent: while paused or outside the -window, and for the -rate
+func (c *controller) wait(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		if c.paused || c.closed {
+			resume := c.resume
+			c.mu.Unlock()
+			select {
+			case <-resume:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var d time.Duration
+		if _, interval := c.limits(); interval > 0 {
+			now := time.Now()
+			if c.next.Before(now) {
+				c.next = now
+			}
+			d = c.next.Sub(now)
+			c.next = c.next.Add(interval)
+		}
+		c.mu.Unlock()
+		if d > 0 {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+// Control returns a Middleware that holds requests back while c is paused
+// and to keep to its rate, and to the rate of the tier in their context.
+func Control(c *controller) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			if t, ok := ctx.Value(tierKey{}).(*controller); ok {
+				if err := t.wait(ctx); err != nil {
+					return nil, err
+				}
+			}
+			if err := c.wait(ctx); err != nil {
+				return nil, err
+			}
+			return next.Do(ctx, req)
+		})
+	}
+}
+
+// The settings of a controller, as shown and changed with the control API
+type controlState struct {
+	Concurrency int     `json:"concurrency"`
+	Rate        float64 `json:"rate"` // requests per second, or 0 if unlimited
+	Paused      bool    `json:"paused"`
+	Closed      bool    `json:"outside_window,omitempty"`
+	InFlight    int     `json:"in_flight"`
+	// Lower limits of the running job
+	JobConcurrency int     `json:"job_concurrency,omitempty"`
+	JobRate        float64 `json:"job_rate,omitempty"`
+}
+
+// A change to the settings of a controller; unset fields are left as they are
+type controlUpdate struct {
+	Concurrency *int     `json:"concurrency"`
+	Rate        *float64 `json:"rate"`
+	Paused      *bool    `json:"paused"`
+}
+
+func (c *controller) state() controlState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := controlState{Concurrency: c.limit, Paused: c.paused, Closed: c.closed, InFlight: len(flights()), JobConcurrency: c.jobLimit}
+	if c.interval > 0 {
+		s.Rate = float64(time.Second) / float64(c.interval)
+	}
+	if c.jobInterval > 0 {
+		s.JobRate = float64(time.Second) / float64(c.jobInterval)
+	}
+	return s
+}
+
+// Applies u, logging what changed
+func (c *controller) update(u controlUpdate) error {
+	if u.Concurrency != nil && (*u.Concurrency < 1 || *u.Concurrency > maxThrottle) {
+		return fmt.Errorf("concurrency must be between 1 and %d", maxThrottle)
+	}
+	if u.Rate != nil && *u.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u.Concurrency != nil && *u.Concurrency != c.limit {
+		c.setLimit(*u.Concurrency)
+		log.Println("Concurrency changed to", c.limit)
+	}
+	if u.Rate != nil {
+		c.setRate(*u.Rate)
+		log.Printf("Rate changed to %g requests per second\n", *u.Rate)
+	}
+	if u.Paused != nil && *u.Paused != c.paused {
+		c.block(*u.Paused, c.closed)
+		if c.paused {
+			log.Println("Paused")
+		} else {
+			log.Println("Resumed")
+		}
+	}
+	return nil
+}
+
+// Serves the control API, which requires the token as a bearer token:
+//
+//	GET  /control shows the concurrency, rate and whether requests are paused
+//	POST /control {"concurrency": 4, "rate": 10, "paused": true} changes them
+func (c *controller) handler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var u controlUpdate
+			if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid update: "+err.Error())
+				return
+			}
+			if err := c.update(u); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, c.state())
+	}
+}
+
+var (
+	ctlServer      string
+	ctlToken       string
+	ctlConcurrency int
+	ctlRate        float64
+)
+
+func ctlFlags(fs *flag.FlagSet) {
+	fs.StringVar(&ctlServer, "server", "http://localhost:8080", "URL of the ocp serve to control")
+	fs.StringVar(&ctlToken, "token", os.Getenv("OCP_CONTROL_TOKEN"), "the -control-token of the server (default $OCP_CONTROL_TOKEN)")
+	fs.IntVar(&ctlConcurrency, "c", 0, "change the number of URLs primed at once to this")
+	fs.Float64Var(&ctlRate, "rate", -1, "change the maximum requests per second to this (0: unlimited)")
+}
+
+func runCtl(args []string) int {
+	var u controlUpdate
+	if ctlConcurrency != 0 {
+		u.Concurrency = &ctlConcurrency
+	}
+	if ctlRate >= 0 {
+		u.Rate = &ctlRate
+	}
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "status":
+	case "pause", "resume":
+		paused := action == "pause"
+		u.Paused = &paused
+	default:
+		fmt.Printf("Error: unknown action %q (expected status, pause or resume)\n", action)
+		return 2
+	}
+	method, body := "GET", []byte(nil)
+	if u != (controlUpdate{}) {
+		method = "POST"
+		body, _ = json.Marshal(u)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(ctlServer, "/")+"/control", bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	req.Header.Set("Authorization", "Bearer "+ctlToken)
+	req.Header.Set("Content-Type", "application/json")
+	c := &http.Client{Timeout: 30 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e map[string]string
+		json.NewDecoder(res.Body).Decode(&e)
+		fmt.Printf("Error: %s: %s\n", res.Status, e["error"])
+		return 1
+	}
+	var s controlState
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	rate := "unlimited"
+	if s.Rate > 0 {
+		rate = fmt.Sprintf("%g/s", s.Rate)
+	}
+	fmt.Printf("Concurrency: %d\nRate: %s\nPaused: %t\n", s.Concurrency, rate, s.Paused)
+	if s.Closed {
+		fmt.Println("Outside window: true")
+	}
+	if s.JobConcurrency > 0 {
+		fmt.Println("Job concurrency:", s.JobConcurrency)
+	}
+	if s.JobRate > 0 {
+		fmt.Printf("Job rate: %g/s\n", s.JobRate)
+	}
+	fmt.Printf("In flight: %d\n", s.InFlight)
+	return 0
+}
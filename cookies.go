@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cookie saved with -cookie-jar
+type savedCookie struct {
+	Url      string    `json:"url"` // that set it
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Expires  time.Time `json:"expires"` // zero for session cookies
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+func (c savedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// A cookie jar that keeps a copy of the cookies it is given, as those in a
+// cookiejar.Jar can't be listed, so that they can be saved between runs
+type persistentJar struct {
+	*cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]savedCookie // by domain, path and name
+}
+
+// The jar used with -cookie-jar
+var cookieJar *persistentJar
+
+// Returns the key of a cookie set by u, which is the same for cookies that
+// replace each other
+func cookieKey(u *url.URL, c *http.Cookie) string {
+	domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+	if domain == "" {
+		domain = strings.ToLower(u.Hostname())
+	}
+	p := c.Path
+	if !strings.HasPrefix(p, "/") {
+		// The default path, as in RFC 6265 section 5.1.4
+		p = "/"
+		if i := strings.LastIndex(u.Path, "/"); i > 0 {
+			p = u.Path[:i]
+		}
+	}
+	return domain + ";" + p + ";" + c.Name
+}
+
+func (j *persistentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		s := savedCookie{
+			Url:      u.Scheme + "://" + u.Host + u.Path,
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		switch {
+		case c.MaxAge < 0:
+			s.Expires = now
+		case c.MaxAge > 0:
+			s.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			s.Expires = c.Expires
+		}
+		key := cookieKey(u, c)
+		if s.expired(now) {
+			delete(j.cookies, key)
+		} else {
+			j.cookies[key] = s
+		}
+	}
+}
+
+// Reads the cookies saved at path into a new jar. A missing file gives an
+// empty jar.
+func loadCookieJar(path string) (*persistentJar, error) {
+	jar, _ := cookiejar.New(nil)
+	j := &persistentJar{Jar: jar, cookies: make(map[string]savedCookie)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved []savedCookie
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, s := range saved {
+		u, err := url.Parse(s.Url)
+		if err != nil || s.expired(now) {
+			continue
+		}
+		j.SetCookies(u, []*http.Cookie{{
+			Name:     s.Name,
+			Value:    s.Value,
+			Domain:   s.Domain,
+			Path:     s.Path,
+			Expires:  s.Expires,
+			Secure:   s.Secure,
+			HttpOnly: s.HttpOnly,
+		}})
+	}
+	return j, nil
+}
+
+// Writes the unexpired cookies of the jar to path, replacing it atomically.
+// The file is only readable by the user, as it may hold session cookies.
+func (j *persistentJar) save(path string) error {
+	now := time.Now()
+	j.mu.Lock()
+	saved := make([]savedCookie, 0, len(j.cookies))
+	for _, s := range j.cookies {
+		if !s.expired(now) {
+			saved = append(saved, s)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(saved, func(a, b int) bool {
+		if saved[a].Url != saved[b].Url {
+			return saved[a].Url < saved[b].Url
+		}
+		return saved[a].Name < saved[b].Name
+	})
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// Returns whether the -cookie-jar holds cookies for loc, e.g. from an
+// earlier login
+func haveSession(loc string) bool {
+	if cookieJar == nil {
+		return false
+	}
+	u, err := url.Parse(loc)
+	return err == nil && len(cookieJar.Cookies(u)) > 0
+}
+
+// Saves the cookies to the -cookie-jar file
+func saveCookies() {
+	if err := cookieJar.save(cookieJarPath); err != nil && !nowarn {
+		log.Printf("Error saving cookies to %s: %v\n", cookieJarPath, err)
+	}
+}
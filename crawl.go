@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	crawlDepth       uint
+	crawlMax         uint
+	crawlScope       string
+	crawlAllowHosts  string
+	crawlDepthLimits string
+
+	allowHosts  []string
+	depthLimits []uint
+
+	crawlMu   sync.Mutex
+	crawled   uint
+	crawledAt = make(map[int]uint) // pages discovered per depth
+)
+
+func crawlFlags(fs *flag.FlagSet) {
+	fs.UintVar(&crawlDepth, "depth", 2, "follow links this many pages deep from the given URLs")
+	fs.UintVar(&crawlMax, "crawl-max", 0, "stop discovering pages after this many (0 for no limit)")
+	fs.StringVar(&crawlScope, "scope", "host", "follow links to pages on the same host (host), or on any host of the same registered domain, e.g. shop.mysite.com from www.mysite.com (domain)")
+	fs.StringVar(&crawlAllowHosts, "allow-hosts", "", "also follow links to these hosts, e.g. shop.mysite.com,*.cdn.mysite.com")
+	fs.StringVar(&crawlDepthLimits, "depth-limits", "", "discover at most this many pages at each depth, e.g. 100,1000 for 100 pages linked from the given URLs and 1000 at each depth below")
+}
+
+// Parses the -allow-hosts and -depth-limits
+func setupCrawl() error {
+	if crawlScope != "host" && crawlScope != "domain" {
+		return fmt.Errorf("invalid -scope %q (expected host or domain)", crawlScope)
+	}
+	allowHosts, depthLimits = nil, nil
+	for _, h := range strings.Split(crawlAllowHosts, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			allowHosts = append(allowHosts, h)
+		}
+	}
+	for _, v := range strings.Split(crawlDepthLimits, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid -depth-limits value %q (expected a number of pages)", v)
+		}
+		depthLimits = append(depthLimits, uint(n))
+	}
+	return nil
+}
+
+// The second-level domains under which ccTLDs register domains, e.g. co.uk
+var secondLevels = map[string]bool{"co": true, "com": true, "net": true, "org": true, "ac": true, "edu": true, "gov": true, "ne": true, "or": true}
+
+// Returns the domain host is registered under, e.g. mysite.co.uk for
+// www.mysite.co.uk. This is an approximation of the public suffix list, which
+// the standard library lacks.
+func registeredDomain(host string) string {
+	labels := strings.Split(strings.ToLower(host), ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && secondLevels[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// Returns whether a link from the page at base to link is within the -scope
+// or -allow-hosts
+func inScope(base, link *url.URL) bool {
+	host := strings.ToLower(link.Hostname())
+	for _, h := range allowHosts {
+		if host == h || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	if crawlScope == "domain" {
+		return registeredDomain(host) == registeredDomain(base.Hostname())
+	}
+	return strings.EqualFold(link.Host, base.Host)
+}
+
+// Counts a page discovered at depth, unless the -crawl-max or -depth-limits
+// have been reached
+func crawlBudget(depth int) bool {
+	crawlMu.Lock()
+	defer crawlMu.Unlock()
+	if crawlMax > 0 && crawled >= crawlMax {
+		return false
+	}
+	if len(depthLimits) > 0 {
+		limit := depthLimits[len(depthLimits)-1]
+		if depth <= len(depthLimits) {
+			limit = depthLimits[depth-1]
+		}
+		if crawledAt[depth] >= limit {
+			return false
+		}
+	}
+	crawled++
+	crawledAt[depth]++
+	return true
+}
+
+// Returns a counted page to the budget, as it had already been discovered
+func refundBudget(depth int) {
+	crawlMu.Lock()
+	crawled--
+	crawledAt[depth]--
+	crawlMu.Unlock()
+}
+
+// Enqueues the pages in the -scope linked from the page with <a href>, up to
+// -depth deep, -crawl-max pages in total and the -depth-limits at each depth
+func crawlLinks(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if uint(u.depth) >= crawlDepth || !isHTML(res) || res.Request == nil {
+		return
+	}
+	base := res.Request.URL
+	for _, t := range htmlTags(body) {
+		href := t.Attrs["href"]
+		if t.Name != "a" || href == "" || t.hasRel("nofollow") {
+			continue
+		}
+		link, err := url.Parse(resolve(base, href))
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") || !inScope(base, link) {
+			continue
+		}
+		link.Fragment = ""
+		if !crawlBudget(u.depth + 1) {
+			continue
+		}
+		if !enqueue(ctx, base.String(), Url{Loc: link.String(), depth: u.depth + 1}) {
+			refundBudget(u.depth + 1)
+		}
+	}
+}
+
+func runCrawl(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("Error: no URLs to start crawling from given")
+		return 2
+	}
+	if err := setupCrawl(); err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if err := setupPrime(); err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if err := beforeRun(ctx, args); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	inspectors = append(inspectors, crawlLinks)
+	urlset := &Urlset{Url: urlSlice(args)}
+	crawled = uint(len(urlset.Url))
+	return prime(ctx, urlset)
+}
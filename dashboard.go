@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The data of the dashboard page
+type dashboardPage struct {
+	Running  *job
+	InFlight []inFlightUrl
+	Queued   int
+	Jobs     []job // the others, newest first
+}
+
+// A URL being primed by the running job
+type inFlightUrl struct {
+	Url string
+	For time.Duration
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"elapsed": func(from, to *time.Time) string {
+		if from == nil {
+			return ""
+		}
+		end := time.Now()
+		if to != nil {
+			end = *to
+		}
+		return end.Sub(*from).Round(time.Second).String()
+	},
+	"percent": func(n, total int) int {
+		if total == 0 {
+			return 0
+		}
+		return n * 100 / total
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>Optimus Cache Prime</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: .3em .8em; border-bottom: 1px solid #ddd; }
+.failed { color: #b00; }
+.done { color: #070; }
+progress { width: 20em; }
+textarea, input[type=text] { width: 40em; }
+</style>
+</head>
+<body>
+<h1>Optimus Cache Prime</h1>
+<h2>Current run</h2>
+{{with .Running}}
+<p>Job {{.Id}}: {{if .Sitemap}}{{.Sitemap}}{{else}}{{len .Urls}} URLs{{end}}, running for {{elapsed .Started nil}}</p>
+<p><progress value="{{.Primed}}" max="{{.Total}}"></progress> {{.Primed}} of {{.Total}} ({{percent .Primed .Total}}%), <span class="failed">{{.Failed}} failed</span></p>
+{{if $.InFlight}}
+<table>
+<tr><th>In flight</th><th>For</th></tr>
+{{range $.InFlight}}<tr><td>{{.Url}}</td><td>{{.For}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{if .Failures}}<details><summary>Failures</summary><ul>{{range .Failures}}<li>{{.}}</li>{{end}}</ul></details>{{end}}
+{{else}}
+<p>No job is running.</p>
+{{end}}
+{{if .Queued}}<p>{{.Queued}} jobs queued.</p>{{end}}
+<h2>Prime</h2>
+<form method="post" action="/prime">
+<p><input type="text" name="sitemap" placeholder="http://mysite.com/sitemap.xml"></p>
+<p><textarea name="urls" rows="3" placeholder="or URLs, one per line"></textarea></p>
+<p><input type="submit" value="Prime"></p>
+</form>
+<h2>Jobs</h2>
+{{if .Jobs}}
+<table>
+<tr><th>Job</th><th>Input</th><th>State</th><th>Created</th><th>Took</th><th>Primed</th><th>Failed</th></tr>
+{{range .Jobs}}<tr>
+<td>{{.Id}}</td>
+<td>{{if .Sitemap}}{{.Sitemap}}{{else}}{{len .Urls}} URLs{{end}}</td>
+<td class="{{.State}}">{{.State}}{{if .Error}}: {{.Error}}{{end}}</td>
+<td>{{.Created.Format "2006-01-02 15:04:05"}}</td>
+<td>{{elapsed .Started .Finished}}</td>
+<td>{{.Primed}}</td>
+<td>{{if .Failures}}<details><summary class="failed">{{.Failed}}</summary><ul>{{range .Failures}}<li>{{.}}</li>{{end}}</ul></details>{{else}}{{.Failed}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No jobs yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// Serves the dashboard, which shows the progress of the running job, the
+// other jobs and a form to submit one
+func (s *jobServer) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var p dashboardPage
+	t := requestTenant(r)
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if !t.sees(j) {
+			continue
+		}
+		c := s.snapshot(j)
+		switch c.State {
+		case jobRunning:
+			p.Running = &c
+		case jobQueued:
+			p.Queued++
+			p.Jobs = append(p.Jobs, c)
+		default:
+			p.Jobs = append(p.Jobs, c)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(p.Jobs, func(i, k int) bool { return p.Jobs[i].Id > p.Jobs[k].Id })
+	if p.Running != nil {
+		now := time.Now()
+		for _, f := range flights() {
+			p.InFlight = append(p.InFlight, inFlightUrl{f.loc, now.Sub(f.start).Round(time.Millisecond)})
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, p); err != nil && !nowarn {
+		log.Println("Error rendering the dashboard:", err)
+	}
+}
+
+// Returns whether r was sent by a page of this server, per its Origin or
+// Referer header, which browsers send with form submissions
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	if from == "" {
+		// Not sent by a browser
+		return true
+	}
+	u, err := url.Parse(from)
+	return err == nil && u.Host == r.Host
+}
+
+// Submits a job from the dashboard's form
+func (s *jobServer) primeForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		// Another site's page can't submit jobs with the browser's credentials
+		http.Error(w, "cross-origin form submission", http.StatusForbidden)
+		return
+	}
+	j := job{
+		Sitemap: strings.TrimSpace(r.FormValue("sitemap")),
+		Urls:    strings.Fields(r.FormValue("urls")),
+	}
+	if j.Sitemap == "" && len(j.Urls) == 0 {
+		http.Error(w, "a job needs a sitemap or URLs", http.StatusBadRequest)
+		return
+	}
+	if j.Sitemap != "" {
+		if err := checkRemote(j.Sitemap); err != nil {
+			http.Error(w, "invalid sitemap: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := requestTenant(r).claim(&j); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.submit(&j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// Returns the command that runs query against the database at dsn, and the
+// separator of its output
+func dbCommand(dsn, query string) (*exec.Cmd, rune, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch u.Scheme {
+	case "sqlite", "sqlite3":
+		path := u.Path
+		if u.Host != "" {
+			path = u.Host + path // sqlite://relative/path.db
+		}
+		return exec.Command("sqlite3", "-header", "-csv", path, query), 0, nil
+	case "postgres", "postgresql":
+		cmd := exec.Command("psql", "--csv", "--no-psqlrc", "-v", "ON_ERROR_STOP=1", "-c", query)
+		var p string
+		if u.User != nil {
+			p, _ = u.User.Password()
+			u.User = url.User(u.User.Username())
+		}
+		if q := u.Query(); q.Get("password") != "" {
+			p = q.Get("password")
+			q.Del("password")
+			u.RawQuery = q.Encode()
+		}
+		if p != "" {
+			// Passed in the environment so it isn't visible in ps
+			cmd.Env = append(os.Environ(), "PGPASSWORD="+p)
+		}
+		cmd.Args = append(cmd.Args, u.String())
+		return cmd, 0, nil
+	case "mysql":
+		args := []string{"--batch", "-e", query}
+		if u.Hostname() != "" {
+			args = append(args, "-h", u.Hostname())
+		}
+		if u.Port() != "" {
+			args = append(args, "-P", u.Port())
+		}
+		cmd := exec.Command("mysql")
+		if u.User != nil {
+			args = append(args, "-u", u.User.Username())
+			if p, ok := u.User.Password(); ok {
+				// Passed in the environment so it isn't visible in ps
+				cmd.Env = append(os.Environ(), "MYSQL_PWD="+p)
+			}
+		}
+		cmd.Args = append(cmd.Args, append(args, strings.TrimPrefix(u.Path, "/"))...)
+		return cmd, '\t', nil
+	}
+	return nil, 0, fmt.Errorf("unsupported database %q (expected a postgres://, mysql:// or sqlite:// URL)", dsn)
+}
+
+// DatabaseSource returns a Source that yields a URL for each row returned by
+// query from the database at dsn, using the sqlite3, psql or mysql command.
+// URLs are made from rows as in rowUrl, with the template tmpl if it is not
+// empty. $VARIABLES in dsn are expanded from the environment.
+func DatabaseSource(dsn, query, tmpl string) Source {
+	return &lazySource{load: func() ([]Url, error) {
+		var t *template.Template
+		if tmpl != "" {
+			var err error
+			if t, err = template.New("db-url").Option("missingkey=error").Parse(tmpl); err != nil {
+				return nil, err
+			}
+		}
+		cmd, comma, err := dbCommand(os.ExpandEnv(dsn), query)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := exec.LookPath(cmd.Path); err != nil {
+			return nil, fmt.Errorf("database queries require the %s command: %v", cmd.Args[0], err)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("database query: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		rows, err := readRows(&stdout, comma)
+		if err != nil {
+			return nil, fmt.Errorf("database query: %v", err)
+		}
+		urls := make([]Url, 0, len(rows))
+		for _, row := range rows {
+			u, err := rowUrl(row, t)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, u)
+		}
+		return urls, nil
+	}}
+}
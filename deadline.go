@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxDuration     time.Duration
+	deadlineHit     int32 // set once the -max-duration has passed
+	deadlineSkipped int64 // URLs not primed because of it
+)
+
+// Stops starting new primes once the -max-duration has passed, letting those
+// in flight finish
+func startDeadline() {
+	time.AfterFunc(maxDuration, func() {
+		log.Printf("Reached the -max-duration of %s; not starting any more primes\n", maxDuration)
+		atomic.StoreInt32(&deadlineHit, 1)
+	})
+}
+
+// Returns whether the -max-duration has passed
+func pastDeadline() bool {
+	return atomic.LoadInt32(&deadlineHit) == 1
+}
+
+// Skips a URL as the -max-duration has passed
+func skipPastDeadline() {
+	atomic.AddInt64(&deadlineSkipped, 1)
+	atomic.AddInt64(&completed, 1)
+	<-sem
+	wg.Done()
+}
+
+// Logs how many URLs were primed and skipped before the -max-duration
+func reportDeadline() {
+	n, failed := counts()
+	log.Printf("Stopped at the -max-duration: primed %d URLs (%d failed), skipped %d\n", n, failed, atomic.LoadInt64(&deadlineSkipped))
+}
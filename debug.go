@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Returns a file name for the debug output of loc: a readable part of the
+// URL and a hash that keeps it unique
+func debugFileName(loc string) string {
+	name := unsafeFileChars.ReplaceAllString(loc, "_")
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	sum := sha256.Sum256([]byte(loc))
+	return fmt.Sprintf("%s-%x.txt", name, sum[:4])
+}
+
+// Writes the status, headers and the first -debug-size KB of body of the
+// failed response res for loc to a file in -debug-dir
+func saveDebug(loc string, res *http.Response, body []byte) {
+	if limit := int(debugSize) * 1024; len(body) > limit {
+		body = body[:limit]
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "GET %s\n%s %s\n", loc, res.Proto, res.Status)
+	keys := make([]string, 0, len(res.Header))
+	for k := range res.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range res.Header[k] {
+			fmt.Fprintf(&b, "%s: %s\n", k, v)
+		}
+	}
+	b.WriteString("\n")
+	b.Write(body)
+	path := filepath.Join(debugDir, debugFileName(loc))
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		if !nowarn {
+			log.Printf("Error saving the response for %s: %v\n", loc, err)
+		}
+	} else if verbose {
+		log.Printf("Saved the response for %s to %s\n", loc, path)
+	}
+}
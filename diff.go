@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var diffFormat string
+
+func diffFlags(fs *flag.FlagSet) {
+	fs.StringVar(&diffFormat, "format", "", "format of the sitemaps: xml, text, json, csv, openapi or accesslog (default: guessed from the file names)")
+}
+
+// Returns the URLs that are only in a and only in b, in order
+func diffUrlsets(a, b *Urlset) (removed, added []string) {
+	inA := make(map[string]bool, len(a.Url))
+	inB := make(map[string]bool, len(b.Url))
+	for _, u := range a.Url {
+		inA[u.Loc] = true
+	}
+	for _, u := range b.Url {
+		inB[u.Loc] = true
+		if !inA[u.Loc] {
+			added = append(added, u.Loc)
+		}
+	}
+	for _, u := range a.Url {
+		if !inB[u.Loc] {
+			removed = append(removed, u.Loc)
+		}
+	}
+	return
+}
+
+// Prints the URLs removed (-) and added (+) between two sitemaps. Like
+// diff(1), exits with status 1 if they differ.
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		fmt.Println("Error: diff needs exactly two sitemaps")
+		return 2
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	var urlsets [2]*Urlset
+	for i, v := range args {
+		src, err := FileSource(ctx, v, diffFormat)
+		if err == nil {
+			urlsets[i], err = collect(src)
+		}
+		if err != nil {
+			printError(err)
+			return 2
+		}
+	}
+	removed, added := diffUrlsets(urlsets[0], urlsets[1])
+	for _, v := range removed {
+		fmt.Println("-", v)
+	}
+	for _, v := range added {
+		fmt.Println("+", v)
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		return 1
+	}
+	return 0
+}
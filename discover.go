@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"sync"
+)
+
+// Functions that inspect each successful prime response. body is only read if
+// at least one inspector is registered.
+var inspectors []func(ctx context.Context, u Url, res *http.Response, body []byte)
+
+var (
+	seenMu sync.Mutex
+	seen   = make(map[string]bool)
+)
+
+// Primes u, found on the page at from, in the background as part of the
+// current run, unless it has already been primed or enqueued, its extension is
+// unwanted, it is in another -shard or it is on another host skipped with
+// -skip-cross-host. Returns whether u was enqueued.
+func enqueue(ctx context.Context, from string, u Url) bool {
+	if !wantedExtension(u.Loc) || !inShard(u.Loc) || !hostAllowed(from, u.Loc) {
+		return false
+	}
+	key := u.Loc // each -client-hints device is primed separately
+	if u.device != "" {
+		key += " " + u.device
+	}
+	seenMu.Lock()
+	if seen[key] {
+		seenMu.Unlock()
+		return false
+	}
+	seen[key] = true
+	seenMu.Unlock()
+	queue(1)
+	wg.Add(1)
+	go func() {
+		sem <- true
+		primeUrl(ctx, u)
+	}()
+	return true
+}
+
+// Returns whether loc, found on the page at from, may be primed: with
+// -skip-cross-host, only if it is on the same host or, when crawling, within
+// the -scope or -allow-hosts
+func hostAllowed(from, loc string) bool {
+	if !skipCrossHost {
+		return true
+	}
+	base, err := url.Parse(from)
+	if err != nil {
+		return false
+	}
+	link, err := url.Parse(loc)
+	if err != nil {
+		return false
+	}
+	if !inScope(base, link) {
+		if verbose {
+			log.Printf("Skipping %s on a different host than %s\n", loc, from)
+		}
+		return false
+	}
+	return true
+}
+
+// Marks the URLs in urlset as seen so they are not discovered again
+func markSeen(urlset *Urlset) {
+	seenMu.Lock()
+	for _, u := range urlset.Url {
+		seen[u.Loc] = true
+	}
+	seenMu.Unlock()
+}
+
+// Enqueues the pages linked with rel="next", up to -follow-next deep
+func followRelNext(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if uint(u.depth) >= followNext {
+		return
+	}
+	for _, loc := range relLinks(res, body, "next") {
+		if enqueue(ctx, u.Loc, Url{Loc: loc, Priority: u.Priority, depth: u.depth + 1}) && verbose {
+			log.Printf("Following rel=next from %s to %s\n", u.Loc, loc)
+		}
+	}
+}
+
+var (
+	refreshesMu sync.Mutex
+	refreshes   = make(map[string]string) // meta refresh targets by page URL
+)
+
+// Records the URL the page redirects to with a meta refresh, for the
+// -results-file, and enqueues it with -meta-refresh follow
+func checkMetaRefresh(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if res.StatusCode != http.StatusOK {
+		return
+	}
+	loc, ok := metaRefresh(res, body)
+	if !ok || loc == u.Loc {
+		return
+	}
+	refreshesMu.Lock()
+	refreshes[u.Loc] = loc
+	refreshesMu.Unlock()
+	if !nowarn {
+		log.Printf("Meta refresh redirect from %s to %s\n", u.Loc, loc)
+	}
+	if metaRefreshMode == "follow" && uint(u.depth) < maxRedirects {
+		enqueue(ctx, u.Loc, Url{Loc: loc, Priority: u.Priority, depth: u.depth + 1})
+	}
+}
+
+// Enqueues the AMP version of the page, if it links one with rel="amphtml"
+func primeAmp(ctx context.Context, u Url, res *http.Response, body []byte) {
+	for _, loc := range relLinks(res, body, "amphtml") {
+		if enqueue(ctx, u.Loc, Url{Loc: loc, Priority: u.Priority, depth: u.depth + 1}) && verbose {
+			log.Printf("Priming AMP version of %s: %s\n", u.Loc, loc)
+		}
+	}
+}
+
+// Enqueues the resources the page declares with rel="preload", in a Link
+// header or tag
+func primePreload(ctx context.Context, u Url, res *http.Response, body []byte) {
+	for _, loc := range relLinks(res, body, "preload") {
+		if enqueue(ctx, u.Loc, Url{Loc: loc, Priority: u.Priority, depth: u.depth + 1}) && verbose {
+			log.Printf("Priming preload of %s: %s\n", u.Loc, loc)
+		}
+	}
+}
+
+// Returns a context that enqueues the resources preloaded in any 103 Early
+// Hints sent in response to the request for u, as part of the run of run
+func withEarlyHints(ctx, run context.Context, u Url) context.Context {
+	base, err := url.Parse(u.Loc)
+	if err != nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				res := &http.Response{Header: http.Header(header), Request: &http.Request{URL: base}}
+				for _, loc := range relLinks(res, nil, "preload") {
+					if enqueue(run, u.Loc, Url{Loc: loc, Priority: u.Priority, depth: u.depth + 1}) && verbose {
+						log.Printf("Priming early hint of %s: %s\n", u.Loc, loc)
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
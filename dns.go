@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The pinned addresses of a host name
+type pinnedHost struct {
+	mu       sync.Mutex
+	addrs    []string
+	err      error
+	resolved time.Time
+}
+
+// A dialer that resolves each host name once and keeps using the same
+// addresses for the rest of the run, or until they are refresh old if it is
+// greater than zero
+type dnsPinner struct {
+	refresh time.Duration
+	dialer  net.Dialer
+	mu      sync.Mutex
+	hosts   map[string]*pinnedHost
+}
+
+// The dialer used with -pin-dns
+var pinner *dnsPinner
+
+func newDNSPinner(refresh time.Duration) *dnsPinner {
+	return &dnsPinner{
+		refresh: refresh,
+		dialer:  net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second},
+		hosts:   make(map[string]*pinnedHost),
+	}
+}
+
+// Returns the pinned addresses of host, resolving it if needed
+func (p *dnsPinner) lookup(ctx context.Context, host string) ([]string, error) {
+	p.mu.Lock()
+	h := p.hosts[host]
+	if h == nil {
+		h = &pinnedHost{}
+		p.hosts[host] = h
+	}
+	p.mu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.resolved.IsZero() || p.refresh > 0 && time.Since(h.resolved) > p.refresh {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil || h.addrs == nil {
+			h.addrs, h.err = addrs, err
+		} else if !nowarn {
+			// Keep the previous answers if re-resolving fails
+			log.Printf("Error re-resolving %s, keeping %v: %v\n", host, h.addrs, err)
+		}
+		h.resolved = time.Now()
+		if verbose && err == nil {
+			log.Printf("Pinned %s to %v\n", host, addrs)
+		}
+	}
+	return h.addrs, h.err
+}
+
+// Dials addr using the pinned addresses of its host, trying each in turn
+func (p *dnsPinner) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return p.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := p.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var c net.Conn
+		if c, err = p.dialer.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+			return c, nil
+		}
+		if verbose {
+			log.Printf("Could not connect to %s at %s: %v\n", host, a, err)
+		}
+	}
+	return nil, err
+}
+
+// Resolves the hosts of the URLs in urlset, logging those that can't be
+func (p *dnsPinner) preResolve(urlset *Urlset) {
+	hosts := make(map[string]bool)
+	for _, u := range urlset.Url {
+		if h := u.Host(); h != "" {
+			if name, _, err := net.SplitHostPort(h); err == nil {
+				h = name
+			}
+			if net.ParseIP(h) == nil {
+				hosts[h] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for h := range hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	var wg sync.WaitGroup
+	for _, h := range names {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			if _, err := p.lookup(context.Background(), h); err != nil {
+				log.Printf("Could not resolve %s: %v\n", h, err)
+			}
+		}(h)
+	}
+	wg.Wait()
+}
+
+// An http.RoundTripper that sends successive requests for a host to each of
+// its pinned addresses in turn. Each address has its own transport, and so its
+// own connection pool, as reused connections would otherwise all go to the
+// first address.
+type roundRobinTransport struct {
+	base       *http.Transport
+	pinner     *dnsPinner
+	mu         sync.Mutex
+	next       map[string]int
+	transports map[string]*http.Transport
+}
+
+func newRoundRobinTransport(base *http.Transport, p *dnsPinner) *roundRobinTransport {
+	return &roundRobinTransport{
+		base:       base,
+		pinner:     p,
+		next:       make(map[string]int),
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+// Returns the transport that connects to addr
+func (rt *roundRobinTransport) transport(addr string) *http.Transport {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	t := rt.transports[addr]
+	if t == nil {
+		t = rt.base.Clone()
+		t.DialContext = func(ctx context.Context, network, hostport string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(hostport)
+			if err != nil {
+				return nil, err
+			}
+			return rt.pinner.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		}
+		rt.transports[addr] = t
+	}
+	return t
+}
+
+// Returns whether err is a failure to connect, so nothing was sent
+func isDialError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// Sends req to the next address of its host, falling back to the others if it
+// can't connect
+func (rt *roundRobinTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if net.ParseIP(host) != nil {
+		return rt.base.RoundTrip(req)
+	}
+	addrs, err := rt.pinner.lookup(req.Context(), host)
+	if err != nil || len(addrs) < 2 {
+		return rt.base.RoundTrip(req)
+	}
+	rt.mu.Lock()
+	start := rt.next[host]
+	rt.next[host]++
+	rt.mu.Unlock()
+	for i := range addrs {
+		addr := addrs[(start+i)%len(addrs)]
+		var res *http.Response
+		if res, err = rt.transport(addr).RoundTrip(req); !isDialError(err) {
+			return res, err
+		}
+		if verbose {
+			log.Printf("Could not connect to %s at %s: %v\n", host, addr, err)
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The fields of every -events event
+type eventHeader struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+func newEvent(name string) eventHeader {
+	return eventHeader{name, time.Now()}
+}
+
+// A sitemap, or sitemapindex, has been read
+type sitemapEvent struct {
+	eventHeader
+	Sitemap  string `json:"sitemap"`
+	Urls     int    `json:"urls"`
+	Sitemaps int    `json:"sitemaps,omitempty"` // children of a sitemapindex
+}
+
+// A request for a URL has been sent
+type urlStartEvent struct {
+	eventHeader
+	Url       string `json:"url"`
+	Device    string `json:"device,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// A URL has been primed
+type urlDoneEvent struct {
+	eventHeader
+	Url       string  `json:"url"`
+	Device    string  `json:"device,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	Status    int     `json:"status,omitempty"`
+	Duration  float64 `json:"duration_ms"`
+	Size      int64   `json:"size"`
+	Error     string  `json:"error,omitempty"`
+	Severity  string  `json:"severity,omitempty"` // warn if slower than -slow-threshold
+	Attempts  int     `json:"attempts,omitempty"` // with -retries
+}
+
+// The run has ended
+type runDoneEvent struct {
+	eventHeader
+	ExitCode int     `json:"exit_code"`
+	Primed   int     `json:"primed"`
+	Failed   int     `json:"failed"`
+	Duration float64 `json:"duration_ms"`
+}
+
+var (
+	eventsMu  sync.Mutex
+	eventsEnc *json.Encoder // nil unless -events is set
+)
+
+// Opens the -events-file, or uses stdout if it isn't set
+func setupEvents() error {
+	if eventsFormat == "" {
+		return nil
+	}
+	if eventsFormat != "ndjson" {
+		return fmt.Errorf("invalid -events format %q (expected ndjson)", eventsFormat)
+	}
+	var w io.Writer = os.Stdout
+	if eventsPath != "" && eventsPath != "-" {
+		f, err := os.Create(eventsPath)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	eventsEnc = json.NewEncoder(w)
+	return nil
+}
+
+// Writes e to the -events stream as a line of JSON, if it is enabled
+func emit(e interface{}) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if eventsEnc == nil {
+		return
+	}
+	if err := eventsEnc.Encode(e); err != nil && !nowarn {
+		log.Println("Error writing event:", err)
+	}
+}
+
+// Returns whether -events is set
+func emitting() bool {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	return eventsEnc != nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// The status the URLs matching a pattern must respond with, given in the
+// config. Redirects are checked by the status of the first response, e.g.
+// 301 for a page that moved. A URL is held to the first rule it matches.
+type expectRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"` // regular expression
+	Status  int    `json:"status"`
+
+	re *regexp.Regexp
+}
+
+// Compiles the patterns of the expected statuses in the config
+func compileExpect(rules []expectRule) error {
+	for i := range rules {
+		e := &rules[i]
+		if e.Name == "" {
+			e.Name = e.Pattern
+		}
+		var err error
+		if e.re, err = regexp.Compile(e.Pattern); err != nil {
+			return fmt.Errorf("expect %q: %v", e.Name, err)
+		}
+		if e.Status < 100 || e.Status > 599 {
+			return fmt.Errorf("expect %q: invalid status %d", e.Name, e.Status)
+		}
+	}
+	return nil
+}
+
+// Returns the status of the first response of a request that may have been
+// redirected
+func firstStatus(res *http.Response) int {
+	for res.Request != nil && res.Request.Response != nil {
+		res = res.Request.Response
+	}
+	return res.StatusCode
+}
+
+// Returns how r differs from the status expected of it, or ""
+func (e expectRule) mismatch(r result) string {
+	status := r.Status
+	if r.FirstStatus != 0 {
+		status = r.FirstStatus
+	}
+	switch {
+	case r.Err != nil:
+		return fmt.Sprintf("expected %d, got %v", e.Status, r.Err)
+	case status != e.Status:
+		return fmt.Sprintf("expected %d, got %d", e.Status, status)
+	}
+	return ""
+}
+
+// Logs each prime whose status differs from the one expected in the config,
+// and returns whether all of them matched
+func reportExpected(rules []expectRule) bool {
+	checked, failed := 0, 0
+	resultsMu.Lock()
+	for _, r := range results {
+		for _, e := range rules {
+			if !e.re.MatchString(r.Url.Loc) {
+				continue
+			}
+			checked++
+			if m := e.mismatch(r); m != "" {
+				failed++
+				log.Printf("Unexpected status for %s (%s): %s\n", r.Url.Loc, e.Name, m)
+			}
+			break
+		}
+	}
+	resultsMu.Unlock()
+	if failed > 0 || verbose {
+		log.Printf("%d of %d URLs with an expected status did not respond with it\n", failed, checked)
+	}
+	return failed == 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The maximum number of URLs in a sitemap, per the sitemaps.org protocol
+const maxSitemapUrls = 50000
+
+// Creates the file at path, gzipping what is written to it if the name ends
+// in .gz
+func createMaybeGzip(path string) (io.WriteCloser, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz := gzip.NewWriter(f)
+	return &writeCloser{gz, []io.Closer{gz, f}}, nil
+}
+
+// A WriteCloser that closes several underlying writers in order
+type writeCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (w *writeCloser) Close() error {
+	var err error
+	for _, c := range w.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func writeXMLText(w io.Writer, tag, s string) {
+	fmt.Fprintf(w, "<%s>", tag)
+	xml.EscapeText(w, []byte(s))
+	fmt.Fprintf(w, "</%s>", tag)
+}
+
+// Writes urls as a sitemap to path
+func writeSitemap(path string, urls []Url) error {
+	f, err := createMaybeGzip(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(xml.Header)
+	w.WriteString(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n")
+	for _, u := range urls {
+		w.WriteString("<url>")
+		writeXMLText(w, "loc", u.Loc)
+		if u.Lastmod != "" {
+			writeXMLText(w, "lastmod", u.Lastmod)
+		}
+		if u.Priority != 0 {
+			writeXMLText(w, "priority", strconv.FormatFloat(u.Priority, 'f', -1, 64))
+		}
+		w.WriteString("</url>\n")
+	}
+	w.WriteString("</urlset>\n")
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Writes a sitemapindex referring to locs to path
+func writeSitemapindex(path string, locs []string) error {
+	f, err := createMaybeGzip(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(xml.Header)
+	w.WriteString(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n")
+	for _, loc := range locs {
+		w.WriteString("<sitemap>")
+		writeXMLText(w, "loc", loc)
+		w.WriteString("</sitemap>\n")
+	}
+	w.WriteString("</sitemapindex>\n")
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Writes the URLs in urlset to a sitemap at path. If there are more URLs than
+// a sitemap may hold, they are split across path-1.xml, path-2.xml, etc., and
+// path is written as a sitemapindex referring to them, prefixed with base if
+// given.
+func exportUrlset(path, base string, urlset *Urlset) error {
+	if len(urlset.Url) <= maxSitemapUrls {
+		return writeSitemap(path, urlset.Url)
+	}
+	ext := ".xml"
+	if strings.HasSuffix(path, ".gz") {
+		ext += ".gz"
+	}
+	stem := strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".xml")
+	var locs []string
+	for i := 0; i*maxSitemapUrls < len(urlset.Url); i++ {
+		end := (i + 1) * maxSitemapUrls
+		if end > len(urlset.Url) {
+			end = len(urlset.Url)
+		}
+		child := fmt.Sprintf("%s-%d%s", stem, i+1, ext)
+		if err := writeSitemap(child, urlset.Url[i*maxSitemapUrls:end]); err != nil {
+			return err
+		}
+		if base != "" {
+			child = strings.TrimSuffix(base, "/") + "/" + filepath.Base(child)
+		}
+		locs = append(locs, child)
+	}
+	return writeSitemapindex(path, locs)
+}
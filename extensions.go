@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The file extensions, without the dot, set with -skip-extensions and
+// -only-extensions
+var skipExts, onlyExts map[string]bool
+
+// Parses a list of extensions like pdf,.zip,MP4
+func parseExtensions(s string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), ".")); e != "" {
+			exts[e] = true
+		}
+	}
+	return exts
+}
+
+func setupExtensions() error {
+	skipExts, onlyExts = parseExtensions(skipExtensions), parseExtensions(onlyExtensions)
+	if len(skipExts) > 0 && len(onlyExts) > 0 {
+		return fmt.Errorf("-skip-extensions and -only-extensions can't be combined")
+	}
+	return nil
+}
+
+// Returns whether the extension of the path of loc is allowed by
+// -skip-extensions and -only-extensions. URLs without one are.
+func wantedExtension(loc string) bool {
+	if len(skipExts) == 0 && len(onlyExts) == 0 {
+		return true
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+	switch {
+	case ext == "":
+		return true
+	case len(onlyExts) > 0:
+		return onlyExts[ext]
+	}
+	return !skipExts[ext]
+}
+
+// Removes the URLs with unwanted extensions from urlset
+func filterExtensions(urlset *Urlset) {
+	if len(skipExts) == 0 && len(onlyExts) == 0 {
+		return
+	}
+	kept := urlset.Url[:0]
+	for _, u := range urlset.Url {
+		if wantedExtension(u.Loc) {
+			kept = append(kept, u)
+		}
+	}
+	urlset.Url = kept
+}
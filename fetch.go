@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// A Fetcher performs prime and sitemap requests. Passing another with
+// WithFetcher lets the transport be swapped out (for recording, signing, or mocking requests)
+// without touching the priming engine.
+type Fetcher interface {
+	Do(ctx context.Context, req *http.Request) (*http.Response, error)
+}
+
+// FetcherFunc adapts an ordinary function to the Fetcher interface.
+type FetcherFunc func(ctx context.Context, req *http.Request) (*http.Response, error)
+
+func (f FetcherFunc) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	return f(ctx, req)
+}
+
+// ClientFetcher returns a Fetcher that sends requests using c, or the copy
+// of it pinned to one connection per host by withConn.
+func ClientFetcher(c *http.Client) Fetcher {
+	return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		if p, ok := ctx.Value(connKey{}).(*pinnedConn); ok {
+			pc, err := p.client(c)
+			if err != nil {
+				return nil, err
+			}
+			return pc.Do(req.WithContext(ctx))
+		}
+		return c.Do(req.WithContext(ctx))
+	})
+}
+
+// A client of its own, which keeps at most one connection to each host, for
+// schemes like NTLM that authenticate connections rather than requests
+type pinnedConn struct {
+	once sync.Once
+	c    *http.Client
+	err  error
+}
+
+func (p *pinnedConn) client(c *http.Client) (*http.Client, error) {
+	p.once.Do(func() {
+		var t *http.Transport
+		switch rt := c.Transport.(type) {
+		case nil:
+			t = http.DefaultTransport.(*http.Transport)
+		case *http.Transport:
+			t = rt
+		case *roundRobinTransport:
+			// Its connections go to the pinned addresses, but not in turn
+			t = rt.base
+		default:
+			p.err = fmt.Errorf("can't keep requests sent with %T on one connection", rt)
+			return
+		}
+		t = t.Clone()
+		t.MaxConnsPerHost, t.MaxIdleConnsPerHost = 1, 1
+		pc := *c
+		pc.Transport = t
+		p.c = &pc
+	})
+	return p.c, p.err
+}
+
+type connKey struct{}
+
+// Returns a context in which requests are sent on the connections of p
+func withConn(ctx context.Context, p *pinnedConn) context.Context {
+	return context.WithValue(ctx, connKey{}, p)
+}
+
+type fetcherKey struct{}
+
+// WithFetcher returns a context in which the primer sends its requests with
+// f.
+func WithFetcher(ctx context.Context, f Fetcher) context.Context {
+	return context.WithValue(ctx, fetcherKey{}, f)
+}
+
+// Returns the Fetcher requests made in ctx are sent with, by default one using
+// http.DefaultClient
+func fetcherOf(ctx context.Context) Fetcher {
+	if f, ok := ctx.Value(fetcherKey{}).(Fetcher); ok {
+		return f
+	}
+	return ClientFetcher(http.DefaultClient)
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if ua, ok := ctx.Value(userAgentKey{}).(string); ok {
+		req.Header.Set("User-Agent", ua)
+	}
+	if h, ok := ctx.Value(headersKey{}).(http.Header); ok {
+		for k, v := range h {
+			req.Header[k] = v
+		}
+	}
+	return fetcherOf(ctx).Do(ctx, req)
+}
+
+type headersKey struct{}
+
+// Returns a context whose GET requests made with get also send the headers h
+func withHeaders(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, headersKey{}, h)
+}
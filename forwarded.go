@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// The values a -forwarded-header template can use
+type forwardedData struct {
+	IP     string // given with -xff
+	Host   string // requested, e.g. mysite.com
+	Scheme string // http or https
+}
+
+// Forwarded returns a Middleware that sets the header key on every request to
+// tmpl executed with the client IP ip and the host and scheme requested.
+func Forwarded(key string, tmpl *template.Template, ip string) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			d := forwardedData{IP: ip, Host: req.Host, Scheme: req.URL.Scheme}
+			if d.Host == "" {
+				d.Host = req.URL.Host
+			}
+			var b strings.Builder
+			if err := tmpl.Execute(&b, d); err != nil {
+				return nil, err
+			}
+			req.Header.Set(key, b.String())
+			return next.Do(ctx, req)
+		})
+	}
+}
+
+// Builds the middlewares that send X-Forwarded-For with -xff and the
+// -forwarded-header templates
+func forwardedMiddlewares() ([]Middleware, error) {
+	if xff != "" && net.ParseIP(xff) == nil {
+		return nil, fmt.Errorf("invalid -xff %q (expected an IP address)", xff)
+	}
+	var mws []Middleware
+	if xff != "" {
+		mws = append(mws, Header("X-Forwarded-For", xff))
+	}
+	for _, v := range forwardedHeaders {
+		i := strings.Index(v, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid -forwarded-header %q (expected 'Name: template')", v)
+		}
+		tmpl, err := template.New("forwarded").Option("missingkey=error").Parse(strings.TrimSpace(v[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid -forwarded-header %q: %v", v, err)
+		}
+		if strings.Contains(v, ".IP") && xff == "" {
+			return nil, fmt.Errorf("-forwarded-header %q uses .IP, which requires -xff", v)
+		}
+		mws = append(mws, Forwarded(strings.TrimSpace(v[:i]), tmpl, xff))
+	}
+	return mws, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sends body as JSON to loc with the OAuth2 access token token and decodes
+// the JSON response into out
+func postJSON(ctx context.Context, loc, token string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", loc, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := fetcherOf(ctx).Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("HTTP %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Returns the Google API access token given with -google-token or in the
+// GOOGLE_ACCESS_TOKEN environment variable (e.g. from
+// gcloud auth print-access-token)
+func googleToken() (string, error) {
+	if googleAccessToken != "" {
+		return googleAccessToken, nil
+	}
+	if t := os.Getenv("GOOGLE_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+	return "", fmt.Errorf("a Google API access token is required; use -google-token or set GOOGLE_ACCESS_TOKEN")
+}
+
+// SearchConsoleSource returns a Source that yields the top pages of the Search
+// Console property site by clicks over the last days days.
+func SearchConsoleSource(ctx context.Context, site, token string, top, days int) Source {
+	return &lazySource{load: func() ([]Url, error) {
+		var res struct {
+			Rows []struct {
+				Keys   []string `json:"keys"`
+				Clicks float64  `json:"clicks"`
+			} `json:"rows"`
+		}
+		now := time.Now()
+		limit := top
+		if limit <= 0 {
+			limit = 25000
+		}
+		err := postJSON(ctx,
+			"https://www.googleapis.com/webmasters/v3/sites/"+url.QueryEscape(site)+"/searchAnalytics/query",
+			token,
+			map[string]interface{}{
+				"startDate":  now.AddDate(0, 0, -days).Format("2006-01-02"),
+				"endDate":    now.Format("2006-01-02"),
+				"dimensions": []string{"page"},
+				"rowLimit":   limit,
+			}, &res)
+		if err != nil {
+			return nil, fmt.Errorf("Search Console: %v", err)
+		}
+		counts := make(map[string]float64)
+		for _, r := range res.Rows {
+			if len(r.Keys) > 0 {
+				counts[r.Keys[0]] += r.Clicks
+			}
+		}
+		return rankedUrls(counts, top), nil
+	}}
+}
+
+// AnalyticsSource returns a Source that yields the most viewed pages of the
+// GA4 property over the last days days.
+func AnalyticsSource(ctx context.Context, property, token string, top, days int) Source {
+	return &lazySource{load: func() ([]Url, error) {
+		var res struct {
+			Rows []struct {
+				DimensionValues []struct {
+					Value string `json:"value"`
+				} `json:"dimensionValues"`
+				MetricValues []struct {
+					Value string `json:"value"`
+				} `json:"metricValues"`
+			} `json:"rows"`
+		}
+		req := map[string]interface{}{
+			"dateRanges": []map[string]string{{"startDate": strconv.Itoa(days) + "daysAgo", "endDate": "today"}},
+			"dimensions": []map[string]string{{"name": "hostName"}, {"name": "pagePath"}},
+			"metrics":    []map[string]string{{"name": "screenPageViews"}},
+			"orderBys":   []map[string]interface{}{{"metric": map[string]string{"metricName": "screenPageViews"}, "desc": true}},
+		}
+		if top > 0 {
+			req["limit"] = top
+		}
+		err := postJSON(ctx,
+			"https://analyticsdata.googleapis.com/v1beta/properties/"+url.PathEscape(property)+":runReport",
+			token, req, &res)
+		if err != nil {
+			return nil, fmt.Errorf("Google Analytics: %v", err)
+		}
+		counts := make(map[string]float64)
+		for _, r := range res.Rows {
+			if len(r.DimensionValues) < 2 || len(r.MetricValues) < 1 {
+				continue
+			}
+			views, _ := strconv.ParseFloat(r.MetricValues[0].Value, 64)
+			counts["https://"+r.DimensionValues[0].Value+r.DimensionValues[1].Value] += views
+		}
+		return rankedUrls(counts, top), nil
+	}}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pings -heartbeat-url with suffix appended, e.g. /start, sending body if it
+// isn't empty. Failures are logged but don't affect the run.
+func pingHeartbeat(suffix, body string) {
+	if heartbeatUrl == "" {
+		return
+	}
+	loc := strings.TrimSuffix(heartbeatUrl, "/") + suffix
+	c := &http.Client{Timeout: 10 * time.Second}
+	res, err := c.Post(loc, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err == nil {
+		discard(res)
+		if res.StatusCode >= 300 {
+			err = fmt.Errorf("HTTP %s", res.Status)
+		}
+	}
+	if err != nil && !nowarn {
+		log.Printf("Error pinging heartbeat %s: %v\n", loc, err)
+	}
+}
+
+// Pings -heartbeat-url/start when a run starts
+func heartbeatStart() {
+	pingHeartbeat("/start", "")
+}
+
+// Pings -heartbeat-url, or -heartbeat-url/fail if the exit code isn't zero,
+// with the stats of the run
+func heartbeatDone(code int) {
+	if heartbeatUrl == "" {
+		return
+	}
+	suffix := ""
+	if code != 0 {
+		suffix = "/fail"
+	}
+	pingHeartbeat(suffix, runSummary(code))
+}
+
+// Returns a summary of the run, which exited with code, for -heartbeat-url
+// and Sentry
+func runSummary(code int) string {
+	n, failed := counts()
+	classes := make(map[string]int)
+	resultsMu.Lock()
+	for _, r := range results {
+		if c := failureClass(r); c != "" {
+			classes[c]++
+		}
+	}
+	resultsMu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Primed %d URLs (%d failed) in %s, exit status %d\n", n, failed, time.Since(progressT0).Round(time.Second), code)
+	if slow := slowCount(); slow > 0 {
+		fmt.Fprintf(&b, "  %d slower than %s\n", slow, slowThreshold)
+	}
+	for _, c := range byCount(classes) {
+		fmt.Fprintf(&b, "  %7d  %s\n", classes[c], c)
+	}
+	return b.String()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	historyPath    string
+	historyLimit   uint
+	historyTop     uint
+	historyCompare uint
+)
+
+func historyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&historyPath, "history-db", "", "the SQLite database runs were recorded in with -history-db")
+	fs.UintVar(&historyLimit, "limit", 20, "number of the most recent runs to list")
+	fs.UintVar(&historyTop, "top", 10, "number of failures, slowest URLs or changes to list")
+	fs.UintVar(&historyCompare, "compare", 0, "compare the run with this earlier one, listing the URLs whose status or latency changed")
+}
+
+const historySchema = `CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	started TEXT NOT NULL,
+	finished TEXT NOT NULL,
+	input TEXT NOT NULL,
+	exit_code INTEGER NOT NULL,
+	primed INTEGER NOT NULL,
+	failed INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	p50_ms REAL NOT NULL,
+	p95_ms REAL NOT NULL
+);
+CREATE TABLE IF NOT EXISTS results (
+	run_id INTEGER NOT NULL REFERENCES runs(id),
+	url TEXT NOT NULL,
+	status INTEGER,
+	duration_ms REAL NOT NULL,
+	size INTEGER NOT NULL,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS results_run_id ON results(run_id);
+`
+
+// Quotes s as an SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// Runs the SQL script with the sqlite3 command against the -history-db,
+// returning the rows of its last statement, if any
+func historySQL(script string) ([]map[string]string, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, fmt.Errorf("-history-db requires the sqlite3 command: %v", err)
+	}
+	cmd := exec.Command("sqlite3", "-bail", "-header", "-csv", historyPath)
+	cmd.Stdin = strings.NewReader(script)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", historyPath, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return readRows(&stdout, 0)
+}
+
+// Records the run, which exited with code, and the result of each prime in
+// the -history-db
+func saveHistory(code int) error {
+	n, failed := counts()
+	ds := durations()
+	var b strings.Builder
+	b.WriteString(historySchema)
+	b.WriteString("BEGIN;\n")
+	resultsMu.Lock()
+	var size int64
+	for _, r := range results {
+		size += r.Size
+	}
+	fmt.Fprintf(&b, "INSERT INTO runs (started, finished, input, exit_code, primed, failed, bytes, p50_ms, p95_ms) VALUES (%s, %s, %s, %d, %d, %d, %d, %g, %g);\n",
+		sqlQuote(progressT0.UTC().Format(time.RFC3339)), sqlQuote(time.Now().UTC().Format(time.RFC3339)),
+		sqlQuote(strings.Join(runInput, " ")), code, n, failed, size, millis(percentile(ds, 50)), millis(percentile(ds, 95)))
+	b.WriteString("CREATE TEMP TABLE run AS SELECT last_insert_rowid() AS id;\n")
+	for _, r := range results {
+		errText := "NULL"
+		if r.Err != nil {
+			errText = sqlQuote(r.Err.Error())
+		}
+		status := "NULL"
+		if r.Status != 0 {
+			status = strconv.Itoa(r.Status)
+		}
+		fmt.Fprintf(&b, "INSERT INTO results VALUES ((SELECT id FROM run), %s, %s, %g, %d, %s);\n",
+			sqlQuote(r.Url.Loc), status, millis(r.Duration), r.Size, errText)
+	}
+	resultsMu.Unlock()
+	b.WriteString("COMMIT;\n")
+	_, err := historySQL(b.String())
+	return err
+}
+
+// Formats a duration in milliseconds as stored in the -history-db
+func historyDuration(ms string) time.Duration {
+	f, _ := strconv.ParseFloat(ms, 64)
+	return time.Duration(f * float64(time.Millisecond)).Round(time.Millisecond)
+}
+
+// Returns the percentage of failed primes of a run
+func errorRate(run map[string]string) float64 {
+	primed, _ := strconv.Atoi(run["primed"])
+	failed, _ := strconv.Atoi(run["failed"])
+	if primed == 0 {
+		return 0
+	}
+	return float64(failed) / float64(primed) * 100
+}
+
+// Writes the runs, oldest first, with how each one's p95 changed from the
+// previous one, followed by the trend of the error rate and p95 between the
+// older and newer half of them
+func writeHistory(w io.Writer, runs []map[string]string) {
+	fmt.Fprintf(w, "%6s  %-20s  %8s  %7s  %7s  %6s  %8s  %8s  %9s  %s\n", "run", "started", "took", "primed", "failed", "errors", "p50", "p95", "p95 drift", "input")
+	for i, r := range runs {
+		started, _ := time.Parse(time.RFC3339, r["started"])
+		finished, _ := time.Parse(time.RFC3339, r["finished"])
+		drift := ""
+		if i > 0 {
+			if prev, _ := strconv.ParseFloat(runs[i-1]["p95_ms"], 64); prev > 0 {
+				cur, _ := strconv.ParseFloat(r["p95_ms"], 64)
+				drift = fmt.Sprintf("%+.1f%%", (cur-prev)/prev*100)
+			}
+		}
+		fmt.Fprintf(w, "%6s  %-20s  %8s  %7s  %7s  %5.1f%%  %8s  %8s  %9s  %s\n", r["id"], started.Local().Format("2006-01-02 15:04:05"),
+			finished.Sub(started), r["primed"], r["failed"], errorRate(r), historyDuration(r["p50_ms"]), historyDuration(r["p95_ms"]), drift, r["input"])
+	}
+	if len(runs) < 2 {
+		return
+	}
+	avg := func(runs []map[string]string) (errors float64, p95 time.Duration) {
+		for _, r := range runs {
+			errors += errorRate(r)
+			p95 += historyDuration(r["p95_ms"])
+		}
+		return errors / float64(len(runs)), p95 / time.Duration(len(runs))
+	}
+	oldErrors, oldP95 := avg(runs[:len(runs)/2])
+	newErrors, newP95 := avg(runs[len(runs)/2:])
+	drift := ""
+	if oldP95 > 0 {
+		drift = fmt.Sprintf(" (%+.1f%%)", float64(newP95-oldP95)/float64(oldP95)*100)
+	}
+	fmt.Fprintf(w, "\nTrend over %d runs (older half to newer half): error rate %.1f%% -> %.1f%%, p95 %s -> %s%s\n",
+		len(runs), oldErrors, newErrors, oldP95.Round(time.Millisecond), newP95.Round(time.Millisecond), drift)
+}
+
+func runHistory(args []string) int {
+	if historyPath == "" {
+		fmt.Println("Error: no -history-db given")
+		return 2
+	}
+	runs, err := historySQL(fmt.Sprintf("SELECT * FROM (SELECT * FROM runs ORDER BY id DESC LIMIT %d) ORDER BY id;", historyLimit))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	if len(runs) == 0 {
+		fmt.Println("No runs recorded in", historyPath)
+		return 0
+	}
+	writeHistory(os.Stdout, runs)
+	return 0
+}
+
+// Writes the failures and slowest URLs of a run
+func writeRun(w io.Writer, run map[string]string, failures, slowest []map[string]string) {
+	fmt.Fprintf(w, "Run %s: %s\n", run["id"], run["input"])
+	fmt.Fprintf(w, "Started %s, finished %s, exit status %s\n", run["started"], run["finished"], run["exit_code"])
+	fmt.Fprintf(w, "%s primed, %s failed (%.1f%%), p50 %s, p95 %s\n", run["primed"], run["failed"], errorRate(run),
+		historyDuration(run["p50_ms"]), historyDuration(run["p95_ms"]))
+	if len(failures) > 0 {
+		fmt.Fprintln(w, "\nFailures:")
+		for _, r := range failures {
+			reason := r["error"]
+			if reason == "" {
+				reason = "HTTP " + r["status"]
+			}
+			fmt.Fprintf(w, "  %s  (%s)\n", r["url"], reason)
+		}
+	}
+	if len(slowest) > 0 {
+		fmt.Fprintln(w, "\nSlowest:")
+		for _, r := range slowest {
+			fmt.Fprintf(w, "  %9s  %s\n", historyDuration(r["duration_ms"]), r["url"])
+		}
+	}
+}
+
+// Writes the URLs whose status changed between two runs, and of those that got
+// a response in both, the ones whose latency changed the most
+func writeComparison(w io.Writer, old, cur string, rows []map[string]string, top int) {
+	var changed []string
+	for _, r := range rows {
+		if r["old_status"] != r["new_status"] {
+			changed = append(changed, fmt.Sprintf("  %s -> %s  %s", statusOrError(r["old_status"]), statusOrError(r["new_status"]), r["url"]))
+		}
+	}
+	fmt.Fprintf(w, "\nStatus changes since run %s:\n", old)
+	if len(changed) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, c := range changed {
+		fmt.Fprintln(w, c)
+	}
+	delta := func(r map[string]string) time.Duration {
+		return historyDuration(r["new_ms"]) - historyDuration(r["old_ms"])
+	}
+	var responded []map[string]string
+	for _, r := range rows {
+		if r["old_status"] != "" && r["new_status"] != "" && delta(r) != 0 {
+			responded = append(responded, r)
+		}
+	}
+	rows = responded
+	sort.SliceStable(rows, func(i, j int) bool {
+		di, dj := delta(rows[i]), delta(rows[j])
+		if di < 0 {
+			di = -di
+		}
+		if dj < 0 {
+			dj = -dj
+		}
+		return di > dj
+	})
+	if len(rows) > top {
+		rows = rows[:top]
+	}
+	fmt.Fprintf(w, "\nLargest latency changes from run %s to run %s:\n", old, cur)
+	for _, r := range rows {
+		d := delta(r)
+		sign := "+"
+		if d < 0 {
+			sign, d = "-", -d
+		}
+		fmt.Fprintf(w, "  %s%-9s  %9s -> %-9s  %s\n", sign, d, historyDuration(r["old_ms"]), historyDuration(r["new_ms"]), r["url"])
+	}
+}
+
+// Returns status, or "error" if the prime got no response
+func statusOrError(status string) string {
+	if status == "" {
+		return "error"
+	}
+	return status
+}
+
+func runShow(args []string) int {
+	if historyPath == "" {
+		fmt.Println("Error: no -history-db given")
+		return 2
+	}
+	if len(args) != 1 {
+		fmt.Println("Error: show needs a run id")
+		return 2
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Println("Error: invalid run id", args[0])
+		return 2
+	}
+	runs, err := historySQL(fmt.Sprintf("SELECT * FROM runs WHERE id = %d;", id))
+	if err == nil && len(runs) == 0 {
+		err = fmt.Errorf("no run %d in %s", id, historyPath)
+	}
+	var failures, slowest []map[string]string
+	if err == nil {
+		failures, err = historySQL(fmt.Sprintf("SELECT url, status, error FROM results WHERE run_id = %d AND (error IS NOT NULL OR status >= 400) LIMIT %d;", id, historyTop))
+	}
+	if err == nil {
+		slowest, err = historySQL(fmt.Sprintf("SELECT url, duration_ms FROM results WHERE run_id = %d AND error IS NULL ORDER BY duration_ms DESC LIMIT %d;", id, historyTop))
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	writeRun(os.Stdout, runs[0], failures, slowest)
+	if historyCompare > 0 {
+		rows, err := historySQL(fmt.Sprintf(`SELECT a.url, a.status AS old_status, b.status AS new_status, a.duration_ms AS old_ms, b.duration_ms AS new_ms
+FROM results a JOIN results b ON a.url = b.url WHERE a.run_id = %d AND b.run_id = %d;`, historyCompare, id))
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		writeComparison(os.Stdout, strconv.Itoa(int(historyCompare)), args[0], rows, int(historyTop))
+	}
+	return 0
+}
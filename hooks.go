@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs command with the shell and env added to its environment, passing its
+// output through
+func runHook(command string, env []string) error {
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// Returns the environment variables that describe the run to -pre-cmd and
+// -post-cmd
+func hookEnv() []string {
+	return []string{
+		"OCP_VERSION=" + version,
+		"OCP_INPUT=" + strings.Join(runInput, " "),
+	}
+}
+
+// Runs -pre-cmd and purges the cache before priming the URLs loaded from args
+func beforeRun(ctx context.Context, args []string) error {
+	runInput = args
+	if preCmd != "" {
+		if verbose {
+			log.Println("Running -pre-cmd", preCmd)
+		}
+		if err := runHook(preCmd, hookEnv()); err != nil {
+			return fmt.Errorf("-pre-cmd %q: %v", preCmd, err)
+		}
+	}
+	return purge(ctx)
+}
+
+// Runs -post-cmd with the outcome of the run, which exits with code
+func afterRun(code int) {
+	if postCmd == "" {
+		return
+	}
+	n, failed := counts()
+	status := "success"
+	if code != 0 {
+		status = "failure"
+	}
+	env := append(hookEnv(),
+		"OCP_STATUS="+status,
+		"OCP_EXIT_CODE="+strconv.Itoa(code),
+		"OCP_PRIMED="+strconv.Itoa(n),
+		"OCP_FAILED="+strconv.Itoa(failed),
+		"OCP_SLOW="+strconv.Itoa(slowCount()),
+		"OCP_DURATION="+strconv.Itoa(int(time.Since(progressT0).Seconds())),
+	)
+	if verbose {
+		log.Println("Running -post-cmd", postCmd)
+	}
+	if err := runHook(postCmd, env); err != nil && !nowarn {
+		log.Printf("Error running -post-cmd %q: %v\n", postCmd, err)
+	}
+}
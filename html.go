@@ -0,0 +1,143 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	tagRe  = regexp.MustCompile(`(?is)<(link|a|meta)\b([^>]*)>`)
+	attrRe = regexp.MustCompile(`(?is)([a-z][a-z0-9_:.-]*)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// A start tag found in an HTML document
+type htmlTag struct {
+	Name  string
+	Attrs map[string]string
+}
+
+// Returns whether the tag's rel attribute contains rel
+func (t htmlTag) hasRel(rel string) bool {
+	for _, v := range strings.Fields(t.Attrs["rel"]) {
+		if strings.EqualFold(v, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the <link>, <a> and <meta> tags in body. This is a deliberately
+// simple scan rather than a full HTML parse, as only a few attributes of a
+// few tags are needed.
+func htmlTags(body []byte) []htmlTag {
+	var tags []htmlTag
+	for _, m := range tagRe.FindAllSubmatch(body, -1) {
+		t := htmlTag{
+			Name:  strings.ToLower(string(m[1])),
+			Attrs: make(map[string]string),
+		}
+		for _, a := range attrRe.FindAllSubmatch(m[2], -1) {
+			v := string(a[2])
+			if v[0] == '"' || v[0] == '\'' {
+				v = v[1 : len(v)-1]
+			}
+			t.Attrs[strings.ToLower(string(a[1]))] = html.UnescapeString(v)
+		}
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+// Returns the hrefs of the <link> and <a> tags in body, and the targets of
+// the Link headers in res, with the given rel, resolved against the URL of
+// the page
+func relLinks(res *http.Response, body []byte, rel string) []string {
+	var links []string
+	for _, v := range res.Header["Link"] {
+		for _, l := range strings.Split(v, ",") {
+			parts := strings.Split(l, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				p = strings.TrimSpace(p)
+				if !strings.HasPrefix(strings.ToLower(p), "rel=") {
+					continue
+				}
+				t := htmlTag{Attrs: map[string]string{"rel": strings.Trim(p[4:], `"`)}}
+				if t.hasRel(rel) {
+					links = append(links, target)
+				}
+			}
+		}
+	}
+	if isHTML(res) {
+		for _, t := range htmlTags(body) {
+			if t.Name != "meta" && t.Attrs["href"] != "" && t.hasRel(rel) {
+				links = append(links, t.Attrs["href"])
+			}
+		}
+	}
+	var base *url.URL
+	if res.Request != nil {
+		base = res.Request.URL
+	}
+	for i, v := range links {
+		links[i] = resolve(base, v)
+	}
+	return links
+}
+
+// Returns whether res is an HTML document
+func isHTML(res *http.Response) bool {
+	return strings.Contains(res.Header.Get("Content-Type"), "html")
+}
+
+// Resolves the possibly relative reference ref against base
+func resolve(base *url.URL, ref string) string {
+	r, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || base == nil {
+		return ref
+	}
+	return base.ResolveReference(r).String()
+}
+
+// Returns the URL in the content of a refresh, e.g. "0; url=/new", if any
+func refreshTarget(content string) (string, bool) {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return "", false
+	}
+	target := strings.TrimSpace(content[i+1:])
+	if len(target) > 3 && strings.EqualFold(target[:3], "url") {
+		if rest := strings.TrimSpace(target[3:]); strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	target = strings.Trim(target, `"'`)
+	return target, target != ""
+}
+
+// Returns the URL the page redirects to with a Refresh header or a
+// <meta http-equiv="refresh"> tag, resolved against the URL of the page
+func metaRefresh(res *http.Response, body []byte) (string, bool) {
+	content := res.Header.Get("Refresh")
+	if content == "" && isHTML(res) {
+		for _, t := range htmlTags(body) {
+			if t.Name == "meta" && strings.EqualFold(t.Attrs["http-equiv"], "refresh") {
+				content = t.Attrs["content"]
+				break
+			}
+		}
+	}
+	target, ok := refreshTarget(content)
+	if !ok {
+		return "", false
+	}
+	var base *url.URL
+	if res.Request != nil {
+		base = res.Request.URL
+	}
+	return resolve(base, target), true
+}
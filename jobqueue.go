@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// The contents of a -queue-file
+type savedJobs struct {
+	NextId int    `json:"next_id"`
+	Jobs   []*job `json:"jobs"`
+}
+
+// Reads the jobs in the -queue-file at path, queueing those that hadn't
+// finished again, and saves the jobs to it from now on
+func (s *jobServer) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved savedJobs
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	s.nextId = saved.NextId
+	for _, j := range saved.Jobs {
+		s.jobs[j.Id] = j
+		switch j.State {
+		case jobRunning:
+			log.Printf("Job %d was interrupted; queueing it again\n", j.Id)
+			j.State, j.Started = jobQueued, nil
+			s.enqueue(j)
+		case jobQueued:
+			s.enqueue(j)
+		}
+	}
+	s.prune()
+	if len(s.pending) > 0 {
+		log.Printf("Queued %d jobs from %s\n", len(s.pending), path)
+	}
+	return nil
+}
+
+// How many finished jobs are kept
+const maxFinishedJobs = 100
+
+// Forgets all but the last maxFinishedJobs finished jobs. s.mu must be held.
+func (s *jobServer) prune() {
+	var finished []int
+	for id, j := range s.jobs {
+		if j.State == jobDone || j.State == jobFailed {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished)-maxFinishedJobs] {
+		delete(s.jobs, id)
+	}
+}
+
+// Writes the jobs to the -queue-file, if any. s.mu must be held.
+func (s *jobServer) save() {
+	if s.path == "" {
+		return
+	}
+	saved := savedJobs{NextId: s.nextId, Jobs: make([]*job, 0, len(s.jobs))}
+	for _, j := range s.jobs {
+		saved.Jobs = append(saved.Jobs, j)
+	}
+	sort.Slice(saved.Jobs, func(i, k int) bool { return saved.Jobs[i].Id < saved.Jobs[k].Id })
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, append(data, '\n'), 0600)
+	}
+	if err != nil && !nowarn {
+		log.Printf("Error saving the jobs to %s: %v\n", s.path, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+)
+
+var (
+	bom          = []byte{0xef, 0xbb, 0xbf}
+	prologRe     = regexp.MustCompile(`^<\?xml[^>]*encoding=["']([^"']+)["']`)
+	bareAmpRe    = regexp.MustCompile(`&([^#a-zA-Z]|#[^0-9xX]|[a-zA-Z0-9#]*[^a-zA-Z0-9#;])`)
+	lenientUrlRe = regexp.MustCompile(`(?is)<(?:[a-z0-9_-]+:)?(url|sitemap)\b[^>]*>(.*?)</(?:[a-z0-9_-]+:)?(?:url|sitemap)\s*>`)
+)
+
+// Recovers as many <url> and <sitemap> entries as possible from a slightly
+// broken sitemap: a byte order mark or junk before the XML, unescaped
+// ampersands, and missing or unusual namespaces are tolerated, and entries
+// that still can't be parsed are skipped and reported.
+func lenientDecode(path string, data []byte, urlset *Urlset) error {
+	if bytes.HasPrefix(data, bom) {
+		data = data[len(bom):]
+		if verbose {
+			log.Printf("%s: ignoring byte order mark\n", path)
+		}
+	}
+	if i := bytes.IndexByte(data, '<'); i > 0 {
+		if !nowarn {
+			log.Printf("%s: ignoring %d bytes of junk before the XML\n", path, i)
+		}
+		data = data[i:]
+	}
+	if m := prologRe.FindSubmatch(data); m != nil {
+		if r, err := charsetReader(string(m[1]), bytes.NewReader(data)); err == nil {
+			data, _ = ioutil.ReadAll(r)
+		}
+	}
+	if n := len(bareAmpRe.FindAllIndex(data, -1)); n > 0 {
+		if !nowarn {
+			log.Printf("%s: escaping %d unescaped ampersands\n", path, n)
+		}
+		data = bareAmpRe.ReplaceAll(data, []byte("&amp;$1"))
+	}
+	matches := lenientUrlRe.FindAllSubmatch(data, -1)
+	if len(matches) == 0 {
+		return fmt.Errorf("%s: no <url> or <sitemap> entries found", path)
+	}
+	skipped := 0
+	for _, m := range matches {
+		var err error
+		if bytes.EqualFold(m[1], []byte("sitemap")) {
+			var s Sitemap
+			if err = lenientUnmarshal(m[0], &s); err == nil && s.Loc != "" {
+				urlset.Sitemap = append(urlset.Sitemap, s)
+				continue
+			}
+		} else {
+			var u Url
+			if err = lenientUnmarshal(m[0], &u); err == nil && u.Loc != "" {
+				urlset.Url = append(urlset.Url, u)
+				continue
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("missing <loc>")
+		}
+		skipped++
+		if !nowarn {
+			log.Printf("%s: skipping entry %q: %v\n", path, truncate(string(m[0]), 100), err)
+		}
+	}
+	if skipped > 0 && !nowarn {
+		log.Printf("%s: recovered %d entries, skipped %d\n", path, len(matches)-skipped, skipped)
+	}
+	return nil
+}
+
+func lenientUnmarshal(data []byte, v interface{}) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	return dec.Decode(v)
+}
+
+// Shortens s to at most n bytes, marking it with ... if it was shortened
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The path prefixes of the locales set with -locale-prefixes, e.g. /fr
+var locales []string
+
+// Parses a -locale-prefixes like /en,/fr,/de
+func parseLocales(s string) ([]string, error) {
+	var ls []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("invalid -locale-prefixes value %q (expected a path prefix like /fr)", p)
+		}
+		ls = append(ls, p)
+	}
+	return ls, nil
+}
+
+// Returns whether path is in one of the -locale-prefixes
+func localized(path string) bool {
+	for _, p := range locales {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the URL of each locale after each URL in urlset that isn't already
+// localized, e.g. http://mysite.com/fr/about after http://mysite.com/about
+func expandLocales(urlset *Urlset) {
+	if len(locales) == 0 {
+		return
+	}
+	urls := make([]Url, 0, len(urlset.Url)*(len(locales)+1))
+	for _, u := range urlset.Url {
+		urls = append(urls, u)
+		parsed, err := url.Parse(u.Loc)
+		if err != nil || localized(parsed.Path) {
+			continue
+		}
+		p := parsed.EscapedPath()
+		if p == "" {
+			p = "/"
+		}
+		for _, l := range locales {
+			lu := *parsed
+			lu.RawPath = l + p
+			lu.Path, _ = url.PathUnescape(lu.RawPath)
+			v := u
+			v.Loc = lu.String()
+			urls = append(urls, v)
+		}
+	}
+	urlset.Url = urls
+}
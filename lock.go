@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errLocked = errors.New("locked")
+
+// The -lock file, which is held open, and so locked, until ocp exits
+var lockFile *os.File
+
+// Locks the file at path, waiting up to wait for the run that holds it to
+// finish. The lock is released by the operating system when the process
+// exits, even if it crashes.
+func acquireLock(path string, wait time.Duration) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(wait)
+	for waiting := false; ; waiting = true {
+		if err = tryLock(f); err != errLocked || !time.Now().Before(deadline) {
+			break
+		}
+		if verbose && !waiting {
+			log.Printf("Waiting up to %s for the run holding %s to finish\n", wait, path)
+		}
+		time.Sleep(time.Second)
+	}
+	if err == errLocked {
+		f.Close()
+		holder := ""
+		b, _ := ioutil.ReadFile(path)
+		if pid := strings.TrimSpace(string(b)); pid != "" {
+			holder = " (pid " + pid + ")"
+		}
+		return fmt.Errorf("%s is %w by another run%s", path, err, holder)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("locking %s: %v", path, err)
+	}
+	// Record who holds the lock, for the error above
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	lockFile = f
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A login step run before priming, so that the session cookies it sets are
+// sent with every prime request
+type loginConfig struct {
+	Url    string `json:"url"`
+	Method string `json:"method"` // default: POST
+	// The credentials, sent as a form or as JSON. $VARIABLES are expanded
+	// from the environment, so secrets needn't be stored in the config.
+	Form map[string]string      `json:"form"`
+	Json map[string]interface{} `json:"json"`
+	// If set, a CSRF token is extracted from the page at CsrfUrl (default:
+	// Url) with the first capture group of CsrfRegex, and sent in the form
+	// or JSON field CsrfField and/or the header CsrfHeader.
+	CsrfUrl    string `json:"csrf_url"`
+	CsrfRegex  string `json:"csrf_regex"`
+	CsrfField  string `json:"csrf_field"`
+	CsrfHeader string `json:"csrf_header"`
+}
+
+// Fetches the page at loc and returns the first submatch of re in it
+func extractCsrf(ctx context.Context, loc string, re *regexp.Regexp) (string, error) {
+	res, err := get(ctx, loc)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if m := re.FindSubmatch(body); len(m) > 1 {
+		return string(m[1]), nil
+	}
+	if m := re.FindSubmatch([]byte(strings.Join(res.Header["Set-Cookie"], "\n"))); len(m) > 1 {
+		return string(m[1]), nil
+	}
+	return "", fmt.Errorf("no CSRF token matching %s found in %s", re, loc)
+}
+
+// Runs the login step, storing the session cookies in the client's jar
+func login(ctx context.Context, c *loginConfig) error {
+	if c.Url == "" {
+		return fmt.Errorf("login in the config needs a url")
+	}
+	var csrf string
+	if c.CsrfRegex != "" {
+		re, err := regexp.Compile(c.CsrfRegex)
+		if err != nil {
+			return fmt.Errorf("invalid csrf_regex: %v", err)
+		}
+		loc := c.CsrfUrl
+		if loc == "" {
+			loc = c.Url
+		}
+		if csrf, err = extractCsrf(ctx, loc, re); err != nil {
+			return err
+		}
+	}
+	var (
+		body        []byte
+		contentType string
+	)
+	if c.Json != nil {
+		v := make(map[string]interface{}, len(c.Json)+1)
+		for k, val := range c.Json {
+			if s, ok := val.(string); ok {
+				val = os.ExpandEnv(s)
+			}
+			v[k] = val
+		}
+		if csrf != "" && c.CsrfField != "" {
+			v[c.CsrfField] = csrf
+		}
+		body, _ = json.Marshal(v)
+		contentType = "application/json"
+	} else {
+		form := url.Values{}
+		for k, v := range c.Form {
+			form.Set(k, os.ExpandEnv(v))
+		}
+		if csrf != "" && c.CsrfField != "" {
+			form.Set(c.CsrfField, csrf)
+		}
+		body = []byte(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+	method := c.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, c.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", contentType)
+	if csrf != "" && c.CsrfHeader != "" {
+		req.Header.Set(c.CsrfHeader, csrf)
+	}
+	res, err := fetcherOf(ctx).Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	discard(res)
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("HTTP %s from %s", res.Status, c.Url)
+	}
+	if verbose {
+		log.Println("Logged in at", c.Url)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Extra headers for the URLs matching a pattern
+type headerRule struct {
+	Url     string            `json:"url"` // * matches any characters
+	Headers map[string]string `json:"headers"`
+	re      *regexp.Regexp
+}
+
+func (r *headerRule) compile() error {
+	if r.Url == "" {
+		return fmt.Errorf("header manifest entry without a url")
+	}
+	parts := strings.Split(r.Url, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	r.re = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	return nil
+}
+
+// Reads a header manifest: either a JSON array of {"url": ..., "headers":
+// {...}} objects, or a CSV file of url,header,value rows. Header values have
+// $VARIABLES expanded from the environment, so e.g. preview tokens need not be
+// stored in the manifest.
+func loadHeaderManifest(path string) ([]*headerRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []*headerRule
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		rules, err = readHeaderCSV(f)
+	} else {
+		err = json.NewDecoder(f).Decode(&rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for k, v := range r.Headers {
+			r.Headers[k] = os.ExpandEnv(v)
+		}
+	}
+	return rules, nil
+}
+
+// Reads url,header,value rows, merging consecutive rows for the same URL. A
+// first row of url,header,value is skipped.
+func readHeaderCSV(r io.Reader) ([]*headerRule, error) {
+	var rules []*headerRule
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.Comment = '#'
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return rules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && strings.EqualFold(row[0], "url") && strings.EqualFold(row[1], "header") {
+			continue
+		}
+		if len(rules) == 0 || rules[len(rules)-1].Url != row[0] {
+			rules = append(rules, &headerRule{Url: row[0], Headers: make(map[string]string)})
+		}
+		rules[len(rules)-1].Headers[row[1]] = row[2]
+	}
+}
+
+// HeaderManifest returns a Middleware that sets the headers of every rule
+// whose pattern matches the request URL. Later rules override earlier ones.
+func HeaderManifest(rules []*headerRule) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			loc := req.URL.String()
+			for _, r := range rules {
+				if !r.re.MatchString(loc) {
+					continue
+				}
+				for k, v := range r.Headers {
+					if strings.EqualFold(k, "Host") {
+						req.Host = v
+					} else {
+						req.Header.Set(k, v)
+					}
+				}
+			}
+			return next.Do(ctx, req)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A Middleware wraps a Fetcher, e.g. to modify requests before they are sent
+// or to inspect responses before they are returned.
+type Middleware func(next Fetcher) Fetcher
+
+// Chain wraps f in mws. The first middleware is the outermost, i.e. it sees
+// each request first and each response last.
+func Chain(f Fetcher, mws ...Middleware) Fetcher {
+	for i := len(mws) - 1; i >= 0; i-- {
+		f = mws[i](f)
+	}
+	return f
+}
+
+// Header returns a Middleware that sets the header key to value on every
+// request.
+func Header(key, value string) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			if strings.EqualFold(key, "Host") {
+				req.Host = value
+			} else {
+				req.Header.Set(key, value)
+			}
+			return next.Do(ctx, req)
+		})
+	}
+}
+
+type requestIDKey struct{}
+
+// Returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Returns a context carrying a new request ID, and the ID
+func withRequestID(ctx context.Context) (context.Context, string) {
+	id := newUUID()
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// RequestID returns a Middleware that sets the header key on every request to
+// the ID carried by its context, or to a new UUID. Retries of a request keep
+// the same ID.
+func RequestID(key string) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			id, ok := ctx.Value(requestIDKey{}).(string)
+			if !ok {
+				id = newUUID()
+			}
+			req.Header.Set(key, id)
+			return next.Do(ctx, req)
+		})
+	}
+}
+
+// RewritePrefix returns a Middleware that sends requests for URLs beginning
+// with from to the same URL beginning with to instead. The original Host
+// header is kept, so e.g. an origin server can be primed directly.
+func RewritePrefix(from, to string) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			loc := req.URL.String()
+			if strings.HasPrefix(loc, from) {
+				host := req.Host
+				if host == "" {
+					host = req.URL.Host
+				}
+				nreq, err := http.NewRequest(req.Method, to+loc[len(from):], req.Body)
+				if err != nil {
+					return nil, err
+				}
+				nreq.Header = req.Header
+				nreq.Host = host
+				req = nreq
+			}
+			return next.Do(ctx, req)
+		})
+	}
+}
+
+// Builds the middlewares requested with -request-id-header, -no-compression, -H, -xff,
+// -forwarded-header, -header-manifest, -auth, -netrc, -cf-access-*, -rewrite, -retries and the
+// config
+func flagMiddlewares() ([]Middleware, error) {
+	var mws []Middleware
+	if requestIDHeader != "" {
+		mws = append(mws, RequestID(requestIDHeader))
+	}
+	if noCompression {
+		mws = append(mws, Header("Accept-Encoding", "identity"))
+	}
+	for _, v := range headers {
+		i := strings.Index(v, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid header %q (expected 'Name: value')", v)
+		}
+		mws = append(mws, Header(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])))
+	}
+	fws, err := forwardedMiddlewares()
+	if err != nil {
+		return nil, err
+	}
+	mws = append(mws, fws...)
+	if headerManifest != "" {
+		rules, err := loadHeaderManifest(headerManifest)
+		if err != nil {
+			return nil, err
+		}
+		mws = append(mws, HeaderManifest(rules))
+	}
+	if authCreds != "" {
+		i := strings.Index(authCreds, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid -auth (expected 'user:password')")
+		}
+		mw, err := Auth(authType, authCreds[:i], authCreds[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		mws = append(mws, mw)
+	} else if len(cfg.Credentials) > 0 || useNetrc {
+		creds := make(map[string]credentials)
+		if useNetrc {
+			netrc, err := parseNetrc(netrcPath())
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range netrc {
+				creds[strings.ToLower(k)] = v
+			}
+		}
+		for k, v := range cfg.Credentials {
+			v.Password = os.ExpandEnv(v.Password)
+			creds[strings.ToLower(k)] = v
+		}
+		mws = append(mws, HostAuth(creds))
+	}
+	if cfg.OAuth2 != nil {
+		if cfg.OAuth2.TokenUrl == "" || cfg.OAuth2.ClientId == "" {
+			return nil, fmt.Errorf("oauth2 in the config needs a token_url and client_id")
+		}
+		mws = append(mws, OAuth2(cfg.OAuth2))
+	}
+	if cfAccessId != "" || cfAccessSecret != "" {
+		if cfAccessSecret == "" {
+			cfAccessSecret = os.Getenv("CF_ACCESS_CLIENT_SECRET")
+		}
+		if cfAccessId == "" || cfAccessSecret == "" {
+			return nil, fmt.Errorf("-cf-access-client-id and -cf-access-client-secret must be given together")
+		}
+		mws = append(mws, CloudflareAccess(cfAccessId, cfAccessSecret, cfAccessCookie))
+	}
+	for _, v := range rewrites {
+		i := strings.Index(v, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid rewrite %q (expected 'from=to')", v)
+		}
+		mws = append(mws, RewritePrefix(v[:i], v[i+1:]))
+	}
+	if retries > 0 {
+		p, err := parseRetryOn(retryOn)
+		if err != nil {
+			return nil, err
+		}
+		if retryBackoff <= 0 || retryJitter < 0 || retryJitter > 1 {
+			return nil, fmt.Errorf("-retry-backoff must be positive and -retry-jitter between 0 and 1")
+		}
+		p.backoff, p.jitter = retryBackoff, retryJitter
+		mws = append(mws, Retry(int(retries), p))
+	}
+	// Innermost, so retries are paused and rate limited too
+	mws = append(mws, Control(ctl))
+	return mws, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	monitorInterval time.Duration
+	monitorSample   uint
+	monitorWindow   time.Duration
+	monitorTimeout  time.Duration
+	monitorReload   time.Duration
+	monitorRounds   uint
+	minAvailability float64
+	maxP95          time.Duration
+	alertWebhook    string
+)
+
+func monitorFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&monitorInterval, "interval", time.Minute, "time between rounds of checks")
+	fs.UintVar(&monitorSample, "sample", 5, "number of randomly chosen URLs to check each round")
+	fs.DurationVar(&monitorWindow, "stats-window", time.Hour, "period over which availability and latency are tracked")
+	fs.DurationVar(&monitorTimeout, "check-timeout", 30*time.Second, "time after which a check fails")
+	fs.DurationVar(&monitorReload, "reload", time.Hour, "read the sitemap again after this long, if it has changed per its ETag or Last-Modified header")
+	fs.UintVar(&monitorRounds, "rounds", 0, "stop after this many rounds (0 to run until interrupted)")
+	fs.Float64Var(&minAvailability, "min-availability", 99, "alert when the percentage of successful checks in the -stats-window falls below this")
+	fs.DurationVar(&maxP95, "max-p95", 0, "alert when the 95th percentile latency of the checks in the -stats-window exceeds this, e.g. 2s")
+	fs.StringVar(&alertWebhook, "alert-webhook", "", "URL to POST a JSON alert to when a threshold is breached, and again when it recovers (the text field makes it usable as a Slack webhook)")
+}
+
+// The outcome of a monitoring check
+type check struct {
+	at       time.Time
+	ok       bool
+	duration time.Duration
+}
+
+// Returns the percentage of successful checks and the 95th percentile of
+// their latencies
+func windowStats(checks []check) (float64, time.Duration) {
+	if len(checks) == 0 {
+		return 100, 0
+	}
+	var ds []time.Duration
+	for _, c := range checks {
+		if c.ok {
+			ds = append(ds, c.duration)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return 100 * float64(len(ds)) / float64(len(checks)), percentile(ds, 95)
+}
+
+// Returns the thresholds that availability and p95 breach
+func breaches(availability float64, p95 time.Duration) []string {
+	var bs []string
+	if availability < minAvailability {
+		bs = append(bs, fmt.Sprintf("availability %.1f%% < %g%%", availability, minAvailability))
+	}
+	if maxP95 > 0 && p95 > maxP95 {
+		bs = append(bs, fmt.Sprintf("p95 %s > %s", p95.Round(time.Millisecond), maxP95))
+	}
+	return bs
+}
+
+// An alert sent to the -alert-webhook
+type alert struct {
+	Text         string   `json:"text"`
+	Status       string   `json:"status"` // alert or resolved
+	Availability float64  `json:"availability"`
+	P95          float64  `json:"p95_ms"`
+	Checks       int      `json:"checks"`
+	Failures     []string `json:"failures,omitempty"` // in the last round
+}
+
+func postWebhook(loc string, v interface{}) error {
+	return sendWebhook(&http.Client{Timeout: 30 * time.Second}, loc, v)
+}
+
+// POSTs v to loc as JSON with c
+func sendWebhook(c *http.Client, loc string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	res, err := c.Post(loc, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	discard(res)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %s from %s", res.Status, loc)
+	}
+	return nil
+}
+
+// Checks loc, returning the outcome and a description of the failure if it
+// failed
+func checkUrl(ctx context.Context, loc string) (check, string) {
+	ctx, cancel := context.WithTimeout(ctx, monitorTimeout)
+	defer cancel()
+	c := check{at: time.Now()}
+	res, err := get(ctx, loc)
+	c.duration = time.Since(c.at)
+	if err != nil {
+		return c, fmt.Sprintf("%s (%v)", loc, err)
+	}
+	discard(res)
+	if res.StatusCode >= 400 {
+		return c, fmt.Sprintf("%s (HTTP %d)", loc, res.StatusCode)
+	}
+	c.ok = true
+	return c, ""
+}
+
+func runMonitor(args []string) int {
+	if !haveInput(args) {
+		fmt.Println("Error: no sitemap or URLs given")
+		return 2
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	urlset, ok := loadUrlset(ctx, args)
+	if !ok {
+		return 1
+	}
+	daemonReady()
+	var (
+		rnd      = rand.New(rand.NewSource(time.Now().UnixNano()))
+		loaded   = time.Now()
+		checks   []check
+		breached []string
+	)
+	for round := uint(1); ; round++ {
+		if monitorReload > 0 && time.Since(loaded) >= monitorReload {
+			if u, ok := loadUrlset(ctx, args); ok {
+				urlset = u
+			}
+			loaded = time.Now()
+		}
+		n := int(monitorSample)
+		if n > len(urlset.Url) {
+			n = len(urlset.Url)
+		}
+		var failures []string
+		for _, i := range rnd.Perm(len(urlset.Url))[:n] {
+			c, failure := checkUrl(ctx, urlset.Url[i].Loc)
+			checks = append(checks, c)
+			if failure != "" {
+				failures = append(failures, failure)
+				if !nowarn {
+					log.Println("Check failed:", failure)
+				}
+			}
+		}
+		// Forget the checks that have left the window
+		cutoff := time.Now().Add(-monitorWindow)
+		for len(checks) > 0 && checks[0].at.Before(cutoff) {
+			checks = checks[1:]
+		}
+		availability, p95 := windowStats(checks)
+		if verbose {
+			log.Printf("Availability %.1f%%, p95 %s over the last %s (%d checks)\n", availability, p95.Round(time.Millisecond), monitorWindow, len(checks))
+		}
+		bs := breaches(availability, p95)
+		if (len(bs) > 0) != (len(breached) > 0) {
+			a := alert{
+				Status:       "alert",
+				Availability: availability,
+				P95:          millis(p95),
+				Checks:       len(checks),
+				Failures:     failures,
+			}
+			if len(bs) > 0 {
+				a.Text = fmt.Sprintf("ocp monitor: %s over the last %s", strings.Join(bs, ", "), monitorWindow)
+			} else {
+				a.Status = "resolved"
+				a.Text = fmt.Sprintf("ocp monitor: resolved (%s)", strings.Join(breached, ", "))
+			}
+			log.Println(strings.TrimPrefix(a.Text, "ocp monitor: "))
+			if alertWebhook != "" {
+				if err := postWebhook(alertWebhook, a); err != nil && !nowarn {
+					log.Println("Error sending alert:", err)
+				}
+			}
+		}
+		breached = bs
+		if monitorRounds > 0 && round >= monitorRounds {
+			return 0
+		}
+		time.Sleep(monitorInterval)
+	}
+}
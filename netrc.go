@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Credentials for a host, from the config or .netrc
+type credentials struct {
+	User     string `json:"user"`
+	Password string `json:"password"` // in the config, $VARIABLES are expanded from the environment
+	Type     string `json:"type"`     // basic (default), digest or ntlm
+}
+
+// Parses a .netrc file into credentials per machine. The default entry, if
+// any, is stored under the empty string.
+func parseNetrc(path string) (map[string]credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		creds   = make(map[string]credentials)
+		machine *string
+		cur     credentials
+		s       = bufio.NewScanner(f)
+	)
+	flush := func() {
+		if machine != nil {
+			creds[*machine] = cur
+		}
+		machine, cur = nil, credentials{}
+	}
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		switch s.Text() {
+		case "machine":
+			flush()
+			if s.Scan() {
+				m := s.Text()
+				machine = &m
+			}
+		case "default":
+			flush()
+			m := ""
+			machine = &m
+		case "login":
+			if s.Scan() {
+				cur.User = s.Text()
+			}
+		case "password":
+			if s.Scan() {
+				cur.Password = s.Text()
+			}
+		case "macdef":
+			// Macros run until a blank line, which ScanWords can't see;
+			// they're rare enough to simply stop parsing
+			flush()
+			return creds, nil
+		}
+	}
+	flush()
+	return creds, s.Err()
+}
+
+// Returns the path of the user's .netrc file
+func netrcPath() string {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".netrc")
+}
+
+// HostAuth returns a Middleware that authenticates requests with the
+// credentials for their host, looked up by host:port and then host name. The
+// entry for the empty string, if any, is used for all other hosts.
+func HostAuth(creds map[string]credentials) Middleware {
+	return func(next Fetcher) Fetcher {
+		var (
+			mu       sync.Mutex
+			fetchers = make(map[string]Fetcher)
+		)
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			key := strings.ToLower(req.URL.Host)
+			c, ok := creds[key]
+			if !ok {
+				key = strings.ToLower(req.URL.Hostname())
+				if c, ok = creds[key]; !ok {
+					key = ""
+					if c, ok = creds[key]; !ok {
+						return next.Do(ctx, req)
+					}
+				}
+			}
+			mu.Lock()
+			f := fetchers[key]
+			if f == nil {
+				mw, err := Auth(c.Type, c.User, c.Password)
+				if err != nil {
+					mu.Unlock()
+					return nil, err
+				}
+				f = mw(next)
+				fetchers[key] = f
+			}
+			mu.Unlock()
+			return f.Do(ctx, req)
+		})
+	}
+}
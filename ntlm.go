@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// Authenticates requests with NTLMv2. NTLM authenticates connections rather
+// than requests, so each request is sent on a connection of its own, from a
+// pool, and the handshake is only made on connections that aren't yet
+// authenticated to the host.
+type ntlmFetcher struct {
+	next     Fetcher
+	user     string
+	password string
+	mu       sync.Mutex
+	free     []*ntlmConn
+}
+
+// A connection of the pool, and the hosts it has been authenticated to
+type ntlmConn struct {
+	pin    pinnedConn
+	authed map[string]bool
+}
+
+// Returns a connection no other request is using
+func (f *ntlmFetcher) take() *ntlmConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n := len(f.free); n > 0 {
+		c := f.free[n-1]
+		f.free = f.free[:n-1]
+		return c
+	}
+	return &ntlmConn{authed: make(map[string]bool)}
+}
+
+func (f *ntlmFetcher) put(c *ntlmConn) {
+	f.mu.Lock()
+	f.free = append(f.free, c)
+	f.mu.Unlock()
+}
+
+const ntlmFlags = 0x00000001 | // NEGOTIATE_UNICODE
+	0x00000004 | // REQUEST_TARGET
+	0x00000200 | // NEGOTIATE_NTLM
+	0x00008000 | // NEGOTIATE_ALWAYS_SIGN
+	0x00080000 | // NEGOTIATE_EXTENDED_SESSIONSECURITY
+	0x00800000 | // NEGOTIATE_TARGET_INFO
+	0x20000000 | // NEGOTIATE_128
+	0x80000000 // NEGOTIATE_56
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+func (f *ntlmFetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	c := f.take()
+	res, err := f.do(withConn(ctx, &c.pin), c, req)
+	if err != nil {
+		f.put(c)
+		return nil, err
+	}
+	// Until the response has been read, the connection is still in use
+	res.Body = &releasingBody{ReadCloser: res.Body, release: func() { f.put(c) }}
+	return res, nil
+}
+
+// Calls release when closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Sends req on the connection c, authenticating it first if needed
+func (f *ntlmFetcher) do(ctx context.Context, c *ntlmConn, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if c.authed[host] {
+		res, err := f.next.Do(ctx, req.Clone(ctx))
+		if err != nil || res.StatusCode != http.StatusUnauthorized {
+			return res, err
+		}
+		// The connection was closed, or the server forgot it
+		discard(res)
+		c.authed[host] = false
+	}
+	first := req.Clone(ctx)
+	first.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+	res, err := f.next.Do(ctx, first)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	params, ok := authChallenge(res, "NTLM")
+	if !ok || params == "" {
+		return res, nil
+	}
+	challenge, err := base64.StdEncoding.DecodeString(params)
+	if err != nil {
+		return res, nil
+	}
+	discard(res)
+	domain, user := "", f.user
+	if i := strings.IndexAny(user, `\/`); i >= 0 {
+		domain, user = user[:i], user[i+1:]
+	}
+	auth, err := ntlmAuthenticate(challenge, domain, user, f.password)
+	if err != nil {
+		return nil, err
+	}
+	last := req.Clone(ctx)
+	last.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(auth))
+	res, err = f.next.Do(ctx, last)
+	c.authed[host] = err == nil && res.StatusCode != http.StatusUnauthorized
+	return res, err
+}
+
+// Returns a NEGOTIATE_MESSAGE
+func ntlmNegotiate() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmFlags)
+	return b
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, v := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// Returns an AUTHENTICATE_MESSAGE answering the CHALLENGE_MESSAGE challenge
+// with NTLMv2 responses
+func ntlmAuthenticate(challenge []byte, domain, user, password string) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.HasPrefix(challenge, ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, fmt.Errorf("invalid NTLM challenge")
+	}
+	serverChallenge := challenge[24:32]
+	tiLen := int(binary.LittleEndian.Uint16(challenge[40:]))
+	tiOff := int(binary.LittleEndian.Uint32(challenge[44:]))
+	if tiOff+tiLen > len(challenge) {
+		return nil, fmt.Errorf("invalid NTLM challenge target info")
+	}
+	targetInfo := challenge[tiOff : tiOff+tiLen]
+
+	ntHash := md4(utf16le(password))
+	v2Hash := hmacMD5(ntHash, utf16le(strings.ToUpper(user)+domain))
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+	// Windows FILETIME: 100ns intervals since 1601-01-01
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, uint64(time.Now().UnixNano()/100+116444736000000000))
+	var blob bytes.Buffer
+	blob.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	blob.Write(ts)
+	blob.Write(clientChallenge)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+	ntProof := hmacMD5(v2Hash, serverChallenge, blob.Bytes())
+	ntResponse := append(ntProof, blob.Bytes()...)
+	lmResponse := append(hmacMD5(v2Hash, serverChallenge, clientChallenge), clientChallenge...)
+
+	fields := [][]byte{lmResponse, ntResponse, utf16le(domain), utf16le(user), utf16le(""), nil}
+	const headerLen = 64
+	b := make([]byte, headerLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	offset := headerLen
+	for i, f := range fields {
+		pos := 12 + 8*i
+		binary.LittleEndian.PutUint16(b[pos:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(b[pos+2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(b[pos+4:], uint32(offset))
+		offset += len(f)
+	}
+	binary.LittleEndian.PutUint32(b[60:], ntlmFlags)
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return b, nil
+}
+
+// Returns the MD4 (RFC 1320) digest of data, which NTLM uses to hash
+// passwords and the standard library doesn't provide
+func md4(data []byte) []byte {
+	msg := append([]byte{}, data...)
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(data))*8)
+	msg = append(msg, l[:]...)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	var x [16]uint32
+	for len(msg) > 0 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		msg = msg[64:]
+		aa, bb, cc, dd := a, b, c, d
+		f := func(x, y, z uint32) uint32 { return x&y | ^x&z }
+		g := func(x, y, z uint32) uint32 { return x&y | x&z | y&z }
+		h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+		for _, i := range []int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+f(b, c, d)+x[i], 3)
+			d = bits.RotateLeft32(d+f(a, b, c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+f(d, a, b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+f(c, d, a)+x[i+3], 19)
+		}
+		for _, i := range []int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+g(b, c, d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+g(a, b, c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+g(d, a, b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+g(c, d, a)+x[i+12]+0x5a827999, 13)
+		}
+		for _, i := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+h(b, c, d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+h(a, b, c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+h(d, a, b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+h(c, d, a)+x[i+12]+0x6ed9eba1, 15)
+		}
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+	out := make([]byte, 16)
+	binary.LittleEndian.PutUint32(out, a)
+	binary.LittleEndian.PutUint32(out[4:], b)
+	binary.LittleEndian.PutUint32(out[8:], c)
+	binary.LittleEndian.PutUint32(out[12:], d)
+	return out
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 client credentials grant (RFC 6749 section 4.4) settings
+type oauth2Config struct {
+	TokenUrl     string   `json:"token_url"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"` // default: $OCP_OAUTH2_CLIENT_SECRET
+	Scopes       []string `json:"scopes"`
+	Audience     string   `json:"audience"`
+	// Send the client credentials in the request body rather than with HTTP
+	// Basic authentication, for token endpoints that require it
+	AuthInBody bool `json:"auth_in_body"`
+}
+
+// OAuth2 returns a Middleware that attaches an access token obtained with the
+// client credentials grant to every request. The token is refreshed shortly
+// before it expires, or when a request is rejected with 401 Unauthorized.
+func OAuth2(c *oauth2Config) Middleware {
+	return func(next Fetcher) Fetcher {
+		return &oauth2Fetcher{next: next, config: c}
+	}
+}
+
+type oauth2Fetcher struct {
+	next    Fetcher
+	config  *oauth2Config
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Returns a valid access token, requesting a new one if the current one has
+// expired or force is true
+func (f *oauth2Fetcher) accessToken(ctx context.Context, force bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !force && f.token != "" && (f.expires.IsZero() || time.Now().Before(f.expires.Add(-30*time.Second))) {
+		return f.token, nil
+	}
+	c := f.config
+	secret := c.ClientSecret
+	if secret == "" {
+		secret = os.Getenv("OCP_OAUTH2_CLIENT_SECRET")
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	if c.Audience != "" {
+		form.Set("audience", c.Audience)
+	}
+	if c.AuthInBody {
+		form.Set("client_id", c.ClientId)
+		form.Set("client_secret", secret)
+	}
+	req, err := http.NewRequest("POST", c.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if !c.AuthInBody {
+		req.SetBasicAuth(url.QueryEscape(c.ClientId), url.QueryEscape(secret))
+	}
+	res, err := f.next.Do(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("OAuth2 token request: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OAuth2 token request: HTTP %s: %s", res.Status, truncate(strings.TrimSpace(string(body)), 200))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &tok); err != nil || tok.AccessToken == "" {
+		return "", fmt.Errorf("OAuth2 token request: no access_token in response")
+	}
+	f.token = tok.AccessToken
+	f.expires = time.Time{}
+	if tok.ExpiresIn > 0 {
+		f.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return f.token, nil
+}
+
+func (f *oauth2Fetcher) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	token, err := f.accessToken(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := f.next.Do(ctx, req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	// The token may have been revoked or expired early
+	if token, err = f.accessToken(ctx, true); err != nil {
+		return res, nil
+	}
+	discard(res)
+	retry := req.Clone(ctx)
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return f.next.Do(ctx, retry)
+}
@@ -1,32 +1,48 @@
 package main
 
 import (
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"path"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
 const (
 	version   = "2.7"
 	defaultUA = "Optimus Cache Prime/" + version + " (http://patrickmylund.com/projects/ocp/)"
+
+	exitSLO        = 3  // a latency objective given with -slo, or an SLA rule in the config, was not met
+	exitFailFast   = 4  // a prime failed with -fail-fast
+	exitVerify     = 5  // a URL wasn't served from the cache with -verify
+	exitRegression = 6  // a URL regressed against the -baseline with -fail-on-regression
+	exitLocked     = 7  // another run holds the -lock
+	exitDeclined   = 8  // the run was not confirmed
+	exitExpect     = 9  // a URL did not respond with the status expected in the config
+	exitDeadline   = 10 // the run was stopped at the -max-duration
 )
 
 var (
-	one    chan bool
-	sem    chan bool
-	wg     sync.WaitGroup
-	client = http.DefaultClient
+	one chan bool
+	sem chan bool
+	wg  sync.WaitGroup
 )
 
 type Sitemap struct {
@@ -36,9 +52,26 @@ type Sitemap struct {
 
 type Url struct {
 	Loc string `xml:"loc"`
-	// Lastmod string `xml:"lastmod"`
 	// Changefreq string `xml:"changefreq"`
 	Priority float64 `xml:"priority"`
+	Lastmod  string  `xml:"lastmod"`
+	// Extra columns of CSV and database rows, e.g. for -print-format
+	Fields map[string]string `xml:"-"`
+
+	depth     int    // how many links were followed to discover the URL
+	variantOf string // the URL this is a variant of, with -also-variants
+	sitemap   string // the child of a sitemapindex the URL is listed in
+	device    string // whose Client Hints are sent, with -client-hints
+	tier      *tierRule
+}
+
+// Returns the host name of the URL, or an empty string if it is invalid
+func (u Url) Host() string {
+	parsed, err := url.Parse(u.Loc)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
 }
 
 type Urlset struct {
@@ -47,7 +80,7 @@ type Urlset struct {
 	Url     []Url     `xml:"url"`
 }
 
-// Functions needed by sort.Sort
+// Functions needed by sort.Stable
 func (u Urlset) Len() int {
 	return len(u.Url)
 }
@@ -60,84 +93,228 @@ func (u Urlset) Less(i, j int) bool {
 	return u.Url[i].Priority > u.Url[j].Priority
 }
 
-func get(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// A ReadCloser that closes several underlying readers
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var err error
+	for i := len(m.closers) - 1; i >= 0; i-- {
+		if cerr := m.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-	req.Header.Set("User-Agent", userAgent)
-	return client.Do(req)
+	return err
 }
 
-func getUrlsFromSitemap(path string, follow bool) (*Urlset, error) {
+// Opens a local file, stdin (-) or an HTTP(S) URL, decompressing gzip,
+// Zstandard and Brotli data. The compression is detected by content sniffing,
+// falling back to the response headers or file name for Brotli.
+func openPath(ctx context.Context, path string) (io.ReadCloser, error) {
 	var (
-		urlset Urlset
-		f      io.ReadCloser
-		err    error
-		res    *http.Response
+		f        io.ReadCloser
+		err      error
+		res      *http.Response
+		encoding = encodingFromName(path)
 	)
+	if remoteOnly {
+		if err := checkRemote(path); err != nil {
+			return nil, err
+		}
+	}
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
 		if verbose {
 			log.Println("Downloading", path)
 		}
-		res, err = get(path)
+		res, err = get(conditional(ctx, path), path)
 		if err != nil {
 			return nil, err
 		}
+		if res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+			return nil, errNotModified
+		}
 		if res.Status != "200 OK" {
+			res.Body.Close()
 			return nil, fmt.Errorf("HTTP %s", res.Status)
 		}
 		f = res.Body
+		noteValidators(path, res)
+		if ce := res.Header.Get("Content-Encoding"); ce != "" {
+			encoding = strings.ToLower(ce)
+		} else if ct := encodingFromContentType(res.Header.Get("Content-Type")); ct != "" {
+			encoding = ct
+		}
+	} else if strings.HasPrefix(path, "ftp://") || strings.HasPrefix(path, "sftp://") {
+		var u *url.URL
+		if u, err = url.Parse(path); err != nil {
+			return nil, err
+		}
+		if verbose {
+			log.Println("Downloading", u.Redacted())
+		}
+		if u.Scheme == "ftp" {
+			f, err = openFTP(u)
+		} else {
+			f, err = openSFTP(u)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if path == "-" {
+		f = ioutil.NopCloser(os.Stdin)
 	} else {
 		f, err = os.Open(path)
 		if err != nil {
 			return nil, err
 		}
 	}
-	defer f.Close()
-	if strings.HasSuffix(path, ".gz") {
-		if verbose {
-			log.Println("Extracting compressed data")
+	d, err := sniffDecompress(f, encoding)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// If set, the URLs of each child of a sitemapindex are passed to streamChild as
+// soon as the child has been read, instead of being added to the index's Urlset
+var streamChild func(urlset *Urlset)
+
+// Reads and parses the sitemap at path into urlset, or copies it from the
+// cache of a daemon if it hasn't changed
+func readSitemap(ctx context.Context, path string, urlset *Urlset) error {
+	f, err := openPath(ctx, path)
+	if err == errNotModified {
+		if c, ok := cachedUrlset(path); ok {
+			if verbose {
+				log.Printf("%s has not changed\n", path)
+			}
+			*urlset = *c
+			return nil
 		}
-		f, err = gzip.NewReader(f)
-		if err != nil {
-			return nil, err
+	}
+	if err != nil {
+		return err
+	}
+	if lenient {
+		var data []byte
+		data, err = ioutil.ReadAll(f)
+		if err == nil {
+			err = lenientDecode(path, data, urlset)
+		}
+	} else {
+		dec := xml.NewDecoder(f)
+		dec.CharsetReader = charsetReader
+		if err = dec.Decode(urlset); err == nil {
+			// To the end, so a decompression command's failure is seen
+			_, err = io.Copy(ioutil.Discard, f)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		storeSitemap(path, urlset)
+	}
+	return err
+}
+
+func getUrlsFromSitemap(ctx context.Context, path string, follow bool) (*Urlset, error) {
+	var urlset Urlset
+	err := readSitemap(ctx, path, &urlset)
+	if err == nil {
+		checkHosts(path, &urlset)
+		if emitting() {
+			emit(sitemapEvent{newEvent("sitemap"), path, len(urlset.Url), len(urlset.Sitemap)})
 		}
-		defer f.Close()
 	}
-	err = xml.NewDecoder(f).Decode(&urlset)
 	if err == nil && follow && len(urlset.Sitemap) > 0 { // This is a sitemapindex
-		children := len(urlset.Sitemap)
-		ch := make(chan *Urlset, children)
+		var (
+			children = make([]*Urlset, len(urlset.Sitemap))
+			done     = make(chan bool, len(children))
+			csem     = make(chan bool, sitemapConcurrency)
+		)
+		if sitemapConcurrency == 0 {
+			csem = make(chan bool, 1)
+		}
 		if verbose {
 			log.Printf("%s is a Sitemapindex\n", path)
 		}
-		for _, v := range urlset.Sitemap {
-			sem <- true
+		for i, v := range urlset.Sitemap {
+			csem <- true
 			if verbose {
 				log.Printf("Adding URLs from child sitemap %s\n", v.Loc)
 			}
-			go func(loc string) {
+			go func(i int, loc string) {
 				// Follow is false as Sitemapindex spec says sitemapindex children are illegal
-				ourlset, err := getUrlsFromSitemap(loc, false)
+				ourlset, err := getUrlsFromSitemap(ctx, loc, false)
+				<-csem
 				if err != nil {
-					log.Printf("Error getting Urlset from sitemap %s: %s", loc, err)
-					ch <- nil
+					log.Printf("Error getting Urlset from sitemap %s: %s\n", loc, err)
+					done <- true
+					return
+				}
+				for j := range ourlset.Url {
+					ourlset.Url[j].sitemap = loc
+				}
+				if streamChild != nil {
+					streamChild(ourlset)
 				} else {
-					ch <- ourlset
+					children[i] = ourlset
 				}
-				<-sem
-			}(v.Loc)
+				done <- true
+			}(i, v.Loc)
+		}
+		// Add every URL from each Urlset to the main Urlset, in index order
+		for range children {
+			<-done
 		}
-		// Add every URL from each Urlset to the main Urlset
-		for i := 0; i < children; i++ {
-			childUrlset := <-ch
-			urlset.Url = append(urlset.Url, childUrlset.Url...)
+		for _, childUrlset := range children {
+			if childUrlset != nil {
+				urlset.Url = append(urlset.Url, childUrlset.Url...)
+			}
 		}
 	}
 	return &urlset, err
 }
 
+// Reports the URLs in a sitemap fetched over HTTP(S) whose host differs from
+// the sitemap's, which the sitemaps.org protocol doesn't allow, and removes
+// them from urlset if -skip-cross-host is set
+func checkHosts(path string, urlset *Urlset) {
+	parsed, err := url.Parse(path)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return
+	}
+	var (
+		kept  = urlset.Url[:0]
+		cross = 0
+	)
+	for _, u := range urlset.Url {
+		if host := u.Host(); host != "" && !strings.EqualFold(host, parsed.Host) {
+			cross++
+			if verbose {
+				log.Printf("%s is on a different host than sitemap %s\n", u.Loc, path)
+			}
+			if skipCrossHost {
+				continue
+			}
+		}
+		kept = append(kept, u)
+	}
+	urlset.Url = kept
+	if cross > 0 && !nowarn {
+		if skipCrossHost {
+			log.Printf("Skipped %d URLs in %s on other hosts than %s\n", cross, path, parsed.Host)
+		} else {
+			log.Printf("%d URLs in %s are on other hosts than %s (use -skip-cross-host to skip them)\n", cross, path, parsed.Host)
+		}
+	}
+}
+
 func urlSlice(args []string) []Url {
 	urls := make([]Url, len(args))
 	for i, v := range args {
@@ -151,7 +328,7 @@ func urlSlice(args []string) []Url {
 	return urls
 }
 
-func primeUrlset(urlset *Urlset) {
+func primeUrlset(ctx context.Context, urlset *Urlset) {
 	if verbose {
 		var top int
 		m := int(max)
@@ -163,18 +340,66 @@ func primeUrlset(urlset *Urlset) {
 		}
 		log.Println("URLs in sitemap:", l, "- URLs to prime:", top)
 	}
+	if len(cfg.Tiers) > 0 {
+		primeTiers(ctx, urlset, cfg.Tiers)
+		return
+	}
+	markSeen(urlset)
+	queue(len(urlset.Url))
 	wg.Add(len(urlset.Url))
 	for _, u := range urlset.Url {
 		sem <- true
-		go primeUrl(u)
+		go primeUrl(ctx, u)
 	}
 	wg.Wait()
 }
 
-func primeUrl(u Url) error {
+// Starts priming the URLs of each sitemapindex child as soon as it has been
+// read, rather than after every child has been merged and sorted. URLs are
+// only sorted by priority within each child. The primes are waited for by the
+// primeUrlset call that follows.
+func streamChildren(ctx context.Context) {
+	streamChild = func(child *Urlset) {
+		expandLocales(child)
+		sort.Stable(child)
+		if verbose {
+			log.Println("URLs in child sitemap:", len(child.Url))
+		}
+		var urls []Url
+		for _, u := range child.Url {
+			if !inShard(u.Loc) || !wantedExtension(u.Loc) {
+				continue
+			}
+			seenMu.Lock()
+			dup := seen[u.Loc]
+			seen[u.Loc] = true
+			seenMu.Unlock()
+			if !dup {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			trackChild(urls[0].sitemap, len(urls))
+		}
+		queue(len(urls))
+		for _, u := range urls {
+			sem <- true
+			wg.Add(1)
+			go primeUrl(ctx, u)
+		}
+	}
+}
+
+func primeUrl(ctx context.Context, u Url) error {
+	defer reportPanic()
+	if pastDeadline() {
+		skipPastDeadline()
+		return nil
+	}
 	var (
 		err    error
 		found  = false
+		failed = false
 		weight = int(u.Priority * 100)
 	)
 	if localDir != "" {
@@ -190,30 +415,159 @@ func primeUrl(u Url) error {
 			}
 		}
 	}
+	if !found && skipUncacheable {
+		found = knownUncacheable(u.Loc)
+	}
+	if !found && refreshWithin > 0 && u.depth == 0 {
+		found = stillFresh(ctx, u.Loc)
+	}
+	if !found && len(allowedTypes) > 0 && contentTypesHead {
+		found = unwantedType(ctx, u.Loc)
+	}
 	if !found {
 		if verbose {
 			log.Printf("Get (weight %d) %s\n", weight, u.Loc)
 		}
-		res, err := get(u.Loc)
+		r := result{Url: u}
+		rctx, trace := withTrace(withTier(ctx, u))
+		if preload {
+			rctx = withEarlyHints(rctx, ctx, u)
+		}
+		loc := u.Loc // for logging
+		if u.device != "" {
+			rctx = withHeaders(rctx, clientHintProfiles[u.device])
+			loc += " (" + u.device + ")"
+		}
+		if requestIDHeader != "" {
+			rctx, r.RequestID = withRequestID(rctx)
+			loc += " (" + requestIDHeader + ": " + r.RequestID + ")"
+		}
+		if len(userAgents) > 0 {
+			rctx, r.UserAgent = withUserAgent(rctx)
+		}
+		rctx = withAttempts(withSlot(rctx), &r.Attempts)
+		id := takeOff(loc)
+		if emitting() {
+			emit(urlStartEvent{newEvent("url_start"), u.Loc, u.device, r.RequestID})
+		}
+		start := time.Now()
+		res, err := get(rctx, u.Loc)
+		r.Err = err
+		var body []byte
 		if err != nil {
-			if !nowarn {
-				log.Printf("Error priming %s: %v\n", u.Loc, err)
+			if !nowarn && r.Attempts > 1 {
+				log.Printf("Error priming %s after %d attempts: %v\n", loc, r.Attempts, err)
+			} else if !nowarn {
+				log.Printf("Error priming %s: %v\n", loc, err)
 			}
 		} else {
+			if noCompression {
+				uncompressed(loc, res)
+			}
+			var readErr error
+			switch {
+			case !typeAllowed(res):
+				// Not downloaded
+				skipType(loc, res)
+			case len(inspectors) > 0:
+				body, readErr = ioutil.ReadAll(res.Body)
+				r.Size = int64(len(body))
+			case debugDir != "" && res.StatusCode >= 400:
+				body, readErr = ioutil.ReadAll(io.LimitReader(res.Body, int64(debugSize)*1024))
+				if readErr == nil {
+					r.Size, readErr = io.Copy(ioutil.Discard, res.Body)
+				}
+				r.Size += int64(len(body))
+			default:
+				r.Size, readErr = io.Copy(ioutil.Discard, res.Body)
+			}
 			res.Body.Close()
+			if readErr != nil {
+				// E.g. the -timeout expired during the download
+				err = readErr
+				r.Err = err
+				if !nowarn {
+					log.Printf("Error reading %s: %v\n", loc, err)
+				}
+			}
+			r.Status = res.StatusCode
+			if s := firstStatus(res); s != r.Status {
+				r.FirstStatus = s
+			}
+			if len(captureHeaders) > 0 {
+				r.Headers = captureHeaderValues(res.Header)
+			}
+			if debugDir != "" && res.StatusCode >= 400 {
+				saveDebug(u.Loc, res, body)
+			}
+			if minTTL > 0 {
+				auditTTL(u, res)
+			}
 			if res.Status != "200 OK" && !nowarn {
-				log.Printf("Bad response for %s: %s\n", u.Loc, res.Status)
+				log.Printf("Bad response for %s: %s\n", loc, res.Status)
+			}
+		}
+		r.Duration = time.Since(start)
+		land(id)
+		if err == nil {
+			trace.finish(&r)
+		}
+		record(r)
+		failed = r.failed()
+		if r.slow() && !nowarn {
+			log.Printf("WARN: slow prime of %s: %s\n", loc, r.Duration.Round(time.Millisecond))
+		}
+		checkFailFast(r)
+		if err == nil {
+			for _, f := range inspectors {
+				f(ctx, u, res, body)
 			}
 		}
 		if max > 0 {
 			one <- true
 		}
 	}
-	wg.Done()
+	childPrimed(u, failed)
+	atomic.AddInt64(&completed, 1)
 	<-sem
+	wg.Done()
 	return err
 }
 
+// Records the end of a run that exits with code in the -history-db, reports
+// it to -heartbeat-url, and to Sentry if it failed, and runs -post-cmd
+func runEnded(code int) {
+	if emitting() {
+		n, failed := counts()
+		emit(runDoneEvent{newEvent("run_done"), code, n, failed, millis(time.Since(progressT0))})
+	}
+	if historyPath != "" {
+		if err := saveHistory(code); err != nil && !nowarn {
+			log.Println("Error recording the run:", err)
+		}
+	}
+	heartbeatDone(code)
+	if code != 0 {
+		reportRunFailure(code)
+	}
+	afterRun(code)
+}
+
+var failFastOnce sync.Once
+
+// Stops the run if r failed and -fail-fast is set
+func checkFailFast(r result) {
+	if !failFast || !r.failed() {
+		return
+	}
+	failFastOnce.Do(func() {
+		log.Printf("Stopping after the first failure (%s)\n", r.Url.Loc)
+		finish()
+		runEnded(exitFailFast)
+		os.Exit(exitFailFast)
+	})
+}
+
 func maxStopper() {
 	count := uint(0)
 	for {
@@ -221,98 +575,929 @@ func maxStopper() {
 		count++
 		if count == max {
 			log.Println("Uncached page prime limit reached; stopping")
-			os.Exit(0)
+			code := finish()
+			runEnded(code)
+			os.Exit(code)
 		}
 	}
 }
 
+// Builds the Source for the sitemap and URLs given on the command line
+func inputSource(ctx context.Context, args []string) (Source, error) {
+	var srcs []Source
+	if primeUrls {
+		srcs = append(srcs, SliceSource(urlSlice(args)))
+	} else {
+		for _, v := range args {
+			src, err := FileSource(ctx, v, inputFormat)
+			if err != nil {
+				return nil, err
+			}
+			srcs = append(srcs, src)
+		}
+	}
+	if urlFile != "" {
+		format := inputFormat
+		if format == "" && !strings.HasSuffix(urlFile, ".json") && !strings.HasSuffix(urlFile, ".csv") {
+			format = "text"
+		}
+		src, err := FileSource(ctx, urlFile, format)
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	if retryFile != "" {
+		src, err := FileSource(ctx, retryFile, "text")
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	if dbDsn != "" {
+		if dbQuery == "" {
+			return nil, fmt.Errorf("-db requires -db-query")
+		}
+		srcs = append(srcs, DatabaseSource(dbDsn, dbQuery, dbUrl))
+	}
+	for _, v := range sourceExecs {
+		srcs = append(srcs, ExecSource(v, inputFormat))
+	}
+	for _, v := range expands {
+		srcs = append(srcs, ExpandSource(v))
+	}
+	if gscSite != "" || ga4Property != "" {
+		token, err := googleToken()
+		if err != nil {
+			return nil, err
+		}
+		if gscSite != "" {
+			srcs = append(srcs, SearchConsoleSource(ctx, gscSite, token, int(googleTop), int(googleDays)))
+		}
+		if ga4Property != "" {
+			srcs = append(srcs, AnalyticsSource(ctx, ga4Property, token, int(googleTop), int(googleDays)))
+		}
+	}
+	return MultiSource(srcs...), nil
+}
+
+// Returns whether any sitemap or URLs were given on the command line
+func haveInput(args []string) bool {
+	return len(args) > 0 || urlFile != "" || retryFile != "" || len(sourceExecs) > 0 || dbDsn != "" || replayPath != "" || len(expands) > 0 || gscSite != "" || ga4Property != ""
+}
+
+// Reads and sorts the URLs given on the command line, printing any error
+func loadUrlset(ctx context.Context, args []string) (*Urlset, bool) {
+	var err error
+	runInput = args
+	if shard != "" {
+		if shardK, shardN, err = parseShard(shard); err != nil {
+			printError(err)
+			return nil, false
+		}
+	}
+	if locales, err = parseLocales(localePrefixes); err != nil {
+		printError(err)
+		return nil, false
+	}
+	if err = setupExtensions(); err != nil {
+		printError(err)
+		return nil, false
+	}
+	src, err := inputSource(ctx, args)
+	var urlset *Urlset
+	if err == nil {
+		urlset, err = collect(src)
+	}
+	if err != nil {
+		printError(err)
+		return nil, false
+	}
+	expandLocales(urlset)
+	filterExtensions(urlset)
+	filterShard(urlset)
+	sort.Stable(urlset)
+	if exportPath != "" {
+		if err = exportUrlset(exportPath, exportBase, urlset); err != nil {
+			printError(err)
+			return nil, false
+		}
+		if verbose {
+			log.Printf("Exported %d URLs to %s\n", len(urlset.Url), exportPath)
+		}
+	}
+	return urlset, true
+}
+
+func printError(err error) {
+	runErr = err
+	fmt.Println("Error:", err)
+	if strings.HasSuffix(err.Error(), "x509: certificate signed by unknown authority") {
+		fmt.Println("\nUse the --insecure-ssl toggle to disable certificate verification")
+	}
+}
+
+// Clears the results of the previous run
+func resetRun() {
+	resultsMu.Lock()
+	results = nil
+	resultsMu.Unlock()
+	seenMu.Lock()
+	seen = make(map[string]bool)
+	seenMu.Unlock()
+	bodyHashesMu.Lock()
+	bodyHashes = make(map[[sha256.Size]byte][]string)
+	bodyHashesMu.Unlock()
+	atomic.StoreInt64(&freshSkipped, 0)
+	atomic.StoreInt64(&uncacheableSkipped, 0)
+	atomic.StoreInt64(&typeSkipped, 0)
+	atomic.StoreInt64(&originChecked, 0)
+	atomic.StoreInt64(&originDiffers, 0)
+	childMu.Lock()
+	childProgress = make(map[string]*childCounts)
+	childMu.Unlock()
+	refreshesMu.Lock()
+	refreshes = make(map[string]string)
+	refreshesMu.Unlock()
+	ttlsMu.Lock()
+	ttls = make(map[string]time.Duration)
+	ttlsMu.Unlock()
+	resetProgress()
+}
+
+// Evaluates end-of-run checks and returns the process exit code
+func finish() int {
+	code := 0
+	stopProfiling()
+	if checkDuplicates {
+		reportDuplicates()
+	}
+	if !nowarn {
+		reportFailures()
+	}
+	if slowThreshold > 0 && !nowarn {
+		reportSlow()
+	}
+	if slowestN > 0 {
+		reportSlowest(int(slowestN), slowestPath)
+	}
+	if compareOrigin != "" {
+		reportOriginDiffs()
+	}
+	if noCompression {
+		reportSizes()
+	}
+	if minTTL > 0 {
+		reportTTLs()
+	}
+	if hostStatsReport {
+		reportHostStats()
+	}
+	if sitemapStatsReport {
+		reportSitemapStats()
+	}
+	if connStatsReport {
+		reportConnStats()
+	}
+	if phasesReport {
+		reportPhases()
+	}
+	if roundRobin {
+		reportAddrStats()
+	}
+	if refreshWithin > 0 && verbose {
+		log.Printf("Skipped %d URLs that stay fresh for more than %s\n", atomic.LoadInt64(&freshSkipped), refreshWithin)
+	}
+	if skipUncacheable && verbose {
+		log.Printf("Skipped %d uncacheable URLs\n", atomic.LoadInt64(&uncacheableSkipped))
+	}
+	if len(allowedTypes) > 0 && verbose {
+		log.Printf("Skipped %d URLs of other types than %s\n", atomic.LoadInt64(&typeSkipped), contentTypes)
+	}
+	for _, path := range []string{failuresPath, retryFile} {
+		if path == "" {
+			continue
+		}
+		if err := writeFailures(path); err != nil && !nowarn {
+			log.Printf("Error writing %s: %v\n", path, err)
+		}
+	}
+	if resultsPath != "" {
+		if err := writeResultsFile(resultsPath); err != nil && !nowarn {
+			log.Printf("Error writing %s: %v\n", resultsPath, err)
+		}
+	}
+	if saveBaselinePath != "" {
+		if err := currentBaseline().save(saveBaselinePath); err != nil && !nowarn {
+			log.Printf("Error saving the baseline to %s: %v\n", saveBaselinePath, err)
+		}
+	}
+	if state != nil {
+		if err := state.save(statePath); err != nil && !nowarn {
+			log.Printf("Error saving the state to %s: %v\n", statePath, err)
+		}
+	}
+	if cookieJar != nil {
+		saveCookies()
+	}
+	if len(cfg.SLA) > 0 && !reportSLA(cfg.SLA) {
+		code = exitSLO
+	}
+	if len(cfg.Expect) > 0 && !reportExpected(cfg.Expect) && code == 0 {
+		code = exitExpect
+	}
+	if len(slos) > 0 {
+		ds := sloDurations()
+		for _, o := range slos {
+			v, ok := o.check(ds)
+			if ok {
+				if verbose {
+					log.Printf("SLO %s met (%s)\n", o.expr, v)
+				}
+			} else {
+				log.Printf("SLO %s violated (%s)\n", o.expr, v)
+				code = exitSLO
+			}
+		}
+	}
+	if base != nil && reportRegressions() && failOnRegression && code == 0 {
+		code = exitRegression
+	}
+	if pastDeadline() {
+		reportDeadline()
+		if code == 0 {
+			code = exitDeadline
+		}
+	}
+	return code
+}
+
+// A flag that may be given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 var (
-	throttle    uint
-	max         uint
-	localDir    string
-	localSuffix string
-	userAgent   string
-	verbose     bool
-	nowarn      bool
-	printUrls   bool
-	primeUrls   bool
-	insecureSsl bool
+	throttle           uint
+	max                uint
+	localDir           string
+	localSuffix        string
+	userAgent          string
+	uaFile             string
+	uaOrder            string
+	verbose            bool
+	nowarn             bool
+	printUrls          bool
+	printFormat        string
+	printNul           bool
+	primeUrls          bool
+	insecureSsl        bool
+	contentTypes       string
+	contentTypesHead   bool
+	noCompression      bool
+	sloSpec            string
+	slos               []slo
+	urlFile            string
+	inputFormat        string
+	sitemapConcurrency uint
+	expands            stringsFlag
+	lenient            bool
+	skipCrossHost      bool
+	shard              string
+	localePrefixes     string
+	skipExtensions     string
+	onlyExtensions     string
+	exportPath         string
+	exportBase         string
+	logBase            string
+	logTop             uint
+	logSince           time.Duration
+	gscSite            string
+	ga4Property        string
+	googleAccessToken  string
+	googleTop          uint
+	googleDays         uint
+	followNext         uint
+	metaRefreshMode    string
+	amp                bool
+	preload            bool
+	checkCanon         bool
+	checkNoidx         bool
+	lastmodTolerance   time.Duration
+	checkDuplicates    bool
+	compareOrigin      string
+	compareHeaders     string
+	compareIgnore      string
+	recordPath         string
+	failFast           bool
+	slowestN           uint
+	slowThreshold      time.Duration
+	minTTL             time.Duration
+	slowestPath        string
+	connStatsReport    bool
+	phasesReport       bool
+	alsoVariants       string
+	clientHints        string
+	purgePlugin        string
+	purgeUrl           string
+	purgeMethod        string
+	wpPath             string
+	wpSSH              string
+	verifyCache        bool
+	refreshWithin      time.Duration
+	statePath          string
+	baselinePath       string
+	captureHeaders     stringsFlag
+	failuresPath       string
+	hostStatsReport    bool
+	lockPath           string
+	heartbeatUrl       string
+	preCmd             string
+	eventsFormat       string
+	eventsPath         string
+	postCmd            string
+	logSyslog          bool
+	syslogFacility     string
+	syslogTag          string
+	lockWait           time.Duration
+	sitemapStatsReport bool
+	retryFile          string
+	debugDir           string
+	debugSize          uint
+	resultsPath        string
+	saveBaselinePath   string
+	regressionPct      float64
+	regressionMin      time.Duration
+	failOnRegression   bool
+	skipUncacheable    bool
+	recheckUncacheable time.Duration
+	cacheHeaderSpecs   stringsFlag
+	sftpKey            string
+	sourceExecs        stringsFlag
+	dbDsn              string
+	dbQuery            string
+	dbUrl              string
+	pinDNS             bool
+	dnsRefresh         time.Duration
+	roundRobin         bool
+	replayPath         string
+	headers            stringsFlag
+	headerManifest     string
+	xff                string
+	forwardedHeaders   stringsFlag
+	requestIDHeader    string
+	cookieJarPath      string
+	retries            uint
+	rateLimit          float64
+	maxRedirects       uint
+	confirmOver        uint
+	assumeYes          bool
+	retryOn            string
+	retryBackoff       time.Duration
+	requestTimeout     time.Duration
+	connectTimeout     time.Duration
+	retryJitter        float64
+	authCreds          string
+	authType           string
+	configPath         string
+	useNetrc           bool
+	cfAccessId         string
+	cfAccessSecret     string
+	cfAccessCookie     bool
+	rewrites           stringsFlag
+
+	pprofAddr      string
+	cpuProfilePath string
+	memProfilePath string
 )
 
+// Registers the flags that select the URLs to prime
+func inputFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&primeUrls, "urls", false, "prime the URLs given as arguments rather than a sitemap")
+	fs.StringVar(&urlFile, "f", "", "read URLs from this file, one per line, or as JSON or CSV if it ends in .json or .csv ('-' for stdin)")
+	fs.Var(&sourceExecs, "source-exec", "also prime the URLs this shell command writes to stdout, one per line (or as JSON with -format json) (may be repeated)")
+	fs.StringVar(&dbDsn, "db", "", "also prime URLs from this database, e.g. postgres://user@host/cms, mysql://user@host/cms or sqlite:///path/to/cms.db ($VARIABLES are expanded; uses the psql, mysql or sqlite3 command)")
+	fs.StringVar(&dbQuery, "db-query", "", "query for -db, e.g. 'SELECT slug FROM posts WHERE published'")
+	fs.StringVar(&dbUrl, "db-url", "", "template for the URL of each -db row, e.g. 'https://mysite.com/blog/{{.slug}}' (default: the url or loc column)")
+	fs.Var(&expands, "expand", "also prime the URLs matching this pattern, e.g. 'http://mysite.com/page/{1..500}' or 'http://mysite.com/{en,fr}/' (may be repeated)")
+	fs.StringVar(&inputFormat, "format", "", "format of the sitemap or -f input: xml, text, json, csv (with a header row naming the url column and optionally priority, lastmod and other columns), openapi (an OpenAPI/Swagger JSON document whose GET endpoints are primed) or accesslog (an nginx/Apache access log whose most requested URLs are primed) (default: guessed from the file name)")
+	fs.BoolVar(&lenient, "lenient", false, "tolerate common sitemap defects (byte order marks, junk before the XML, unescaped ampersands), skipping and reporting entries that can't be parsed")
+	fs.UintVar(&sitemapConcurrency, "sitemap-concurrency", 4, "child sitemaps of a sitemapindex to download at once; when priming, the URLs in each child are primed as soon as it has been downloaded, so they are only primed in priority order within each child (unless -export, tiers or a scenario are used)")
+	fs.StringVar(&sftpKey, "sftp-key", "", "SSH private key for sftp:// sitemaps (default: the user's SSH keys and agent)")
+	fs.StringVar(&localePrefixes, "locale-prefixes", "", "also use the URL of each of these locales for each URL, e.g. /en,/fr to add /en/about and /fr/about for /about, for sitemaps that only list the default locale")
+	fs.StringVar(&skipExtensions, "skip-extensions", "", "leave out URLs whose paths end in these file extensions, e.g. pdf,zip,mp4")
+	fs.StringVar(&onlyExtensions, "only-extensions", "", "leave out URLs whose paths end in other file extensions than these, e.g. html,php (URLs without one, such as /about/, are kept)")
+	fs.StringVar(&shard, "shard", "", "only use the URLs in this shard of the URL set, e.g. 2/5 on the second of five machines that together cover all of it (URLs are assigned to shards by a hash of the URL)")
+	fs.BoolVar(&skipCrossHost, "skip-cross-host", false, "skip URLs in sitemaps that are on a different host than the sitemap itself, and those found on pages (e.g. preloads and AMP versions) that are on a different host than the page")
+	fs.StringVar(&exportPath, "export", "", "write the sorted URLs to this sitemap file (gzipped if it ends in .gz; split into a sitemapindex and child sitemaps if there are more than 50,000)")
+	fs.StringVar(&exportBase, "export-base", "", "URL the child sitemaps written by -export will be served from, for the sitemapindex")
+	fs.StringVar(&logBase, "log-base", "", "site URL to prepend to the paths in an access log, e.g. https://mysite.com")
+	fs.UintVar(&logTop, "log-top", 0, "prime only this many of the most requested URLs in an access log")
+	fs.DurationVar(&logSince, "log-since", 0, "count only access log requests made within this long, e.g. 24h")
+	fs.StringVar(&gscSite, "gsc-site", "", "also prime the top pages by clicks of this Search Console property, e.g. https://mysite.com/ or sc-domain:mysite.com")
+	fs.StringVar(&ga4Property, "ga4-property", "", "also prime the most viewed pages of this Google Analytics 4 property ID")
+	fs.StringVar(&googleAccessToken, "google-token", "", "OAuth2 access token for -gsc-site and -ga4-property (default: $GOOGLE_ACCESS_TOKEN)")
+	fs.UintVar(&googleTop, "google-top", 1000, "number of top pages to get from Search Console or Google Analytics")
+	fs.UintVar(&googleDays, "google-days", 28, "number of days of Search Console or Google Analytics data to rank pages by")
+}
+
+// Registers the flags that control how requests are sent
+func requestFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", "", "read further settings, such as OAuth2 client credentials, from this JSON file")
+	fs.UintVar(&throttle, "c", 1, "URLs to prime at once")
+	fs.UintVar(&maxRedirects, "max-redirects", 10, "fail URLs that redirect more than this many times, or in a loop, reporting the chain of redirects")
+	fs.Float64Var(&rateLimit, "rate", 0, "maximum requests per second, e.g. 0.5 for one every two seconds (0: unlimited)")
+	fs.StringVar(&userAgent, "ua", defaultUA, "User-Agent header to send")
+	fs.StringVar(&uaFile, "ua-file", "", "rotate the User-Agent sent when priming each URL through those in this file, one per line, recording the one used in the -results-file and -record")
+	fs.StringVar(&uaOrder, "ua-order", "sequential", "order in which -ua-file User-Agents are used: sequential or random")
+	fs.BoolVar(&verbose, "v", false, "show additional information about the priming process")
+	fs.BoolVar(&nowarn, "no-warn", false, "do not warn about pages that were not primed successfully")
+	fs.BoolVar(&logSyslog, "log-syslog", false, "send log messages to syslog (or the journal on systemd systems) instead of stderr")
+	fs.StringVar(&syslogFacility, "syslog-facility", "daemon", "with -log-syslog, the facility to log with, e.g. user or local0")
+	fs.StringVar(&syslogTag, "syslog-tag", "ocp", "with -log-syslog, the tag to log with")
+	fs.BoolVar(&insecureSsl, "insecure-ssl", false, "disable SSL certificate verification when priming HTTPS URLs")
+	fs.BoolVar(&noCompression, "no-compression", false, "ask for uncompressed responses with Accept-Encoding: identity and record their full sizes, e.g. to compare page weights (caches usually keep compressed and uncompressed responses apart, so this primes the latter)")
+	fs.BoolVar(&pinDNS, "pin-dns", false, "resolve each host name once, reporting failures before priming, and keep using the same addresses for the run")
+	fs.DurationVar(&dnsRefresh, "dns-refresh", 0, "with -pin-dns, resolve host names again after this long, e.g. 5m")
+	fs.BoolVar(&roundRobin, "round-robin", false, "send requests to each address of a host name in turn, so every server behind round-robin DNS is primed, falling back to the next address if one can't be connected to, and report per-address stats (implies -pin-dns)")
+	fs.Var(&headers, "H", "extra header to send with every request, e.g. 'X-Warm: 1' (may be repeated)")
+	fs.StringVar(&xff, "xff", "", "send X-Forwarded-For with this client IP address, e.g. for origins that pick geo variants or exempt warming from rate limits by client IP")
+	fs.Var(&forwardedHeaders, "forwarded-header", "header to send with every request, whose value is a template using the -xff IP and the requested Host and Scheme, e.g. 'Forwarded: for={{.IP}};host={{.Host}};proto={{.Scheme}}' (may be repeated)")
+	fs.DurationVar(&requestTimeout, "timeout", 0, "time after which a request fails if it hasn't been answered and downloaded in full, e.g. 1m (0: no limit)")
+	fs.DurationVar(&connectTimeout, "connect-timeout", 30*time.Second, "time after which connecting to a server fails")
+	fs.UintVar(&retries, "retries", 0, "number of times to retry requests that fail as listed in -retry-on, backing off exponentially, or for as long as a 429 or 503 response asks with Retry-After")
+	fs.DurationVar(&retryBackoff, "retry-backoff", time.Second, "time to wait before the first -retries, doubling for each one after")
+	fs.Float64Var(&retryJitter, "retry-jitter", 0.2, "fraction of each -retry-backoff wait to add or take off at random, so retries of many URLs are spread out (0-1)")
+	fs.StringVar(&retryOn, "retry-on", "429,500,502,503,504,timeout", "failures to retry: status codes (e.g. 503 or 5xx), timeout and/or error (any other network error)")
+	fs.StringVar(&cookieJarPath, "cookie-jar", "", "keep cookies, e.g. from the login in the config or a consent wall, and save them to this JSON file for the next run, which skips the login while its session cookies are valid")
+	fs.StringVar(&requestIDHeader, "request-id-header", "", "header, e.g. X-Request-Id, to send a unique ID in with each request, which is included in error messages, -record and -slowest-file for finding them in server logs")
+	fs.StringVar(&headerManifest, "header-manifest", "", "JSON or CSV file of extra headers for the URLs matching patterns, e.g. a preview token for embargoed pages (see example-headers.csv)")
+	fs.StringVar(&authCreds, "auth", "", "authenticate as 'user:password' (for NTLM, 'DOMAIN\\user:password')")
+	fs.StringVar(&authType, "auth-type", "basic", "authentication scheme for -auth: basic, digest or ntlm")
+	fs.BoolVar(&useNetrc, "netrc", false, "authenticate with the credentials for each host in ~/.netrc (or $NETRC)")
+	fs.StringVar(&cfAccessId, "cf-access-client-id", os.Getenv("CF_ACCESS_CLIENT_ID"), "Cloudflare Access service token client ID (default: $CF_ACCESS_CLIENT_ID)")
+	fs.StringVar(&cfAccessSecret, "cf-access-client-secret", "", "Cloudflare Access service token client secret (default: $CF_ACCESS_CLIENT_SECRET)")
+	fs.BoolVar(&cfAccessCookie, "cf-access-cookie", false, "after authenticating with the service token, send the CF_Authorization cookie Cloudflare Access issues instead")
+	fs.Var(&rewrites, "rewrite", "send requests for URLs beginning with one prefix to another, keeping the Host header, e.g. 'https://mysite.com=http://10.0.0.5' (may be repeated)")
+}
+
+// Registers the flags that control priming
+func primeFlags(fs *flag.FlagSet) {
+	fs.UintVar(&max, "max", 0, "maximum number of uncached URLs to prime")
+	fs.DurationVar(&maxDuration, "max-duration", 0, "stop starting new primes after this long, e.g. 30m, finishing those in flight, reporting how many URLs were primed and skipped, and exiting with status 10")
+	fs.UintVar(&confirmOver, "confirm-over", 10000, "when run interactively, show an estimate of how long priming will take and ask before priming more than this many URLs, exiting with status 8 if declined (0: never ask)")
+	fs.BoolVar(&assumeYes, "yes", false, "do not ask before priming many URLs (see -confirm-over)")
+	fs.StringVar(&localDir, "l", "", "directory containing cached files (relative file names, i.e. /about/ -> <path>/about/index.html)")
+	fs.StringVar(&localSuffix, "ls", "index.html", "suffix of locally cached files")
+	fs.StringVar(&contentTypes, "content-types", "", "only download responses of these types, e.g. text/html,application/json or text/*, closing others, such as large PDFs, once their headers arrive")
+	fs.BoolVar(&contentTypesHead, "content-types-head", false, "check the -content-types of each URL with a HEAD request first, and skip those of other types without requesting them")
+	fs.UintVar(&followNext, "follow-next", 0, "also prime pages linked with rel=\"next\" from primed pages, up to this many pages deep")
+	fs.StringVar(&metaRefreshMode, "meta-refresh", "", "detect pages that redirect with <meta http-equiv=\"refresh\"> or a Refresh header, and report them (report), or also prime their targets (follow)")
+	fs.BoolVar(&amp, "amp", false, "also prime the AMP versions of pages (linked with rel=\"amphtml\")")
+	fs.BoolVar(&preload, "preload", false, "also prime the resources pages preload (with Link: rel=\"preload\" or 103 Early Hints)")
+	fs.BoolVar(&checkCanon, "check-canonical", false, "report pages whose rel=\"canonical\" URL differs from their sitemap URL")
+	fs.BoolVar(&checkNoidx, "check-noindex", false, "report pages that are excluded from indexing with a robots meta tag or X-Robots-Tag header")
+	fs.DurationVar(&lastmodTolerance, "check-lastmod", 0, "report pages whose sitemap lastmod differs by more than this from their Last-Modified header or modification date meta tags, e.g. 24h")
+	fs.BoolVar(&checkDuplicates, "check-duplicates", false, "report groups of pages whose responses have identical bodies at the end of the run")
+	fs.StringVar(&compareOrigin, "compare-origin", "", "also fetch each page from this origin, keeping the Host header, e.g. http://10.0.0.5:8080, or with 'bypass' from the same URL, in both cases with Cache-Control: no-cache, and report pages whose status, -compare-headers or body differ from what the cache served")
+	fs.StringVar(&compareHeaders, "compare-headers", "Content-Type,Content-Language,Vary", "response headers compared with -compare-origin")
+	fs.StringVar(&compareIgnore, "compare-ignore", "", "regular expression matching the parts of bodies -compare-origin ignores, such as nonces or timestamps")
+	fs.StringVar(&historyPath, "history-db", "", "record the run and the result of each URL in this SQLite database, for the history and show commands (requires the sqlite3 command)")
+	fs.StringVar(&eventsFormat, "events", "", "stream an event for each sitemap read, request started and URL primed, and the end of the run, as they happen, in this format: ndjson (one JSON object per line)")
+	fs.StringVar(&eventsPath, "events-file", "", "write -events to this file instead of stdout")
+	fs.StringVar(&preCmd, "pre-cmd", "", "run this shell command before priming, stopping if it fails; $OCP_INPUT is the sitemap or URLs given")
+	fs.StringVar(&postCmd, "post-cmd", "", "run this shell command after priming, with $OCP_STATUS (success or failure), $OCP_EXIT_CODE, $OCP_PRIMED, $OCP_FAILED, $OCP_SLOW (primes over -slow-threshold) and $OCP_DURATION (in seconds) describing the run")
+	fs.StringVar(&heartbeatUrl, "heartbeat-url", "", "ping this URL when a run starts (with /start appended) and ends (with /fail appended if it failed), sending the stats of the run, e.g. a Healthchecks.io check URL")
+	fs.StringVar(&lockPath, "lock", "", "lock this file for the duration of the run, so a run started while another holds it, e.g. from cron, exits with status 7 instead of priming alongside it")
+	fs.DurationVar(&lockWait, "lock-wait", 0, "with -lock, wait up to this long for the other run to finish, e.g. 30m")
+	fs.BoolVar(&failFast, "fail-fast", false, "stop the run as soon as a prime fails (exits with status 4)")
+	fs.UintVar(&slowestN, "slowest", 0, "list this many of the slowest URLs, with their timings and sizes, at the end of the run")
+	fs.DurationVar(&slowThreshold, "slow-threshold", 0, "log primes that take longer than this, e.g. 1500ms, as warnings, and mark them with severity warn in -results-file and -events, counting them separately from failures without failing the run")
+	fs.StringVar(&slowestPath, "slowest-file", "", "also write the -slowest URLs, with the time spent in each phase of the request, to this CSV file")
+	fs.BoolVar(&hostStatsReport, "host-stats", false, "report the number of primes, error rate, latency percentiles and bytes downloaded per host at the end of the run")
+	fs.BoolVar(&sitemapStatsReport, "sitemap-stats", false, "report the number of primes, error rate, latency percentiles and bytes downloaded per child sitemap of a sitemapindex at the end of the run, those with the most failures first")
+	fs.BoolVar(&connStatsReport, "conn-stats", false, "report per host how many primes reused a connection and how many TLS sessions were resumed at the end of the run")
+	fs.BoolVar(&phasesReport, "phases", false, "report percentiles of the time spent on DNS, connecting, TLS, waiting for the first byte and downloading at the end of the run")
+	fs.Var(&captureHeaders, "capture-header", "include this response header in -results-file and -slowest-file, e.g. CF-Cache-Status (may be repeated)")
+	fs.StringVar(&resultsPath, "results-file", "", "write the URL, status, duration, size, error and -capture-header values of every prime to this file at the end of the run (JSON lines)")
+	fs.StringVar(&failuresPath, "failures", "", "write the URLs that failed to this file, one per line, for priming them again with -f or -retry-file")
+	fs.StringVar(&retryFile, "retry-file", "", "prime the URLs in this file written by -failures, and replace it with those that fail again")
+	fs.StringVar(&debugDir, "debug-dir", "", "save the status, headers and start of the body of each response with an error status to a file in this directory")
+	fs.UintVar(&debugSize, "debug-size", 16, "KB of each body to save to -debug-dir")
+	fs.StringVar(&recordPath, "record", "", "write the URL, timing, status and response headers of every request to this file (JSON lines)")
+	fs.StringVar(&replayPath, "replay", "", "re-issue the requests in a file written by -record, with the same pacing, instead of priming a sitemap")
+	fs.StringVar(&clientHints, "client-hints", "", "also prime each URL with the Client Hints (Sec-CH-UA-Mobile, viewport width and DPR) of these devices, for caches that vary on them: mobile, tablet and/or desktop")
+	fs.StringVar(&alsoVariants, "also-variants", "", "also prime these variants of each URL, reporting those that don't redirect to it: scheme (http/https), www (www/bare domain) and/or slash (/path and /path/), e.g. scheme,www")
+	fs.DurationVar(&minTTL, "min-ttl", 0, "report the pages that shared caches may keep for less than this per their Cache-Control s-maxage or max-age, or that have neither, by section (host and first path segment), e.g. 1h")
+	fs.DurationVar(&refreshWithin, "refresh-within", 0, "probe each URL with a HEAD request first, and only prime those that are stale or expire from the cache within this time according to their Age and Cache-Control max-age, e.g. 5m")
+	fs.StringVar(&baselinePath, "baseline", "", "compare the status and latency of each URL against this file written by -save-baseline, and report new failures and URLs that got slower")
+	fs.StringVar(&saveBaselinePath, "save-baseline", "", "write the status and latency of each URL to this file, for -baseline")
+	fs.Float64Var(&regressionPct, "regression-threshold", 50, "percentage by which a URL must be slower than its -baseline to be reported")
+	fs.DurationVar(&regressionMin, "regression-min", 100*time.Millisecond, "minimum latency increase over the -baseline that is reported, so small absolute changes aren't")
+	fs.BoolVar(&failOnRegression, "fail-on-regression", false, "exit with status 6 if there are regressions against the -baseline")
+	fs.StringVar(&statePath, "state", "", "keep what is learned about the URLs between runs in this JSON file, e.g. which are uncacheable (Cache-Control: private or no-store), reporting them when first found")
+	fs.BoolVar(&skipUncacheable, "skip-uncacheable", false, "don't prime the URLs the -state file lists as uncacheable")
+	fs.DurationVar(&recheckUncacheable, "recheck-uncacheable", 7*24*time.Hour, "prime uncacheable URLs again to check whether they still are after this long")
+	fs.StringVar(&purgePlugin, "purge", "", "purge the cache of this WordPress plugin with WP-CLI before priming: lscache (LiteSpeed Cache) or wp-rocket")
+	fs.StringVar(&wpPath, "wp-path", "", "path of the WordPress installation for -purge")
+	fs.StringVar(&wpSSH, "wp-ssh", "", "run the -purge WP-CLI command on this server over SSH, e.g. user@host:2222/var/www/html")
+	fs.StringVar(&purgeUrl, "purge-url", "", "request this URL to purge the cache before priming")
+	fs.StringVar(&purgeMethod, "purge-method", "PURGE", "HTTP method used for -purge-url")
+	fs.BoolVar(&verifyCache, "verify", false, "request each URL again after priming and report how many were served from the cache, according to the cache status headers of LiteSpeed, WP Rocket (rocket-nginx), Cloudflare, nginx, Varnish and other caches, or -cache-header (exits with status 5 if any weren't)")
+	fs.Var(&cacheHeaderSpecs, "cache-header", "response header and values that mean the cache served the request, e.g. 'X-Proxy-Cache: HIT,STALE' or 'X-Proxy-Cache: hit=HIT; bypass=BYPASS,EXPIRED' (other values are misses; may be repeated)")
+	fs.StringVar(&sloSpec, "slo", "", "latency objectives for the run, e.g. 'p95<800ms,p99<2s' (exits with status 3 if violated; primes that failed without a response count as too slow)")
+	fs.StringVar(&pprofAddr, "pprof", "", "serve runtime profiling data (net/http/pprof) on this address, e.g. :6060")
+	fs.StringVar(&cpuProfilePath, "cpuprofile", "", "write a CPU profile to this file")
+	fs.StringVar(&memProfilePath, "memprofile", "", "write a heap profile to this file when the run ends")
+}
+
+// Registers the flags that control printing URLs
+func printFlags(fs *flag.FlagSet) {
+	fs.StringVar(&printFormat, "print-format", "", "Go template used to print each URL, e.g. '{{.Priority}} {{.Lastmod}} {{.Host}} {{.Loc}}'")
+	fs.BoolVar(&printNul, "print0", false, "terminate each URL with a NUL character rather than a newline (for xargs -0)")
+}
+
+// Registers the flags of the legacy invocation without a subcommand
 func init() {
-	flag.UintVar(&throttle, "c", 1, "URLs to prime at once")
-	flag.UintVar(&max, "max", 0, "maximum number of uncached URLs to prime")
-	flag.StringVar(&localDir, "l", "", "directory containing cached files (relative file names, i.e. /about/ -> <path>/about/index.html)")
-	flag.StringVar(&localSuffix, "ls", "index.html", "suffix of locally cached files")
-	flag.StringVar(&userAgent, "ua", defaultUA, "User-Agent header to send")
-	flag.BoolVar(&verbose, "v", false, "show additional information about the priming process")
-	flag.BoolVar(&nowarn, "no-warn", false, "do not warn about pages that were not primed successfully")
+	inputFlags(flag.CommandLine)
+	requestFlags(flag.CommandLine)
+	primeFlags(flag.CommandLine)
+	printFlags(flag.CommandLine)
 	flag.BoolVar(&printUrls, "print", false, "(exclusive) just print the sorted URLs (can be used with xargs)")
-	flag.BoolVar(&primeUrls, "urls", false, "prime the URLs given as arguments rather than a sitemap")
-	flag.BoolVar(&insecureSsl, "insecure-ssl", false, "disable SSL certificate verification when priming HTTPS URLs")
-	flag.Parse()
 }
 
-func main() {
-	var (
-		urlset *Urlset
-		err    error
-	)
-	if flag.NArg() == 0 {
-		fmt.Println("Optimus Cache Prime", version)
-		fmt.Println("http://patrickmylund.com/projects/ocp/")
-		fmt.Println("-----")
-		flag.Usage()
-		fmt.Println("")
-		fmt.Println("Examples:")
-		fmt.Println(" ", os.Args[0], "sitemap.xml")
-		fmt.Println(" ", os.Args[0], "http://mysite.com/sitemap.xml")
-		fmt.Println(" ", os.Args[0], "-c 10 http://mysite.com/sitemap.xml.gz")
-		fmt.Println(" ", os.Args[0], "-l /var/www/mysite.com/wp-content/cache/supercache/ http://mysite.com/sitemap.xml")
-		fmt.Println(" ", os.Args[0], "-l /var/www/mysite.com/wp-content/w3tc/pgcache/ -ls _index.html http://mysite.com/sitemap.xml")
-		fmt.Println(" ", os.Args[0], "--print http://mysite.com/sitemap.xml | xargs curl -I")
-		fmt.Println(" ", os.Args[0], "--urls http://foo.com/a http://foo.com/b")
-		fmt.Println("")
-		fmt.Println("If specifying a sitemap URL, make sure to prepend http:// or https://")
-		return
+// Sends log messages to syslog with -log-syslog
+func setupLog() error {
+	if !logSyslog {
+		return nil
 	}
-	if max > 0 {
-		one = make(chan bool)
+	w, err := openSyslog(syslogFacility, syslogTag)
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0) // syslog adds the time
+	log.SetOutput(w)
+	return nil
+}
+
+// Prepares the fetcher and semaphore according to the request flags, and
+// returns the context of the run, whose requests are sent with the fetcher
+func setupRequests() (context.Context, error) {
+	if configPath != "" {
+		if err := loadConfig(configPath); err != nil {
+			return nil, fmt.Errorf("reading config %s: %v", configPath, err)
+		}
+		if err := compileSLARules(cfg.SLA); err != nil {
+			return nil, fmt.Errorf("config %s: %v", configPath, err)
+		}
+		if err := compileScenario(cfg.Scenario); err != nil {
+			return nil, fmt.Errorf("config %s: %v", configPath, err)
+		}
+		if err := compileTiers(cfg.Tiers); err != nil {
+			return nil, fmt.Errorf("config %s: %v", configPath, err)
+		}
+		if err := compileExpect(cfg.Expect); err != nil {
+			return nil, fmt.Errorf("config %s: %v", configPath, err)
+		}
+		if err := compileTenants(cfg.Tenants); err != nil {
+			return nil, fmt.Errorf("config %s: %v", configPath, err)
+		}
+	}
+	sentryDsn = configuredSentryDSN()
+	if sentryDsn != "" {
+		if _, _, err := parseSentryDSN(sentryDsn); err != nil {
+			return nil, err
+		}
+	}
+	if rateLimit < 0 {
+		return nil, fmt.Errorf("-rate must not be negative")
+	}
+	if uaFile != "" {
+		if err := setupUserAgents(); err != nil {
+			return nil, fmt.Errorf("reading -ua-file: %v", err)
+		}
 	}
 	sem = make(chan bool, throttle)
-	if insecureSsl {
-		client = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			},
+	ctl = newController(throttle, rateLimit)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: insecureSsl,
+		// Let TLS sessions be resumed on new connections
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	transport.DisableCompression = noCompression
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	client := &http.Client{Transport: transport, CheckRedirect: checkRedirect, Timeout: requestTimeout}
+	if pinDNS || roundRobin {
+		pinner = newDNSPinner(dnsRefresh)
+		transport.DialContext = pinner.DialContext
+		if roundRobin {
+			client.Transport = newRoundRobinTransport(transport, pinner)
 		}
 	}
-	if primeUrls {
-		urlset = &Urlset{
-			Url: urlSlice(flag.Args()),
+	if cookieJarPath != "" {
+		var err error
+		if cookieJar, err = loadCookieJar(cookieJarPath); err != nil {
+			return nil, fmt.Errorf("reading cookie jar %s: %v", cookieJarPath, err)
+		}
+		client.Jar = cookieJar
+	} else if cfg.Login != nil {
+		// Only keep cookies when logging in, as caches usually bypass
+		// requests with cookies
+		client.Jar, _ = cookiejar.New(nil)
+	}
+	f := ClientFetcher(client)
+	mws, err := flagMiddlewares()
+	if err != nil {
+		return nil, err
+	}
+	f = Chain(f, mws...)
+	if recordPath != "" {
+		rf, err := os.Create(recordPath)
+		if err != nil {
+			return nil, err
 		}
+		f = Chain(f, Recorder(rf))
+	}
+	ctx := WithFetcher(context.Background(), f)
+	if cfg.Login != nil {
+		if haveSession(cfg.Login.Url) {
+			if verbose {
+				log.Println("Using the session saved in", cookieJarPath)
+			}
+		} else if err = login(ctx, cfg.Login); err != nil {
+			return nil, fmt.Errorf("login: %v", err)
+		} else if cookieJar != nil {
+			saveCookies()
+		}
+	}
+	return ctx, nil
+}
+
+// Validates the prime flags and starts profiling
+func setupPrime() error {
+	var err error
+	if err = setupEvents(); err != nil {
+		return err
+	}
+	if lockPath != "" {
+		if err = acquireLock(lockPath, lockWait); errors.Is(err, errLocked) {
+			fmt.Println("Error:", err)
+			os.Exit(exitLocked)
+		} else if err != nil {
+			return err
+		}
+	}
+	handleProgressSignals()
+	if sloSpec != "" {
+		slos, err = parseSlos(sloSpec)
+		if err != nil {
+			return err
+		}
+	}
+	if allowedTypes, err = parseContentTypes(contentTypes); err != nil {
+		return err
+	}
+	if followNext > 0 {
+		inspectors = append(inspectors, followRelNext)
+	}
+	switch metaRefreshMode {
+	case "":
+	case "report", "follow":
+		inspectors = append(inspectors, checkMetaRefresh)
+	default:
+		return fmt.Errorf("invalid -meta-refresh %q (expected report or follow)", metaRefreshMode)
+	}
+	if amp {
+		inspectors = append(inspectors, primeAmp)
+	}
+	if preload {
+		inspectors = append(inspectors, primePreload)
+	}
+	for _, v := range cacheHeaderSpecs {
+		r, err := parseCacheHeader(v)
+		if err != nil {
+			return err
+		}
+		cacheHeaders = append(cacheHeaders, r)
+	}
+	if debugDir != "" {
+		if err := os.MkdirAll(debugDir, 0755); err != nil {
+			return err
+		}
+	}
+	if baselinePath != "" {
+		if base, err = loadBaseline(baselinePath); err != nil {
+			return err
+		}
+	}
+	if skipUncacheable && statePath == "" {
+		return fmt.Errorf("-skip-uncacheable requires -state")
+	}
+	if statePath != "" {
+		if state, err = loadState(statePath); err != nil {
+			return fmt.Errorf("reading state %s: %v", statePath, err)
+		}
+		inspectors = append(inspectors, learnUncacheable)
+	}
+	if purgePlugin != "" {
+		if _, err := wpPurgeCommand(purgePlugin); err != nil {
+			return err
+		}
+	}
+	if alsoVariants != "" {
+		if err := parseVariants(alsoVariants); err != nil {
+			return err
+		}
+		inspectors = append(inspectors, primeVariants)
+	}
+	if clientHints != "" {
+		if err := parseClientHints(clientHints); err != nil {
+			return err
+		}
+		inspectors = append(inspectors, primeClientHints)
+	}
+	if checkCanon {
+		inspectors = append(inspectors, checkCanonical)
+	}
+	if checkNoidx {
+		inspectors = append(inspectors, checkNoindex)
+	}
+	if lastmodTolerance > 0 {
+		inspectors = append(inspectors, checkLastmod)
+	}
+	if checkDuplicates {
+		inspectors = append(inspectors, hashBody)
+	}
+	if compareOrigin != "" {
+		if err := setupCompareOrigin(); err != nil {
+			return err
+		}
+		inspectors = append(inspectors, checkOrigin)
+	}
+	if max > 0 {
+		one = make(chan bool)
+		go maxStopper()
+	}
+	if maxDuration > 0 {
+		startDeadline()
+	}
+	if err = startProfiling(); err != nil {
+		return err
+	}
+	heartbeatStart()
+	return nil
+}
+
+// Validates the print flags
+func setupPrint() error {
+	if printFormat != "" {
+		if _, err := template.New("print").Parse(printFormat); err != nil {
+			return fmt.Errorf("invalid -print-format: %v", err)
+		}
+	}
+	return nil
+}
+
+// Primes the URLs in urlset and returns the exit code
+func prime(ctx context.Context, urlset *Urlset) int {
+	defer stopProfiling()
+	if pinner != nil {
+		pinner.preResolve(urlset)
+	}
+	if len(cfg.Scenario) > 0 {
+		primeScenario(ctx, urlset, cfg.Scenario)
 	} else {
-		path := flag.Arg(0)
-		urlset, err = getUrlsFromSitemap(path, true)
+		primeUrlset(ctx, urlset)
+	}
+	code := finish()
+	if verifyCache && !pastDeadline() && !verifyUrlset(ctx, urlset) && code == 0 {
+		code = exitVerify
+	}
+	runEnded(code)
+	return code
+}
+
+func usage() {
+	fmt.Println("Optimus Cache Prime", version)
+	fmt.Println("http://patrickmylund.com/projects/ocp/")
+	fmt.Println("-----")
+	fmt.Println("Usage:", os.Args[0], "[command] [flags] <sitemap>")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	for _, c := range commands {
+		fmt.Printf("  %-10s %s\n", c.name, c.desc)
+	}
+	fmt.Println("")
+	fmt.Println("Run", os.Args[0], "<command> -h for the flags of each command. Without a command, the")
+	fmt.Println("sitemap is primed using these flags:")
+	flag.PrintDefaults()
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Println(" ", os.Args[0], "sitemap.xml")
+	fmt.Println(" ", os.Args[0], "http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "-c 10 http://mysite.com/sitemap.xml.gz")
+	fmt.Println(" ", os.Args[0], "-l /var/www/mysite.com/wp-content/cache/supercache/ http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "-l /var/www/mysite.com/wp-content/w3tc/pgcache/ -ls _index.html http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "print http://mysite.com/sitemap.xml | xargs curl -I")
+	fmt.Println(" ", os.Args[0], "print -print0 http://mysite.com/sitemap.xml | xargs -0 curl -I")
+	fmt.Println(" ", os.Args[0], "print -print-format '{{.Priority}} {{.Loc}}' http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "--urls http://foo.com/a http://foo.com/b")
+	fmt.Println(" ", os.Args[0], "-f urls.txt")
+	fmt.Println(" ", os.Args[0], "-source-exec 'my-script --list-urls'")
+	fmt.Println(" ", os.Args[0], "-db postgres://cms@db/cms -db-query 'SELECT slug FROM posts WHERE published' -db-url 'https://mysite.com/blog/{{.slug}}'")
+	fmt.Println(" ", os.Args[0], "-format openapi http://api.mysite.com/openapi.json")
+	fmt.Println(" ", os.Args[0], "-log-base https://mysite.com -log-top 500 /var/log/nginx/access.log")
+	fmt.Println(" ", "GOOGLE_ACCESS_TOKEN=$(gcloud auth print-access-token)", os.Args[0], "-gsc-site https://mysite.com/")
+	fmt.Println(" ", os.Args[0], "-expand 'http://mysite.com/page/{1..50}' http://mysite.com/sitemap.xml")
+	fmt.Println(" ", "cat urls.json |", os.Args[0], "-f - -format json")
+	fmt.Println(" ", os.Args[0], "-slo 'p95<800ms' http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "-failures failed.txt http://mysite.com/sitemap.xml &&", os.Args[0], "-retry-file failed.txt")
+	fmt.Println(" ", os.Args[0], "-purge lscache -wp-ssh deploy@mysite.com/var/www/html -verify https://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "-compare-origin http://10.0.0.5 -compare-ignore 'nonce=\"[^\"]*\"' https://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "print -export merged.xml.gz http://mysite.com/sitemap_index.xml > /dev/null")
+	fmt.Println(" ", os.Args[0], "validate http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "crawl -depth 3 http://mysite.com/")
+	fmt.Println(" ", os.Args[0], "diff old-sitemap.xml http://mysite.com/sitemap.xml")
+	fmt.Println(" ", os.Args[0], "-history-db runs.db http://mysite.com/sitemap.xml &&", os.Args[0], "history -history-db runs.db")
+	fmt.Println("")
+	fmt.Println("If specifying a sitemap URL, make sure to prepend http:// or https://")
+	fmt.Println("To see the progress of a running prime, send it SIGUSR1, e.g. with: pkill -USR1 ocp")
+}
+
+func main() {
+	defer reportPanic()
+	if len(os.Args) > 1 {
+		if c := findCommand(os.Args[1]); c != nil {
+			os.Exit(c.main(os.Args[2:]))
+		}
+	}
+	flag.Usage = usage
+	flag.Parse()
+	if err := setupLog(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+	if !haveInput(flag.Args()) {
+		usage()
+		return
+	}
+	if printNul {
+		printUrls = true
+	}
+	if err := setupPrint(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
 	}
+	ctx, err := setupRequests()
 	if err != nil {
 		fmt.Println("Error:", err)
-		if strings.HasSuffix(err.Error(), "x509: certificate signed by unknown authority") {
-			fmt.Println("\nUse the --insecure-ssl toggle to disable certificate verification") 
+		os.Exit(2)
+	}
+	if !printUrls {
+		if err := setupPrime(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(2)
 		}
-	} else {
-		sort.Sort(urlset)
-		if printUrls {
-			for _, v := range urlset.Url {
-				fmt.Println(v.Loc)
-			}
-		} else {
-			if max > 0 {
-				go maxStopper()
-			}
-			primeUrlset(urlset)
+	}
+	if replayPath != "" && !printUrls {
+		os.Exit(replay(ctx, replayPath))
+	}
+	if !printUrls {
+		if err := beforeRun(ctx, flag.Args()); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+	if !printUrls && exportPath == "" && len(cfg.Scenario) == 0 && len(cfg.Tiers) == 0 && !confirming() {
+		streamChildren(ctx)
+	}
+	urlset, ok := loadUrlset(ctx, flag.Args())
+	if !ok {
+		stopProfiling()
+		if !printUrls {
+			runEnded(1)
+			os.Exit(1)
 		}
+		return
+	}
+	if printUrls {
+		if err := printUrlset(os.Stdout, urlset); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if !confirmUrlset(ctx, urlset) {
+		stopProfiling()
+		os.Exit(exitDeclined)
 	}
+	os.Exit(prime(ctx, urlset))
 }
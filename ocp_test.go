@@ -1,17 +1,39 @@
 package main
 
 import (
-	"flag"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
+	"time"
 )
 
 func init() {
-	flag.Parse()
 	sem = make(chan bool, throttle)
 }
 
@@ -51,7 +73,7 @@ func TestGetUrlsFromSitemap(t *testing.T) {
 </url>
 </urlset>`)
 	f.Close()
-	urlset, err := getUrlsFromSitemap(f.Name(), true)
+	urlset, err := getUrlsFromSitemap(context.Background(), f.Name(), true)
 	if err != nil ||
 		urlset.Url[0].Loc != "http://localhost:8081/a" ||
 		urlset.Url[0].Priority != 0.4 ||
@@ -120,7 +142,7 @@ func TestGetUrlsFromSitemapindex(t *testing.T) {
 </sitemap>
 </sitemapindex>`, f1.Name(), f2.Name(), f3.Name())
 	fi.Close()
-	urlset, err := getUrlsFromSitemap(fi.Name(), true)
+	urlset, err := getUrlsFromSitemap(context.Background(), fi.Name(), true)
 	if err != nil ||
 		urlset.Url[0].Loc != "http://localhost:8081/a" ||
 		urlset.Url[0].Priority != 0.4 ||
@@ -136,16 +158,3389 @@ func TestPrimeUrlset(t *testing.T) {
 	ch := make(chan string)
 	s := dummyServer(ch)
 	defer s.Close()
-	a := Url{s.URL + "/a", 0.4}
-	b := Url{s.URL + "/b", 0.6}
-	c := Url{s.URL + "/c", 1.0}
+	a := Url{Loc: s.URL + "/a", Priority: 0.4}
+	b := Url{Loc: s.URL + "/b", Priority: 0.6}
+	c := Url{Loc: s.URL + "/c", Priority: 1.0}
 	urlset := &Urlset{Url: []Url{a, b, c}}
 	sort.Sort(urlset)
-	go primeUrlset(urlset)
+	done := make(chan bool)
+	go func() {
+		primeUrlset(context.Background(), urlset)
+		done <- true
+	}()
 	for i := 0; i < 3; i++ {
 		msg := <-ch
 		if msg != "/a" && msg != "/b" && msg != "/c" {
 			t.Error("Web server on :8081 did not acknowledge a, b, c requests")
 		}
 	}
+	<-done
+}
+
+func TestStreamChildren(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	saved := sem
+	defer func() {
+		sem, streamChild = saved, nil
+		resetRun()
+	}()
+	sem = make(chan bool, 1)
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		got = append(got, req.URL.Path)
+		mu.Unlock()
+		return &http.Response{Status: "200 OK", StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}))
+	dir := t.TempDir()
+	child := func(name string, urls ...string) string {
+		s := "<urlset>"
+		for _, u := range urls {
+			p := strings.SplitN(u, " ", 2)
+			s += "<url><loc>http://foo.com/" + p[0] + "</loc><priority>" + p[1] + "</priority></url>"
+		}
+		ioutil.WriteFile(dir+"/"+name, []byte(s+"</urlset>"), 0644)
+		return dir + "/" + name
+	}
+	index := fmt.Sprintf("<sitemapindex><sitemap><loc>%s</loc></sitemap><sitemap><loc>%s</loc></sitemap></sitemapindex>",
+		child("1.xml", "a1 0.2", "a2 0.5"), child("2.xml", "b1 0.1", "b2 1.0"))
+	ioutil.WriteFile(dir+"/index.xml", []byte(index), 0644)
+	streamChildren(ctx)
+	urlset, err := getUrlsFromSitemap(ctx, dir+"/index.xml", true)
+	if err != nil || len(urlset.Url) != 0 {
+		t.Fatal("Expected the children to be streamed, got", urlset, err)
+	}
+	primeUrlset(ctx, urlset)
+	// Priority order only holds within each child: b2 needn't come first
+	pos := make(map[string]int)
+	for i, p := range got {
+		pos[p] = i
+	}
+	if len(got) != 4 || pos["/a2"] > pos["/a1"] || pos["/b2"] > pos["/b1"] {
+		t.Errorf("Expected each child to be primed in priority order, got %v", got)
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	var seen []string
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		seen = append(seen, req.URL.String())
+		if ua := req.Header.Get("User-Agent"); ua != userAgent {
+			t.Error("Unexpected User-Agent:", ua)
+		}
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}))
+	urlset := &Urlset{Url: urlSlice([]string{"foo.com/a"})}
+	primeUrlset(ctx, urlset)
+	if len(seen) != 1 || seen[0] != "http://foo.com/a" {
+		t.Error("Fetcher did not receive the prime request:", seen)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var got *http.Request
+	var f Fetcher = FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		got = req
+		return nil, nil
+	})
+	f = Chain(f, Header("X-A", "1"), RewritePrefix("http://foo.com", "http://127.0.0.1:8080"), Header("X-A", "2"))
+	req, _ := http.NewRequest("GET", "http://foo.com/a", nil)
+	f.Do(context.Background(), req)
+	if got.URL.String() != "http://127.0.0.1:8080/a" || got.Host != "foo.com" || got.Header.Get("X-A") != "2" {
+		t.Error("Middlewares were not applied in order:", got.URL, got.Host, got.Header)
+	}
+}
+
+func TestSources(t *testing.T) {
+	text, err := collect(TextSource(strings.NewReader("# comment\nfoo.com/a\n\nhttps://foo.com/b\n")))
+	if err != nil || len(text.Url) != 2 ||
+		text.Url[0].Loc != "http://foo.com/a" ||
+		text.Url[1].Loc != "https://foo.com/b" {
+		t.Error("Incorrectly parsed text source:", text, err)
+	}
+	js, err := collect(JSONSource(strings.NewReader(`["foo.com/a", {"loc": "http://foo.com/b", "priority": 0.5}]`)))
+	if err != nil || len(js.Url) != 2 ||
+		js.Url[0].Loc != "http://foo.com/a" ||
+		js.Url[1].Loc != "http://foo.com/b" ||
+		js.Url[1].Priority != 0.5 {
+		t.Error("Incorrectly parsed JSON source:", js, err)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	got, err := expand("http://foo.com/{a,b}/{9..11}")
+	want := []string{
+		"http://foo.com/a/9", "http://foo.com/a/10", "http://foo.com/a/11",
+		"http://foo.com/b/9", "http://foo.com/b/10", "http://foo.com/b/11",
+	}
+	if err != nil || strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Error("Incorrect expansion:", got, err)
+	}
+	got, err = expand("http://foo.com/{01..03}")
+	if err != nil || strings.Join(got, " ") != "http://foo.com/01 http://foo.com/02 http://foo.com/03" {
+		t.Error("Incorrect zero-padded expansion:", got, err)
+	}
+	if _, err = expand("http://foo.com/{1..x}"); err == nil {
+		t.Error("Invalid range did not return an error")
+	}
+}
+
+func TestRelLinks(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://foo.com/blog/", nil)
+	res := &http.Response{
+		Header:  http.Header{"Content-Type": {"text/html"}, "Link": {`</a>; rel="prev", </blog/2>; rel="next"`}},
+		Request: req,
+	}
+	body := []byte(`<html><head><LINK href='page/3' REL="next nofollow"><link rel="canonical" href="/"></head></html>`)
+	links := relLinks(res, body, "next")
+	if len(links) != 2 || links[0] != "http://foo.com/blog/2" || links[1] != "http://foo.com/blog/page/3" {
+		t.Error("Incorrect rel=next links:", links)
+	}
+}
+
+func TestValidateUrlset(t *testing.T) {
+	urlset := &Urlset{Url: []Url{
+		{Loc: "http://foo.com/a", Priority: 0.5, Lastmod: "2012-01-02"},
+		{Loc: "http://foo.com/a"},
+		{Loc: "/b", Priority: 1.5},
+		{Loc: "http://foo.com/c", Lastmod: "yesterday"},
+	}}
+	if problems := validateUrlset(urlset); len(problems) != 4 {
+		t.Error("Expected 4 problems, got:", problems)
+	}
+}
+
+func TestDiffUrlsets(t *testing.T) {
+	a := &Urlset{Url: urlSlice([]string{"foo.com/a", "foo.com/b"})}
+	b := &Urlset{Url: urlSlice([]string{"foo.com/b", "foo.com/c"})}
+	removed, added := diffUrlsets(a, b)
+	if len(removed) != 1 || removed[0] != "http://foo.com/a" || len(added) != 1 || added[0] != "http://foo.com/c" {
+		t.Error("Incorrect diff:", removed, added)
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	urlset := &Urlset{Url: []Url{
+		{Loc: "http://a.com/?a=1&b=2", Priority: 0.8, Lastmod: "2024-01-01"},
+		{Loc: "http://a.com/c"},
+	}}
+	if err := exportUrlset(dir+"/small.xml", "", urlset); err != nil {
+		t.Fatal(err)
+	}
+	got, err := getUrlsFromSitemap(context.Background(), dir+"/small.xml", true)
+	if err != nil || len(got.Url) != 2 || got.Url[0].Loc != "http://a.com/?a=1&b=2" || got.Url[0].Priority != 0.8 ||
+		got.Url[0].Lastmod != "2024-01-01" || got.Url[1].Loc != "http://a.com/c" {
+		t.Error("Unexpected URLs read back from the export:", got, err)
+	}
+	urlset = &Urlset{}
+	for i := 0; i <= maxSitemapUrls; i++ {
+		urlset.Url = append(urlset.Url, Url{Loc: fmt.Sprintf("http://a.com/%d", i)})
+	}
+	if err := exportUrlset(dir+"/big.xml.gz", "", urlset); err != nil {
+		t.Fatal(err)
+	}
+	got, err = getUrlsFromSitemap(context.Background(), dir+"/big.xml.gz", true)
+	if err != nil || len(got.Sitemap) != 2 || got.Sitemap[1].Loc != dir+"/big-2.xml.gz" ||
+		len(got.Url) != maxSitemapUrls+1 || got.Url[maxSitemapUrls].Loc != fmt.Sprintf("http://a.com/%d", maxSitemapUrls) {
+		t.Fatalf("Expected a sitemapindex of 2 sitemaps with every URL, got %d sitemaps and %d URLs: %v", len(got.Sitemap), len(got.Url), err)
+	}
+	if err := exportUrlset(dir+"/big.xml", "https://a.com/sitemaps/", urlset); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(dir + "/big.xml")
+	if !strings.Contains(string(data), "<loc>https://a.com/sitemaps/big-1.xml</loc>") {
+		t.Errorf("Expected -export-base in the sitemapindex, got\n%s", data)
+	}
+}
+
+func TestCrossHostUrls(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<urlset><url><loc>%s/a</loc></url><url><loc>%s/b</loc></url><url><loc>http://other.com/c</loc></url></urlset>",
+			ts.URL, strings.ToUpper(ts.URL))
+	}))
+	defer ts.Close()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		skipCrossHost = false
+	}()
+	for _, skip := range []bool{false, true} {
+		logs.Reset()
+		skipCrossHost = skip
+		urlset, err := getUrlsFromSitemap(context.Background(), ts.URL+"/sitemap.xml", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, msg := 3, "1 URLs in "+ts.URL+"/sitemap.xml are on other hosts than "
+		if skip {
+			want, msg = 2, "Skipped 1 URLs in "+ts.URL+"/sitemap.xml on other hosts than "
+		}
+		if len(urlset.Url) != want || !strings.Contains(logs.String(), msg) {
+			t.Errorf("-skip-cross-host=%t: expected %d URLs and %q, got %v and %q", skip, want, msg, urlset.Url, logs.String())
+		}
+	}
+	// Local sitemaps have no host to compare with
+	f := t.TempDir() + "/sitemap.xml"
+	ioutil.WriteFile(f, []byte("<urlset><url><loc>http://other.com/c</loc></url></urlset>"), 0644)
+	if urlset, err := getUrlsFromSitemap(context.Background(), f, false); err != nil || len(urlset.Url) != 1 {
+		t.Error("Expected the URL in a local sitemap to be kept, got", urlset, err)
+	}
+}
+
+func TestSniffDecompress(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("<urlset/>"))
+	gz.Close()
+	for _, data := range [][]byte{buf.Bytes(), []byte("<urlset/>")} {
+		r, err := sniffDecompress(ioutil.NopCloser(bytes.NewReader(data)), "")
+		if err != nil {
+			t.Fatal("Couldn't decompress:", err)
+		}
+		out, _ := ioutil.ReadAll(r)
+		if string(out) != "<urlset/>" {
+			t.Errorf("Incorrectly decompressed data: %q", out)
+		}
+	}
+}
+
+func TestDecompressCmdFailure(t *testing.T) {
+	dir := t.TempDir()
+	// A zstd that outputs part of the data before failing, as it does on a
+	// truncated stream
+	script := "#!/bin/sh\ncat >/dev/null\necho \"$ZSTD_OUT\"\nexit $ZSTD_EXIT\n"
+	if err := ioutil.WriteFile(dir+"/zstd", []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	path := dir + "/urls.txt.zst"
+	ioutil.WriteFile(path, []byte{0x28, 0xb5, 0x2f, 0xfd, 0}, 0644)
+	t.Setenv("ZSTD_OUT", "http://a.com/1")
+	for _, code := range []string{"0", "1"} {
+		t.Setenv("ZSTD_EXIT", code)
+		src, err := FileSource(context.Background(), path, "text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urlset, err := collect(src)
+		if code == "0" && (err != nil || len(urlset.Url) != 1) {
+			t.Error("Expected one URL, got", urlset, err)
+		}
+		if code == "1" && (err == nil || !strings.Contains(err.Error(), "exit status 1")) {
+			t.Error("Expected the zstd failure to be reported, got", err)
+		}
+	}
+	t.Setenv("ZSTD_OUT", "<urlset><url><loc>http://a.com/1</loc></url></urlset>")
+	if _, err := getUrlsFromSitemap(context.Background(), path, false); err == nil {
+		t.Error("Expected the zstd failure to fail the sitemap")
+	}
+}
+
+func TestCharsetReader(t *testing.T) {
+	r, err := charsetReader("windows-1251", bytes.NewReader([]byte{0xcf, 0xf0, 0xe8, 'x'}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	if string(out) != "Приx" {
+		t.Errorf("Incorrectly decoded Windows-1251: %q", out)
+	}
+	if _, err = charsetReader("ebcdic", nil); err == nil {
+		t.Error("Unsupported charset did not return an error")
+	}
+}
+
+func TestLenientDecode(t *testing.T) {
+	var urlset Urlset
+	data := []byte("\xef\xbb\xbf\n<urlset><url><loc>http://foo.com/?a=1&b=2</loc></url><url></url><sm:url><sm:loc>http://foo.com/b</sm:loc></sm:url></urlset>")
+	if err := lenientDecode("test", data, &urlset); err != nil {
+		t.Fatal(err)
+	}
+	if len(urlset.Url) != 2 || urlset.Url[0].Loc != "http://foo.com/?a=1&b=2" || urlset.Url[1].Loc != "http://foo.com/b" {
+		t.Error("Incorrectly recovered urlset:", urlset)
+	}
+}
+
+func TestMD4(t *testing.T) {
+	for in, want := range map[string]string{
+		"":               "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc":            "a448017aaf21d8525fc10ae87aa6729d",
+		"message digest": "d9130a8164549fe818874806e1c7014b",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		if got := hex.EncodeToString(md4([]byte(in))); got != want {
+			t.Errorf("md4(%q) = %s, want %s", in, got, want)
+		}
+	}
+	if got := hex.EncodeToString(md4(utf16le("password"))); got != "8846f7eaee8fb117ad06bdd830b7586c" {
+		t.Error("Incorrect NT hash:", got)
+	}
+}
+
+func TestNTLM(t *testing.T) {
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	var (
+		mu                   sync.Mutex
+		authed               = make(map[string]bool) // by connection
+		handshakes, inFlight int
+		most                 int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth := r.Header.Get("Authorization")
+		switch {
+		case authed[r.RemoteAddr]:
+		case strings.HasPrefix(auth, "NTLM ") && len(auth) < 60:
+			handshakes++
+			mu.Unlock()
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case strings.HasPrefix(auth, "NTLM "):
+			authed[r.RemoteAddr] = true
+		default:
+			mu.Unlock()
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, "primed")
+	}))
+	defer ts.Close()
+	mw, _ := Auth("ntlm", `CORP\ocp`, "s3cret")
+	f := Chain(ClientFetcher(ts.Client()), mw)
+	fetch := func() {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := f.Do(context.Background(), req)
+		if err != nil || res.StatusCode != http.StatusOK || req.Header.Get("Authorization") != "" {
+			t.Errorf("Unexpected response %v, %v or header %v", res, err, req.Header)
+			return
+		}
+		discard(res)
+	}
+	fetch()
+	fetch()
+	if handshakes != 1 {
+		t.Errorf("Expected 1 handshake on one connection, got %d", handshakes)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetch()
+		}()
+	}
+	wg.Wait()
+	if most < 2 {
+		t.Error("NTLM requests were sent one at a time")
+	}
+
+	// A connection is only reused once the response sent on it was read
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	held, err := f.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		fetch()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Request waited for the body of another to be read")
+	}
+	discard(held)
+
+	var p pinnedConn
+	rr := newRoundRobinTransport(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, nil)
+	if c, err := p.client(&http.Client{Transport: rr}); err != nil || !c.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("Pinned connection without the round robin transport's settings: %v", err)
+	}
+	var other pinnedConn
+	if _, err := other.client(&http.Client{Transport: http.NewFileTransport(http.Dir("."))}); err == nil {
+		t.Error("Pinned connection made without a transport to clone")
+	}
+}
+
+func TestCloudflareAccess(t *testing.T) {
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Cookie("CF_Authorization")
+		if c != nil {
+			seen = append(seen, "cookie "+c.Value+" "+r.Header.Get("CF-Access-Client-Id"))
+			return
+		}
+		if r.Header.Get("CF-Access-Client-Id") != "id" || r.Header.Get("CF-Access-Client-Secret") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		seen = append(seen, "token")
+		http.SetCookie(w, &http.Cookie{Name: "CF_Authorization", Value: "jwt"})
+	}))
+	defer ts.Close()
+	defer func() { cfAccessId, cfAccessSecret, cfAccessCookie = "", "", false }()
+	cfAccessId = "id"
+	if _, err := setupRequests(); err == nil {
+		t.Error("Expected an error for a client ID without a secret")
+	}
+	t.Setenv("CF_ACCESS_CLIENT_SECRET", "secret")
+	for _, cookie := range []bool{false, true} {
+		seen, cfAccessSecret, cfAccessCookie = nil, "", cookie
+		ctx, err := setupRequests()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			res, err := get(ctx, ts.URL)
+			if err != nil || res.StatusCode != http.StatusOK {
+				t.Fatal("Request was not authenticated:", res, err)
+			}
+			discard(res)
+		}
+		want := "token token"
+		if cookie {
+			want = "token cookie jwt "
+		}
+		if strings.Join(seen, " ") != want {
+			t.Errorf("-cf-access-cookie=%t: expected %q, got %q", cookie, want, seen)
+		}
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Digest ") {
+			w.Header().Set("WWW-Authenticate", `Digest realm="ocp", nonce="abc", qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	mw, _ := Auth("digest", "ocp", "s3cret")
+	f := Chain(ClientFetcher(ts.Client()), mw)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := f.Do(context.Background(), req)
+		if err != nil || res.StatusCode != http.StatusOK || req.Header.Get("Authorization") != "" {
+			t.Fatalf("Unexpected response %v, %v or header %v", res, err, req.Header)
+		}
+		discard(res)
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	tokens := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			id, secret, _ := r.BasicAuth()
+			if id != "ocp" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tokens++
+			fmt.Fprintf(w, `{"access_token": "tok%d", "expires_in": 3600}`, tokens)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer tok1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer s.Close()
+	f := Chain(ClientFetcher(http.DefaultClient), OAuth2(&oauth2Config{
+		TokenUrl:     s.URL + "/token",
+		ClientId:     "ocp",
+		ClientSecret: "s3cret",
+	}))
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", s.URL+"/a", nil)
+		res, err := f.Do(context.Background(), req)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatal("Request was not authorized:", res, err)
+		}
+		res.Body.Close()
+	}
+	if tokens != 1 {
+		t.Error("Expected the token to be reused, but got", tokens, "tokens")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login" && r.Method == "GET":
+			fmt.Fprint(w, `<input type="hidden" name="_token" value="abc123">`)
+		case r.URL.Path == "/login":
+			if r.FormValue("_token") != "abc123" || r.FormValue("user") != "u" || r.FormValue("pass") != "p" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		default:
+			if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer s.Close()
+	origCfg := cfg
+	defer func() { cfg = origCfg }()
+	cfg.Login = &loginConfig{
+		Url:       s.URL + "/login",
+		Form:      map[string]string{"user": "u", "pass": "p"},
+		CsrfRegex: `name="_token" value="([^"]+)"`,
+		CsrfField: "_token",
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		t.Fatal("Login failed:", err)
+	}
+	res, err := get(ctx, s.URL+"/members")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Error("Session cookie was not sent:", res, err)
+	}
+}
+
+func TestHostAuth(t *testing.T) {
+	f, err := ioutil.TempFile("", "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "machine a.example.com login alice password one\ndefault\n\tlogin bob\n\tpassword two\n")
+	f.Close()
+	creds, err := parseNetrc(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds["a.example.com"].User != "alice" || creds[""].Password != "two" {
+		t.Fatal("Unexpected .netrc credentials:", creds)
+	}
+	var got []string
+	fetch := Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		user, _, _ := req.BasicAuth()
+		got = append(got, user)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}), HostAuth(creds))
+	for _, loc := range []string{"http://a.example.com/", "http://b.example.com/"} {
+		req, _ := http.NewRequest("GET", loc, nil)
+		if _, err := fetch.Do(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(got, ",") != "alice,bob" {
+		t.Error("Expected alice,bob, got", got)
+	}
+}
+
+func TestNoindex(t *testing.T) {
+	for _, c := range []struct {
+		header, body string
+		want         bool
+	}{
+		{"", `<meta name="robots" content="index, follow">`, false},
+		{"", `<meta name="Robots" content="NOINDEX">`, true},
+		{"", `<meta content="none" name="googlebot">`, true},
+		{"noindex, nofollow", "", true},
+		{"googlebot: noindex", "", true},
+		{"unavailable_after: 25 Jun 2030 15:00:00 PST", "", false},
+		{"noindex, unavailable_after: 25 Jun 2030 15:00:00 PST", "", true},
+	} {
+		res := &http.Response{Header: http.Header{"Content-Type": {"text/html"}}}
+		if c.header != "" {
+			res.Header.Set("X-Robots-Tag", c.header)
+		}
+		if got := noindex(res, []byte(c.body)); got != c.want {
+			t.Errorf("noindex(%q, %q) = %v, want %v", c.header, c.body, got, c.want)
+		}
+	}
+}
+
+func TestPageModified(t *testing.T) {
+	res := &http.Response{Header: http.Header{
+		"Content-Type":  {"text/html"},
+		"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"},
+	}}
+	if m, from, ok := pageModified(res, []byte(`<meta property="article:published_time" content="2023-01-01">`)); !ok || from != "Last-Modified" || m.Year() != 2024 {
+		t.Error("Expected the Last-Modified header, got", m, from, ok)
+	}
+	if m, from, ok := pageModified(res, []byte(`<meta property="article:modified_time" content="2024-06-01T00:00:00Z">`)); !ok || from != "article:modified_time" || m.Month() != time.June {
+		t.Error("Expected article:modified_time, got", m, from, ok)
+	}
+}
+
+func TestSummarizeUrlset(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := summarizeUrlset(&Urlset{Url: []Url{
+		{Loc: "http://a.com/blog/1", Priority: 0.8, Lastmod: "2024-06-01"},
+		{Loc: "http://a.com/blog/2", Priority: 0.8, Lastmod: "2023-01-01"},
+		{Loc: "http://a.com/blog/2", Priority: 0.5},
+		{Loc: "http://b.com/", Priority: 1},
+	}}, now)
+	if s.Total != 4 || s.Hosts["a.com"] != 3 || s.Sections["a.com/blog"] != 3 || s.Sections["b.com/"] != 1 {
+		t.Error("Incorrect counts:", s)
+	}
+	if s.Priorities[8] != 2 || s.Priorities[5] != 1 || s.Priorities[10] != 1 {
+		t.Error("Incorrect priorities:", s.Priorities)
+	}
+	if s.Ages[0] != 1 || s.Ages[4] != 1 || s.Ages[5] != 2 {
+		t.Error("Incorrect lastmod ages:", s.Ages)
+	}
+	if len(s.Duplicates) != 1 || s.Duplicates["http://a.com/blog/2"] != 2 {
+		t.Error("Incorrect duplicates:", s.Duplicates)
+	}
+}
+
+func TestCheckCanonical(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	page := func(loc string, status int, header http.Header, body string) {
+		req, _ := http.NewRequest("GET", loc, nil)
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Content-Type", "text/html")
+		checkCanonical(context.Background(), Url{Loc: loc}, &http.Response{StatusCode: status, Header: header, Request: req}, []byte(body))
+	}
+	page("http://a.com/a", 200, nil, `<link rel="canonical" href="/a">`)
+	page("http://a.com/b?utm=x", 200, nil, `<link rel="canonical" href="http://a.com/b">`)
+	page("http://a.com/c", 200, http.Header{"Link": {`<http://a.com/d>; rel="canonical"`}}, "")
+	page("http://a.com/e", 404, nil, `<link rel="canonical" href="/f">`)
+	page("http://a.com/g", 200, nil, "<p>no canonical</p>")
+	got := logs.String()
+	if strings.Count(got, "Canonical mismatch") != 2 ||
+		!strings.Contains(got, "Canonical mismatch for http://a.com/b?utm=x: http://a.com/b\n") ||
+		!strings.Contains(got, "Canonical mismatch for http://a.com/c: http://a.com/d\n") {
+		t.Errorf("Expected mismatches for /b and /c, got\n%s", got)
+	}
+}
+
+func TestDuplicateBodies(t *testing.T) {
+	defer resetRun()
+	ok := &http.Response{StatusCode: http.StatusOK}
+	hashBody(context.Background(), Url{Loc: "http://a.com/1"}, ok, []byte("same"))
+	hashBody(context.Background(), Url{Loc: "http://a.com/2"}, ok, []byte("other"))
+	hashBody(context.Background(), Url{Loc: "http://a.com/3"}, ok, []byte("same"))
+	hashBody(context.Background(), Url{Loc: "http://a.com/4"}, &http.Response{StatusCode: http.StatusNotFound}, []byte("same"))
+	c := duplicateBodies()
+	if len(c) != 1 || strings.Join(c[0], " ") != "http://a.com/1 http://a.com/3" {
+		t.Error("Expected one cluster of /1 and /3, got", c)
+	}
+}
+
+func TestHeaderManifest(t *testing.T) {
+	rules, err := readHeaderCSV(strings.NewReader("url,header,value\nhttp://a.com/eu/*,Accept-Language,de\nhttp://a.com/eu/*,X-Geo,DE\nhttp://a.com/eu/fr/*,Accept-Language,fr\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	f := Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		got = append(got, req.Header.Get("Accept-Language")+"/"+req.Header.Get("X-Geo"))
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), HeaderManifest(rules))
+	for _, loc := range []string{"http://a.com/", "http://a.com/eu/a", "http://a.com/eu/fr/b"} {
+		req, _ := http.NewRequest("GET", loc, nil)
+		f.Do(context.Background(), req)
+	}
+	if strings.Join(got, " ") != "/ de/DE fr/DE" {
+		t.Error("Expected '/ de/DE fr/DE', got", got)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	f, err := ioutil.TempFile("", "ocp-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fetch := Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Cache": {"HIT"}}}, nil
+	}), Recorder(f))
+	done := make(chan bool)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://a.com/slow", nil)
+		fetch.Do(context.Background(), req)
+		done <- true
+	}()
+	time.Sleep(5 * time.Millisecond)
+	req, _ := http.NewRequest("GET", "http://a.com/fast", nil)
+	fetch.Do(context.Background(), req)
+	<-done
+	f.Close()
+	reqs, err := readRecording(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].Url != "http://a.com/slow" || reqs[1].Url != "http://a.com/fast" || reqs[1].Header.Get("X-Cache") != "HIT" {
+		t.Error("Expected /slow then /fast, got", reqs)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	p, err := parseRetryOn("429,5xx,timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts int
+	f := Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		attempts++
+		status := http.StatusNotFound
+		if req.URL.Path == "/flaky" && attempts < 2 {
+			status = http.StatusBadGateway
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}), Retry(3, p))
+	for _, c := range []struct {
+		path     string
+		status   int
+		attempts int
+	}{
+		{"/flaky", http.StatusNotFound, 2},
+		{"/missing", http.StatusNotFound, 1},
+	} {
+		attempts = 0
+		var counted int
+		req, _ := http.NewRequest("GET", "http://a.com"+c.path, nil)
+		res, err := f.Do(withAttempts(context.Background(), &counted), req)
+		if err != nil || res.StatusCode != c.status || attempts != c.attempts || counted != c.attempts {
+			t.Errorf("%s: expected %d after %d attempts, got %v, %v after %d (counted %d)", c.path, c.status, c.attempts, res, err, attempts, counted)
+		}
+	}
+	if _, err := parseRetryOn("404,bogus"); err == nil {
+		t.Error("Expected an error for an invalid -retry-on value")
+	}
+
+	p.backoff = 100 * time.Millisecond
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if d := p.wait(i); d != want {
+			t.Errorf("Expected to wait %s before retry %d, got %s", want, i, d)
+		}
+	}
+	if d := p.wait(100); d < time.Hour || d > 2*time.Hour {
+		t.Errorf("Backoff not capped: %s", d)
+	}
+	p.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.wait(1); d < 100*time.Millisecond || d > 300*time.Millisecond {
+			t.Fatalf("Jittered wait %s not within 50%% of 200ms", d)
+		}
+	}
+
+	now := time.Now()
+	for _, c := range []struct {
+		status int
+		header string
+		want   time.Duration
+	}{
+		{429, "120", 2 * time.Minute},
+		{503, now.Add(time.Minute).UTC().Format(http.TimeFormat), time.Minute},
+		{503, "tomorrow", 0},
+		{500, "120", 0},
+		{429, "86400", time.Hour},
+	} {
+		res := &http.Response{StatusCode: c.status, Header: http.Header{"Retry-After": {c.header}}}
+		if d := retryAfter(res, now); d < c.want-time.Second || d > c.want {
+			t.Errorf("Retry-After %q with %d: expected %s, got %s", c.header, c.status, c.want, d)
+		}
+	}
+
+	// The slot in sem is free for other URLs while waiting to retry
+	saved := sem
+	defer func() { sem = saved }()
+	sem = make(chan bool, 1)
+	sem <- true
+	p.backoff, p.jitter = 50*time.Millisecond, 0
+	attempts = 0
+	freed := make(chan bool)
+	go func() {
+		select {
+		case sem <- true:
+			<-sem
+			freed <- true
+		case <-time.After(time.Second):
+			freed <- false
+		}
+	}()
+	req, _ := http.NewRequest("GET", "http://a.com/flaky", nil)
+	if _, err := f.Do(withSlot(context.Background()), req); err != nil {
+		t.Fatal(err)
+	}
+	if !<-freed || len(sem) != 1 {
+		t.Errorf("Slot not freed while waiting to retry, or not taken again (%d held)", len(sem))
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	for _, c := range []struct {
+		r    result
+		want string
+	}{
+		{result{Status: 200}, ""},
+		{result{Status: 503}, "HTTP 503"},
+		{result{Err: &net.DNSError{Err: "no such host", Name: "x.invalid"}}, "DNS"},
+		{result{Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, "connect"},
+		{result{Err: x509.UnknownAuthorityError{}}, "TLS"},
+		{result{Err: context.DeadlineExceeded}, "read timeout"},
+	} {
+		if got := failureClass(c.r); got != c.want {
+			t.Errorf("failureClass(%v) = %q, want %q", c.r, got, c.want)
+		}
+	}
+}
+
+func TestSlowest(t *testing.T) {
+	defer resetRun()
+	for i, d := range []time.Duration{300, 100, 500, 200} {
+		record(result{Url: Url{Loc: fmt.Sprint(i)}, Status: 200, Duration: d * time.Millisecond})
+	}
+	record(result{Url: Url{Loc: "err"}, Duration: time.Second, Err: fmt.Errorf("timeout")})
+	var b bytes.Buffer
+	if err := writeResultsCSV(&b, slowest(2)); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "url,status,duration_ms,size,dns_ms,connect_ms,tls_ms,ttfb_ms,download_ms\n2,200,500.0,0,0.0,0.0,0.0,0.0,0.0\n0,200,300.0,0,0.0,0.0,0.0,0.0,0.0\n" {
+		t.Errorf("Unexpected slowest URLs:\n%s", b.String())
+	}
+}
+
+func TestConnTrace(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	c := s.Client()
+	var rs [2]result
+	for i := range rs {
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		ctx, trace := withTrace(context.Background())
+		res, err := c.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		discard(res)
+		trace.finish(&rs[i])
+	}
+	if rs[0].Reused || !rs[0].TLSHandshake || !rs[1].Reused || rs[1].TLSHandshake {
+		t.Error("Expected a new TLS connection, then a reused one, got", rs)
+	}
+	if rs[0].Phases.Connect == 0 || rs[0].Phases.TLS == 0 || rs[0].Phases.TTFB == 0 || rs[1].Phases.TLS != 0 {
+		t.Error("Expected connect and TLS times for the first request only, got", rs[0].Phases, rs[1].Phases)
+	}
+}
+
+func TestVariants(t *testing.T) {
+	defer func() { variantKinds = make(map[string]bool) }()
+	if err := parseVariants("scheme,www"); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(variants("https://mysite.com:8443/a?b=c"), " ")
+	if got != "http://mysite.com:8443/a?b=c https://www.mysite.com:8443/a?b=c http://www.mysite.com:8443/a?b=c" {
+		t.Error("Unexpected variants:", got)
+	}
+	if got := variants("http://127.0.0.1/"); len(got) != 1 || got[0] != "https://127.0.0.1/" {
+		t.Error("Expected only a scheme variant for an IP address, got", got)
+	}
+	variantKinds = map[string]bool{"slash": true}
+	for loc, want := range map[string]string{
+		"http://a.com/blog":       "http://a.com/blog/",
+		"http://a.com/blog/?p=1":  "http://a.com/blog?p=1",
+		"http://a.com/a%2Fb":      "http://a.com/a%2Fb/",
+		"http://a.com/index.html": "",
+		"http://a.com/":           "",
+	} {
+		if got := strings.Join(variants(loc), " "); got != want {
+			t.Errorf("variants(%q) = %q, want %q", loc, got, want)
+		}
+	}
+	if err := parseVariants("ftp"); err == nil {
+		t.Error("Expected an error for an invalid variant")
+	}
+}
+
+func TestFTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	data, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	var got []string
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		conn := textproto.NewConn(c)
+		conn.PrintfLine("220 ready")
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+			got = append(got, line)
+			switch cmd := strings.Fields(line)[0]; cmd {
+			case "USER":
+				conn.PrintfLine("331 password please")
+			case "PASV":
+				port := data.Addr().(*net.TCPAddr).Port
+				conn.PrintfLine("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			case "RETR":
+				conn.PrintfLine("150 sending")
+				d, _ := data.Accept()
+				d.Write([]byte(`<urlset><url><loc>http://a.com/</loc></url></urlset>`))
+				d.Close()
+				conn.PrintfLine("226 done")
+			case "QUIT":
+				conn.PrintfLine("221 bye")
+				return
+			default:
+				conn.PrintfLine("200 ok")
+			}
+		}
+	}()
+	u, _ := url.Parse("ftp://ocp:s3cret@" + l.Addr().String() + "/sitemaps/sitemap.xml")
+	f, err := openFTP(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	<-done
+	if err != nil || !bytes.Contains(b, []byte("http://a.com/")) {
+		t.Fatal("Unexpected download:", string(b), err)
+	}
+	if strings.Join(got, "|") != "USER ocp|PASS s3cret|TYPE I|PASV|RETR sitemaps/sitemap.xml|QUIT" {
+		t.Error("Unexpected commands:", got)
+	}
+}
+
+func TestExecSource(t *testing.T) {
+	urlset, err := collect(ExecSource("echo http://a.com/1; echo; echo http://a.com/2", ""))
+	if err != nil || len(urlset.Url) != 2 || urlset.Url[1].Loc != "http://a.com/2" {
+		t.Error("Unexpected URLs from command:", urlset, err)
+	}
+	if _, err := collect(ExecSource("echo http://a.com/1; exit 1", "")); err == nil {
+		t.Error("Expected an error for a failing command")
+	}
+}
+
+func TestOpenAPISource(t *testing.T) {
+	doc := `{
+  "servers": [{"url": "/api/v1/"}],
+  "paths": {
+    "/items": {"get": {}, "post": {}},
+    "/items/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/id"}],
+      "get": {"parameters": [{"name": "lang", "in": "query", "required": true, "schema": {"enum": ["en", "de"]}}]}
+    },
+    "/search": {"get": {"parameters": [{"name": "q", "in": "query", "required": true}]}},
+    "/orders": {"post": {}},
+    "/users/{user}": {"get": {}}
+  },
+  "components": {"parameters": {"id": {"name": "id", "in": "path", "required": true, "example": 42}}}
+}`
+	urlset, err := collect(OpenAPISource(strings.NewReader(doc), "https://a.com/openapi.json"))
+	var locs []string
+	if urlset != nil {
+		for _, u := range urlset.Url {
+			locs = append(locs, u.Loc)
+		}
+	}
+	if err != nil || strings.Join(locs, " ") != "https://a.com/api/v1/items https://a.com/api/v1/items/42?lang=en" {
+		t.Error("Unexpected URLs from OpenAPI document:", locs, err)
+	}
+	swagger := `{"host": "b.com", "basePath": "/v2", "schemes": ["http"], "paths": {"/pets": {"get": {}}}}`
+	urlset, err = collect(OpenAPISource(strings.NewReader(swagger), ""))
+	if err != nil || len(urlset.Url) != 1 || urlset.Url[0].Loc != "http://b.com/v2/pets" {
+		t.Error("Unexpected URLs from Swagger document:", urlset, err)
+	}
+	if _, err := collect(OpenAPISource(strings.NewReader(`{"paths": {"/a": {"get": {}}}}`), "-")); err == nil {
+		t.Error("Expected an error for a document without a server URL")
+	}
+}
+
+func TestAccessLogSource(t *testing.T) {
+	now := time.Now()
+	line := func(ago time.Duration, req string, status int) string {
+		return fmt.Sprintf("10.0.0.1 - - [%s] \"%s HTTP/1.1\" %d 512 \"-\" \"curl/8\"\n", now.Add(-ago).Format(accessLogTime), req, status)
+	}
+	data := line(time.Minute, "GET /a", 200) +
+		line(time.Minute, "GET /b", 200) +
+		line(time.Minute, "GET /a?x=1", 304) +
+		line(time.Minute, "GET /b", 200) +
+		line(time.Minute, "GET /b", 404) +
+		line(time.Minute, "POST /b", 200) +
+		"not a log line\n" +
+		line(48*time.Hour, "GET /old", 200) +
+		line(48*time.Hour, "GET /old", 200) +
+		line(48*time.Hour, "GET /old", 200)
+	urlset, err := collect(AccessLogSource(strings.NewReader(data), "https://a.com/", 0, 24*time.Hour))
+	if err != nil || len(urlset.Url) != 3 ||
+		urlset.Url[0].Loc != "https://a.com/b" || urlset.Url[0].Priority != 1 ||
+		urlset.Url[1].Loc != "https://a.com/a" || urlset.Url[1].Priority != 0.5 ||
+		urlset.Url[2].Loc != "https://a.com/a?x=1" {
+		t.Error("Unexpected URLs from access log:", urlset, err)
+	}
+	urlset, err = collect(AccessLogSource(strings.NewReader(data), "https://a.com", 1, 0))
+	if err != nil || len(urlset.Url) != 1 || urlset.Url[0].Loc != "https://a.com/old" {
+		t.Error("Expected only the most requested URL, got", urlset, err)
+	}
+	if _, err := collect(AccessLogSource(strings.NewReader(data), "", 0, 0)); err == nil {
+		t.Error("Expected an error for relative paths without -log-base")
+	}
+}
+
+func TestGoogleSources(t *testing.T) {
+	var requests []string
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, req.URL.String()+" "+req.Header.Get("Authorization")+" "+string(body))
+		var out string
+		switch req.URL.Host {
+		case "www.googleapis.com":
+			out = `{"rows": [{"keys": ["https://a.com/x"], "clicks": 10}, {"keys": ["https://a.com/y"], "clicks": 40}, {"keys": ["https://a.com/x"], "clicks": 10}]}`
+		case "analyticsdata.googleapis.com":
+			out = `{"rows": [{"dimensionValues": [{"value": "a.com"}, {"value": "/p"}], "metricValues": [{"value": "300"}]},
+				{"dimensionValues": [{"value": "a.com"}, {"value": "/q"}], "metricValues": [{"value": "100"}]}]}`
+		}
+		return &http.Response{Status: "200 OK", StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(out))}, nil
+	}))
+	urlset, err := collect(SearchConsoleSource(ctx, "sc-domain:a.com", "tok", 0, 28))
+	if err != nil || len(urlset.Url) != 2 || urlset.Url[0].Loc != "https://a.com/y" || urlset.Url[1].Priority != 0.5 {
+		t.Error("Unexpected URLs from Search Console:", urlset, err)
+	}
+	if len(requests) != 1 || !strings.HasPrefix(requests[0], "https://www.googleapis.com/webmasters/v3/sites/sc-domain%3Aa.com/searchAnalytics/query Bearer tok ") ||
+		!strings.Contains(requests[0], `"rowLimit":25000`) {
+		t.Error("Unexpected Search Console request:", requests)
+	}
+	requests = nil
+	urlset, err = collect(AnalyticsSource(ctx, "123", "tok", 1, 7))
+	if err != nil || len(urlset.Url) != 1 || urlset.Url[0].Loc != "https://a.com/p" {
+		t.Error("Unexpected URLs from Google Analytics:", urlset, err)
+	}
+	if len(requests) != 1 || !strings.HasPrefix(requests[0], "https://analyticsdata.googleapis.com/v1beta/properties/123:runReport Bearer tok ") ||
+		!strings.Contains(requests[0], `"startDate":"7daysAgo"`) || !strings.Contains(requests[0], `"limit":1`) {
+		t.Error("Unexpected Google Analytics request:", requests)
+	}
+	if _, err := collect(AnalyticsSource(WithFetcher(ctx, FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		return &http.Response{Status: "403 Forbidden", StatusCode: 403, Body: ioutil.NopCloser(strings.NewReader("denied"))}, nil
+	})), "123", "tok", 0, 7)); err == nil || !strings.Contains(err.Error(), "403 Forbidden: denied") {
+		t.Error("Expected the API error to be reported, got", err)
+	}
+}
+
+func TestRowUrls(t *testing.T) {
+	rows, err := readRows(strings.NewReader("slug\tPriority\nhello\t0.8\nworld\t\n"), '\t')
+	if err != nil || len(rows) != 2 {
+		t.Fatal("Unexpected rows:", rows, err)
+	}
+	tmpl := template.Must(template.New("").Parse("https://a.com/blog/{{.slug}}"))
+	u, err := rowUrl(rows[0], tmpl)
+	if err != nil || u.Loc != "https://a.com/blog/hello" || u.Priority != 0.8 {
+		t.Error("Unexpected URL:", u, err)
+	}
+	if _, err := rowUrl(rows[1], nil); err == nil {
+		t.Error("Expected an error for a row without a url column")
+	}
+	rows, err = readRows(strings.NewReader("url\tTitle\tlastmod\nhttp://a.com/x\t\"Tabs\\tand\\\\n\\nnewlines\tNULL\n"), '\t')
+	if err != nil || len(rows) != 1 || rows[0]["title"] != "\"Tabs\tand\\n\nnewlines" || rows[0]["lastmod"] != "" {
+		t.Errorf("Unexpected rows from mysql: %q %v", rows, err)
+	}
+	urlset, err := collect(CSVSource(strings.NewReader("URL,lastmod,section\nhttp://a.com/x,2024-01-01,\"blog, news\"\n")))
+	if err != nil || len(urlset.Url) != 1 || urlset.Url[0].Lastmod != "2024-01-01" || urlset.Url[0].Fields["section"] != "blog, news" {
+		t.Error("Unexpected URLs from CSV:", urlset, err)
+	}
+}
+
+func TestDNSPinner(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p := newDNSPinner(0)
+	p.dialer.Timeout = time.Second
+	p.preResolve(&Urlset{Url: []Url{{Loc: "http://localhost:" + port + "/"}, {Loc: "http://127.0.0.1/"}}})
+	if len(p.hosts) != 1 || p.hosts["localhost"] == nil || len(p.hosts["localhost"].addrs) == 0 {
+		t.Fatal("Expected localhost to be pinned, got", p.hosts)
+	}
+	p.hosts["localhost"].addrs = []string{"192.0.2.1", "127.0.0.1"} // the first is unreachable
+	c, err := p.DialContext(context.Background(), "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestRoundRobin(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		served = make(map[string]int)
+	)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Context().Value(http.LocalAddrContextKey).(net.Addr).String())
+		mu.Lock()
+		served[host]++
+		mu.Unlock()
+	}))
+	l, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		t.Skip(err)
+	}
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p := newDNSPinner(0)
+	p.hosts["example.test"] = &pinnedHost{addrs: []string{"127.0.0.1", "127.0.0.2"}, resolved: time.Now()}
+	client := &http.Client{Transport: newRoundRobinTransport(http.DefaultTransport.(*http.Transport).Clone(), p)}
+	addrs := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		ctx, trace := withTrace(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.test:"+port+"/", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		discard(res)
+		var r result
+		trace.finish(&r)
+		addrs[r.Addr]++
+	}
+	if served["127.0.0.1"] != 2 || served["127.0.0.2"] != 2 {
+		t.Error("Expected requests to alternate between addresses, got", served)
+	}
+	if addrs["127.0.0.1"] != 2 || addrs["127.0.0.2"] != 2 {
+		t.Error("Expected the address of each response to be traced, got", addrs)
+	}
+}
+
+func TestRoundRobinFallback(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p := newDNSPinner(0)
+	p.dialer.Timeout = time.Second
+	// Only the second is listening
+	p.hosts["example.test"] = &pinnedHost{addrs: []string{"127.0.0.2", "127.0.0.1"}, resolved: time.Now()}
+	client := &http.Client{Transport: newRoundRobinTransport(http.DefaultTransport.(*http.Transport).Clone(), p)}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://example.test:" + port + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		discard(res)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var ids []string
+	f := Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		ids = append(ids, req.Header.Get("X-Request-Id"))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}), RequestID("X-Request-Id"))
+	ctx, id := withRequestID(context.Background())
+	for _, c := range []context.Context{ctx, context.Background()} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if _, err := f.Do(c, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ids) != 2 || ids[0] != id || ids[1] == "" || ids[1] == id {
+		t.Errorf("Expected the context's ID and then a new one, got %q (context %q)", ids, id)
+	}
+	if len(id) != 36 || id[14] != '4' {
+		t.Error("Expected a version 4 UUID, got", id)
+	}
+}
+
+func TestSLARules(t *testing.T) {
+	rules := []slaRule{
+		{Name: "products", Pattern: "/product/", MaxLatency: "1s", Status: 200},
+		{Pattern: ".", MaxLatency: "5s"},
+	}
+	if err := compileSLARules(rules); err != nil {
+		t.Fatal(err)
+	}
+	if rules[1].Name != "." {
+		t.Error("Expected the pattern to name an unnamed rule, got", rules[1].Name)
+	}
+	tests := []struct {
+		r      result
+		rule   int
+		missed bool
+	}{
+		{result{Url: Url{Loc: "http://a/product/1"}, Status: 200, Duration: 500 * time.Millisecond}, 0, false},
+		{result{Url: Url{Loc: "http://a/product/2"}, Status: 200, Duration: 2 * time.Second}, 0, true},
+		{result{Url: Url{Loc: "http://a/product/3"}, Status: 301, Duration: time.Millisecond}, 0, true},
+		{result{Url: Url{Loc: "http://a/search"}, Status: 301, Duration: 2 * time.Second}, 1, false},
+		{result{Url: Url{Loc: "http://a/search"}, Err: fmt.Errorf("timeout")}, 1, true},
+	}
+	for _, tt := range tests {
+		i := matchSLA(rules, tt.r.Url.Loc)
+		if i != tt.rule {
+			t.Errorf("Expected %s to match rule %d, got %d", tt.r.Url.Loc, tt.rule, i)
+			continue
+		}
+		if v := rules[i].violation(tt.r); (v != "") != tt.missed {
+			t.Errorf("Unexpected violation %q for %+v", v, tt.r)
+		}
+	}
+	if compileSLARules([]slaRule{{Pattern: ".", MaxLatency: "fast"}}) == nil {
+		t.Error("Expected an invalid max_latency to be rejected")
+	}
+}
+
+func TestScenarioGroups(t *testing.T) {
+	steps := []scenarioStep{
+		{Name: "warm-up", Urls: []string{"http://a/warm", "http://a/product/1"}},
+		{Pattern: "/category/"},
+		{Pattern: "/product/"},
+	}
+	if err := compileScenario(steps); err != nil {
+		t.Fatal(err)
+	}
+	urlset := &Urlset{Url: []Url{
+		{Loc: "http://a/product/1"},
+		{Loc: "http://a/about"},
+		{Loc: "http://a/product/2"},
+		{Loc: "http://a/category/product/"},
+	}}
+	var got [][]string
+	for _, g := range scenarioGroups(urlset, steps) {
+		var locs []string
+		for _, u := range g {
+			locs = append(locs, u.Loc)
+		}
+		got = append(got, locs)
+	}
+	want := "[[http://a/warm http://a/product/1] [http://a/category/product/] [http://a/product/2] [http://a/about]]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if steps[1].Name != "step 2" {
+		t.Error("Expected unnamed steps to be numbered, got", steps[1].Name)
+	}
+	if compileScenario([]scenarioStep{{Name: "empty"}}) == nil {
+		t.Error("Expected a step without urls or a pattern to be rejected")
+	}
+}
+
+func TestClientHints(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	origInspectors := inspectors
+	defer func() {
+		inspectors, clientHintDevices = origInspectors, nil
+		resetRun()
+	}()
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		got = append(got, req.URL.Path+" "+req.Header.Get("Sec-CH-UA-Mobile")+" "+req.Header.Get("Viewport-Width"))
+		mu.Unlock()
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}))
+	if err := parseClientHints("mobile, desktop"); err != nil {
+		t.Fatal(err)
+	}
+	inspectors = []func(context.Context, Url, *http.Response, []byte){primeClientHints}
+	primeUrlset(ctx, &Urlset{Url: urlSlice([]string{"foo.com/a"})})
+	sort.Strings(got)
+	if strings.Join(got, ",") != "/a  ,/a ?0 1920,/a ?1 412" {
+		t.Errorf("Unexpected requests: %q", got)
+	}
+	if parseClientHints("watch") == nil {
+		t.Error("Expected an error for an unknown device")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			http.SetCookie(w, &http.Cookie{Name: "consent", Value: "yes", Path: "/", MaxAge: 3600})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "consent", Path: "/", MaxAge: -1})
+		}
+	}))
+	defer s.Close()
+	path := t.TempDir() + "/cookies.json"
+	jar, err := loadCookieJar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Jar: jar}
+	res, err := c.Get(s.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard(res)
+	if err := jar.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("Expected the jar to be saved readable only by the user:", fi, err)
+	}
+	jar, err = loadCookieJar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(s.URL + "/")
+	if got := fmt.Sprint(jar.Cookies(u)); got != "[session=abc consent=yes]" && got != "[consent=yes session=abc]" {
+		t.Error("Expected the cookies to be restored, got", got)
+	}
+	c.Jar = jar
+	if res, err = c.Get(s.URL + "/logout"); err != nil {
+		t.Fatal(err)
+	}
+	discard(res)
+	jar.save(path)
+	if jar, _ = loadCookieJar(path); fmt.Sprint(jar.Cookies(u)) != "[session=abc]" {
+		t.Error("Expected a deleted cookie not to be saved, got", jar.Cookies(u))
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	for _, tt := range []struct {
+		key, value, want string
+	}{
+		{"X-LiteSpeed-Cache", "hit,private", cacheHit},
+		{"X-LiteSpeed-Cache", "miss", cacheMiss},
+		{"X-LiteSpeed-Cache", "no-cache", cacheBypass},
+		{"X-Rocket-Nginx-Serving-Static", "Yes", cacheHit},
+		{"X-Rocket-Nginx-Serving-Static", "No", cacheMiss},
+		{"Cache-Status", "ExampleCache; hit; ttl=30", cacheHit},
+		{"Cache-Status", "ExampleCache; fwd=uri-miss", cacheMiss},
+		{"CF-Cache-Status", "DYNAMIC", cacheBypass},
+		{"CF-Cache-Status", "EXPIRED", cacheMiss},
+		{"X-Cache", "Hit from cloudfront", cacheHit},
+		{"X-Cache", "MISS, MISS", cacheMiss},
+		{"Server", "nginx", ""},
+	} {
+		h := http.Header{}
+		h.Set(tt.key, tt.value)
+		if got := cacheStatus(h); got != tt.want {
+			t.Errorf("cacheStatus(%s: %s) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWPPurgeCommand(t *testing.T) {
+	defer func() { wpPath, wpSSH = "", "" }()
+	wpPath, wpSSH = "/var/www", "deploy@web1"
+	cmd, err := wpPurgeCommand("lscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cmd.Args, " "); got != "wp --ssh=deploy@web1 --path=/var/www litespeed-purge all" {
+		t.Error("Unexpected command:", got)
+	}
+	if _, err := wpPurgeCommand("w3tc"); err == nil {
+		t.Error("Expected an error for an unknown plugin")
+	}
+}
+
+func TestCacheHeader(t *testing.T) {
+	defer func() { cacheHeaders = nil }()
+	for _, v := range []string{"X-Proxy-Cache: HIT, stale", "X-Edge: hit=TCP_HIT; bypass=NONE"} {
+		r, err := parseCacheHeader(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cacheHeaders = append(cacheHeaders, r)
+	}
+	for _, tt := range []struct {
+		key, value, want string
+	}{
+		{"X-Proxy-Cache", "STALE", cacheHit},
+		{"X-Proxy-Cache", "EXPIRED", cacheMiss},
+		{"X-Edge", "tcp_hit", cacheHit},
+		{"X-Edge", "none", cacheBypass},
+		{"X-Edge", "TCP_MISS", cacheMiss},
+		{"X-Cache", "HIT", cacheHit},
+	} {
+		h := http.Header{}
+		h.Set(tt.key, tt.value)
+		if got := cacheStatus(h); got != tt.want {
+			t.Errorf("cacheStatus(%s: %s) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+	for _, v := range []string{"HIT", "X-Edge: served=1"} {
+		if _, err := parseCacheHeader(v); err == nil {
+			t.Errorf("Expected an error for %q", v)
+		}
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	date := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		headers map[string]string
+		left    time.Duration
+		ok      bool
+	}{
+		{map[string]string{"Cache-Control": "public, max-age=600", "Age": "100"}, 500 * time.Second, true},
+		{map[string]string{"Cache-Control": "max-age=60, s-maxage=3600", "Age": "600"}, 3000 * time.Second, true},
+		{map[string]string{"Cache-Control": "max-age=600"}, 0, false},
+		{map[string]string{"Cache-Control": "max-age=600", "X-Cache": "HIT"}, 600 * time.Second, true},
+		{map[string]string{"Cache-Control": "private, max-age=600", "Age": "0"}, 0, true},
+		{map[string]string{"Expires": date.Add(time.Hour).Format(http.TimeFormat), "Date": date.Format(http.TimeFormat), "Age": "60"}, 59 * time.Minute, true},
+		{map[string]string{"Age": "60"}, 0, false},
+	} {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		if left, ok := freshness(h); left != tt.left || ok != tt.ok {
+			t.Errorf("freshness(%v) = %s, %t, want %s, %t", tt.headers, left, ok, tt.left, tt.ok)
+		}
+	}
+	defer func() {
+		refreshWithin = 0
+		resetRun()
+	}()
+	var methods []string
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		methods = append(methods, req.Method)
+		h := http.Header{"Cache-Control": {"max-age=600"}, "Age": {"200"}}
+		return &http.Response{StatusCode: 200, Header: h, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}))
+	refreshWithin = 5 * time.Minute
+	primeUrlset(ctx, &Urlset{Url: urlSlice([]string{"foo.com/a"})})
+	refreshWithin = 10 * time.Minute
+	primeUrlset(ctx, &Urlset{Url: urlSlice([]string{"foo.com/b"})})
+	if strings.Join(methods, " ") != "HEAD HEAD GET" || freshSkipped != 1 {
+		t.Errorf("Expected only the URL expiring within -refresh-within to be primed, got %v", methods)
+	}
+}
+
+func TestUncacheable(t *testing.T) {
+	origInspectors := inspectors
+	defer func() {
+		inspectors, state, skipUncacheable = origInspectors, nil, false
+		resetRun()
+	}()
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		got = append(got, req.URL.Path)
+		mu.Unlock()
+		h := http.Header{"Cache-Control": {"public, max-age=60"}}
+		if req.URL.Path == "/a" {
+			h.Set("Cache-Control", "private")
+		}
+		return &http.Response{StatusCode: 200, Header: h, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}))
+	path := t.TempDir() + "/state.json"
+	var err error
+	if state, err = loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	inspectors = []func(context.Context, Url, *http.Response, []byte){learnUncacheable}
+	skipUncacheable, recheckUncacheable = true, time.Hour
+	urlset := &Urlset{Url: urlSlice([]string{"foo.com/a", "foo.com/b"})}
+	primeUrlset(ctx, urlset)
+	if err := state.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := state.Uncacheable["http://foo.com/a"]; !ok || e.Reason != "Cache-Control: private" || len(state.Uncacheable) != 1 {
+		t.Fatal("Expected /a to be remembered as uncacheable, got", state.Uncacheable)
+	}
+	resetRun()
+	got = nil
+	primeUrlset(ctx, urlset)
+	if strings.Join(got, " ") != "/b" {
+		t.Error("Expected the uncacheable URL to be skipped, got", got)
+	}
+	recheckUncacheable = 0
+	resetRun()
+	got = nil
+	primeUrlset(ctx, urlset)
+	if len(got) != 2 {
+		t.Error("Expected the uncacheable URL to be rechecked, got", got)
+	}
+}
+
+func TestAmpShard(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	origInspectors := inspectors
+	defer func() {
+		inspectors, shardK, shardN = origInspectors, 0, 0
+		resetRun()
+	}()
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		got = append(got, req.URL.Path)
+		mu.Unlock()
+		h := http.Header{}
+		if !strings.HasSuffix(req.URL.Path, "/amp") {
+			h.Set("Link", "<http://foo.com"+req.URL.Path+"/amp>; rel=amphtml")
+		}
+		return &http.Response{Status: "200 OK", StatusCode: 200, Header: h, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}))
+	inspectors = []func(context.Context, Url, *http.Response, []byte){primeAmp}
+	// Pages in the shard whose AMP versions are in it and in the other one
+	var in, out string
+	shardN, shardK = 2, shardOf("http://foo.com/0", 2)
+	for i := 0; in == "" || out == ""; i++ {
+		loc := fmt.Sprintf("http://foo.com/%d", i)
+		if shardOf(loc, 2) != shardK {
+			continue
+		}
+		if shardOf(loc+"/amp", 2) == shardK {
+			in = loc
+		} else {
+			out = loc
+		}
+	}
+	primeUrlset(ctx, &Urlset{Url: []Url{{Loc: in}, {Loc: out}}})
+	sort.Strings(got)
+	want := []string{strings.TrimPrefix(in, "http://foo.com"), strings.TrimPrefix(in, "http://foo.com") + "/amp", strings.TrimPrefix(out, "http://foo.com")}
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected only the AMP version in the shard to be primed, got %v, want %v", got, want)
+	}
+}
+
+func TestPreloadCrossHost(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	origInspectors := inspectors
+	defer func() {
+		inspectors, skipCrossHost = origInspectors, false
+		resetRun()
+	}()
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		got = append(got, req.URL.String())
+		mu.Unlock()
+		h := http.Header{}
+		if req.URL.Path == "/" {
+			h.Set("Link", "</app.css>; rel=preload; as=style, <http://cdn.foo.com/app.js>; rel=preload; as=script")
+		}
+		return &http.Response{Status: "200 OK", StatusCode: 200, Header: h, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	}))
+	inspectors = []func(context.Context, Url, *http.Response, []byte){primePreload}
+	for _, skip := range []bool{false, true} {
+		resetRun()
+		got, skipCrossHost = nil, skip
+		primeUrlset(ctx, &Urlset{Url: urlSlice([]string{"foo.com/"})})
+		sort.Strings(got)
+		want := "http://cdn.foo.com/app.js http://foo.com/ http://foo.com/app.css"
+		if skip {
+			want = "http://foo.com/ http://foo.com/app.css"
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("-skip-cross-host=%t: expected %s to be primed, got %v", skip, want, got)
+		}
+	}
+}
+
+func TestShard(t *testing.T) {
+	if _, _, err := parseShard("6/5"); err == nil {
+		t.Error("Expected an error for a shard out of range")
+	}
+	k, n, err := parseShard("2/5")
+	if err != nil || k != 2 || n != 5 {
+		t.Fatal("Unexpected shard:", k, n, err)
+	}
+	counts := make(map[int]int)
+	moved := 0
+	for i := 0; i < 5000; i++ {
+		loc := fmt.Sprintf("https://mysite.com/page/%d", i)
+		s := shardOf(loc, 5)
+		counts[s]++
+		if s != shardOf(loc, 5) {
+			t.Fatal("Expected shards to be deterministic")
+		}
+		if s6 := shardOf(loc, 6); s6 != s && s6 != 6 {
+			moved++
+		}
+	}
+	for s := 1; s <= 5; s++ {
+		if counts[s] < 800 || counts[s] > 1200 {
+			t.Errorf("Expected about a fifth of the URLs in each shard, got %v", counts)
+			break
+		}
+	}
+	if moved > 0 {
+		t.Errorf("Expected adding a shard to only move URLs to it, %d moved elsewhere", moved)
+	}
+}
+
+func TestMonitorThresholds(t *testing.T) {
+	defer func() { minAvailability, maxP95 = 0, 0 }()
+	minAvailability, maxP95 = 99, time.Second
+	var checks []check
+	for i := 0; i < 19; i++ {
+		checks = append(checks, check{ok: true, duration: time.Duration(i+1) * 100 * time.Millisecond})
+	}
+	checks = append(checks, check{})
+	availability, p95 := windowStats(checks)
+	if availability != 95 || p95 != 1900*time.Millisecond {
+		t.Fatal("Unexpected window stats:", availability, p95)
+	}
+	if bs := breaches(availability, p95); fmt.Sprint(bs) != "[availability 95.0% < 99% p95 1.9s > 1s]" {
+		t.Error("Unexpected breaches:", bs)
+	}
+	if bs := breaches(100, 500*time.Millisecond); len(bs) != 0 {
+		t.Error("Expected no breaches, got", bs)
+	}
+	var got alert
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer s.Close()
+	if err := postWebhook(s.URL, alert{Text: "down", Status: "alert", Checks: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "down" || got.Checks != 3 {
+		t.Error("Unexpected alert:", got)
+	}
+}
+
+func TestRegressions(t *testing.T) {
+	old := &baseline{Urls: map[string]baselineUrl{
+		"a": {Status: 200, Duration: 100},
+		"b": {Status: 200, Duration: 1000},
+		"c": {Status: 200, Duration: 10},
+		"d": {Status: 500, Duration: 100},
+		"e": {Status: 200, Duration: 100},
+	}}
+	cur := &baseline{Urls: map[string]baselineUrl{
+		"a": {Status: 200, Duration: 120},
+		"b": {Status: 200, Duration: 2500},
+		"c": {Status: 200, Duration: 40},
+		"d": {Status: 500, Duration: 100},
+		"e": {Error: "timeout", Duration: 30000},
+		"f": {Status: 404},
+	}}
+	got := strings.Join(regressions(old, cur, 50, 20*time.Millisecond), "\n")
+	want := "new failure: e (timeout, was 200)\nslower: b (2.5s, was 1s, +150%)\nslower: c (40ms, was 10ms, +300%)"
+	if got != want {
+		t.Errorf("Unexpected regressions:\n%s", got)
+	}
+	path := t.TempDir() + "/baseline.json"
+	if err := cur.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := loadBaseline(path); err != nil || len(b.Urls) != 6 || b.Urls["e"].Error != "timeout" {
+		t.Error("Expected the baseline to be saved and loaded, got", b, err)
+	}
+}
+
+func TestCaptureHeaders(t *testing.T) {
+	defer func() {
+		captureHeaders = nil
+		resetRun()
+	}()
+	captureHeaders = stringsFlag{"CF-Cache-Status", "X-Backend"}
+	h := http.Header{"Cf-Cache-Status": {"HIT"}, "Server": {"nginx"}}
+	record(result{Url: Url{Loc: "a"}, Status: 200, Duration: time.Second, Headers: captureHeaderValues(h)})
+	record(result{Url: Url{Loc: "b"}, Err: fmt.Errorf("timeout")})
+	var b bytes.Buffer
+	if err := writeResultsCSV(&b, slowest(1)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "url,status,duration_ms,size,dns_ms,connect_ms,tls_ms,ttfb_ms,download_ms,CF-Cache-Status,X-Backend\n") ||
+		!strings.HasSuffix(b.String(), ",HIT,\n") {
+		t.Errorf("Unexpected CSV:\n%s", b.String())
+	}
+	path := t.TempDir() + "/results.jsonl"
+	if err := writeResultsFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	want := `{"url":"a","status":200,"duration_ms":1000,"size":0,"headers":{"CF-Cache-Status":"HIT"}}` + "\n" +
+		`{"url":"b","duration_ms":0,"size":0,"error":"timeout"}` + "\n"
+	if string(data) != want {
+		t.Errorf("Unexpected results file:\n%s", data)
+	}
+}
+
+func TestSaveDebug(t *testing.T) {
+	defer func() {
+		debugDir, debugSize = "", 0
+		resetRun()
+	}()
+	ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		status, body := 200, "ok"
+		if req.URL.Path == "/broken" {
+			status, body = 500, "<h1>Fatal error</h1>"+strings.Repeat(".", 2000)
+		}
+		return &http.Response{
+			Proto:      "HTTP/1.1",
+			Status:     fmt.Sprint(status, " ", http.StatusText(status)),
+			StatusCode: status,
+			Header:     http.Header{"X-Backend": {"web2"}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	}))
+	debugDir, debugSize = t.TempDir(), 1
+	primeUrlset(ctx, &Urlset{Url: urlSlice([]string{"foo.com/broken", "foo.com/ok"})})
+	files, _ := ioutil.ReadDir(debugDir)
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), "http_foo.com_broken-") {
+		t.Fatal("Expected the failed response to be saved, got", files)
+	}
+	data, _ := ioutil.ReadFile(debugDir + "/" + files[0].Name())
+	if !strings.HasPrefix(string(data), "GET http://foo.com/broken\nHTTP/1.1 500 Internal Server Error\nX-Backend: web2\n\n<h1>Fatal error</h1>") || len(data) > 1200 {
+		t.Errorf("Unexpected debug output:\n%s", data)
+	}
+	for _, r := range results {
+		if r.Status == 500 && r.Size != 2020 {
+			t.Error("Expected the full body size to be recorded, got", r.Size)
+		}
+	}
+}
+
+func TestWriteFailures(t *testing.T) {
+	defer resetRun()
+	record(result{Url: Url{Loc: "http://a/ok"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a/missing"}, Status: 404})
+	record(result{Url: Url{Loc: "http://a/down"}, Err: fmt.Errorf("timeout")})
+	record(result{Url: Url{Loc: "http://a/missing", device: "mobile"}, Status: 404})
+	path := t.TempDir() + "/failed.txt"
+	if err := writeFailures(path); err != nil {
+		t.Fatal(err)
+	}
+	src, err := FileSource(context.Background(), path, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlset, err := collect(src)
+	if err != nil || len(urlset.Url) != 2 || urlset.Url[0].Loc != "http://a/missing" || urlset.Url[1].Loc != "http://a/down" {
+		t.Error("Expected the failed URLs to be readable with -f, got", urlset, err)
+	}
+}
+
+func TestGroupResults(t *testing.T) {
+	defer resetRun()
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200, Duration: 100 * time.Millisecond, Size: 10})
+	record(result{Url: Url{Loc: "http://a.com/2"}, Status: 500, Duration: 300 * time.Millisecond, Size: 5})
+	record(result{Url: Url{Loc: "http://b.com/1"}, Err: fmt.Errorf("timeout")})
+	gs := groupResults(func(r result) string { return r.Url.Host() })
+	if len(gs) != 2 || gs[0].name != "a.com" || gs[0].primes != 2 || gs[0].failed != 1 || gs[0].bytes != 15 ||
+		len(gs[0].durations) != 2 || gs[0].durations[0] != 100*time.Millisecond || gs[1].failed != 1 || len(gs[1].durations) != 0 {
+		t.Fatalf("Unexpected groups: %+v %+v", gs[0], gs[1])
+	}
+	var b strings.Builder
+	writeGroupStats(&b, "Primes by host", "host", gs)
+	if !strings.Contains(b.String(), "        2        1   50.0%     100ms     300ms          15  a.com\n") {
+		t.Errorf("Unexpected table:\n%s", b.String())
+	}
+}
+
+func TestChildProgress(t *testing.T) {
+	defer resetRun()
+	trackChild("http://a.com/products-17.xml", 2)
+	childPrimed(Url{Loc: "http://a.com/1", sitemap: "http://a.com/products-17.xml"}, true)
+	childMu.Lock()
+	c := childProgress["http://a.com/products-17.xml"]
+	childMu.Unlock()
+	if c == nil || c.pending != 1 || c.failed != 1 {
+		t.Fatalf("Unexpected progress: %+v", c)
+	}
+	// URLs found by following links are not counted
+	childPrimed(Url{Loc: "http://a.com/3", sitemap: "http://a.com/products-17.xml", depth: 1}, false)
+	childPrimed(Url{Loc: "http://a.com/2", sitemap: "http://a.com/products-17.xml"}, false)
+	childMu.Lock()
+	n := len(childProgress)
+	childMu.Unlock()
+	if n != 0 {
+		t.Errorf("Finished child sitemap still tracked")
+	}
+
+	record(result{Url: Url{Loc: "http://a.com/1", sitemap: "http://a.com/a.xml"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a.com/2", sitemap: "http://a.com/b.xml"}, Status: 404})
+	record(result{Url: Url{Loc: "http://a.com/3"}, Status: 404})
+	gs := groupResults(func(r result) string { return r.Url.sitemap })
+	if len(gs) != 2 || gs[0].name != "http://a.com/a.xml" || gs[1].failed != 1 {
+		t.Errorf("Unexpected groups: %+v", gs)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer resetRun()
+	queue(3)
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 404})
+	atomic.AddInt64(&completed, 1)
+	id := takeOff("http://a.com/2")
+	takeOff("http://a.com/3")
+	land(id)
+	var b strings.Builder
+	writeProgress(&b)
+	out := b.String()
+	for _, s := range []string{"1 URLs done (1 failed), 2 remaining\n", "        1  HTTP 404\n", "In flight: 1\n", "  http://a.com/3\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Progress does not contain %q:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "a.com/2") {
+		t.Errorf("Finished request still in flight:\n%s", out)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("systemd is not available on Windows")
+	}
+	dir, err := ioutil.TempDir("", "ocp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/notify"
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := l.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("Got %q, %v", buf[:n], err)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if d := watchdogInterval(); d != 30*time.Second {
+		t.Errorf("Unexpected watchdog interval %s", d)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if d := watchdogInterval(); d != 0 {
+		t.Errorf("Watchdog of another process used: %s", d)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/ocp.lock"
+	if err := acquireLock(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		lockFile.Close()
+		lockFile = nil
+	}()
+	// A second open file description conflicts, as another process's would
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := tryLock(f); err != errLocked {
+		t.Errorf("Lock taken twice: %v", err)
+	}
+	start := time.Now()
+	err = acquireLock(path, 1500*time.Millisecond)
+	if !errors.Is(err, errLocked) || !strings.Contains(err.Error(), fmt.Sprintf("(pid %d)", os.Getpid())) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("Did not wait for the lock")
+	}
+}
+
+func TestSyslogFacility(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("syslog is not available on Windows")
+	}
+	if _, err := openSyslog("bogus", "ocp"); err == nil || !strings.Contains(err.Error(), "unknown syslog facility") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	defer resetRun()
+	var (
+		mu    sync.Mutex
+		pings []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		pings = append(pings, r.Method+" "+r.URL.Path+" "+string(body))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	heartbeatUrl = ts.URL + "/ping/abc"
+	defer func() { heartbeatUrl = "" }()
+	heartbeatStart()
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a.com/2"}, Status: 503})
+	heartbeatDone(0)
+	heartbeatDone(exitFailFast)
+	if len(pings) != 3 || pings[0] != "POST /ping/abc/start " ||
+		!strings.HasPrefix(pings[1], "POST /ping/abc Primed 2 URLs (1 failed) in ") ||
+		!strings.Contains(pings[1], "exit status 0\n        1  HTTP 503\n") ||
+		!strings.HasPrefix(pings[2], "POST /ping/abc/fail ") || !strings.Contains(pings[2], "exit status 4") {
+		t.Errorf("Unexpected pings: %q", pings)
+	}
+}
+
+func TestSentry(t *testing.T) {
+	endpoint, auth, err := parseSentryDSN("https://abc@sentry.mysite.com/prefix/42")
+	if err != nil || endpoint != "https://sentry.mysite.com/prefix/api/42/envelope/" || !strings.Contains(auth, "sentry_key=abc") {
+		t.Errorf("Unexpected endpoint %q, auth %q, error %v", endpoint, auth, err)
+	}
+	if _, _, err := parseSentryDSN("https://sentry.mysite.com/42"); err == nil {
+		t.Errorf("DSN without a key accepted")
+	}
+
+	defer resetRun()
+	var lines []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=abc") {
+			t.Errorf("Unexpected request to %s", r.URL)
+		}
+		lines = strings.Split(strings.TrimSpace(string(body)), "\n")
+	}))
+	defer ts.Close()
+	os.Setenv("SENTRY_DSN", strings.Replace(ts.URL, "://", "://abc@", 1)+"/42")
+	defer os.Unsetenv("SENTRY_DSN")
+	sentryDsn = configuredSentryDSN()
+	defer func() { sentryDsn = "" }()
+	runInput, runErr = []string{"https://mysite.com/sitemap.xml"}, fmt.Errorf("no URLs")
+	defer func() { runInput, runErr = nil, nil }()
+	reportRunFailure(1)
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected envelope: %q", lines)
+	}
+	var event struct {
+		Level   string
+		Message struct{ Formatted string }
+		Tags    map[string]string
+		Extra   map[string]string
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Level != "error" || event.Message.Formatted != "ocp run failed with exit status 1: no URLs" ||
+		event.Tags["site"] != "mysite.com" || event.Extra["input"] != "https://mysite.com/sitemap.xml" ||
+		!strings.HasPrefix(event.Extra["summary"], "Primed 0 URLs") {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	defer resetRun()
+	dir, err := ioutil.TempDir("", "ocp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	preCmd = "echo \"$OCP_INPUT\" > " + dir + "/pre"
+	postCmd = "echo \"$OCP_STATUS $OCP_EXIT_CODE $OCP_PRIMED $OCP_FAILED\" > " + dir + "/post"
+	defer func() { preCmd, postCmd, runInput = "", "", nil }()
+	if err := beforeRun(context.Background(), []string{"http://a.com/sitemap.xml"}); err != nil {
+		t.Fatal(err)
+	}
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a.com/2"}, Status: 500})
+	afterRun(exitSLO)
+	for name, want := range map[string]string{"pre": "http://a.com/sitemap.xml\n", "post": "failure 3 2 1\n"} {
+		if b, err := ioutil.ReadFile(dir + "/" + name); err != nil || string(b) != want {
+			t.Errorf("%s wrote %q, %v; want %q", name, b, err, want)
+		}
+	}
+	preCmd = "exit 1"
+	if err := beforeRun(context.Background(), nil); err == nil {
+		t.Errorf("Failing -pre-cmd did not stop the run")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	defer resetRun()
+	var b bytes.Buffer
+	eventsMu.Lock()
+	eventsEnc = json.NewEncoder(&b)
+	eventsMu.Unlock()
+	defer func() {
+		eventsMu.Lock()
+		eventsEnc = nil
+		eventsMu.Unlock()
+	}()
+	urlset, err := getUrlsFromSitemap(context.Background(), "example-sitemap.xml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(result{Url: Url{Loc: "http://a.com/1", device: "mobile"}, Status: 200, Duration: 1500 * time.Microsecond, Size: 10})
+	record(result{Url: Url{Loc: "http://a.com/2"}, Err: fmt.Errorf("timeout")})
+	runEnded(0)
+	var events []map[string]interface{}
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 4 {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	if e := events[0]; e["event"] != "sitemap" || e["sitemap"] != "example-sitemap.xml" || e["urls"] != float64(len(urlset.Url)) {
+		t.Errorf("Unexpected sitemap event: %v", e)
+	}
+	if e := events[1]; e["event"] != "url_done" || e["url"] != "http://a.com/1" || e["device"] != "mobile" ||
+		e["status"] != float64(200) || e["duration_ms"] != 1.5 || e["size"] != float64(10) {
+		t.Errorf("Unexpected url_done event: %v", e)
+	}
+	if e := events[2]; e["error"] != "timeout" {
+		t.Errorf("Unexpected url_done event: %v", e)
+	}
+	if e := events[3]; e["event"] != "run_done" || e["primed"] != float64(2) || e["failed"] != float64(1) || e["exit_code"] != float64(0) {
+		t.Errorf("Unexpected run_done event: %v", e)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	defer resetRun()
+	s := newJobServer()
+	started := time.Now().Add(-time.Minute)
+	s.jobs[1] = &job{Id: 1, Sitemap: "http://a.com/old.xml", State: jobDone, Primed: 3, Failed: 1,
+		Failures: []string{"http://a.com/x (HTTP 404)"}, Started: &started, Finished: &started}
+	s.jobs[2] = &job{Id: 2, Sitemap: "http://a.com/sitemap.xml", State: jobRunning, Total: 4, Started: &started}
+	s.nextId = 2
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a.com/2"}, Status: 500})
+	defer land(takeOff("http://a.com/3"))
+
+	rec := httptest.NewRecorder()
+	s.dashboard(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"Job 2: http://a.com/sitemap.xml",
+		"2 of 4 (50%)",
+		"<td>http://a.com/3</td>",
+		"<li>http://a.com/2 (HTTP 500)</li>",
+		"<td>http://a.com/old.xml</td>",
+		"<li>http://a.com/x (HTTP 404)</li>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Dashboard does not contain %q:\n%s", want, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/prime", strings.NewReader("urls=http%3A%2F%2Fa.com%2Fa%0Ahttp%3A%2F%2Fa.com%2Fb"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.primeForm(rec, req)
+	if rec.Code != http.StatusSeeOther || len(s.pending) != 1 {
+		t.Fatalf("Form not submitted: %d %s", rec.Code, rec.Body)
+	}
+	if j := s.next(); len(j.Urls) != 2 || j.Urls[1] != "http://a.com/b" {
+		t.Errorf("Unexpected job: %+v", j)
+	}
+
+	for _, h := range [][2]string{{"Origin", "http://evil.com"}, {"Origin", "null"}, {"Referer", "http://evil.com/page"}} {
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "http://localhost:8080/prime", strings.NewReader("urls=http%3A%2F%2Fa.com%2Fa"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(h[0], h[1])
+		s.primeForm(rec, req)
+		if rec.Code != http.StatusForbidden || len(s.pending) != 0 {
+			t.Errorf("Form submitted from %s %s: %d", h[0], h[1], rec.Code)
+		}
+	}
+	req.Header.Del("Referer")
+	req.Header.Set("Origin", "http://localhost:8080")
+	rec = httptest.NewRecorder()
+	s.primeForm(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("Form from the dashboard not submitted: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	defer resetRun()
+	dir, err := ioutil.TempDir("", "ocp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyPath = dir + "/history.db"
+	runInput = []string{"http://a.com/sitemap.xml"}
+	defer func() { historyPath, runInput = "", nil }()
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200, Duration: 100 * time.Millisecond})
+	record(result{Url: Url{Loc: "http://a.com/it's"}, Status: 200, Duration: 200 * time.Millisecond})
+	if err := saveHistory(0); err != nil {
+		t.Fatal(err)
+	}
+	resetRun()
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200, Duration: 300 * time.Millisecond})
+	record(result{Url: Url{Loc: "http://a.com/it's"}, Err: fmt.Errorf("timeout")})
+	if err := saveHistory(1); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := historySQL("SELECT * FROM runs ORDER BY id;")
+	if err != nil || len(runs) != 2 || runs[1]["failed"] != "1" || runs[1]["exit_code"] != "1" || runs[0]["p95_ms"] != "200.0" {
+		t.Fatalf("Unexpected runs %v, %v", runs, err)
+	}
+	var b strings.Builder
+	writeHistory(&b, runs)
+	if !strings.Contains(b.String(), "error rate 0.0% -> 50.0%, p95 200ms -> 300ms (+50.0%)") {
+		t.Errorf("Unexpected history:\n%s", b.String())
+	}
+	rows, err := historySQL(`SELECT a.url, a.status AS old_status, b.status AS new_status, a.duration_ms AS old_ms, b.duration_ms AS new_ms
+FROM results a JOIN results b ON a.url = b.url WHERE a.run_id = 1 AND b.run_id = 2;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	writeComparison(&b, "1", "2", rows, 10)
+	for _, want := range []string{"  200 -> error  http://a.com/it's\n", "  +200ms          100ms -> 300ms      http://a.com/1\n"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Comparison does not contain %q:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "-200ms") {
+		t.Errorf("Failed prime compared by latency:\n%s", b.String())
+	}
+}
+
+func TestControl(t *testing.T) {
+	saved := sem
+	defer func() { sem = saved }()
+	c := newController(2, 0)
+	c.resizable()
+	free := func(want int) {
+		for i := 0; i < 100 && cap(sem)-len(sem) != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := cap(sem) - len(sem); got != want {
+			t.Errorf("%d URLs can be primed at once, expected %d", got, want)
+		}
+	}
+	free(2)
+
+	h := c.handler("s3cret")
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/control", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/control", strings.NewReader(`{"concurrency": 5, "rate": 50, "paused": true}`))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	h(rec, req)
+	var s controlState
+	json.NewDecoder(rec.Body).Decode(&s)
+	if rec.Code != http.StatusOK || s != (controlState{Concurrency: 5, Rate: 50, Paused: true}) {
+		t.Fatalf("Unexpected state: %d %+v", rec.Code, s)
+	}
+	free(5)
+	if err := c.update(controlUpdate{Concurrency: new(int)}); err == nil {
+		t.Error("Concurrency of 0 accepted")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.wait(ctx); err == nil {
+		t.Error("Request sent while paused")
+	}
+	resumed := false
+	c.update(controlUpdate{Paused: &resumed})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("3 requests at 50/s took only %s", d)
+	}
+
+	// A job's limits only ever lower those set with ocp ctl
+	c.setJobLimits(8, 0)
+	free(5)
+	c.setJobLimits(3, 0)
+	free(3)
+	c.setJobLimits(0, 0)
+	free(5)
+}
+
+func TestCompareOrigin(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "mysite.com" || r.Header.Get("Cache-Control") != "no-cache" {
+			t.Errorf("Origin request without the Host or Cache-Control header: %s %v", r.Host, r.Header)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<p nonce="%d">%s</p>`, time.Now().UnixNano(), r.URL.Path)
+	}))
+	defer origin.Close()
+	defer func(o, h, i string) {
+		compareOrigin, compareHeaders, compareIgnore, originIgnore = o, h, i, nil
+	}(compareOrigin, compareHeaders, compareIgnore)
+	compareOrigin, compareHeaders, compareIgnore = origin.URL, "content-type", ` nonce="\d+"`
+	if err := setupCompareOrigin(); err != nil {
+		t.Fatal(err)
+	}
+	if loc, _ := originLoc("https://mysite.com/a?b=c"); loc != origin.URL+"/a?b=c" {
+		t.Errorf("Unexpected origin URL: %s", loc)
+	}
+
+	res, body, err := fetchOrigin(context.Background(), "https://mysite.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}}}
+	if diffs := responseDiffs(same, []byte("<p>/a</p>"), res, body); diffs != nil {
+		t.Errorf("Unexpected differences: %v", diffs)
+	}
+	stale := &http.Response{StatusCode: 404, Header: http.Header{"Content-Type": {"text/plain"}}}
+	want := []string{
+		"status 404 (cache) vs 200 (origin)",
+		`Content-Type "text/plain" (cache) vs "text/html" (origin)`,
+		fmt.Sprintf("body of 9 bytes (cache) vs %d bytes (origin)", len(body)),
+	}
+	if diffs := responseDiffs(stale, []byte("not found"), res, body); fmt.Sprint(diffs) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, diffs)
+	}
+
+	compareOrigin = "http://"
+	if err := setupCompareOrigin(); err == nil {
+		t.Error("Invalid -compare-origin accepted")
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		case "/3", "/2", "/1":
+			http.Redirect(w, r, fmt.Sprint(r.URL.Path[1]-'1'), http.StatusMovedPermanently)
+		}
+	}))
+	defer ts.Close()
+	defer func(n uint) { maxRedirects = n }(maxRedirects)
+	maxRedirects = 2
+	c := &http.Client{CheckRedirect: checkRedirect}
+
+	_, err := c.Get(ts.URL + "/a")
+	want := fmt.Sprintf("redirect loop: %[1]s/a -> %[1]s/b -> %[1]s/a", ts.URL)
+	if err == nil || !strings.HasSuffix(err.Error(), want) || failureClass(result{Err: err}) != "redirect loop" {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+	_, err = c.Get(ts.URL + "/3")
+	want = fmt.Sprintf("more than 2 redirects: %[1]s/3 -> %[1]s/2 -> %[1]s/1 -> %[1]s/0", ts.URL)
+	if err == nil || !strings.HasSuffix(err.Error(), want) || failureClass(result{Err: err}) != "too many redirects" {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+	if res, err := c.Get(ts.URL + "/2"); err != nil || res.StatusCode != 200 {
+		t.Errorf("2 redirects not followed: %v", err)
+	}
+}
+
+func TestConfirmRun(t *testing.T) {
+	defer func(c uint, r float64) { throttle, rateLimit = c, r }(throttle, rateLimit)
+	throttle, rateLimit = 10, 0
+	if d := estimateDuration(6000, 500*time.Millisecond); d != 5*time.Minute {
+		t.Errorf("Expected 5m0s, got %s", d)
+	}
+	rateLimit = 4
+	if d := estimateDuration(6000, 500*time.Millisecond); d != 25*time.Minute {
+		t.Errorf("Expected -rate to limit the run to 25m0s, got %s", d)
+	}
+
+	var out bytes.Buffer
+	if !confirmRun(strings.NewReader("y\n"), &out, 6000, 500*time.Millisecond) {
+		t.Error("Run not confirmed")
+	}
+	want := "About to prime 6000 URLs, 10 at a time (at most 4 requests per second).\n" +
+		"At 500ms per URL, this will take about 25m0s.\nContinue? [y/N] "
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+	for _, answer := range []string{"\n", "no\n", ""} {
+		if confirmRun(strings.NewReader(answer), ioutil.Discard, 6000, 0) {
+			t.Errorf("Run confirmed with %q", answer)
+		}
+	}
+}
+
+func TestUserAgentRotation(t *testing.T) {
+	f, err := ioutil.TempFile("", "ocp-agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# Desktop\nAgent/1\n\n  Agent/2  \n")
+	f.Close()
+	defer func(f, o string) { uaFile, uaOrder, userAgents, uaNext = f, o, nil, 0 }(uaFile, uaOrder)
+	uaFile, uaOrder = f.Name(), "sequential"
+	if err := setupUserAgents(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan string, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch <- r.UserAgent()
+	}))
+	defer ts.Close()
+	for _, want := range []string{"Agent/1", "Agent/2", "Agent/1"} {
+		ctx, ua := withUserAgent(context.Background())
+		res, err := get(ctx, ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		discard(res)
+		if got := <-ch; ua != want || got != want {
+			t.Errorf("Expected %s, sent %s (recorded as %s)", want, got, ua)
+		}
+	}
+
+	uaOrder = "shuffled"
+	if err := setupUserAgents(); err == nil {
+		t.Error("Invalid -ua-order accepted")
+	}
+}
+
+func TestExpandLocales(t *testing.T) {
+	var err error
+	defer func() { locales = nil }()
+	if locales, err = parseLocales("/en, /fr/,"); err != nil {
+		t.Fatal(err)
+	}
+	urlset := &Urlset{Url: []Url{
+		{Loc: "http://a.com", Priority: 0.8},
+		{Loc: "http://a.com/about?x=1"},
+		{Loc: "http://a.com/fr/contact"},
+		{Loc: "http://a.com/caf%C3%A9"},
+	}}
+	expandLocales(urlset)
+	var locs []string
+	for _, u := range urlset.Url {
+		locs = append(locs, u.Loc)
+	}
+	want := []string{
+		"http://a.com", "http://a.com/en/", "http://a.com/fr/",
+		"http://a.com/about?x=1", "http://a.com/en/about?x=1", "http://a.com/fr/about?x=1",
+		"http://a.com/fr/contact",
+		"http://a.com/caf%C3%A9", "http://a.com/en/caf%C3%A9", "http://a.com/fr/caf%C3%A9",
+	}
+	if fmt.Sprint(locs) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, locs)
+	}
+	if urlset.Url[2].Priority != 0.8 {
+		t.Error("Locale URL did not keep the priority")
+	}
+	if _, err := parseLocales("en,fr"); err == nil {
+		t.Error("Prefix without a slash accepted")
+	}
+}
+
+func TestMetaRefresh(t *testing.T) {
+	for content, want := range map[string]string{
+		"0; url=/new":            "http://a.com/new",
+		"5;URL='http://b.com/x'": "http://b.com/x",
+		`0, "other"`:             "http://a.com/dir/other",
+		"30":                     "",
+		"0; url=":                "",
+	} {
+		res := &http.Response{
+			Header:  http.Header{"Content-Type": {"text/html"}},
+			Request: httptest.NewRequest("GET", "http://a.com/dir/page", nil),
+		}
+		body := []byte(`<head><meta HTTP-EQUIV="Refresh" content="` + html.EscapeString(content) + `"></head>`)
+		if got, _ := metaRefresh(res, body); got != want {
+			t.Errorf("Expected %q for %q, got %q", want, content, got)
+		}
+	}
+	res := &http.Response{Header: http.Header{"Refresh": {"0;url=https://a.com/"}}}
+	if got, ok := metaRefresh(res, nil); !ok || got != "https://a.com/" {
+		t.Errorf("Refresh header not detected: %q", got)
+	}
+}
+
+func TestTiers(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		times = make(map[string][]time.Time)
+	)
+	defer func() { cfg.Tiers = nil; resetRun() }()
+	ctx := WithFetcher(context.Background(), Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		tier := strings.Split(req.URL.Path, "/")[1]
+		times[tier] = append(times[tier], time.Now())
+		mu.Unlock()
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}), Control(newController(1, 0))))
+	cfg.Tiers = []tierRule{{Name: "slow", Pattern: "/slow/", Rate: 20}, {MinPriority: 0.8}}
+	if err := compileTiers(cfg.Tiers); err != nil {
+		t.Fatal(err)
+	}
+	urlset := &Urlset{Url: []Url{
+		{Loc: "http://a.com/slow/1", Priority: 1}, {Loc: "http://a.com/slow/2"}, {Loc: "http://a.com/slow/3"},
+		{Loc: "http://a.com/top/1", Priority: 0.9}, {Loc: "http://a.com/rest/1", Priority: 0.5},
+	}}
+	groups := tierGroups(urlset, cfg.Tiers)
+	if len(groups[0]) != 3 || len(groups[1]) != 1 || len(groups[2]) != 1 || cfg.Tiers[1].Name != "tier 2" {
+		t.Errorf("Unexpected tiers: %v", groups)
+	}
+	primeUrlset(ctx, urlset)
+	if len(times["slow"]) != 3 || len(times["top"]) != 1 || len(times["rest"]) != 1 {
+		t.Fatalf("Not every URL was primed: %v", times)
+	}
+	if d := times["slow"][2].Sub(times["slow"][0]); d < 90*time.Millisecond {
+		t.Errorf("3 requests of a tier limited to 20/s took only %s", d)
+	}
+	if compileTiers([]tierRule{{Pattern: "("}}) == nil {
+		t.Error("Invalid pattern accepted")
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ae := r.Header.Get("Accept-Encoding"); ae != "identity" {
+			t.Errorf("Unexpected Accept-Encoding: %q", ae)
+		}
+		// Compressed regardless, as some servers do
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("hello, uncompressed world"))
+		gz.Close()
+	}))
+	defer ts.Close()
+	ctx := WithFetcher(context.Background(), Chain(ClientFetcher(&http.Client{Transport: &http.Transport{DisableCompression: true}}),
+		Header("Accept-Encoding", "identity")))
+	res, err := get(ctx, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	uncompressed(ts.URL, res)
+	if n, _ := io.Copy(ioutil.Discard, res.Body); n != 25 {
+		t.Errorf("Expected the uncompressed size of 25 bytes, got %d", n)
+	}
+}
+
+func TestExpectedStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old/a" {
+			http.Redirect(w, r, "/new/a", http.StatusMovedPermanently)
+		}
+	}))
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/old/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard(res)
+	if s := firstStatus(res); s != 301 || res.StatusCode != 200 {
+		t.Errorf("Expected 301 then 200, got %d then %d", s, res.StatusCode)
+	}
+
+	defer resetRun()
+	rules := []expectRule{{Pattern: "/old/", Status: 301}, {Name: "health", Pattern: "/health$", Status: 200}}
+	if err := compileExpect(rules); err != nil {
+		t.Fatal(err)
+	}
+	record(result{Url: Url{Loc: "http://a.com/old/a"}, Status: 200, FirstStatus: 301})
+	record(result{Url: Url{Loc: "http://a.com/health"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a.com/other"}, Status: 500})
+	if !reportExpected(rules) {
+		t.Error("Expected statuses reported as mismatched")
+	}
+	record(result{Url: Url{Loc: "http://a.com/old/b"}, Status: 200})
+	if reportExpected(rules) {
+		t.Error("Page that didn't redirect not reported")
+	}
+	if rules[1].mismatch(result{Status: 503}) != "expected 200, got 503" {
+		t.Error("Unexpected mismatch description")
+	}
+	if compileExpect([]expectRule{{Pattern: "/a"}}) == nil {
+		t.Error("Rule without a status accepted")
+	}
+}
+
+func TestSitemapCache(t *testing.T) {
+	version := "1"
+	var conditional []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		etag := `"v` + version + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `<urlset><url><loc>http://%s/v%s</loc></url></urlset>`, r.Host, version)
+	}))
+	defer ts.Close()
+	cacheSitemaps = true
+	defer func() {
+		cacheSitemaps = false
+		sitemapCache = make(map[string]*cachedSitemap)
+	}()
+
+	locs := func() string {
+		urlset, err := getUrlsFromSitemap(context.Background(), ts.URL, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc := urlset.Url[0].Loc
+		urlset.Url[0].Loc = "modified"
+		return loc[strings.LastIndex(loc, "/")+1:]
+	}
+	resetSitemapChanges()
+	if v := locs(); v != "v1" || sitemapsUnmodified() {
+		t.Errorf("Expected v1 to be downloaded, got %s", v)
+	}
+	resetSitemapChanges()
+	if v := locs(); v != "v1" || !sitemapsUnmodified() {
+		t.Errorf("Expected the cached v1, got %s", v)
+	}
+	version = "2"
+	resetSitemapChanges()
+	if v := locs(); v != "v2" || sitemapsUnmodified() {
+		t.Errorf("Expected v2 to be downloaded, got %s", v)
+	}
+	if want := []string{"", `"v1"`, `"v1"`}; fmt.Sprint(conditional) != fmt.Sprint(want) {
+		t.Errorf("Expected If-None-Match headers %q, got %q", want, conditional)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	defer func() { xff, forwardedHeaders = "", nil }()
+	xff = "203.0.113.7"
+	forwardedHeaders = stringsFlag{"Forwarded: for={{.IP}};host={{.Host}};proto={{.Scheme}}", "X-Real-IP: {{.IP}}"}
+	mws, err := forwardedMiddlewares()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got http.Header
+	f := Chain(FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		got = req.Header
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}), mws...)
+	req, _ := http.NewRequest("GET", "https://mysite.com/a", nil)
+	f.Do(context.Background(), req)
+	for k, want := range map[string]string{
+		"X-Forwarded-For": "203.0.113.7",
+		"Forwarded":       "for=203.0.113.7;host=mysite.com;proto=https",
+		"X-Real-Ip":       "203.0.113.7",
+	} {
+		if v := got.Get(k); v != want {
+			t.Errorf("Expected %s: %s, got %q", k, want, v)
+		}
+	}
+
+	for _, c := range []struct{ xff, header string }{
+		{"not-an-ip", ""},
+		{"", "X-Real-IP: {{.IP}}"},
+		{"10.0.0.1", "X-Real-IP {{.IP}}"},
+		{"10.0.0.1", "X-Real-IP: {{.IP"},
+	} {
+		xff, forwardedHeaders = c.xff, nil
+		if c.header != "" {
+			forwardedHeaders = stringsFlag{c.header}
+		}
+		if _, err := forwardedMiddlewares(); err == nil {
+			t.Errorf("Expected -xff %q -forwarded-header %q to be rejected", c.xff, c.header)
+		}
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	var err error
+	defer func() { allowedTypes = nil; resetRun() }()
+	if allowedTypes, err = parseContentTypes("text/html, application/JSON,image/*"); err != nil {
+		t.Fatal(err)
+	}
+	for ct, want := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"application/json":         true,
+		"image/webp":               true,
+		"":                         true,
+		"application/pdf":          false,
+		"text/plain":               false,
+	} {
+		res := &http.Response{Header: http.Header{"Content-Type": {ct}}}
+		if typeAllowed(res) != want {
+			t.Errorf("Expected %q to be allowed: %t", ct, want)
+		}
+	}
+
+	var methods []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Content-Type", "application/zip")
+	}))
+	defer ts.Close()
+	if !unwantedType(context.Background(), ts.URL+"/big.zip") || atomic.LoadInt64(&typeSkipped) != 1 || fmt.Sprint(methods) != "[HEAD]" {
+		t.Errorf("Expected a HEAD request to skip the ZIP file, got %v", methods)
+	}
+	if _, err := parseContentTypes("html"); err == nil {
+		t.Error("Invalid type accepted")
+	}
+}
+
+func TestExtensionFilters(t *testing.T) {
+	defer func(s, o string) {
+		skipExtensions, onlyExtensions = s, o
+		setupExtensions()
+	}(skipExtensions, onlyExtensions)
+	urlset := func() *Urlset {
+		return &Urlset{Url: urlSlice([]string{"a.com/", "a.com/doc.PDF", "a.com/x.zip?dl=1", "a.com/p.html", "a.com/v1.2/"})}
+	}
+	for _, c := range []struct{ skip, only, want string }{
+		{"pdf, .zip", "", "[http://a.com/ http://a.com/p.html http://a.com/v1.2/]"},
+		{"", "html", "[http://a.com/ http://a.com/p.html http://a.com/v1.2/]"},
+		{"", "pdf", "[http://a.com/ http://a.com/doc.PDF http://a.com/v1.2/]"},
+	} {
+		skipExtensions, onlyExtensions = c.skip, c.only
+		if err := setupExtensions(); err != nil {
+			t.Fatal(err)
+		}
+		u := urlset()
+		filterExtensions(u)
+		var locs []string
+		for _, v := range u.Url {
+			locs = append(locs, v.Loc)
+		}
+		if fmt.Sprint(locs) != c.want {
+			t.Errorf("-skip-extensions %q -only-extensions %q: expected %s, got %v", c.skip, c.only, c.want, locs)
+		}
+	}
+	skipExtensions, onlyExtensions = "pdf", "html"
+	if setupExtensions() == nil {
+		t.Error("Expected -skip-extensions and -only-extensions to be exclusive")
+	}
+}
+
+func TestCrawlScope(t *testing.T) {
+	defer func() {
+		crawlScope, crawlAllowHosts, crawlDepthLimits = "host", "", ""
+		setupCrawl()
+	}()
+	for host, want := range map[string]string{
+		"www.mysite.com":     "mysite.com",
+		"mysite.com":         "mysite.com",
+		"shop.mysite.co.uk":  "mysite.co.uk",
+		"a.b.mysite.de":      "mysite.de",
+		"localhost":          "localhost",
+		"www.bbc.co.uk":      "bbc.co.uk",
+		"static.example.com": "example.com",
+	} {
+		if d := registeredDomain(host); d != want {
+			t.Errorf("Expected the registered domain of %s to be %s, got %s", host, want, d)
+		}
+	}
+
+	base, _ := url.Parse("https://www.mysite.com/")
+	crawlAllowHosts = "*.cdn.net, other.org"
+	for _, c := range []struct {
+		scope, link string
+		want        bool
+	}{
+		{"host", "https://www.mysite.com/a", true},
+		{"host", "https://shop.mysite.com/a", false},
+		{"domain", "https://shop.mysite.com/a", true},
+		{"domain", "https://mysite.org/a", false},
+		{"host", "https://img.cdn.net/a", true},
+		{"host", "https://other.org/a", true},
+		{"host", "https://www.other.org/a", false},
+	} {
+		crawlScope = c.scope
+		if err := setupCrawl(); err != nil {
+			t.Fatal(err)
+		}
+		link, _ := url.Parse(c.link)
+		if inScope(base, link) != c.want {
+			t.Errorf("Expected %s to be in -scope %s: %t", c.link, c.scope, c.want)
+		}
+	}
+
+	crawlDepthLimits = "2,1"
+	if err := setupCrawl(); err != nil {
+		t.Fatal(err)
+	}
+	crawled, crawledAt = 0, make(map[int]uint)
+	var got []bool
+	for _, depth := range []int{1, 1, 1, 2, 2, 3, 3} {
+		got = append(got, crawlBudget(depth))
+	}
+	if fmt.Sprint(got) != "[true true false true false true false]" {
+		t.Errorf("Unexpected budget per depth: %v", got)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	for _, s := range []string{"", "1:00", "01:00-01:00", "01:00-25:00", "01:00-06:00 Nowhere/Else", "Mon-Fri", "Mon-Funday 01:00-06:00", "Mo 01:00-06:00 UTC"} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("Invalid window %q accepted", s)
+		}
+	}
+	sc, err := parseSchedule("22:00-02:00,12:00-13:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(h, m int) time.Time { return time.Date(2024, 3, 1, h, m, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		t    time.Time
+		open bool
+		next time.Time
+	}{
+		{at(23, 0), true, at(26, 0)},
+		{at(1, 59), true, at(2, 0)},
+		{at(2, 0), false, at(12, 0)},
+		{at(12, 30), true, at(13, 0)},
+		{at(13, 0), false, at(22, 0)},
+	} {
+		if sc.open(c.t) != c.open || !sc.next(c.t).Equal(c.next) {
+			t.Errorf("At %s: expected %t until %s, got %t until %s", c.t, c.open, c.next, sc.open(c.t), sc.next(c.t))
+		}
+	}
+	berlin, err := parseSchedule("01:00-06:00 Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	if !berlin.open(at(0, 30)) || berlin.open(at(5, 30)) {
+		t.Error("Window not applied in its time zone")
+	}
+	// On weekday nights, starting Monday and ending Saturday morning
+	weekdays, err := parseSchedule("Mon-Fri 22:00-06:00 Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := func(d, h int) time.Time { return time.Date(2024, 1, d, h, 0, 0, 0, time.UTC) } // Jan 1 2024 was a Monday
+	for _, c := range []struct {
+		t    time.Time
+		open bool
+		next time.Time
+	}{
+		{day(5, 23), true, day(6, 6)},
+		{day(6, 3), true, day(6, 6)},
+		{day(6, 23), false, day(8, 22)},
+		{day(8, 3), false, day(8, 22)},
+		{day(9, 3), true, day(9, 6)},
+	} {
+		if weekdays.open(c.t) != c.open || !weekdays.next(c.t).Equal(c.next) {
+			t.Errorf("At %s: expected %t until %s, got %t until %s", c.t, c.open, c.next, weekdays.open(c.t), weekdays.next(c.t))
+		}
+	}
+	if sc, err := parseSchedule("Sat,Sun 22:00-02:00, 12:00-13:00 UTC"); err != nil || len(sc.windows) != 2 || !sc.open(day(7, 12)) || sc.open(day(8, 12)) {
+		t.Error("Unexpected weekend schedule:", sc, err)
+	}
+
+	c := newController(1, 0)
+	c.applyWindow(sc, at(3, 0))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.wait(ctx); err == nil {
+		t.Error("Request sent outside the window")
+	}
+	paused := true
+	c.update(controlUpdate{Paused: &paused})
+	c.applyWindow(sc, at(12, 0))
+	if s := c.state(); !s.Paused || s.Closed {
+		t.Errorf("Unexpected state: %+v", s)
+	}
+	paused = false
+	c.update(controlUpdate{Paused: &paused})
+	if err := c.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	defer resetRun()
+	defer func(d time.Duration) { slowThreshold = d }(slowThreshold)
+	slowThreshold = 1500 * time.Millisecond
+	fast := result{Url: Url{Loc: "http://a.com/fast"}, Status: 200, Duration: time.Second}
+	slow := result{Url: Url{Loc: "http://a.com/slow"}, Status: 200, Duration: 2 * time.Second}
+	failed := result{Url: Url{Loc: "http://a.com/failed"}, Status: 500, Duration: 3 * time.Second}
+	for _, c := range []struct {
+		r        result
+		severity string
+	}{{fast, ""}, {slow, "warn"}, {failed, ""}} {
+		if s := c.r.severity(); s != c.severity {
+			t.Errorf("Expected severity %q for %s, got %q", c.severity, c.r.Url.Loc, s)
+		}
+		record(c.r)
+	}
+	if n, failed := counts(); n != 3 || failed != 1 || slowCount() != 1 {
+		t.Errorf("Expected 3 primes, 1 failed and 1 slow, got %d, %d and %d", n, failed, slowCount())
+	}
+	if !strings.Contains(runSummary(0), "1 slower than 1.5s") {
+		t.Errorf("Slow primes missing from summary: %q", runSummary(0))
+	}
+	slowThreshold = 0
+	if slowCount() != 0 || slow.severity() != "" {
+		t.Error("Primes marked slow without -slow-threshold")
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	for _, c := range []struct {
+		cc  string
+		ttl time.Duration
+		ok  bool
+	}{
+		{"public, max-age=600", 10 * time.Minute, true},
+		{"max-age=600, s-maxage=3600", time.Hour, true},
+		{"s-maxage=3600, max-age=600", time.Hour, true},
+		{"private, max-age=600", 0, true},
+		{"public", 0, false},
+		{"", 0, false},
+	} {
+		h := http.Header{}
+		h.Set("Cache-Control", c.cc)
+		if ttl, ok := cacheTTL(h); ttl != c.ttl || ok != c.ok {
+			t.Errorf("Expected %s, %t for %q, got %s, %t", c.ttl, c.ok, c.cc, ttl, ok)
+		}
+	}
+
+	defer resetRun()
+	defer func(d time.Duration) { minTTL = d }(minTTL)
+	minTTL = time.Hour
+	for loc, cc := range map[string]string{
+		"http://a.com/blog/1": "max-age=86400",
+		"http://a.com/blog/2": "max-age=60",
+		"http://a.com/shop/1": "",
+		"http://a.com/shop/2": "no-store",
+	} {
+		res := &http.Response{StatusCode: 200, Header: http.Header{}}
+		res.Header.Set("Cache-Control", cc)
+		auditTTL(Url{Loc: loc}, res)
+	}
+	auditTTL(Url{Loc: "http://a.com/gone"}, &http.Response{StatusCode: 404, Header: http.Header{}})
+	if n := reportTTLs(); n != 3 {
+		t.Errorf("Expected 3 pages with short or missing TTLs, got %d", n)
+	}
+}
+
+func TestJobCallback(t *testing.T) {
+	if checkCallback("ftp://a.com/") == nil || checkCallback("/hook") == nil || checkCallback("https://a.com/hook") != nil {
+		t.Error("Callback URLs not checked")
+	}
+	for _, loc := range []string{"http://127.0.0.1:8080/", "http://169.254.169.254/latest", "http://[::1]/", "http://localhost/"} {
+		if checkCallback(loc) == nil {
+			t.Errorf("Internal callback URL %s accepted", loc)
+		}
+	}
+	if err := sendWebhook(callbackClient, "http://127.0.0.1:1/", nil); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Callback to 127.0.0.1 not refused: %v", err)
+	}
+	defer func() { allowInternalCallbacks = false }()
+	allowInternalCallbacks = true
+	var (
+		mu      sync.Mutex
+		batches []callbackBatch
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b callbackBatch
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		batches = append(batches, b)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	defer resetRun()
+	j := &job{Id: 7, Callback: ts.URL, Batch: 2, Total: 3}
+	cb := newCallbacker(j)
+	onRecord(cb.add)
+	record(result{Url: Url{Loc: "http://a.com/1"}, Status: 200})
+	record(result{Url: Url{Loc: "http://a.com/2"}, Status: 500})
+	record(result{Url: Url{Loc: "http://a.com/3"}, Status: 200})
+	onRecord(nil)
+	record(result{Url: Url{Loc: "http://a.com/4"}, Status: 200})
+	j.State = jobDone
+	cb.finish(j)
+	<-cb.done
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 batches, got %+v", batches)
+	}
+	if b := batches[0]; b.Job != 7 || b.Batch != 1 || b.Final || b.State != jobRunning || b.Primed != 2 || b.Failed != 1 || len(b.Results) != 2 || b.Results[1].Status != 500 {
+		t.Errorf("Unexpected first batch: %+v", b)
+	}
+	if b := batches[1]; b.Batch != 2 || !b.Final || b.State != jobDone || b.Total != 3 || b.Primed != 3 || len(b.Results) != 1 || b.Results[0].Url != "http://a.com/3" {
+		t.Errorf("Unexpected final batch: %+v", b)
+	}
+
+	// A stuck callback neither holds up priming nor misses the last batch
+	stuck := make(chan struct{})
+	var last callbackBatch
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+		json.NewDecoder(r.Body).Decode(&last)
+	}))
+	defer slow.Close()
+	cb = newCallbacker(&job{Id: 8, Callback: slow.URL, Batch: 1})
+	for i := 0; i < maxCallbackBatches+5; i++ {
+		cb.add(result{Url: Url{Loc: "http://a.com/"}, Status: 200})
+	}
+	cb.finish(j)
+	close(stuck)
+	<-cb.done
+	if !last.Final || last.Dropped == 0 || last.Primed != maxCallbackBatches+5 {
+		t.Errorf("Unexpected last batch after dropping some: %+v", last)
+	}
+}
+
+func TestAPIGuard(t *testing.T) {
+	defer func() { apiTokens, clientRate = nil, 0 }()
+	apiTokens = stringsFlag{"one", "two"}
+	clientRate = 1
+	g, err := newAPIGuard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := g.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), true)
+	do := func(auth func(r *http.Request), addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/jobs", nil)
+		req.RemoteAddr = addr
+		if auth != nil {
+			auth(req)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	if rec := do(nil, "10.0.0.1:1234"); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 without a token, got %d", rec.Code)
+	}
+	if rec := do(bearer("three"), "10.0.0.1:1234"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with an unknown token, got %d", rec.Code)
+	}
+	if rec := do(bearer("two"), "10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with a token, got %d", rec.Code)
+	}
+	if rec := do(bearer("two"), "10.0.0.2:1234"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 for the same token from another address, got %d", rec.Code)
+	}
+	basic := func(r *http.Request) { r.SetBasicAuth("", "one") }
+	if rec := do(basic, "10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with another client's token as a basic auth password, got %d", rec.Code)
+	}
+
+	l := newClientLimiter()
+	now := time.Now()
+	if l.take("a", 2, now) != 0 || l.take("a", 2, now) != 0 || l.take("a", 2, now) != 500*time.Millisecond {
+		t.Error("Burst of 2 not limited")
+	}
+	if l.take("b", 2, now) != 0 || l.take("a", 2, now.Add(500*time.Millisecond)) != 0 {
+		t.Error("Clients not limited separately")
+	}
+	l.take("c", 2, now.Add(time.Second))
+	if l.take("d", 2, now.Add(2*time.Minute)); len(l.clients) != 1 {
+		t.Errorf("Clients with a full burst not forgotten: %d left", len(l.clients))
+	}
+
+	clientRate = 0
+	for i := 0; i < maxAuthFailures; i++ {
+		do(bearer("guess"), "10.0.0.3:1234")
+	}
+	if rec := do(bearer("two"), "10.0.0.3:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after %d invalid tokens, got %d", maxAuthFailures, rec.Code)
+	}
+	if rec := do(bearer("two"), "10.0.0.4:1234"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 from another address, got %d", rec.Code)
+	}
+
+	defer func() { tlsCert, tlsKey, clientCA = "", "", "" }()
+	for _, c := range [][3]string{{"", "key.pem", ""}, {"", "", "ca.pem"}, {"cert.pem", "", ""}} {
+		tlsCert, tlsKey, clientCA = c[0], c[1], c[2]
+		if _, err := serverTLS(); err == nil {
+			t.Errorf("TLS flags %q accepted", c)
+		}
+	}
+
+	apiTokens = stringsFlag{""}
+	if _, err := newAPIGuard(); err == nil {
+		t.Error("Empty -api-token accepted")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/body" {
+			w.Write([]byte("<html>"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer func() { requestTimeout = 0 }()
+	defer resetRun()
+	requestTimeout = 100 * time.Millisecond
+	ctx, err := setupRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/headers", "/body"} {
+		sem <- true
+		wg.Add(1)
+		primeUrl(ctx, Url{Loc: ts.URL + path})
+	}
+	resultsMu.Lock()
+	rs := results
+	resultsMu.Unlock()
+	if len(rs) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(rs))
+	}
+	for _, r := range rs {
+		if c := failureClass(r); c != "request timeout" || !r.record().TimedOut || r.Duration > 500*time.Millisecond {
+			t.Errorf("%s: expected a request timeout after 100ms, got %q after %s: %v", r.Url.Loc, c, r.Duration, r.Err)
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	// -fail-fast exits, so the run is made by a copy of the test binary
+	if urls := os.Getenv("OCP_TEST_FAIL_FAST"); urls != "" {
+		failFast = true
+		ctx := WithFetcher(context.Background(), FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			status := 200
+			if req.URL.Path == "/broken" {
+				status = 500
+			}
+			return &http.Response{Status: fmt.Sprint(status), StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}))
+		primeUrlset(ctx, &Urlset{Url: urlSlice(strings.Split(urls, ","))})
+		os.Exit(0)
+	}
+	for _, c := range []struct {
+		urls string
+		code int
+	}{
+		{"foo.com/a,foo.com/b", 0},
+		{"foo.com/a,foo.com/broken,foo.com/b", exitFailFast},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFailFast$")
+		cmd.Env = append(os.Environ(), "OCP_TEST_FAIL_FAST="+c.urls)
+		out, err := cmd.CombinedOutput()
+		code := 0
+		if e, ok := err.(*exec.ExitError); ok {
+			code = e.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		stopped := strings.Contains(string(out), "Stopping after the first failure (http://foo.com/broken)")
+		if code != c.code || stopped != (c.code != 0) {
+			t.Errorf("%s: expected exit status %d, got %d:\n%s", c.urls, c.code, code, out)
+		}
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+	origThrottle := throttle
+	defer func() {
+		throttle, maxDuration = origThrottle, 0
+		atomic.StoreInt32(&deadlineHit, 0)
+		atomic.StoreInt64(&deadlineSkipped, 0)
+	}()
+	defer resetRun()
+	throttle = 1
+	ctx, err := setupRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlset := &Urlset{}
+	for i := 0; i < 5; i++ {
+		urlset.Url = append(urlset.Url, Url{Loc: fmt.Sprintf("%s/%d", ts.URL, i)})
+	}
+	maxDuration = 50 * time.Millisecond
+	startDeadline()
+	primeUrlset(ctx, urlset)
+	if n, _ := counts(); n != 1 || atomic.LoadInt64(&deadlineSkipped) != 4 || !pastDeadline() {
+		t.Errorf("Expected 1 URL primed and 4 skipped, got %d and %d", n, atomic.LoadInt64(&deadlineSkipped))
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/jobs.json"
+	s := newJobServer()
+	if err := s.load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []int{0, 5, 5, 1} {
+		if err := s.submit(&job{Urls: []string{"http://a.com/"}, Priority: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var order []int
+	for _, j := range s.pending {
+		order = append(order, j.Id)
+	}
+	if fmt.Sprint(order) != "[2 3 4 1]" {
+		t.Errorf("Expected jobs to run in order [2 3 4 1], got %v", order)
+	}
+	j := s.next()
+	s.mu.Lock()
+	j.State = jobRunning
+	s.save()
+	s.mu.Unlock()
+
+	s = newJobServer()
+	if err := s.load(path); err != nil {
+		t.Fatal(err)
+	}
+	order = nil
+	for _, j := range s.pending {
+		order = append(order, j.Id)
+	}
+	if fmt.Sprint(order) != "[2 3 4 1]" || s.jobs[2].State != jobQueued {
+		t.Errorf("Expected the interrupted job to be queued again, got %v", order)
+	}
+	if err := s.submit(&job{Urls: []string{"http://a.com/"}}); err != nil || s.nextId != 5 {
+		t.Errorf("Job numbering not kept: %d, %v", s.nextId, err)
+	}
+	for i := len(s.pending); i < maxQueuedJobs; i++ {
+		s.submit(&job{Urls: []string{"http://a.com/"}})
+	}
+	if err := s.submit(&job{Urls: []string{"http://a.com/"}}); err == nil {
+		t.Error("Job accepted into a full queue")
+	}
+
+	s.mu.Lock()
+	for _, j := range s.pending {
+		j.State = jobDone
+	}
+	s.pending = nil
+	s.mu.Unlock()
+	s.submit(&job{Urls: []string{"http://a.com/"}})
+	s.mu.Lock()
+	s.jobs[s.nextId].State = jobDone
+	s.prune()
+	s.mu.Unlock()
+	if len(s.jobs) != maxFinishedJobs || s.jobs[1] != nil || s.jobs[s.nextId] == nil {
+		t.Errorf("Expected the last %d finished jobs to be kept, got %d", maxFinishedJobs, len(s.jobs))
+	}
+
+	defer func(p int) { maxPriority = p }(maxPriority)
+	maxPriority = 10
+	if err := (*tenant)(nil).claim(&job{Priority: 11}); err == nil {
+		t.Error("Priority above -max-priority accepted")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	if compileTenants([]tenant{{Name: "a", Token: "x"}, {Name: "b", Token: "x"}}) == nil {
+		t.Error("Tenants sharing a token accepted")
+	}
+	origCfg, origThrottle, origPriority := cfg, throttle, maxPriority
+	defer func() { cfg, throttle, maxPriority = origCfg, origThrottle, origPriority }()
+	throttle, maxPriority = 8, 10
+	cfg.Tenants = []tenant{{Name: "blog", Token: "b", Concurrency: 2, APIRate: 2, MaxPriority: 5}, {Name: "shop", Token: "s"}}
+	if err := compileTenants(cfg.Tenants); err != nil {
+		t.Fatal(err)
+	}
+	s := newJobServer()
+	g, err := newAPIGuard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := g.wrap(s, true)
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do("POST", "/jobs", "s", `{"urls": ["http://shop.com/"], "tenant": "blog"}`); rec.Code != http.StatusAccepted || s.jobs[1].Tenant != "shop" {
+		t.Fatalf("Job not submitted as the shop: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/jobs", "b", `{"urls": ["http://blog.com/"], "priority": 5}`); rec.Code != http.StatusAccepted || s.jobs[2].Conc != 2 {
+		t.Fatalf("Job not submitted with the blog's concurrency: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/jobs", "s", `{"urls": ["http://shop.com/"], "priority": 6}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a job over the shop's max_priority, got %d", rec.Code)
+	}
+	if s.pending[0].Id != 2 || len(s.pending) != 2 {
+		t.Errorf("Expected the blog's job to run first, got job %d", s.pending[0].Id)
+	}
+	if rec := do("POST", "/jobs", "b", `{"urls": ["http://blog.com/"], "concurrency": 4}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a job over the blog's concurrency, got %d", rec.Code)
+	}
+	if rec := do("GET", "/jobs", "b", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over the blog's api_rate, got %d", rec.Code)
+	}
+	var list []job
+	json.NewDecoder(do("GET", "/jobs", "s", "").Body).Decode(&list)
+	if len(list) != 1 || list[0].Id != 1 {
+		t.Errorf("Expected the shop to see only its job, got %+v", list)
+	}
+	if rec := do("GET", "/jobs/2", "s", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another tenant's job, got %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.metrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`ocp_jobs{tenant="blog",state="queued"} 1`, `ocp_urls_primed_total{tenant="shop"} 0`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Metrics do not contain %q:\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestDatabaseCommand(t *testing.T) {
+	for _, dsn := range []string{"postgres://ocp:s3cret@db/site?sslmode=require", "postgres://ocp@db/site?password=s3cret&sslmode=require"} {
+		cmd, _, err := dbCommand(dsn, "SELECT loc FROM pages")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := strings.Join(cmd.Args, " "); strings.Contains(args, "s3cret") || !strings.HasSuffix(args, " postgres://ocp@db/site?sslmode=require") {
+			t.Errorf("Password in the arguments to psql: %s", args)
+		}
+		if env := strings.Join(cmd.Env, "\n"); !strings.Contains(env, "PGPASSWORD=s3cret") {
+			t.Errorf("PGPASSWORD not set for %s", dsn)
+		}
+	}
+}
+
+func TestJobSitemapIsRemote(t *testing.T) {
+	s := newJobServer()
+	for _, sitemap := range []string{"/etc/passwd", "-", "ftp://a.com/sitemap.xml", "file:///etc/passwd"} {
+		rec := httptest.NewRecorder()
+		body, _ := json.Marshal(job{Sitemap: sitemap})
+		s.ServeHTTP(rec, httptest.NewRequest("POST", "/jobs", bytes.NewReader(body)))
+		if rec.Code != http.StatusBadRequest || len(s.pending) != 0 {
+			t.Errorf("Job with sitemap %s not rejected: %d %s", sitemap, rec.Code, rec.Body)
+		}
+	}
+	f, err := ioutil.TempFile("", "sitemap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`<urlset><url><loc>http://a.com/</loc></url></urlset>`)
+	f.Close()
+	defer func() { remoteOnly = false }()
+	remoteOnly = true
+	if _, err := getUrlsFromSitemap(context.Background(), f.Name(), false); err == nil || !strings.Contains(err.Error(), "not an http") {
+		t.Errorf("Local sitemap read while serving: %v", err)
+	}
+}
+
+func TestSLO(t *testing.T) {
+	slos, err := parseSlos("p95<800ms, p99<=2s,")
+	if err != nil || len(slos) != 2 || slos[0].p != 95 || slos[0].limit != 800*time.Millisecond || slos[0].inclusive || !slos[1].inclusive {
+		t.Fatalf("Unexpected SLOs %+v, %v", slos, err)
+	}
+	for _, s := range []string{"95<1s", "p0<1s", "p101<1s", "p95>1s", "p95<fast"} {
+		if _, err := parseSlos(s); err == nil {
+			t.Errorf("Invalid SLO %q accepted", s)
+		}
+	}
+
+	var ds []time.Duration
+	for i := 1; i <= 20; i++ {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{0.1: time.Millisecond, 50: 10 * time.Millisecond, 95: 19 * time.Millisecond, 95.1: 20 * time.Millisecond, 100: 20 * time.Millisecond} {
+		if v := percentile(ds, p); v != want {
+			t.Errorf("p%g: expected %s, got %s", p, want, v)
+		}
+	}
+	o := slo{p: 95, limit: 19 * time.Millisecond}
+	if _, ok := o.check(ds); ok {
+		t.Error("p95<19ms met with a p95 of 19ms")
+	}
+	o.inclusive = true
+	if _, ok := o.check(ds); !ok {
+		t.Error("p95<=19ms not met with a p95 of 19ms")
+	}
+
+	defer resetRun()
+	if v, ok := o.check(sloDurations()); ok {
+		t.Errorf("SLO met without any primes: %s", v)
+	}
+	for i := 0; i < 10; i++ {
+		record(result{Url: Url{Loc: "http://a.com/"}, Err: fmt.Errorf("timeout")})
+	}
+	record(result{Url: Url{Loc: "http://a.com/"}, Status: 200, Duration: time.Millisecond})
+	if v, ok := o.check(sloDurations()); ok || v != "failed primes" {
+		t.Errorf("SLO met when most primes failed: %s", v)
+	}
 }
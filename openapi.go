@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The parts of an OpenAPI 3 or Swagger 2 document needed to list GET
+// endpoints
+type openapiDoc struct {
+	Servers []struct {
+		Url string `json:"url"`
+	} `json:"servers"`
+	Host       string                                `json:"host"`
+	BasePath   string                                `json:"basePath"`
+	Schemes    []string                              `json:"schemes"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Parameters map[string]openapiParam               `json:"parameters"`
+	Components struct {
+		Parameters map[string]openapiParam `json:"parameters"`
+	} `json:"components"`
+}
+
+type openapiParam struct {
+	Ref      string        `json:"$ref"`
+	Name     string        `json:"name"`
+	In       string        `json:"in"`
+	Required bool          `json:"required"`
+	Example  interface{}   `json:"example"`
+	XExample interface{}   `json:"x-example"`
+	Default  interface{}   `json:"default"`
+	Enum     []interface{} `json:"enum"`
+	Schema   struct {
+		Example interface{}   `json:"example"`
+		Default interface{}   `json:"default"`
+		Enum    []interface{} `json:"enum"`
+	} `json:"schema"`
+}
+
+// Returns an example value for the parameter, if the document provides one
+func (p openapiParam) value() (string, bool) {
+	for _, v := range []interface{}{p.Example, p.XExample, p.Schema.Example, p.Default, p.Schema.Default} {
+		if v != nil {
+			return fmt.Sprint(v), true
+		}
+	}
+	for _, enum := range [][]interface{}{p.Enum, p.Schema.Enum} {
+		if len(enum) > 0 {
+			return fmt.Sprint(enum[0]), true
+		}
+	}
+	return "", false
+}
+
+// OpenAPISource returns a Source that yields a URL for each GET operation in
+// the OpenAPI 3 or Swagger 2 JSON document read from r. Path and required
+// query parameters are filled in with the example, default or first enum
+// value given in the document; operations lacking one are skipped. Relative
+// server URLs are resolved against base.
+func OpenAPISource(r io.Reader, base string) Source {
+	return &openapiSource{r: r, base: base}
+}
+
+type openapiSource struct {
+	r    io.Reader
+	base string
+	urls Source
+}
+
+func (s *openapiSource) Next() (Url, error) {
+	if s.urls == nil {
+		var doc openapiDoc
+		if err := json.NewDecoder(s.r).Decode(&doc); err != nil {
+			return Url{}, err
+		}
+		urls, err := doc.urls(s.base)
+		if err != nil {
+			return Url{}, err
+		}
+		s.urls = SliceSource(urls)
+	}
+	return s.urls.Next()
+}
+
+func (doc *openapiDoc) server(base string) string {
+	var server string
+	if len(doc.Servers) > 0 {
+		server = doc.Servers[0].Url
+	} else if doc.Host != "" {
+		scheme := "https"
+		if len(doc.Schemes) > 0 {
+			scheme = doc.Schemes[0]
+		}
+		server = scheme + "://" + doc.Host + doc.BasePath
+	} else {
+		server = doc.BasePath
+	}
+	if b, err := url.Parse(base); err == nil && b.IsAbs() {
+		server = resolve(b, server)
+	}
+	return strings.TrimSuffix(server, "/")
+}
+
+func (doc *openapiDoc) param(p openapiParam) openapiParam {
+	if p.Ref == "" {
+		return p
+	}
+	name := p.Ref[strings.LastIndex(p.Ref, "/")+1:]
+	if strings.HasPrefix(p.Ref, "#/components/") {
+		return doc.Components.Parameters[name]
+	}
+	return doc.Parameters[name]
+}
+
+func (doc *openapiDoc) urls(base string) ([]Url, error) {
+	var (
+		urls   []Url
+		server = doc.server(base)
+		paths  = make([]string, 0, len(doc.Paths))
+	)
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		return nil, fmt.Errorf("OpenAPI document has no absolute server URL (got %q)", server)
+	}
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+paths:
+	for _, p := range paths {
+		item := doc.Paths[p]
+		op, ok := item["get"]
+		if !ok {
+			continue
+		}
+		var (
+			shared []openapiParam
+			own    struct {
+				Parameters []openapiParam `json:"parameters"`
+			}
+		)
+		if raw, ok := item["parameters"]; ok {
+			json.Unmarshal(raw, &shared)
+		}
+		json.Unmarshal(op, &own)
+		loc := p
+		query := url.Values{}
+		for _, param := range append(shared, own.Parameters...) {
+			param = doc.param(param)
+			if param.In != "path" && (param.In != "query" || !param.Required) {
+				continue
+			}
+			v, ok := param.value()
+			if !ok {
+				if verbose {
+					log.Printf("Skipping GET %s: no example value for parameter %s\n", p, param.Name)
+				}
+				continue paths
+			}
+			if param.In == "path" {
+				loc = strings.Replace(loc, "{"+param.Name+"}", url.PathEscape(v), -1)
+			} else {
+				query.Set(param.Name, v)
+			}
+		}
+		if strings.Contains(loc, "{") {
+			if verbose {
+				log.Printf("Skipping GET %s: undeclared path parameter\n", p)
+			}
+			continue
+		}
+		loc = server + loc
+		if len(query) > 0 {
+			loc += "?" + query.Encode()
+		}
+		urls = append(urls, Url{Loc: loc})
+	}
+	return urls, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	originHeaders []string       // compared with -compare-origin
+	originIgnore  *regexp.Regexp // parts of bodies not compared
+	originChecked int64
+	originDiffers int64
+)
+
+// Validates -compare-origin, -compare-headers and -compare-ignore
+func setupCompareOrigin() error {
+	if compareOrigin != "bypass" {
+		u, err := url.Parse(compareOrigin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid -compare-origin %q (expected a URL like http://10.0.0.5:8080, or bypass)", compareOrigin)
+		}
+	}
+	originHeaders = nil
+	for _, h := range strings.Split(compareHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			originHeaders = append(originHeaders, http.CanonicalHeaderKey(h))
+		}
+	}
+	if compareIgnore != "" {
+		var err error
+		if originIgnore, err = regexp.Compile(compareIgnore); err != nil {
+			return fmt.Errorf("invalid -compare-ignore: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns the URL to fetch loc from the origin with
+func originLoc(loc string) (string, error) {
+	if compareOrigin == "bypass" {
+		return loc, nil
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return "", err
+	}
+	o, _ := url.Parse(compareOrigin)
+	u.Scheme, u.Host = o.Scheme, o.Host
+	return u.String(), nil
+}
+
+// Fetches loc from the origin, asking any cache in between not to answer
+func fetchOrigin(ctx context.Context, loc string) (*http.Response, []byte, error) {
+	oloc, err := originLoc(loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest("GET", oloc, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u, err := url.Parse(loc); err == nil {
+		req.Host = u.Host
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Pragma", "no-cache")
+	res, err := fetcherOf(ctx).Do(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return res, body, err
+}
+
+// Returns the hash of body, without the parts matching -compare-ignore
+func comparableHash(body []byte) [sha256.Size]byte {
+	if originIgnore != nil {
+		body = originIgnore.ReplaceAll(body, nil)
+	}
+	return sha256.Sum256(body)
+}
+
+// Returns how the origin's response differs from the cache's, or nil if it
+// doesn't
+func responseDiffs(cache *http.Response, cacheBody []byte, origin *http.Response, originBody []byte) []string {
+	var diffs []string
+	if cache.StatusCode != origin.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status %d (cache) vs %d (origin)", cache.StatusCode, origin.StatusCode))
+	}
+	for _, h := range originHeaders {
+		if c, o := cache.Header.Get(h), origin.Header.Get(h); c != o {
+			diffs = append(diffs, fmt.Sprintf("%s %q (cache) vs %q (origin)", h, c, o))
+		}
+	}
+	if comparableHash(cacheBody) != comparableHash(originBody) {
+		diffs = append(diffs, fmt.Sprintf("body of %d bytes (cache) vs %d bytes (origin)", len(cacheBody), len(originBody)))
+	}
+	return diffs
+}
+
+// Fetches the page from the origin with -compare-origin and reports where
+// the response differs from the one the cache served
+func checkOrigin(ctx context.Context, u Url, res *http.Response, body []byte) {
+	ores, obody, err := fetchOrigin(ctx, u.Loc)
+	if err != nil {
+		if !nowarn {
+			log.Printf("Error fetching %s from the origin: %v\n", u.Loc, err)
+		}
+		return
+	}
+	atomic.AddInt64(&originChecked, 1)
+	if diffs := responseDiffs(res, body, ores, obody); len(diffs) > 0 {
+		atomic.AddInt64(&originDiffers, 1)
+		log.Printf("Origin mismatch for %s: %s\n", u.Loc, strings.Join(diffs, ", "))
+	}
+}
+
+// Logs how many pages differed from the origin
+func reportOriginDiffs() {
+	n, d := atomic.LoadInt64(&originChecked), atomic.LoadInt64(&originDiffers)
+	if d > 0 || verbose {
+		log.Printf("%d of %d URLs differ from the origin\n", d, n)
+	}
+}
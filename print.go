@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"text/template"
+)
+
+// Writes the URLs in urlset to w, one per line (or NUL-terminated with
+// -print0), formatted with the -print-format template if given
+func printUrlset(w io.Writer, urlset *Urlset) error {
+	var tmpl *template.Template
+	if printFormat != "" {
+		var err error
+		tmpl, err = template.New("print").Parse(printFormat)
+		if err != nil {
+			return err
+		}
+	}
+	sep := "\n"
+	if printNul {
+		sep = "\x00"
+	}
+	bw := bufio.NewWriter(w)
+	for _, v := range urlset.Url {
+		if tmpl != nil {
+			if err := tmpl.Execute(bw, v); err != nil {
+				return err
+			}
+		} else {
+			bw.WriteString(v.Loc)
+		}
+		bw.WriteString(sep)
+	}
+	return bw.Flush()
+}
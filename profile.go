@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+var (
+	cpuProfile *os.File
+	stopOnce   sync.Once
+)
+
+// Starts the pprof HTTP server and CPU profiling as requested by the flags
+func startProfiling() error {
+	if pprofAddr != "" {
+		go func() {
+			if verbose {
+				log.Println("Serving pprof on", pprofAddr)
+			}
+			if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+				log.Println("Error serving pprof:", err)
+			}
+		}()
+	}
+	if cpuProfilePath != "" {
+		f, err := os.Create(cpuProfilePath)
+		if err != nil {
+			return err
+		}
+		if err = pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		cpuProfile = f
+	}
+	return nil
+}
+
+// Stops CPU profiling and writes the heap profile, if requested. Safe to
+// call more than once.
+func stopProfiling() {
+	stopOnce.Do(func() {
+		if cpuProfile != nil {
+			pprof.StopCPUProfile()
+			cpuProfile.Close()
+		}
+		if memProfilePath != "" {
+			f, err := os.Create(memProfilePath)
+			if err != nil {
+				log.Println("Error writing heap profile:", err)
+				return
+			}
+			runtime.GC()
+			if err = pprof.WriteHeapProfile(f); err != nil {
+				log.Println("Error writing heap profile:", err)
+			}
+			f.Close()
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	queued    int64 // URLs handed to primeUrl in this run
+	completed int64 // of which have been primed or skipped
+
+	flightMu   sync.Mutex
+	flightId   int64
+	inFlight   = make(map[int64]flight)
+	progressT0 = time.Now()
+)
+
+// A request that is being made
+type flight struct {
+	loc   string
+	start time.Time
+}
+
+// Counts n more URLs as queued for priming
+func queue(n int) {
+	atomic.AddInt64(&queued, int64(n))
+}
+
+// Records that a request for loc has started, returning the id to pass to
+// land when it is done
+func takeOff(loc string) int64 {
+	flightMu.Lock()
+	defer flightMu.Unlock()
+	flightId++
+	inFlight[flightId] = flight{loc, time.Now()}
+	return flightId
+}
+
+func land(id int64) {
+	flightMu.Lock()
+	delete(inFlight, id)
+	flightMu.Unlock()
+}
+
+// Clears the progress of the previous run
+func resetProgress() {
+	atomic.StoreInt64(&queued, 0)
+	atomic.StoreInt64(&completed, 0)
+	flightMu.Lock()
+	inFlight = make(map[int64]flight)
+	progressT0 = time.Now()
+	flightMu.Unlock()
+}
+
+// Returns the requests being made, longest running first
+func flights() []flight {
+	flightMu.Lock()
+	fs := make([]flight, 0, len(inFlight))
+	for _, f := range inFlight {
+		fs = append(fs, f)
+	}
+	flightMu.Unlock()
+	sort.Slice(fs, func(i, j int) bool { return fs[i].start.Before(fs[j].start) })
+	return fs
+}
+
+// Writes how many URLs have been primed and remain, the failures so far by
+// kind, and the requests being made with how long they have taken, longest
+// first
+func writeProgress(w io.Writer) {
+	var (
+		now     = time.Now()
+		done    = atomic.LoadInt64(&completed)
+		pending = atomic.LoadInt64(&queued) - done
+		classes = make(map[string]int)
+		failed  int
+	)
+	resultsMu.Lock()
+	for _, r := range results {
+		if c := failureClass(r); c != "" {
+			classes[c]++
+			failed++
+		}
+	}
+	resultsMu.Unlock()
+	fs := flights()
+	flightMu.Lock()
+	elapsed := now.Sub(progressT0)
+	flightMu.Unlock()
+	fmt.Fprintf(w, "Progress after %s: %d URLs done (%d failed), %d remaining\n",
+		elapsed.Round(time.Second), done, failed, pending)
+	if len(classes) > 0 {
+		fmt.Fprintln(w, "Failures by kind:")
+	}
+	for _, c := range byCount(classes) {
+		fmt.Fprintf(w, "  %7d  %s\n", classes[c], c)
+	}
+	fmt.Fprintf(w, "In flight: %d\n", len(fs))
+	for _, f := range fs {
+		fmt.Fprintf(w, "  %7s  %s\n", now.Sub(f.start).Round(time.Millisecond), f.loc)
+	}
+}
+
+var progressOnce sync.Once
+
+// Logs the progress of the run whenever one of progressSignals is received,
+// e.g. with kill -USR1, without stopping it
+func handleProgressSignals() {
+	if len(progressSignals) == 0 {
+		return
+	}
+	progressOnce.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, progressSignals...)
+		go func() {
+			for range c {
+				var b strings.Builder
+				writeProgress(&b)
+				log.Print(b.String())
+			}
+		}()
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals that make a run log its progress
+var progressSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// Windows has no user-defined signals, so progress can't be requested
+var progressSignals []os.Signal
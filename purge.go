@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+)
+
+// The WP-CLI commands that purge the cache of each -purge plugin
+var purgeCommands = map[string][]string{
+	"lscache":   {"litespeed-purge", "all"},
+	"wp-rocket": {"rocket", "clean", "--confirm"},
+}
+
+// Returns the WP-CLI command that purges the cache of plugin, on the server
+// given with -wp-ssh if set
+func wpPurgeCommand(plugin string) (*exec.Cmd, error) {
+	args, ok := purgeCommands[plugin]
+	if !ok {
+		return nil, fmt.Errorf("invalid -purge value %q (expected lscache or wp-rocket)", plugin)
+	}
+	if wpPath != "" {
+		args = append([]string{"--path=" + wpPath}, args...)
+	}
+	if wpSSH != "" {
+		args = append([]string{"--ssh=" + wpSSH}, args...)
+	}
+	return exec.Command("wp", args...), nil
+}
+
+// Purges the cache with -purge-url and/or -purge before priming
+func purge(ctx context.Context) error {
+	if purgeUrl != "" {
+		req, err := http.NewRequest(purgeMethod, purgeUrl, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		res, err := fetcherOf(ctx).Do(ctx, req)
+		if err != nil {
+			return fmt.Errorf("purge: %v", err)
+		}
+		discard(res)
+		if res.StatusCode >= 400 {
+			return fmt.Errorf("purge: HTTP %s from %s", res.Status, purgeUrl)
+		}
+		if verbose {
+			log.Println("Purged the cache at", purgeUrl)
+		}
+	}
+	if purgePlugin != "" {
+		cmd, err := wpPurgeCommand(purgePlugin)
+		if err != nil {
+			return err
+		}
+		if _, err := exec.LookPath("wp"); err != nil {
+			return fmt.Errorf("-purge requires WP-CLI (the wp command): %v", err)
+		}
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("purge: %v: %s", err, bytes.TrimSpace(out.Bytes()))
+		}
+		if verbose {
+			log.Printf("Purged the %s cache: %s\n", purgePlugin, bytes.TrimSpace(out.Bytes()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A request made during a recorded run, stored as one JSON object per line
+type recordedRequest struct {
+	Offset    float64     `json:"offset_ms"` // since the start of the run
+	Method    string      `json:"method"`
+	Url       string      `json:"url"`
+	Status    int         `json:"status,omitempty"`
+	Duration  float64     `json:"duration_ms"` // until the response headers
+	Error     string      `json:"error,omitempty"`
+	RequestID string      `json:"request_id,omitempty"` // with -request-id-header
+	UserAgent string      `json:"user_agent,omitempty"` // with -ua-file
+	Header    http.Header `json:"header,omitempty"`     // of the response
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Recorder returns a Middleware that writes the metadata of every GET and HEAD
+// request and its response to w, for replaying the run later with -replay.
+// Request headers are not recorded, as they may contain credentials, except
+// for the -request-id-header and the User-Agent with -ua-file.
+func Recorder(w io.Writer) Middleware {
+	var (
+		mu    sync.Mutex
+		enc   = json.NewEncoder(w)
+		start = time.Now()
+	)
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				return next.Do(ctx, req)
+			}
+			t := time.Now()
+			res, err := next.Do(ctx, req)
+			r := recordedRequest{
+				Offset:   millis(t.Sub(start)),
+				Method:   req.Method,
+				Url:      req.URL.String(),
+				Duration: millis(time.Since(t)),
+			}
+			if requestIDHeader != "" {
+				r.RequestID = req.Header.Get(requestIDHeader)
+			}
+			if len(userAgents) > 0 {
+				r.UserAgent = req.Header.Get("User-Agent")
+			}
+			if err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Status = res.StatusCode
+				r.Header = res.Header
+			}
+			mu.Lock()
+			if err := enc.Encode(r); err != nil && !nowarn {
+				log.Printf("Error recording %s: %v\n", r.Url, err)
+			}
+			mu.Unlock()
+			return res, err
+		})
+	}
+}
+
+// Reads the requests recorded with -record from path
+func readRecording(path string) ([]recordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		reqs []recordedRequest
+		s    = bufio.NewScanner(f)
+	)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		var r recordedRequest
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		reqs = append(reqs, r)
+	}
+	// Requests are written as they complete, so restore the order they were
+	// made in
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].Offset < reqs[j].Offset })
+	return reqs, s.Err()
+}
+
+// Re-issues the requests recorded in path in the same order and at the same
+// offsets from the start of the run, regardless of -c, and returns the exit
+// code of the run
+func replay(ctx context.Context, path string) int {
+	defer stopProfiling()
+	reqs, err := readRecording(path)
+	if err != nil {
+		fmt.Println("Error:", err)
+		runEnded(1)
+		return 1
+	}
+	if verbose {
+		log.Println("Requests to replay:", len(reqs))
+	}
+	start := time.Now()
+	for _, r := range reqs {
+		time.Sleep(time.Until(start.Add(time.Duration(r.Offset * float64(time.Millisecond)))))
+		wg.Add(1)
+		go func(r recordedRequest) {
+			defer wg.Done()
+			if verbose {
+				log.Printf("Replaying %s %s\n", r.Method, r.Url)
+			}
+			req, err := http.NewRequest(r.Method, r.Url, nil)
+			if err != nil {
+				log.Printf("Error replaying %s: %v\n", r.Url, err)
+				return
+			}
+			req.Header.Set("User-Agent", userAgent)
+			if r.UserAgent != "" {
+				req.Header.Set("User-Agent", r.UserAgent)
+			}
+			t := time.Now()
+			res, err := fetcherOf(ctx).Do(ctx, req)
+			result := result{Url: Url{Loc: r.Url}, Err: err}
+			if err != nil {
+				if !nowarn {
+					log.Printf("Error replaying %s: %v\n", r.Url, err)
+				}
+			} else {
+				result.Size, _ = io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				result.Status = res.StatusCode
+				if len(captureHeaders) > 0 {
+					result.Headers = captureHeaderValues(res.Header)
+				}
+				if res.StatusCode != r.Status && !nowarn {
+					log.Printf("Status of %s changed from %d to %s\n", r.Url, r.Status, res.Status)
+				}
+			}
+			result.Duration = time.Since(t)
+			record(result)
+			checkFailFast(result)
+		}(r)
+	}
+	wg.Wait()
+	code := finish()
+	runEnded(code)
+	return code
+}
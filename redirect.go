@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The error of a request whose redirects looped or went on for longer than
+// -max-redirects
+type redirectError struct {
+	loop  bool
+	chain []string // the URLs requested, in order
+}
+
+func (e *redirectError) Error() string {
+	if e.loop {
+		return "redirect loop: " + strings.Join(e.chain, " -> ")
+	}
+	return fmt.Sprintf("more than %d redirects: %s", maxRedirects, strings.Join(e.chain, " -> "))
+}
+
+// Stops following redirects that loop or exceed -max-redirects, with the
+// chain of URLs in the error
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	loop := false
+	next := req.URL.String()
+	for _, r := range via {
+		loc := r.URL.String()
+		chain = append(chain, loc)
+		loop = loop || loc == next
+	}
+	chain = append(chain, next)
+	if loop || uint(len(via)) > maxRedirects {
+		return &redirectError{loop, chain}
+	}
+	return nil
+}
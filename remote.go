@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the user name and password for a sitemap on an FTP or SFTP server:
+// those in the URL, else those for the host in the config, else those in
+// .netrc if -netrc is set
+func remoteCredentials(u *url.URL) (user, password string, ok bool) {
+	if u.User != nil {
+		password, _ = u.User.Password()
+		return u.User.Username(), password, true
+	}
+	host := strings.ToLower(u.Hostname())
+	if c, ok := cfg.Credentials[host]; ok {
+		return c.User, os.ExpandEnv(c.Password), true
+	}
+	if useNetrc {
+		if creds, err := parseNetrc(netrcPath()); err == nil {
+			if c, ok := creds[host]; ok {
+				return c.User, c.Password, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// An FTP file download, which ends the session when closed
+type ftpReader struct {
+	io.ReadCloser // the data connection
+	conn          *textproto.Conn
+}
+
+func (r *ftpReader) Close() error {
+	r.ReadCloser.Close()
+	r.conn.ReadResponse(2)
+	r.conn.Cmd("QUIT")
+	return r.conn.Close()
+}
+
+// Downloads the file at an ftp:// URL using passive mode, logging in
+// anonymously unless credentials are found. As in RFC 1738, the path is
+// relative to the login directory; use %2F for an absolute one.
+func openFTP(u *url.URL) (io.ReadCloser, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	nc, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn := textproto.NewConn(nc)
+	fail := func(err error) (io.ReadCloser, error) {
+		conn.Close()
+		return nil, fmt.Errorf("FTP %s: %v", u.Host, err)
+	}
+	cmd := func(expect int, format string, args ...interface{}) (string, error) {
+		if _, err := conn.Cmd(format, args...); err != nil {
+			return "", err
+		}
+		_, msg, err := conn.ReadResponse(expect)
+		return msg, err
+	}
+	if _, _, err = conn.ReadResponse(2); err != nil {
+		return fail(err)
+	}
+	user, password, ok := remoteCredentials(u)
+	if !ok {
+		user, password = "anonymous", "anonymous@"
+	}
+	if _, err = conn.Cmd("USER %s", user); err != nil {
+		return fail(err)
+	}
+	code, msg, err := conn.ReadResponse(0)
+	if err != nil {
+		return fail(err)
+	}
+	switch {
+	case code == 331:
+		if _, err = cmd(2, "PASS %s", password); err != nil {
+			return fail(err)
+		}
+	case code/100 != 2:
+		return fail(fmt.Errorf("%d %s", code, msg))
+	}
+	if _, err = cmd(2, "TYPE I"); err != nil {
+		return fail(err)
+	}
+	// The port is taken from the reply, but the address is always that of the
+	// control connection, as servers behind NAT often report internal ones
+	msg, err = cmd(227, "PASV")
+	if err != nil {
+		return fail(err)
+	}
+	start, end := strings.Index(msg, "("), strings.Index(msg, ")")
+	if start < 0 || end < start {
+		return fail(fmt.Errorf("invalid PASV reply %q", msg))
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return fail(fmt.Errorf("invalid PASV reply %q", msg))
+	}
+	hi, _ := strconv.Atoi(strings.TrimSpace(fields[4]))
+	lo, _ := strconv.Atoi(strings.TrimSpace(fields[5]))
+	host, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+	data, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(hi<<8|lo)), 30*time.Second)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err = conn.Cmd("RETR %s", strings.TrimPrefix(u.Path, "/")); err == nil {
+		_, _, err = conn.ReadResponse(1)
+	}
+	if err != nil {
+		data.Close()
+		return fail(err)
+	}
+	return &ftpReader{data, conn}, nil
+}
+
+// A downloaded temporary file, which is removed when closed
+type tempFile struct {
+	*os.File
+	dir string
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.RemoveAll(f.dir)
+	return err
+}
+
+// Downloads the file at an sftp:// URL with the sftp command, using
+// -sftp-key or the user's SSH keys and agent. A password requires the
+// sshpass command.
+func openSFTP(u *url.URL) (io.ReadCloser, error) {
+	if _, err := exec.LookPath("sftp"); err != nil {
+		return nil, fmt.Errorf("sftp:// sitemaps require the sftp command: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "ocp-sftp")
+	if err != nil {
+		return nil, err
+	}
+	local := filepath.Join(dir, "sitemap")
+	var (
+		name = "sftp"
+		args = []string{"-q", "-b", "-"}
+		env  = os.Environ()
+		dest = u.Hostname()
+	)
+	user, password, ok := remoteCredentials(u)
+	if ok && user != "" {
+		dest = user + "@" + dest
+	}
+	if u.Port() != "" {
+		args = append(args, "-P", u.Port())
+	}
+	if sftpKey != "" {
+		args = append(args, "-i", sftpKey)
+	}
+	if password != "" {
+		if _, err := exec.LookPath("sshpass"); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("sftp:// sitemaps with a password require the sshpass command: %v", err)
+		}
+		// -b turns on BatchMode, which disables password authentication
+		name, args = "sshpass", append([]string{"-e", "sftp", "-o", "BatchMode=no"}, args...)
+		env = append(env, "SSHPASS="+password)
+	} else {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	cmd := exec.Command(name, append(args, "--", dest)...)
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("get %s %s\n", strconv.Quote(u.Path), strconv.Quote(local)))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("sftp %s: %v: %s", u.Host, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &tempFile{f, dir}, nil
+}
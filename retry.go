@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The failures a request is retried on: response status codes (or classes
+// like 5xx) and kinds of error, and how long to wait before each retry
+type retryPolicy struct {
+	statuses map[int]bool
+	classes  map[int]bool // status / 100
+	timeout  bool
+	error    bool          // any other error
+	backoff  time.Duration // before the first retry, doubling for each one after
+	jitter   float64       // fraction of the wait added or taken off at random
+}
+
+// Parses a -retry-on list like "429,5xx,timeout", with a backoff of a second
+func parseRetryOn(s string) (*retryPolicy, error) {
+	p := &retryPolicy{statuses: make(map[int]bool), classes: make(map[int]bool), backoff: time.Second}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		switch {
+		case v == "":
+		case v == "timeout":
+			p.timeout = true
+		case v == "error":
+			p.error = true
+		case len(v) == 3 && strings.HasSuffix(v, "xx") && v[0] >= '1' && v[0] <= '5':
+			p.classes[int(v[0]-'0')] = true
+		default:
+			code, err := strconv.Atoi(v)
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid -retry-on value %q (expected a status code, e.g. 503 or 5xx, timeout or error)", v)
+			}
+			p.statuses[code] = true
+		}
+	}
+	return p, nil
+}
+
+// Returns whether err is a timeout
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// Returns whether the outcome of a request should be retried
+func (p *retryPolicy) retry(res *http.Response, err error) bool {
+	if err != nil {
+		if isTimeout(err) {
+			return p.timeout
+		}
+		return p.error
+	}
+	return p.statuses[res.StatusCode] || p.classes[res.StatusCode/100]
+}
+
+// Returns how long to wait before retry i (from 0)
+func (p *retryPolicy) wait(i int) time.Duration {
+	d := p.backoff
+	for j := 0; j < i && d < time.Hour; j++ {
+		d *= 2
+	}
+	if p.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	}
+	return d
+}
+
+// Returns how long the response to a failed request asks to wait before
+// retrying it, per its Retry-After header, or 0
+func retryAfter(res *http.Response, now time.Time) time.Duration {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	v := strings.TrimSpace(res.Header.Get("Retry-After"))
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+type attemptsKey struct{}
+
+// Returns a context in which Retry counts the attempts made at a request in n
+func withAttempts(ctx context.Context, n *int) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, n)
+}
+
+type slotKey struct{}
+
+// Returns a context for a request holding a slot in sem, which Retry frees
+// while it waits
+func withSlot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, slotKey{}, true)
+}
+
+// Retry returns a Middleware that repeats GET and HEAD requests up to retries
+// more times, backing off exponentially, or as long as a 429 or 503 response
+// asks with Retry-After if that is longer, while their outcome matches the
+// policy.
+func Retry(retries int, p *retryPolicy) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+			res, err := next.Do(ctx, req)
+			if req.Method != "GET" && req.Method != "HEAD" {
+				return res, err
+			}
+			n, _ := ctx.Value(attemptsKey{}).(*int)
+			if n != nil {
+				*n = 1
+			}
+			slot, _ := ctx.Value(slotKey{}).(bool)
+			for i := 0; i < retries && p.retry(res, err); i++ {
+				wait := p.wait(i)
+				if err == nil {
+					if d := retryAfter(res, time.Now()); d > wait {
+						wait = d
+					}
+					discard(res)
+				}
+				if verbose {
+					reason := fmt.Sprint(err)
+					if err == nil {
+						reason = res.Status
+					}
+					log.Printf("Retrying %s in %s (%s)\n", req.URL, wait.Round(time.Millisecond), reason)
+				}
+				if slot {
+					// So other URLs are primed meanwhile
+					<-sem
+				}
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+				if slot {
+					sem <- true
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				res, err = next.Do(ctx, req)
+				if n != nil {
+					*n++
+				}
+			}
+			return res, err
+		})
+	}
+}
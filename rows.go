@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Returns a URL for a row of named columns. If tmpl is set it is executed with
+// the row, e.g. https://mysite.com/blog/{{.slug}}; otherwise the url or loc
+// column is used. priority and lastmod columns are used if present, and the
+// other columns are kept in the URL's Fields.
+func rowUrl(row map[string]string, tmpl *template.Template) (Url, error) {
+	var loc string
+	if tmpl != nil {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, row); err != nil {
+			return Url{}, err
+		}
+		loc = b.String()
+	} else if loc = row["url"]; loc == "" {
+		loc = row["loc"]
+	}
+	if loc == "" {
+		return Url{}, fmt.Errorf("row has no url or loc column: %v", row)
+	}
+	u := Url{Loc: loc, Lastmod: row["lastmod"]}
+	if p := row["priority"]; p != "" {
+		var err error
+		if u.Priority, err = strconv.ParseFloat(p, 64); err != nil {
+			return Url{}, fmt.Errorf("invalid priority %q for %s", p, loc)
+		}
+	}
+	for k, v := range row {
+		switch k {
+		case "url", "loc", "priority", "lastmod":
+		default:
+			if u.Fields == nil {
+				u.Fields = make(map[string]string)
+			}
+			u.Fields[k] = v
+		}
+	}
+	return u, nil
+}
+
+// Reads rows with a header row from r, which is CSV unless comma is set. With
+// a comma of '\t', r is the output of mysql --batch.
+func readRows(r io.Reader, comma rune) ([]map[string]string, error) {
+	var read func() ([]string, error)
+	if comma == '\t' {
+		read = batchRecords(r)
+	} else {
+		cr := csv.NewReader(r)
+		cr.LazyQuotes = true
+		if comma != 0 {
+			cr.Comma = comma
+		}
+		read = cr.Read
+	}
+	header, err := read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(h))
+	}
+	var rows []map[string]string
+	for {
+		rec, err := read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(header))
+		for i, v := range rec {
+			if i < len(header) {
+				row[header[i]] = v
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// Unescapes the tabs, newlines, NULs and backslashes in a field of mysql
+// --batch output
+var batchUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\0`, "\x00")
+
+// Returns a function that reads the records of the tab-separated output of
+// mysql --batch from r. NULL values are read as empty.
+func batchRecords(r io.Reader) func() ([]string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	return func() ([]string, error) {
+		if !sc.Scan() {
+			if err := sc.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		rec := strings.Split(sc.Text(), "\t")
+		for i, v := range rec {
+			if v == "NULL" {
+				rec[i] = ""
+			} else {
+				rec[i] = batchUnescaper.Replace(v)
+			}
+		}
+		return rec, nil
+	}
+}
+
+// CSVSource returns a Source that yields a URL for each row of the CSV read from
+// r, whose header row names the columns as in rowUrl.
+func CSVSource(r io.Reader) Source {
+	return &lazySource{load: func() ([]Url, error) {
+		rows, err := readRows(r, 0)
+		if err != nil {
+			return nil, fmt.Errorf("CSV: %v", err)
+		}
+		urls := make([]Url, 0, len(rows))
+		for _, row := range rows {
+			u, err := rowUrl(row, nil)
+			if err != nil {
+				return nil, fmt.Errorf("CSV: %v", err)
+			}
+			urls = append(urls, u)
+		}
+		return urls, nil
+	}}
+}
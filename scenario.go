@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// A step of the scenario in the config. The steps are primed in order, each
+// only after the previous one has finished.
+type scenarioStep struct {
+	Name    string   `json:"name"`
+	Urls    []string `json:"urls"`    // e.g. a warm-up endpoint
+	Pattern string   `json:"pattern"` // the sitemap URLs matching this regular expression
+
+	re *regexp.Regexp
+}
+
+// Compiles the patterns of the scenario steps in the config
+func compileScenario(steps []scenarioStep) error {
+	for i := range steps {
+		s := &steps[i]
+		if s.Name == "" {
+			s.Name = fmt.Sprint("step ", i+1)
+		}
+		if len(s.Urls) == 0 && s.Pattern == "" {
+			return fmt.Errorf("scenario %s: expected urls or a pattern", s.Name)
+		}
+		if s.Pattern != "" {
+			var err error
+			if s.re, err = regexp.Compile(s.Pattern); err != nil {
+				return fmt.Errorf("scenario %s: %v", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Splits the URLs of urlset into the scenario steps: each step's own URLs,
+// followed by the URLs matching its pattern (but not an earlier step's). The
+// last group holds the URLs that match no step.
+func scenarioGroups(urlset *Urlset, steps []scenarioStep) [][]Url {
+	groups := make([][]Url, len(steps)+1)
+	own := make(map[string]bool)
+	for i, s := range steps {
+		for _, loc := range s.Urls {
+			if !own[loc] {
+				own[loc] = true
+				groups[i] = append(groups[i], Url{Loc: loc})
+			}
+		}
+	}
+	for _, u := range urlset.Url {
+		if own[u.Loc] {
+			continue
+		}
+		i := len(steps)
+		for j, s := range steps {
+			if s.re != nil && s.re.MatchString(u.Loc) {
+				i = j
+				break
+			}
+		}
+		groups[i] = append(groups[i], u)
+	}
+	return groups
+}
+
+// Primes urlset one scenario step at a time
+func primeScenario(ctx context.Context, urlset *Urlset, steps []scenarioStep) {
+	for i, g := range scenarioGroups(urlset, steps) {
+		if len(g) == 0 {
+			continue
+		}
+		if verbose {
+			name := "the rest"
+			if i < len(steps) {
+				name = steps[i].Name
+			}
+			log.Printf("Priming %s of the scenario\n", name)
+		}
+		primeUrlset(ctx, &Urlset{Url: g})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where run failures and panics are reported, if anywhere
+type sentryConfig struct {
+	DSN         string `json:"dsn"`         // $VARIABLES are expanded
+	Environment string `json:"environment"` // e.g. production
+}
+
+var (
+	// Where failures are reported, if set
+	sentryDsn string
+	// The arguments the URLs to prime were loaded from, e.g. a sitemap URL
+	runInput []string
+	// The error that ended the run early, if any
+	runErr error
+)
+
+// Returns the Sentry DSN in the config, or else $SENTRY_DSN
+func configuredSentryDSN() string {
+	if cfg.Sentry != nil && cfg.Sentry.DSN != "" {
+		return os.ExpandEnv(cfg.Sentry.DSN)
+	}
+	return os.Getenv("SENTRY_DSN")
+}
+
+// Returns the envelope endpoint and X-Sentry-Auth header of a DSN like
+// https://<key>@o1.ingest.sentry.io/<project>
+func parseSentryDSN(dsn string) (endpoint, auth string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	project := path.Base(u.Path)
+	if u.User == nil || u.Host == "" || project == "/" || project == "." {
+		return "", "", fmt.Errorf("invalid Sentry DSN %q", dsn)
+	}
+	prefix := strings.TrimSuffix(path.Dir(u.Path), "/")
+	endpoint = fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project)
+	auth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=ocp/%s, sentry_key=%s", version, u.User.Username())
+	return endpoint, auth, nil
+}
+
+// Sends an event with message to Sentry, with the site, input and extra as
+// context
+func sendSentryEvent(level, message string, extra map[string]string) error {
+	endpoint, auth, err := parseSentryDSN(sentryDsn)
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{}
+	if len(runInput) > 0 {
+		if u, err := url.Parse(runInput[0]); err == nil && u.Host != "" {
+			tags["site"] = u.Host
+		}
+		extra["input"] = strings.Join(runInput, " ")
+	}
+	if code, ok := extra["exit_code"]; ok {
+		tags["exit_code"] = code
+	}
+	event := map[string]interface{}{
+		"event_id":  strings.Replace(newUUID(), "-", "", -1),
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"platform":  "go",
+		"level":     level,
+		"logger":    "ocp",
+		"release":   "ocp@" + version,
+		"message":   map[string]string{"formatted": message},
+		"tags":      tags,
+		"extra":     extra,
+	}
+	if cfg.Sentry != nil && cfg.Sentry.Environment != "" {
+		event["environment"] = cfg.Sentry.Environment
+	}
+	if host, err := os.Hostname(); err == nil {
+		event["server_name"] = host
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.Encode(map[string]string{"event_id": event["event_id"].(string), "dsn": sentryDsn})
+	enc.Encode(map[string]string{"type": "event"})
+	enc.Encode(event)
+	req, err := http.NewRequest("POST", endpoint, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", auth)
+	c := &http.Client{Timeout: 10 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	discard(res)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %s from %s", res.Status, endpoint)
+	}
+	return nil
+}
+
+// Reports a run that exited with a non-zero code to Sentry
+func reportRunFailure(code int) {
+	if sentryDsn == "" {
+		return
+	}
+	msg := fmt.Sprintf("ocp run failed with exit status %d", code)
+	if runErr != nil {
+		msg += ": " + runErr.Error()
+	}
+	extra := map[string]string{
+		"exit_code": strconv.Itoa(code),
+		"summary":   runSummary(code),
+	}
+	if err := sendSentryEvent("error", msg, extra); err != nil && !nowarn {
+		log.Println("Error reporting to Sentry:", err)
+	}
+}
+
+// Reports a panic to Sentry before letting it crash the program. It must be
+// deferred.
+func reportPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if sentryDsn != "" {
+		extra := map[string]string{"stack": string(debug.Stack())}
+		if err := sendSentryEvent("fatal", fmt.Sprint("panic: ", r), extra); err != nil {
+			log.Println("Error reporting to Sentry:", err)
+		}
+	}
+	panic(r)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listenAddr    string
+	controlToken  string
+	skipUnchanged bool
+	primeWindow   string
+	callbackSize  int
+	queuePath     string
+	maxPriority   int
+
+	// Set while serving, so clients can't have sitemaps, or the children of
+	// sitemapindexes, read from local files, stdin or FTP
+	remoteOnly bool
+
+	allowInternalCallbacks bool
+)
+
+func serveFlags(fs *flag.FlagSet) {
+	fs.StringVar(&listenAddr, "listen", "localhost:8080", "address to serve the API and dashboard on")
+	fs.BoolVar(&skipUnchanged, "skip-unchanged", false, "finish jobs for a sitemap that was primed by an earlier job without priming it again if it hasn't changed since, per its ETag or Last-Modified header")
+	fs.StringVar(&primeWindow, "window", "", "only send requests during these times of day, e.g. 01:00-06:00, 22:00-02:00,12:00-13:00 Europe/Berlin or Mon-Fri 22:00-06:00 Europe/London (default every day, local time), pausing jobs outside of them and resuming them when the next window opens")
+	fs.StringVar(&queuePath, "queue-file", "", "keep the jobs in this JSON file, so queued jobs, and the one running, are run when the server is restarted")
+	fs.IntVar(&maxPriority, "max-priority", 10, "highest priority a job may ask for; jobs with a higher priority run first")
+	fs.IntVar(&callbackSize, "callback-batch", 100, "number of results in each batch POSTed to the callback URL of a job, unless the job sets its batch_size")
+	fs.BoolVar(&allowInternalCallbacks, "allow-internal-callbacks", false, "let jobs POST their results to callback URLs on this machine or its link-local network, such as 127.0.0.1 or 169.254.169.254")
+	fs.StringVar(&controlToken, "control-token", os.Getenv("OCP_CONTROL_TOKEN"), "enable the /control API, which changes the concurrency and rate and pauses and resumes requests while running (see ocp ctl), for clients presenting this bearer token (default $OCP_CONTROL_TOKEN)")
+}
+
+// A priming job submitted to the API
+type job struct {
+	Id       int        `json:"id"`
+	Tenant   string     `json:"tenant,omitempty"` // that submitted it
+	Sitemap  string     `json:"sitemap,omitempty"`
+	Format   string     `json:"format,omitempty"`
+	Urls     []string   `json:"urls,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Total    int        `json:"total"`
+	Primed   int        `json:"primed"`
+	Failed   int        `json:"failed"`
+	Priority int        `json:"priority,omitempty"`    // jobs with a higher priority run first
+	Conc     int        `json:"concurrency,omitempty"` // URLs to prime at once, at most -c
+	Callback string     `json:"callback,omitempty"`    // to POST batches of results to
+	Batch    int        `json:"batch_size,omitempty"`  // results per batch, default -callback-batch
+	Failures []string   `json:"failures,omitempty"`    // the first maxJobFailures
+	Skipped  bool       `json:"skipped,omitempty"`     // as the sitemap hadn't changed
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Runs submitted jobs one at a time, those with the highest priority first
+type jobServer struct {
+	mu      sync.Mutex
+	jobs    map[int]*job
+	nextId  int
+	pending []*job          // queued jobs, the next to run first
+	added   chan struct{}   // signaled when a job is queued
+	primed  map[string]bool // the sitemaps of finished jobs
+	path    string          // the -queue-file, if any
+}
+
+// How many jobs may be queued
+const maxQueuedJobs = 100
+
+func newJobServer() *jobServer {
+	return &jobServer{
+		jobs:   make(map[int]*job),
+		added:  make(chan struct{}, 1),
+		primed: make(map[string]bool),
+	}
+}
+
+// How many failed URLs are kept with each job
+const maxJobFailures = 100
+
+// Returns a copy of j, with progress filled in if it is running
+func (s *jobServer) snapshot(j *job) job {
+	c := *j
+	if c.State == jobRunning {
+		c.Primed, c.Failed = counts()
+		c.Failures = failureList(maxJobFailures)
+	}
+	return c
+}
+
+func (s *jobServer) submit(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= maxQueuedJobs {
+		return fmt.Errorf("job queue is full")
+	}
+	s.nextId++
+	j.Id = s.nextId
+	j.State = jobQueued
+	j.Created = time.Now()
+	s.jobs[j.Id] = j
+	s.enqueue(j)
+	s.save()
+	return nil
+}
+
+// Adds j to the pending jobs, after those of the same or a higher priority.
+// s.mu must be held.
+func (s *jobServer) enqueue(j *job) {
+	i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i].Priority < j.Priority })
+	s.pending = append(s.pending, nil)
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = j
+	select {
+	case s.added <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for a job to be queued and returns the one to run next
+func (s *jobServer) next() *job {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			j := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			return j
+		}
+		s.mu.Unlock()
+		<-s.added
+	}
+}
+
+func (s *jobServer) work(ctx context.Context) {
+	for {
+		s.run(ctx, s.next())
+	}
+}
+
+func (s *jobServer) run(ctx context.Context, j *job) {
+	s.mu.Lock()
+	now := time.Now()
+	j.State = jobRunning
+	j.Started = &now
+	s.save()
+	var rate float64
+	if t := findTenant(j.Tenant); t != nil {
+		rate = t.Rate
+	}
+	s.mu.Unlock()
+	// On top of the limits set with -c, -rate and ocp ctl
+	ctl.setJobLimits(j.Conc, rate)
+	defer ctl.setJobLimits(0, 0)
+	resetRun()
+	resetSitemapChanges()
+	urlset, err := j.load(ctx)
+	s.mu.Lock()
+	skip := err == nil && skipUnchanged && len(j.Urls) == 0 && s.primed[j.Sitemap] && sitemapsUnmodified()
+	s.mu.Unlock()
+	var cb *callbacker
+	if err == nil && !skip {
+		s.mu.Lock()
+		j.Total = len(urlset.Url)
+		s.mu.Unlock()
+		if j.Callback != "" {
+			cb = newCallbacker(j)
+			onRecord(cb.add)
+		}
+		log.Printf("Job %d: priming %d URLs\n", j.Id, j.Total)
+		primeUrlset(ctx, urlset)
+		onRecord(nil)
+	} else if j.Callback != "" {
+		cb = newCallbacker(j)
+	}
+	if cb != nil {
+		// After the job is updated below
+		defer cb.finish(j)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.save()
+	defer s.prune()
+	now = time.Now()
+	j.Finished = &now
+	if err != nil {
+		j.State = jobFailed
+		j.Error = err.Error()
+		log.Printf("Job %d failed: %v\n", j.Id, err)
+		return
+	}
+	j.State = jobDone
+	if skip {
+		j.Skipped = true
+		log.Printf("Job %d skipped: %s has not changed since it was primed\n", j.Id, j.Sitemap)
+		return
+	}
+	if j.Sitemap != "" {
+		s.primed[j.Sitemap] = true
+	}
+	j.Primed, j.Failed = counts()
+	j.Failures = failureList(maxJobFailures)
+	log.Printf("Job %d done: %d primed, %d failed\n", j.Id, j.Primed, j.Failed)
+}
+
+func (j *job) load(ctx context.Context) (*Urlset, error) {
+	var srcs []Source
+	if j.Sitemap != "" {
+		src, err := URLSource(ctx, j.Sitemap, j.Format)
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	srcs = append(srcs, SliceSource(urlSlice(j.Urls)))
+	urlset, err := collect(MultiSource(srcs...))
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(urlset)
+	return urlset, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// Handles /jobs and /jobs/<id>
+func (s *jobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "jobs" && r.Method == "GET":
+		t := requestTenant(r)
+		s.mu.Lock()
+		list := make([]job, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			if t.sees(j) {
+				list = append(list, s.snapshot(j))
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(list, func(i, k int) bool { return list[i].Id < list[k].Id })
+		writeJSON(w, http.StatusOK, list)
+	case path == "jobs" && r.Method == "POST":
+		var j job
+		if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid job: "+err.Error())
+			return
+		}
+		if j.Sitemap == "" && len(j.Urls) == 0 {
+			writeError(w, http.StatusBadRequest, "a job needs a sitemap or urls")
+			return
+		}
+		if j.Sitemap != "" {
+			if err := checkRemote(j.Sitemap); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid sitemap: "+err.Error())
+				return
+			}
+		}
+		if err := requestTenant(r).claim(&j); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if j.Callback != "" {
+			if err := checkCallback(j.Callback); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if err := s.submit(&j); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		s.mu.Lock()
+		c := s.snapshot(&j)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusAccepted, c)
+	case strings.HasPrefix(path, "jobs/") && r.Method == "GET":
+		id, _ := strconv.Atoi(path[len("jobs/"):])
+		s.mu.Lock()
+		j, ok := s.jobs[id]
+		ok = ok && requestTenant(r).sees(j)
+		var c job
+		if ok {
+			c = s.snapshot(j)
+		}
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such job")
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Serves the job API:
+//
+//	POST /jobs      {"sitemap": "http://mysite.com/sitemap.xml"} or {"urls": [...]}
+//	GET  /jobs      lists all jobs
+//	GET  /jobs/<id> shows the state and progress of a job
+//
+// a dashboard of the jobs at /, and with -control-token, the control API at
+// /control. With -api-token, all but the control API require a token; with
+// -tls-cert, they are served over HTTPS. The tenants in the config only see
+// their own jobs, and those in the job and URL counts per tenant at /metrics.
+//
+// Jobs run one at a time, those with the highest "priority" first, each
+// priming at most "concurrency" URLs at once, or -c. A job with a "callback"
+// URL has its results POSTed to it in batches of "batch_size" (default
+// -callback-batch) as it runs, and a final batch when it finishes.
+func runServe(args []string) int {
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	remoteOnly = true
+	if primeWindow != "" {
+		sc, err := parseSchedule(primeWindow)
+		if err != nil {
+			fmt.Println("Error: -window:", err)
+			return 2
+		}
+		ctl.keepWindow(sc)
+	}
+	tlsConfig, err := serverTLS()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if throttle <= maxThrottle {
+		// So jobs and the control API can change the concurrency. Before
+		// any job starts, as this replaces sem.
+		ctl.resizable()
+	} else if controlToken != "" {
+		fmt.Printf("Error: -c must be at most %d with -control-token\n", maxThrottle)
+		return 2
+	} else {
+		for _, t := range cfg.Tenants {
+			if t.Concurrency > 0 {
+				fmt.Printf("Error: -c must be at most %d with the concurrency of tenant %s\n", maxThrottle, t.Name)
+				return 2
+			}
+		}
+	}
+	g, err := newAPIGuard()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	s := newJobServer()
+	if queuePath != "" {
+		if err := s.load(queuePath); err != nil {
+			fmt.Printf("Error reading %s: %v\n", queuePath, err)
+			return 2
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", g.wrap(s, true))
+	mux.Handle("/jobs/", g.wrap(s, true))
+	mux.Handle("/", g.wrap(http.HandlerFunc(s.dashboard), true))
+	mux.Handle("/prime", g.wrap(http.HandlerFunc(s.primeForm), true))
+	mux.Handle("/metrics", g.wrap(http.HandlerFunc(s.metrics), true))
+	if controlToken != "" {
+		// Which has a token of its own
+		mux.Handle("/control", g.wrap(ctl.handler(controlToken), false))
+	}
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		log.Println("Serving job API and dashboard over HTTPS on", listenAddr)
+	} else {
+		log.Println("Serving job API and dashboard on", listenAddr)
+	}
+	warnExposed(listenAddr)
+	go s.work(ctx)
+	daemonReady()
+	if err := http.Serve(l, mux); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
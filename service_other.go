@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// Daemon commands are only run as services on Windows; elsewhere they are
+// supervised by e.g. systemd
+func runService(run func() int) (code int, ok bool) {
+	return 0, false
+}
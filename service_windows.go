@@ -0,0 +1,110 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped        = 1
+	serviceStopPending    = 3
+	serviceRunning        = 4
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+	errorServiceSpecificError           = 1066
+)
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// The handle the status of the service is reported with
+var serviceHandle uintptr
+
+func setServiceStatus(state uint32, code int) {
+	s := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state}
+	if state == serviceRunning {
+		s.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	if code != 0 {
+		s.win32ExitCode = errorServiceSpecificError
+		s.serviceSpecificExitCode = uint32(code)
+	}
+	procSetServiceStatus.Call(serviceHandle, uintptr(unsafe.Pointer(&s)))
+}
+
+// Handles the requests of the service control manager. Daemon commands have
+// no state to save, so stopping the service exits the process.
+func serviceControl(ctl, eventType uint32, eventData, context uintptr) uintptr {
+	switch ctl {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStopPending, 0)
+		setServiceStatus(serviceStopped, 0)
+		os.Exit(0)
+	case serviceControlInterrogate:
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+// Runs run as a Windows service if ocp was started by the service control
+// manager, e.g. after sc create ocp binPath= "C:\ocp\ocp.exe serve", and
+// returns its exit code. ok is false if ocp was started from a console.
+func runService(run func() int) (code int, ok bool) {
+	name, _ := syscall.UTF16PtrFromString("ocp")
+	serviceMain := syscall.NewCallback(func(argc uint32, argv **uint16) uintptr {
+		h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceControl), 0)
+		if h == 0 {
+			log.Println("Error registering the service control handler:", err)
+			code = 1
+			return 0
+		}
+		serviceHandle = h
+		setServiceStatus(serviceRunning, 0)
+		code = run()
+		setServiceStatus(serviceStopped, code)
+		return 0
+	})
+	table := []serviceTableEntry{{name, serviceMain}, {nil, 0}}
+	r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		if err == syscall.Errno(errorFailedServiceControllerConnect) {
+			return 0, false
+		}
+		log.Println("Error starting the service:", err)
+		return 1, true
+	}
+	return code, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// The shard selected with -shard, e.g. 2 of 5, or 0 of 0 for all URLs
+var shardK, shardN int
+
+// Parses a -shard like 2/5
+func parseShard(s string) (k, n int, err error) {
+	i := strings.Index(s, "/")
+	if i > 0 {
+		k, err = strconv.Atoi(s[:i])
+		if err == nil {
+			n, err = strconv.Atoi(s[i+1:])
+		}
+	}
+	if i <= 0 || err != nil || n < 1 || k < 1 || k > n {
+		return 0, 0, fmt.Errorf("invalid -shard %q (expected e.g. 2/5)", s)
+	}
+	return k, n, nil
+}
+
+// Returns the shard, from 1 to n, that loc belongs to. Shards are assigned by
+// rendezvous hashing, so a URL's shard doesn't depend on the other URLs, and
+// adding a shard only moves the URLs that now belong to it.
+func shardOf(loc string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(loc))
+	sum := h.Sum64()
+	var (
+		best      = 1
+		bestScore uint64
+	)
+	for i := 1; i <= n; i++ {
+		if s := mix64(sum ^ mix64(uint64(i))); i == 1 || s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+// The splitmix64 finalizer, which spreads small differences in x over all of
+// its bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// Returns whether loc is in the -shard, if one is selected
+func inShard(loc string) bool {
+	return shardN == 0 || shardOf(loc, shardN) == shardK
+}
+
+// Removes the URLs of other shards from urlset
+func filterShard(urlset *Urlset) {
+	if shardN == 0 {
+		return
+	}
+	kept := urlset.Url[:0]
+	for _, u := range urlset.Url {
+		if inShard(u.Loc) {
+			kept = append(kept, u)
+		}
+	}
+	urlset.Url = kept
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Returned by openPath when a cached sitemap hasn't changed
+var errNotModified = errors.New("not modified")
+
+// A sitemap downloaded by a daemon, kept with the validators of the response
+// so that it is only downloaded and parsed again once it has changed
+type cachedSitemap struct {
+	etag, lastModified string
+	urlset             *Urlset // as parsed, before following a sitemapindex
+}
+
+var (
+	cacheSitemaps  bool // set for the daemon commands
+	sitemapCacheMu sync.Mutex
+	sitemapCache   = make(map[string]*cachedSitemap)
+	// The validators of sitemaps downloaded but not yet parsed
+	sitemapValidators = make(map[string]http.Header)
+	// Since the last resetSitemapChanges
+	sitemapsChanged, sitemapsUnchanged int64
+)
+
+// Returns a context whose request for the sitemap at loc is conditional on it
+// having changed since it was cached
+func conditional(ctx context.Context, loc string) context.Context {
+	if !cacheSitemaps {
+		return ctx
+	}
+	sitemapCacheMu.Lock()
+	defer sitemapCacheMu.Unlock()
+	c := sitemapCache[loc]
+	if c == nil {
+		return ctx
+	}
+	h := make(http.Header)
+	if c.etag != "" {
+		h.Set("If-None-Match", c.etag)
+	}
+	if c.lastModified != "" {
+		h.Set("If-Modified-Since", c.lastModified)
+	}
+	return withHeaders(ctx, h)
+}
+
+// Notes the validators of the response for the sitemap at loc, to be cached
+// with it once it has been parsed
+func noteValidators(loc string, res *http.Response) {
+	if !cacheSitemaps {
+		return
+	}
+	atomic.AddInt64(&sitemapsChanged, 1)
+	etag, lm := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	sitemapCacheMu.Lock()
+	if etag != "" || lm != "" {
+		sitemapValidators[loc] = http.Header{"Etag": {etag}, "Last-Modified": {lm}}
+	}
+	sitemapCacheMu.Unlock()
+}
+
+// Caches the parsed sitemap at loc, if it was downloaded with validators
+func storeSitemap(loc string, urlset *Urlset) {
+	if !cacheSitemaps {
+		return
+	}
+	sitemapCacheMu.Lock()
+	defer sitemapCacheMu.Unlock()
+	h, ok := sitemapValidators[loc]
+	if !ok {
+		return
+	}
+	delete(sitemapValidators, loc)
+	sitemapCache[loc] = &cachedSitemap{h.Get("Etag"), h.Get("Last-Modified"), copyUrlset(urlset)}
+}
+
+// Returns a copy of the cached sitemap at loc
+func cachedUrlset(loc string) (*Urlset, bool) {
+	sitemapCacheMu.Lock()
+	defer sitemapCacheMu.Unlock()
+	c := sitemapCache[loc]
+	if c == nil {
+		return nil, false
+	}
+	atomic.AddInt64(&sitemapsUnchanged, 1)
+	return copyUrlset(c.urlset), true
+}
+
+func copyUrlset(u *Urlset) *Urlset {
+	c := *u
+	c.Url = append([]Url(nil), u.Url...)
+	c.Sitemap = append([]Sitemap(nil), u.Sitemap...)
+	return &c
+}
+
+func resetSitemapChanges() {
+	atomic.StoreInt64(&sitemapsChanged, 0)
+	atomic.StoreInt64(&sitemapsUnchanged, 0)
+}
+
+// Returns whether every sitemap read since the last resetSitemapChanges was
+// cached and hadn't changed
+func sitemapsUnmodified() bool {
+	return atomic.LoadInt64(&sitemapsChanged) == 0 && atomic.LoadInt64(&sitemapsUnchanged) > 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The latency and status expected of the URLs matching a pattern, given in
+// the config. A URL is held to the first rule it matches.
+type slaRule struct {
+	Name       string `json:"name"`
+	Pattern    string `json:"pattern"`     // regular expression
+	MaxLatency string `json:"max_latency"` // e.g. 800ms
+	Status     int    `json:"status"`      // if not 0
+
+	re    *regexp.Regexp
+	limit time.Duration
+}
+
+// Compiles the patterns and latencies of the SLA rules in the config
+func compileSLARules(rules []slaRule) error {
+	for i := range rules {
+		s := &rules[i]
+		if s.Name == "" {
+			s.Name = s.Pattern
+		}
+		var err error
+		if s.re, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("sla %q: %v", s.Name, err)
+		}
+		if s.MaxLatency != "" {
+			if s.limit, err = time.ParseDuration(s.MaxLatency); err != nil {
+				return fmt.Errorf("sla %q: invalid max_latency: %v", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the index of the first rule matching loc, or -1
+func matchSLA(rules []slaRule, loc string) int {
+	for i, s := range rules {
+		if s.re.MatchString(loc) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns how r misses the expectations of the rule, or ""
+func (s slaRule) violation(r result) string {
+	switch {
+	case r.Err != nil:
+		return r.Err.Error()
+	case s.Status != 0 && r.Status != s.Status:
+		return fmt.Sprintf("status %d, expected %d", r.Status, s.Status)
+	case s.limit > 0 && r.Duration > s.limit:
+		return fmt.Sprintf("took %s, expected at most %s", r.Duration.Round(time.Millisecond), s.limit)
+	}
+	return ""
+}
+
+// Logs how many primes met each SLA rule, and each that didn't if -v is set,
+// and returns whether all of them did
+func reportSLA(rules []slaRule) bool {
+	type ruleStats struct {
+		n, missed int
+		ds        []time.Duration
+	}
+	stats := make([]ruleStats, len(rules))
+	resultsMu.Lock()
+	for _, r := range results {
+		i := matchSLA(rules, r.Url.Loc)
+		if i < 0 {
+			continue
+		}
+		stats[i].n++
+		if v := rules[i].violation(r); v != "" {
+			stats[i].missed++
+			if verbose {
+				log.Printf("SLA %s missed by %s: %s\n", rules[i].Name, r.Url.Loc, v)
+			}
+		}
+		if r.Err == nil {
+			stats[i].ds = append(stats[i].ds, r.Duration)
+		}
+	}
+	resultsMu.Unlock()
+	var b strings.Builder
+	b.WriteString("SLAs:\n")
+	met := true
+	for i, s := range rules {
+		st := stats[i]
+		sort.Slice(st.ds, func(i, j int) bool { return st.ds[i] < st.ds[j] })
+		if st.missed > 0 {
+			met = false
+		}
+		fmt.Fprintf(&b, "  %s: %d of %d primes missed, p50 %s, p95 %s\n", s.Name, st.missed, st.n,
+			percentile(st.ds, 50).Round(time.Millisecond), percentile(st.ds, 95).Round(time.Millisecond))
+	}
+	log.Print(b.String())
+	return met
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A Source produces the URLs to prime. Next returns io.EOF when there are no
+// more URLs.
+type Source interface {
+	Next() (Url, error)
+}
+
+// SliceSource returns a Source that yields urls in order.
+func SliceSource(urls []Url) Source {
+	return &sliceSource{urls: urls}
+}
+
+type sliceSource struct {
+	urls []Url
+	i    int
+}
+
+func (s *sliceSource) Next() (Url, error) {
+	if s.i >= len(s.urls) {
+		return Url{}, io.EOF
+	}
+	s.i++
+	return s.urls[s.i-1], nil
+}
+
+// SitemapSource returns a Source that yields the URLs in the XML sitemap at
+// path. If follow is true and the sitemap is a sitemapindex, the URLs of all
+// its child sitemaps are yielded.
+func SitemapSource(ctx context.Context, path string, follow bool) Source {
+	return &sitemapSource{ctx: ctx, path: path, follow: follow}
+}
+
+type sitemapSource struct {
+	ctx    context.Context
+	path   string
+	follow bool
+	urls   Source
+}
+
+func (s *sitemapSource) Next() (Url, error) {
+	if s.urls == nil {
+		urlset, err := getUrlsFromSitemap(s.ctx, s.path, s.follow)
+		if err == io.EOF {
+			// Don't let a sitemap without any XML look like the end of the URLs
+			err = fmt.Errorf("%s: not an XML sitemap", s.path)
+		}
+		if err != nil {
+			return Url{}, err
+		}
+		s.urls = SliceSource(urlset.Url)
+	}
+	return s.urls.Next()
+}
+
+// TextSource returns a Source that yields one URL per line of r. Blank lines
+// and lines beginning with # are ignored.
+func TextSource(r io.Reader) Source {
+	return &textSource{scanner: bufio.NewScanner(r)}
+}
+
+type textSource struct {
+	scanner *bufio.Scanner
+}
+
+func (s *textSource) Next() (Url, error) {
+	for s.scanner.Scan() {
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return urlSlice([]string{line})[0], nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return Url{}, err
+	}
+	return Url{}, io.EOF
+}
+
+// JSONSource returns a Source that yields the URLs in a JSON array read from
+// r. Elements may be strings or objects like
+// {"loc": "...", "priority": 0.5, "lastmod": "2012-01-01"}.
+func JSONSource(r io.Reader) Source {
+	return &jsonSource{dec: json.NewDecoder(r)}
+}
+
+type jsonSource struct {
+	dec     *json.Decoder
+	started bool
+}
+
+func (s *jsonSource) Next() (Url, error) {
+	if !s.started {
+		s.started = true
+		t, err := s.dec.Token()
+		if err != nil {
+			return Url{}, err
+		}
+		if d, ok := t.(json.Delim); !ok || d != '[' {
+			return Url{}, fmt.Errorf("expected a JSON array of URLs")
+		}
+	}
+	if !s.dec.More() {
+		return Url{}, io.EOF
+	}
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		return Url{}, err
+	}
+	var loc string
+	if err := json.Unmarshal(raw, &loc); err == nil {
+		return urlSlice([]string{loc})[0], nil
+	}
+	var v struct {
+		Loc      string  `json:"loc"`
+		Priority float64 `json:"priority"`
+		Lastmod  string  `json:"lastmod"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return Url{}, err
+	}
+	u := urlSlice([]string{v.Loc})[0]
+	u.Priority = v.Priority
+	u.Lastmod = v.Lastmod
+	return u, nil
+}
+
+// A Source that closes its underlying reader when exhausted
+type closingSource struct {
+	Source
+	c io.Closer
+}
+
+func (s *closingSource) Next() (Url, error) {
+	u, err := s.Source.Next()
+	if err != nil && s.c != nil {
+		if cerr := s.c.Close(); cerr != nil && err == io.EOF {
+			err = cerr
+		}
+		s.c = nil
+	}
+	return u, err
+}
+
+// Returns the command that runs command with the shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// ExecSource returns a Source that runs command with the shell and yields the
+// URLs it writes to stdout, one per line, or as a JSON array if format is
+// json. The command's stderr is passed through.
+func ExecSource(command, format string) Source {
+	return &execSource{command: command, format: format}
+}
+
+type execSource struct {
+	command string
+	format  string
+	cmd     *exec.Cmd
+	urls    Source
+}
+
+func (s *execSource) Next() (Url, error) {
+	if s.cmd == nil {
+		s.cmd = shellCommand(s.command)
+		s.cmd.Stderr = os.Stderr
+		out, err := s.cmd.StdoutPipe()
+		if err != nil {
+			return Url{}, err
+		}
+		if err = s.cmd.Start(); err != nil {
+			return Url{}, fmt.Errorf("running %q: %v", s.command, err)
+		}
+		if s.format == "json" {
+			s.urls = JSONSource(out)
+		} else {
+			s.urls = TextSource(out)
+		}
+	}
+	u, err := s.urls.Next()
+	if err == io.EOF {
+		if werr := s.cmd.Wait(); werr != nil {
+			return Url{}, fmt.Errorf("running %q: %v", s.command, werr)
+		}
+	} else if err != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+	return u, err
+}
+
+// URLSource is like FileSource, but only reads from HTTP(S) URLs, for
+// sitemaps given by clients of the serve command.
+func URLSource(ctx context.Context, loc, format string) (Source, error) {
+	if err := checkRemote(loc); err != nil {
+		return nil, err
+	}
+	return FileSource(ctx, loc, format)
+}
+
+// Returns an error unless loc is an HTTP(S) URL
+func checkRemote(loc string) error {
+	u, err := url.Parse(loc)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", loc)
+	}
+	return nil
+}
+
+// FileSource returns a Source that reads URLs from the file, stdin (-) or
+// HTTP(S) URL at p. format is one of xml, text, json, csv, openapi or accesslog;
+// if empty, it is guessed from the file name.
+func FileSource(ctx context.Context, p, format string) (Source, error) {
+	if format == "" {
+		name := p
+		if encodingFromName(p) != "" {
+			name = strings.TrimSuffix(p, path.Ext(p))
+		}
+		switch path.Ext(name) {
+		case ".json":
+			format = "json"
+		case ".txt":
+			format = "text"
+		case ".csv":
+			format = "csv"
+		case ".log":
+			format = "accesslog"
+		default:
+			format = "xml"
+		}
+	}
+	switch format {
+	case "xml":
+		return SitemapSource(ctx, p, true), nil
+	case "text", "json", "csv", "openapi", "accesslog":
+		f, err := openPath(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		switch format {
+		case "json":
+			return &closingSource{JSONSource(f), f}, nil
+		case "csv":
+			return &closingSource{CSVSource(f), f}, nil
+		case "openapi":
+			return &closingSource{OpenAPISource(f, p), f}, nil
+		case "accesslog":
+			return &closingSource{AccessLogSource(f, logBase, int(logTop), logSince), f}, nil
+		}
+		return &closingSource{TextSource(f), f}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (expected xml, text, json, csv, openapi or accesslog)", format)
+}
+
+// Reads every URL from src into a Urlset
+func collect(src Source) (*Urlset, error) {
+	urlset := &Urlset{}
+	for {
+		u, err := src.Next()
+		if err == io.EOF {
+			return urlset, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		urlset.Url = append(urlset.Url, u)
+	}
+}
+
+// MultiSource returns a Source that yields the URLs of each of srcs in turn.
+func MultiSource(srcs ...Source) Source {
+	return &multiSource{srcs: srcs}
+}
+
+type multiSource struct {
+	srcs []Source
+}
+
+func (s *multiSource) Next() (Url, error) {
+	for len(s.srcs) > 0 {
+		u, err := s.srcs[0].Next()
+		if err != io.EOF {
+			return u, err
+		}
+		s.srcs = s.srcs[1:]
+	}
+	return Url{}, io.EOF
+}
+
+// ExpandSource returns a Source that yields every URL matching pattern, in
+// which {1..10} denotes a numeric range (zero-padded if the bounds are, e.g.
+// {01..10}) and {a,b,c} a list of alternatives.
+func ExpandSource(pattern string) Source {
+	return &expandSource{pattern: pattern}
+}
+
+type expandSource struct {
+	pattern string
+	urls    Source
+}
+
+func (s *expandSource) Next() (Url, error) {
+	if s.urls == nil {
+		locs, err := expand(s.pattern)
+		if err != nil {
+			return Url{}, err
+		}
+		s.urls = SliceSource(urlSlice(locs))
+	}
+	return s.urls.Next()
+}
+
+// Returns every expansion of the first {...} group in pattern, recursively
+func expand(pattern string) ([]string, error) {
+	i := strings.Index(pattern, "{")
+	if i < 0 {
+		return []string{pattern}, nil
+	}
+	j := strings.Index(pattern[i:], "}")
+	if j < 0 {
+		return nil, fmt.Errorf("unterminated { in %q", pattern)
+	}
+	j += i
+	alts, err := expandGroup(pattern[i+1 : j])
+	if err != nil {
+		return nil, fmt.Errorf("%v in %q", err, pattern)
+	}
+	rest, err := expand(pattern[j+1:])
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(alts)*len(rest))
+	for _, a := range alts {
+		for _, r := range rest {
+			res = append(res, pattern[:i]+a+r)
+		}
+	}
+	return res, nil
+}
+
+// Expands the contents of a single {...} group
+func expandGroup(g string) ([]string, error) {
+	if k := strings.Index(g, ".."); k >= 0 {
+		lo, hi := g[:k], g[k+2:]
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range start %q", lo)
+		}
+		to, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range end %q", hi)
+		}
+		width := 0
+		if (len(lo) > 1 && lo[0] == '0') || (len(hi) > 1 && hi[0] == '0') {
+			width = len(lo)
+			if len(hi) > width {
+				width = len(hi)
+			}
+		}
+		step := 1
+		if to < from {
+			step = -1
+		}
+		var res []string
+		for n := from; ; n += step {
+			res = append(res, fmt.Sprintf("%0*d", width, n))
+			if n == to {
+				break
+			}
+		}
+		return res, nil
+	}
+	return strings.Split(g, ","), nil
+}
+
+// A Source whose URLs are loaded by load on the first call to Next
+type lazySource struct {
+	load func() ([]Url, error)
+	urls Source
+}
+
+func (s *lazySource) Next() (Url, error) {
+	if s.urls == nil {
+		urls, err := s.load()
+		if err != nil {
+			return Url{}, err
+		}
+		s.urls = SliceSource(urls)
+	}
+	return s.urls.Next()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A URL whose responses can't be cached
+type uncacheableUrl struct {
+	Reason  string    `json:"reason"` // e.g. "Cache-Control: private"
+	Found   time.Time `json:"found"`
+	Checked time.Time `json:"checked"`
+}
+
+// What is learned about the URLs between runs, kept in the -state file
+type runState struct {
+	mu          sync.Mutex
+	Uncacheable map[string]uncacheableUrl `json:"uncacheable"`
+}
+
+// The state loaded from -state
+var state *runState
+
+// Reads the state saved at path. A missing file gives an empty state.
+func loadState(path string) (*runState, error) {
+	s := &runState{Uncacheable: make(map[string]uncacheableUrl)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Uncacheable == nil {
+		s.Uncacheable = make(map[string]uncacheableUrl)
+	}
+	return s, nil
+}
+
+func (s *runState) save(path string) error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// Writes data to path by renaming a temporary file over it, so that it is
+// never left half written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Returns why responses with the headers h can't be stored by a shared
+// cache, or ""
+func uncacheableReason(h http.Header) string {
+	for _, d := range strings.Split(strings.ToLower(h.Get("Cache-Control")), ",") {
+		if d = strings.TrimSpace(d); d == "private" || d == "no-store" {
+			return "Cache-Control: " + d
+		}
+	}
+	return ""
+}
+
+// The number of URLs skipped with -skip-uncacheable
+var uncacheableSkipped int64
+
+// Returns whether loc is known to be uncacheable and was checked less than
+// -recheck-uncacheable ago
+func knownUncacheable(loc string) bool {
+	state.mu.Lock()
+	e, ok := state.Uncacheable[loc]
+	state.mu.Unlock()
+	if !ok || time.Since(e.Checked) >= recheckUncacheable {
+		return false
+	}
+	atomic.AddInt64(&uncacheableSkipped, 1)
+	if verbose {
+		log.Printf("Skipping uncacheable (%s) %s\n", e.Reason, loc)
+	}
+	return true
+}
+
+// Remembers whether the response to u could be cached, reporting URLs the
+// first time they are found not to be
+func learnUncacheable(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if res.StatusCode >= 300 {
+		return
+	}
+	reason := uncacheableReason(res.Header)
+	now := time.Now()
+	state.mu.Lock()
+	e, known := state.Uncacheable[u.Loc]
+	switch {
+	case reason != "":
+		if !known {
+			e.Found = now
+		}
+		e.Reason, e.Checked = reason, now
+		state.Uncacheable[u.Loc] = e
+	case known:
+		delete(state.Uncacheable, u.Loc)
+	}
+	state.mu.Unlock()
+	switch {
+	case reason != "" && !known && !nowarn:
+		log.Printf("Not cacheable (%s): %s\n", reason, u.Loc)
+	case reason == "" && known && verbose:
+		log.Printf("Now cacheable: %s\n", u.Loc)
+	}
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The outcome of a single prime request
+type result struct {
+	Url         Url
+	Status      int
+	FirstStatus int // if redirected, of the first response
+	Duration    time.Duration
+	Size        int64 // of the body
+	Err         error
+	RequestID   string            // sent with -request-id-header
+	UserAgent   string            // sent from -ua-file
+	Attempts    int               // with -retries, including the first
+	Headers     map[string]string // captured with -capture-header
+
+	Addr         string // of the server that answered
+	Reused       bool   // an idle connection was reused for the request
+	TLSHandshake bool   // a TLS handshake was made for the request
+	TLSResumed   bool   // and it resumed a previous session
+	Phases       phases
+}
+
+// Returns whether the prime failed with an error or an HTTP error status
+func (r result) failed() bool {
+	return r.Err != nil || r.Status >= 400
+}
+
+// Returns whether the prime succeeded but took longer than -slow-threshold
+func (r result) slow() bool {
+	return slowThreshold > 0 && !r.failed() && r.Duration > slowThreshold
+}
+
+// Returns "warn" if the prime was slow, or "" (failures have an error or
+// status instead)
+func (r result) severity() string {
+	if r.slow() {
+		return "warn"
+	}
+	return ""
+}
+
+var (
+	resultsMu sync.Mutex
+	results   []result
+	recorded  func(r result) // if set, called with each result
+)
+
+// Sets the function called with each result as it is recorded, or unsets it
+// if f is nil
+func onRecord(f func(r result)) {
+	resultsMu.Lock()
+	recorded = f
+	resultsMu.Unlock()
+}
+
+func record(r result) {
+	resultsMu.Lock()
+	results = append(results, r)
+	f := recorded
+	resultsMu.Unlock()
+	if f != nil {
+		f(r)
+	}
+	if emitting() {
+		e := urlDoneEvent{
+			eventHeader: newEvent("url_done"),
+			Url:         r.Url.Loc,
+			Device:      r.Url.device,
+			RequestID:   r.RequestID,
+			Status:      r.Status,
+			Duration:    millis(r.Duration),
+			Size:        r.Size,
+			Severity:    r.severity(),
+			Attempts:    r.Attempts,
+		}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+		emit(e)
+	}
+}
+
+// Returns the sorted durations of all primes that received a response
+func durations() []time.Duration {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	ds := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		if r.Err == nil {
+			ds = append(ds, r.Duration)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds
+}
+
+// Stands for the duration of a prime that failed without a response
+const failedDuration = time.Duration(math.MaxInt64)
+
+// Returns the sorted durations of all primes, with failedDuration for those
+// that failed without a response, so they count against SLOs
+func sloDurations() []time.Duration {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	ds := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			ds = append(ds, failedDuration)
+		} else {
+			ds = append(ds, r.Duration)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds
+}
+
+// Returns the p-th percentile (0-100) of the sorted durations ds
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(ds)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ds[i]
+}
+
+// A latency objective like p95<800ms
+type slo struct {
+	expr      string
+	p         float64
+	limit     time.Duration
+	inclusive bool
+}
+
+func parseSlos(s string) ([]slo, error) {
+	var slos []slo
+	for _, expr := range strings.Split(s, ",") {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		o := slo{expr: expr}
+		i := strings.Index(expr, "<")
+		if i < 0 || !strings.HasPrefix(expr, "p") {
+			return nil, fmt.Errorf("invalid SLO %q (expected e.g. p95<800ms)", expr)
+		}
+		p, err := strconv.ParseFloat(expr[1:i], 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile in SLO %q", expr)
+		}
+		o.p = p
+		rest := expr[i+1:]
+		if strings.HasPrefix(rest, "=") {
+			o.inclusive = true
+			rest = rest[1:]
+		}
+		o.limit, err = time.ParseDuration(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in SLO %q: %v", expr, err)
+		}
+		slos = append(slos, o)
+	}
+	return slos, nil
+}
+
+// Returns the observed value and whether the objective was met by ds, from
+// sloDurations. It isn't without any primes.
+func (o slo) check(ds []time.Duration) (string, bool) {
+	if len(ds) == 0 {
+		return "no primes", false
+	}
+	v := percentile(ds, o.p)
+	if v == failedDuration {
+		return "failed primes", false
+	}
+	if o.inclusive {
+		return v.String(), v <= o.limit
+	}
+	return v.String(), v < o.limit
+}
+
+// Returns the number of primes so far and how many of them failed
+func counts() (n, failed int) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	for _, r := range results {
+		if r.failed() {
+			failed++
+		}
+	}
+	return len(results), failed
+}
+
+// Returns the number of primes that were slow
+func slowCount() (slow int) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	for _, r := range results {
+		if r.slow() {
+			slow++
+		}
+	}
+	return slow
+}
+
+// Logs how many primes were slow, and on which hosts
+func reportSlow() {
+	hosts := make(map[string]int)
+	resultsMu.Lock()
+	for _, r := range results {
+		if r.slow() {
+			hosts[r.Url.Host()]++
+		}
+	}
+	resultsMu.Unlock()
+	if len(hosts) == 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "WARN: primes slower than %s by host:\n", slowThreshold)
+	for _, h := range byCount(hosts) {
+		fmt.Fprintf(&b, "  %7d  %s\n", hosts[h], h)
+	}
+	log.Print(b.String())
+}
+
+// Returns the kind of failure of r, e.g. "HTTP 404", "DNS" or "read timeout",
+// or "" if it succeeded
+func failureClass(r result) string {
+	if r.Err == nil {
+		if r.Status >= 400 {
+			return fmt.Sprint("HTTP ", r.Status)
+		}
+		return ""
+	}
+	var (
+		dnsErr  *net.DNSError
+		opErr   *net.OpError
+		certErr x509.UnknownAuthorityError
+		hostErr x509.HostnameError
+		invErr  x509.CertificateInvalidError
+		recErr  tls.RecordHeaderError
+		redErr  *redirectError
+	)
+	switch {
+	case errors.As(r.Err, &redErr):
+		if redErr.loop {
+			return "redirect loop"
+		}
+		return "too many redirects"
+	case errors.As(r.Err, &dnsErr):
+		return "DNS"
+	case errors.As(r.Err, &certErr), errors.As(r.Err, &hostErr), errors.As(r.Err, &invErr),
+		errors.As(r.Err, &recErr), strings.Contains(r.Err.Error(), "tls: "):
+		return "TLS"
+	case errors.As(r.Err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return "connect timeout"
+		}
+		return "connect"
+	case requestTimeout > 0 && strings.Contains(r.Err.Error(), "Client.Timeout"):
+		return "request timeout"
+	case isTimeout(r.Err):
+		return "read timeout"
+	}
+	return "other error"
+}
+
+// Logs the number of failed primes per kind of failure and per host
+func reportFailures() {
+	classes := make(map[string]int)
+	hosts := make(map[string]int)
+	resultsMu.Lock()
+	for _, r := range results {
+		if c := failureClass(r); c != "" {
+			classes[c]++
+			hosts[r.Url.Host()]++
+		}
+	}
+	resultsMu.Unlock()
+	if len(classes) == 0 {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("Failures by kind:\n")
+	for _, c := range byCount(classes) {
+		fmt.Fprintf(&b, "  %7d  %s\n", classes[c], c)
+	}
+	b.WriteString("Failures by host:\n")
+	for _, h := range byCount(hosts) {
+		fmt.Fprintf(&b, "  %7d  %s\n", hosts[h], h)
+	}
+	log.Print(b.String())
+}
+
+// Returns the n slowest primes that received a response, slowest first
+func slowest(n int) []result {
+	resultsMu.Lock()
+	rs := make([]result, 0, len(results))
+	for _, r := range results {
+		if r.Err == nil {
+			rs = append(rs, r)
+		}
+	}
+	resultsMu.Unlock()
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].Duration > rs[j].Duration })
+	if len(rs) > n {
+		rs = rs[:n]
+	}
+	return rs
+}
+
+// Writes the results as CSV with a header row, a request_id column if
+// -request-id-header is set, a user_agent column if -ua-file is set and a
+// column per -capture-header
+func writeResultsCSV(w io.Writer, rs []result) error {
+	cw := csv.NewWriter(w)
+	header := []string{"url", "status", "duration_ms", "size"}
+	for _, p := range phaseNames {
+		header = append(header, p+"_ms")
+	}
+	if requestIDHeader != "" {
+		header = append(header, "request_id")
+	}
+	if len(userAgents) > 0 {
+		header = append(header, "user_agent")
+	}
+	header = append(header, captureHeaders...)
+	cw.Write(header)
+	for _, r := range rs {
+		row := []string{
+			r.Url.Loc,
+			strconv.Itoa(r.Status),
+			strconv.FormatFloat(millis(r.Duration), 'f', 1, 64),
+			strconv.FormatInt(r.Size, 10),
+		}
+		for _, d := range r.Phases.list() {
+			row = append(row, strconv.FormatFloat(millis(d), 'f', 1, 64))
+		}
+		if requestIDHeader != "" {
+			row = append(row, r.RequestID)
+		}
+		if len(userAgents) > 0 {
+			row = append(row, r.UserAgent)
+		}
+		for _, h := range captureHeaders {
+			row = append(row, r.Headers[h])
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Logs the n slowest primes and, if path is set, writes them to it as CSV
+func reportSlowest(n int, path string) {
+	rs := slowest(n)
+	if len(rs) == 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Slowest %d URLs:\n", len(rs))
+	for _, r := range rs {
+		fmt.Fprintf(&b, "  %8s  %8d B  %d  %s\n", r.Duration.Round(time.Millisecond), r.Size, r.Status, r.Url.Loc)
+	}
+	log.Print(b.String())
+	if path != "" {
+		f, err := os.Create(path)
+		if err == nil {
+			err = writeResultsCSV(f, rs)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Printf("Error writing %s: %v\n", path, err)
+		}
+	}
+}
+
+// Returns the -capture-header values of h
+func captureHeaderValues(h http.Header) map[string]string {
+	m := make(map[string]string, len(captureHeaders))
+	for _, k := range captureHeaders {
+		if v := h.Values(k); len(v) > 0 {
+			m[k] = strings.Join(v, ", ")
+		}
+	}
+	return m
+}
+
+// A result as written to the -results-file
+type resultRecord struct {
+	Url       string            `json:"url"`
+	Status    int               `json:"status,omitempty"`
+	Duration  float64           `json:"duration_ms"`
+	Size      int64             `json:"size"`
+	Error     string            `json:"error,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Refresh   string            `json:"meta_refresh,omitempty"` // the URL redirected to
+	Severity  string            `json:"severity,omitempty"`     // warn if slow
+	Attempts  int               `json:"attempts,omitempty"`     // with -retries
+	TimedOut  bool              `json:"timed_out,omitempty"`
+}
+
+func (r result) record() resultRecord {
+	rec := resultRecord{
+		Url:       r.Url.Loc,
+		Status:    r.Status,
+		Duration:  millis(r.Duration),
+		Size:      r.Size,
+		RequestID: r.RequestID,
+		UserAgent: r.UserAgent,
+		Headers:   r.Headers,
+		Severity:  r.severity(),
+		Attempts:  r.Attempts,
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+		rec.TimedOut = isTimeout(r.Err)
+	}
+	return rec
+}
+
+// Writes every result to path as JSON lines
+func writeResultsFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	refreshesMu.Lock()
+	defer refreshesMu.Unlock()
+	resultsMu.Lock()
+	for _, r := range results {
+		rec := r.record()
+		rec.Refresh = refreshes[r.Url.Loc]
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+	resultsMu.Unlock()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Writes the URLs of the failed primes to path, one per line
+func writeFailures(path string) error {
+	var b bytes.Buffer
+	seen := make(map[string]bool)
+	resultsMu.Lock()
+	for _, r := range results {
+		if r.failed() && !seen[r.Url.Loc] {
+			seen[r.Url.Loc] = true
+			b.WriteString(r.Url.Loc + "\n")
+		}
+	}
+	resultsMu.Unlock()
+	return writeFileAtomic(path, b.Bytes(), 0644)
+}
+
+// Returns up to limit failed URLs, each followed by the kind of failure, e.g.
+// "http://mysite.com/a (HTTP 404)"
+func failureList(limit int) []string {
+	var list []string
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	for _, r := range results {
+		if len(list) == limit {
+			break
+		}
+		if c := failureClass(r); c != "" {
+			list = append(list, fmt.Sprintf("%s (%s)", r.Url.Loc, c))
+		}
+	}
+	return list
+}
+
+// The primes of a group of results, e.g. those for a host
+type groupStats struct {
+	name           string
+	primes, failed int
+	bytes          int64
+	durations      []time.Duration // sorted, of the primes that got a response
+}
+
+// Groups the results by key, skipping those whose key is "", and returns the
+// stats of each group ordered by name
+func groupResults(key func(r result) string) []*groupStats {
+	groups := make(map[string]*groupStats)
+	resultsMu.Lock()
+	for _, r := range results {
+		k := key(r)
+		if k == "" {
+			continue
+		}
+		g := groups[k]
+		if g == nil {
+			g = &groupStats{name: k}
+			groups[k] = g
+		}
+		g.primes++
+		g.bytes += r.Size
+		if r.failed() {
+			g.failed++
+		}
+		if r.Err == nil {
+			g.durations = append(g.durations, r.Duration)
+		}
+	}
+	resultsMu.Unlock()
+	gs := make([]*groupStats, 0, len(groups))
+	for _, g := range groups {
+		sort.Slice(g.durations, func(i, j int) bool { return g.durations[i] < g.durations[j] })
+		gs = append(gs, g)
+	}
+	sort.Slice(gs, func(i, j int) bool { return gs[i].name < gs[j].name })
+	return gs
+}
+
+// Writes the stats of the groups as a table headed by title, with their
+// names in the column named column
+func writeGroupStats(w io.Writer, title, column string, gs []*groupStats) {
+	fmt.Fprintf(w, "%s:\n", title)
+	fmt.Fprintf(w, "  %7s  %7s  %6s  %8s  %8s  %10s  %s\n", "primes", "failed", "errors", "p50", "p95", "bytes", column)
+	for _, g := range gs {
+		fmt.Fprintf(w, "  %7d  %7d  %5.1f%%  %8s  %8s  %10d  %s\n", g.primes, g.failed,
+			100*float64(g.failed)/float64(g.primes),
+			percentile(g.durations, 50).Round(time.Millisecond),
+			percentile(g.durations, 95).Round(time.Millisecond), g.bytes, g.name)
+	}
+}
+
+// Logs the total and average size of the responses
+func reportSizes() {
+	var n, total int64
+	resultsMu.Lock()
+	for _, r := range results {
+		if r.Err == nil {
+			n++
+			total += r.Size
+		}
+	}
+	resultsMu.Unlock()
+	if n > 0 {
+		log.Printf("Uncompressed size of %d responses: %d bytes (%d on average)\n", n, total, total/n)
+	}
+}
+
+// Logs the number of primes, error rate, latency percentiles and bytes
+// downloaded per host
+func reportHostStats() {
+	gs := groupResults(func(r result) string { return r.Url.Host() })
+	if len(gs) == 0 {
+		return
+	}
+	var b strings.Builder
+	writeGroupStats(&b, "Primes by host", "host", gs)
+	log.Print(b.String())
+}
+
+// Logs the stats of each child sitemap of a sitemapindex, those with the most
+// failures first
+func reportSitemapStats() {
+	gs := groupResults(func(r result) string { return r.Url.sitemap })
+	if len(gs) == 0 {
+		return
+	}
+	sort.SliceStable(gs, func(i, j int) bool { return gs[i].failed > gs[j].failed })
+	var b strings.Builder
+	writeGroupStats(&b, "Primes by child sitemap", "sitemap", gs)
+	log.Print(b.String())
+}
+
+// The progress of priming the URLs of a child sitemap
+type childCounts struct {
+	pending, failed int
+}
+
+var (
+	childMu       sync.Mutex
+	childProgress = make(map[string]*childCounts)
+)
+
+// Starts tracking the progress of priming the n URLs of the child sitemap loc
+func trackChild(loc string, n int) {
+	childMu.Lock()
+	childProgress[loc] = &childCounts{pending: n}
+	childMu.Unlock()
+}
+
+// Counts u as primed, logging when all the URLs of its child sitemap have
+// been if -v is set
+func childPrimed(u Url, failed bool) {
+	if u.sitemap == "" || u.depth > 0 {
+		return
+	}
+	childMu.Lock()
+	defer childMu.Unlock()
+	c := childProgress[u.sitemap]
+	if c == nil {
+		return
+	}
+	c.pending--
+	if failed {
+		c.failed++
+	}
+	if c.pending == 0 {
+		delete(childProgress, u.sitemap)
+		if verbose {
+			log.Printf("Finished child sitemap %s (%d failed)\n", u.sitemap, c.failed)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var statsSections uint
+
+func statsFlags(fs *flag.FlagSet) {
+	fs.UintVar(&statsSections, "sections", 20, "number of the largest sections (first path segments) to list")
+}
+
+// The lastmod age buckets of a summary
+var ageBuckets = []struct {
+	name string
+	max  time.Duration
+}{
+	{"< 1 day", 24 * time.Hour},
+	{"< 1 week", 7 * 24 * time.Hour},
+	{"< 1 month", 30 * 24 * time.Hour},
+	{"< 1 year", 365 * 24 * time.Hour},
+	{">= 1 year", 1<<63 - 1},
+}
+
+// A summary of the contents of a sitemap
+type urlsetSummary struct {
+	Total      int
+	Hosts      map[string]int
+	Sections   map[string]int
+	Priorities [11]int // by priority rounded to one decimal
+	Ages       []int   // by ageBuckets, then missing or invalid lastmod
+	Duplicates map[string]int
+}
+
+// Returns the host and first path segment of u, e.g. example.com/blog
+func section(u *url.URL) string {
+	return u.Host + "/" + strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+}
+
+// Summarizes urlset, with lastmod ages relative to now
+func summarizeUrlset(urlset *Urlset, now time.Time) *urlsetSummary {
+	s := &urlsetSummary{
+		Total:      len(urlset.Url),
+		Hosts:      make(map[string]int),
+		Sections:   make(map[string]int),
+		Ages:       make([]int, len(ageBuckets)+1),
+		Duplicates: make(map[string]int),
+	}
+	locs := make(map[string]int, len(urlset.Url))
+	for _, u := range urlset.Url {
+		if locs[u.Loc]++; locs[u.Loc] > 1 {
+			s.Duplicates[u.Loc] = locs[u.Loc]
+		}
+		if parsed, err := url.Parse(u.Loc); err == nil {
+			s.Hosts[parsed.Host]++
+			s.Sections[section(parsed)]++
+		}
+		if p := int(u.Priority*10 + 0.5); p >= 0 && p <= 10 {
+			s.Priorities[p]++
+		}
+		bucket := len(ageBuckets)
+		if t, err := parseLastmod(u.Lastmod); err == nil {
+			age := now.Sub(t)
+			for i, b := range ageBuckets {
+				if age < b.max {
+					bucket = i
+					break
+				}
+			}
+		}
+		s.Ages[bucket]++
+	}
+	return s
+}
+
+// Returns the keys of counts ordered by descending count
+func byCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// Writes the summary to w, listing at most sections sections
+func (s *urlsetSummary) write(w io.Writer, sections int) {
+	fmt.Fprintf(w, "URLs: %d (%d duplicated)\n", s.Total, len(s.Duplicates))
+	fmt.Fprintln(w, "\nHosts:")
+	for _, h := range byCount(s.Hosts) {
+		fmt.Fprintf(w, "  %7d  %s\n", s.Hosts[h], h)
+	}
+	fmt.Fprintln(w, "\nSections:")
+	keys := byCount(s.Sections)
+	if len(keys) > sections {
+		keys = keys[:sections]
+	}
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %7d  %s\n", s.Sections[k], k)
+	}
+	if len(s.Sections) > len(keys) {
+		fmt.Fprintf(w, "  (%d more)\n", len(s.Sections)-len(keys))
+	}
+	fmt.Fprintln(w, "\nPriority:")
+	for i, n := range s.Priorities {
+		if n > 0 {
+			fmt.Fprintf(w, "  %7d  %.1f\n", n, float64(i)/10)
+		}
+	}
+	fmt.Fprintln(w, "\nLastmod age:")
+	for i, b := range ageBuckets {
+		fmt.Fprintf(w, "  %7d  %s\n", s.Ages[i], b.name)
+	}
+	fmt.Fprintf(w, "  %7d  missing or invalid\n", s.Ages[len(ageBuckets)])
+	if len(s.Duplicates) > 0 {
+		fmt.Fprintln(w, "\nDuplicates:")
+		for _, k := range byCount(s.Duplicates) {
+			fmt.Fprintf(w, "  %7d  %s\n", s.Duplicates[k], k)
+		}
+	}
+}
+
+func runStats(args []string) int {
+	if !haveInput(args) {
+		fmt.Println("Error: no sitemap or URLs given")
+		return 2
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	urlset, ok := loadUrlset(ctx, args)
+	if !ok {
+		return 1
+	}
+	summarizeUrlset(urlset, time.Now()).write(os.Stdout, int(statsSections))
+	return 0
+}
@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// Writes log messages to syslog, those about errors with the err severity
+// and the rest with info
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	var err error
+	if strings.HasPrefix(msg, "Error") || strings.HasPrefix(msg, "Could not") {
+		err = s.w.Err(msg)
+	} else {
+		err = s.w.Info(msg)
+	}
+	return len(p), err
+}
+
+// Returns a writer that sends log messages to the local syslog daemon, or the
+// journal on systemd systems
+func openSyslog(facility, tag string) (io.Writer, error) {
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q (expected e.g. daemon, user or local0)", facility)
+	}
+	w, err := syslog.New(f|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w}, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sends state, e.g. "READY=1", to systemd if it started ocp with
+// Type=notify. It does nothing otherwise.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // an abstract socket
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// Returns how often systemd expects a watchdog ping with WatchdogSec, or 0
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Tells systemd that a daemon command has started, and pings its watchdog
+// for as long as the process is running
+func daemonReady() {
+	if err := sdNotify("READY=1"); err != nil && !nowarn {
+		log.Println("Error notifying systemd:", err)
+	}
+	if d := watchdogInterval(); d > 0 {
+		go func() {
+			for range time.Tick(d / 2) {
+				if err := sdNotify("WATCHDOG=1"); err != nil && !nowarn {
+					log.Println("Error pinging the systemd watchdog:", err)
+				}
+			}
+		}()
+	}
+}
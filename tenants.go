@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A team sharing the serve command, which sees and submits its own jobs with
+// its token, within its budget
+type tenant struct {
+	Name        string  `json:"name"`
+	Token       string  `json:"token"`
+	Concurrency int     `json:"concurrency"`  // URLs its jobs prime at once, at most -c
+	Rate        float64 `json:"rate"`         // requests per second its jobs send, within -rate
+	APIRate     float64 `json:"api_rate"`     // API requests per second, default -client-rate
+	MaxPriority int     `json:"max_priority"` // highest priority its jobs may ask for, within -max-priority
+}
+
+func compileTenants(ts []tenant) error {
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, t := range ts {
+		switch {
+		case t.Name == "":
+			return fmt.Errorf("tenant without a name")
+		case names[t.Name]:
+			return fmt.Errorf("tenant %q is listed twice", t.Name)
+		case t.Token == "":
+			return fmt.Errorf("tenant %q has no token", t.Name)
+		case tokens[t.Token]:
+			return fmt.Errorf("tenant %q has the token of another", t.Name)
+		case t.Concurrency < 0 || t.Rate < 0 || t.APIRate < 0 || t.MaxPriority < 0:
+			return fmt.Errorf("tenant %q has a negative budget", t.Name)
+		}
+		names[t.Name], tokens[t.Token] = true, true
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// Returns the tenant that made r, or nil if it was made with an -api-token or
+// without authentication
+func requestTenant(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantKey{}).(*tenant)
+	return t
+}
+
+func withTenant(r *http.Request, t *tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, t))
+}
+
+// Returns the name of t, or "" for nil
+func (t *tenant) name() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// Returns whether t may see j; tenants only see their own jobs
+func (t *tenant) sees(j *job) bool {
+	return t == nil || j.Tenant == t.Name
+}
+
+// Assigns j, submitted by t, to it, checking it is within its budget
+func (t *tenant) claim(j *job) error {
+	j.Tenant = t.name()
+	most := maxPriority
+	if t != nil && t.MaxPriority < most {
+		most = t.MaxPriority
+	}
+	if j.Priority < 0 || j.Priority > most {
+		return fmt.Errorf("priority must be between 0 and %d", most)
+	}
+	if j.Conc != 0 && throttle > maxThrottle {
+		return fmt.Errorf("concurrency can't be set when the server's -c is over %d", maxThrottle)
+	}
+	if j.Conc < 0 || j.Conc > int(throttle) {
+		return fmt.Errorf("concurrency must be at most the server's -c of %d", throttle)
+	}
+	if t == nil || t.Concurrency == 0 {
+		return nil
+	}
+	if j.Conc > t.Concurrency {
+		return fmt.Errorf("concurrency must be at most %d for tenant %s", t.Concurrency, t.Name)
+	}
+	if j.Conc == 0 {
+		j.Conc = t.Concurrency
+	}
+	return nil
+}
+
+// Returns the tenant named name, if any
+func findTenant(name string) *tenant {
+	for i := range cfg.Tenants {
+		if cfg.Tenants[i].Name == name {
+			return &cfg.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// Serves the number of jobs per state and of URLs primed and failed by them
+// per tenant in the Prometheus text format, at /metrics
+func (s *jobServer) metrics(w http.ResponseWriter, r *http.Request) {
+	t := requestTenant(r)
+	type totals struct {
+		states         map[string]int
+		primed, failed int
+	}
+	byTenant := make(map[string]*totals)
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if !t.sees(j) {
+			continue
+		}
+		c := s.snapshot(j)
+		tt := byTenant[c.Tenant]
+		if tt == nil {
+			tt = &totals{states: make(map[string]int)}
+			byTenant[c.Tenant] = tt
+		}
+		tt.states[c.State]++
+		tt.primed += c.Primed
+		tt.failed += c.Failed
+	}
+	s.mu.Unlock()
+	names := make([]string, 0, len(byTenant))
+	for name := range byTenant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# HELP ocp_jobs Jobs by tenant and state.\n# TYPE ocp_jobs gauge\n")
+	for _, name := range names {
+		for _, state := range []string{jobQueued, jobRunning, jobDone, jobFailed} {
+			fmt.Fprintf(&b, "ocp_jobs{tenant=%q,state=%q} %d\n", name, state, byTenant[name].states[state])
+		}
+	}
+	b.WriteString("# HELP ocp_urls_primed_total URLs primed by the jobs of each tenant.\n# TYPE ocp_urls_primed_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "ocp_urls_primed_total{tenant=%q} %d\n", name, byTenant[name].primed)
+	}
+	b.WriteString("# HELP ocp_urls_failed_total URLs that failed in the jobs of each tenant.\n# TYPE ocp_urls_failed_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "ocp_urls_failed_total{tenant=%q} %d\n", name, byTenant[name].failed)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// A tier of URLs in the config, primed at its own pace alongside the other
+// tiers. A URL belongs to the first tier it matches; URLs matching none are
+// primed at the pace set with -c and -rate.
+type tierRule struct {
+	Name        string  `json:"name"`
+	Pattern     string  `json:"pattern"`      // regular expression, if set
+	MinPriority float64 `json:"min_priority"` // the lowest sitemap priority in the tier
+	Concurrency int     `json:"concurrency"`  // URLs primed at once, or 0 for -c
+	Rate        float64 `json:"rate"`         // maximum requests per second, or 0
+
+	re    *regexp.Regexp
+	pacer *controller
+}
+
+// Compiles the patterns and pacing of the tiers in the config
+func compileTiers(tiers []tierRule) error {
+	for i := range tiers {
+		t := &tiers[i]
+		if t.Name == "" {
+			t.Name = fmt.Sprint("tier ", i+1)
+		}
+		if t.Pattern != "" {
+			var err error
+			if t.re, err = regexp.Compile(t.Pattern); err != nil {
+				return fmt.Errorf("tier %s: %v", t.Name, err)
+			}
+		}
+		if t.Concurrency < 0 || t.Rate < 0 {
+			return fmt.Errorf("tier %s: concurrency and rate must not be negative", t.Name)
+		}
+		if t.Concurrency == 0 {
+			t.Concurrency = int(throttle)
+		}
+		t.pacer = newController(uint(t.Concurrency), t.Rate)
+	}
+	return nil
+}
+
+// Returns whether u belongs in the tier
+func (t *tierRule) match(u Url) bool {
+	return u.Priority >= t.MinPriority && (t.re == nil || t.re.MatchString(u.Loc))
+}
+
+// Splits the URLs of urlset into the tiers. The last group holds the URLs
+// that match no tier.
+func tierGroups(urlset *Urlset, tiers []tierRule) [][]Url {
+	groups := make([][]Url, len(tiers)+1)
+	for _, u := range urlset.Url {
+		i := len(tiers)
+		for j := range tiers {
+			if tiers[j].match(u) {
+				i = j
+				break
+			}
+		}
+		groups[i] = append(groups[i], u)
+	}
+	return groups
+}
+
+type tierKey struct{}
+
+// Returns a context whose requests are paced by the tier of u, if any
+func withTier(ctx context.Context, u Url) context.Context {
+	if u.tier == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tierKey{}, u.tier.pacer)
+}
+
+// Primes the tiers of urlset at the same time, each at its own pace. -c still
+// limits the URLs primed at once across all tiers.
+func primeTiers(ctx context.Context, urlset *Urlset, tiers []tierRule) {
+	markSeen(urlset)
+	queue(len(urlset.Url))
+	wg.Add(len(urlset.Url))
+	var tw sync.WaitGroup
+	for i, g := range tierGroups(urlset, tiers) {
+		if len(g) == 0 {
+			continue
+		}
+		var t *tierRule
+		if i < len(tiers) {
+			t = &tiers[i]
+			if verbose {
+				log.Printf("Priming %d URLs of %s\n", len(g), t.Name)
+			}
+		}
+		tw.Add(1)
+		go func(t *tierRule, urls []Url) {
+			defer tw.Done()
+			var tsem chan bool
+			if t != nil {
+				tsem = make(chan bool, t.Concurrency)
+			}
+			for _, u := range urls {
+				if t != nil {
+					tsem <- true
+				}
+				sem <- true
+				u.tier = t
+				go func(u Url) {
+					primeUrl(ctx, u)
+					if t != nil {
+						<-tsem
+					}
+				}(u)
+			}
+		}(t, g)
+	}
+	tw.Wait()
+	wg.Wait()
+}
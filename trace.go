@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time spent in each phase of a request
+type phases struct {
+	DNS, Connect, TLS time.Duration
+	TTFB              time.Duration // from writing the request to the first response byte
+	Download          time.Duration // from the first response byte to the end of the body
+}
+
+var phaseNames = []string{"dns", "connect", "tls", "ttfb", "download"}
+
+func (p phases) list() []time.Duration {
+	return []time.Duration{p.DNS, p.Connect, p.TLS, p.TTFB, p.Download}
+}
+
+// Records how the connection for a request was obtained and when each of its
+// phases started and ended. Dials may finish after the request has been served
+// over another connection, so the trace is locked.
+type requestTrace struct {
+	mu                                      sync.Mutex
+	reused, handshake, resumed              bool
+	addr                                    string
+	dnsStart, connectStart, tlsStart, wrote time.Time
+	firstByte                               time.Time
+	phases                                  phases
+}
+
+// Returns the time since start, or 0 if start is unset
+func since(start time.Time) time.Duration {
+	if start.IsZero() {
+		return 0
+	}
+	return time.Since(start)
+}
+
+// Returns a context that traces the request made with it
+func withTrace(ctx context.Context) (context.Context, *requestTrace) {
+	t := &requestTrace{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.phases.DNS = since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			t.phases.Connect = since(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mu.Lock()
+			t.phases.TLS = since(t.tlsStart)
+			if err == nil {
+				t.handshake = true
+				t.resumed = state.DidResume
+			}
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				t.addr = host
+			}
+			t.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			t.wrote = time.Now()
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now()
+			t.phases.TTFB = since(t.wrote)
+			t.mu.Unlock()
+		},
+	}), t
+}
+
+// Copies the trace into r once the body has been read
+func (t *requestTrace) finish(r *result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r.Reused = t.reused
+	r.Addr = t.addr
+	r.TLSHandshake = t.handshake
+	r.TLSResumed = t.resumed
+	r.Phases = t.phases
+	r.Phases.Download = since(t.firstByte)
+}
+
+// Connection statistics for a host
+type connStats struct {
+	primes, reused, handshakes, resumed int
+}
+
+// Logs per host how many primes reused a connection and how many TLS
+// handshakes resumed a session
+func reportConnStats() {
+	hosts := make(map[string]*connStats)
+	resultsMu.Lock()
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		s := hosts[r.Url.Host()]
+		if s == nil {
+			s = &connStats{}
+			hosts[r.Url.Host()] = s
+		}
+		s.primes++
+		if r.Reused {
+			s.reused++
+		}
+		if r.TLSHandshake {
+			s.handshakes++
+			if r.TLSResumed {
+				s.resumed++
+			}
+		}
+	}
+	resultsMu.Unlock()
+	if len(hosts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(hosts))
+	for h := range hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("Connections by host:\n")
+	for _, h := range names {
+		s := hosts[h]
+		fmt.Fprintf(&b, "  %s: %d primes, %d reused a connection (%.0f%%), %d opened one",
+			h, s.primes, s.reused, 100*float64(s.reused)/float64(s.primes), s.primes-s.reused)
+		if s.handshakes > 0 {
+			fmt.Fprintf(&b, ", %d of %d TLS handshakes resumed a session (%.0f%%)",
+				s.resumed, s.handshakes, 100*float64(s.resumed)/float64(s.handshakes))
+		}
+		b.WriteString("\n")
+	}
+	log.Print(b.String())
+}
+
+// Logs the percentiles of the time spent in each phase of the primes
+func reportPhases() {
+	resultsMu.Lock()
+	all := make([][]time.Duration, len(phaseNames))
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		for i, d := range r.Phases.list() {
+			all[i] = append(all[i], d)
+		}
+	}
+	resultsMu.Unlock()
+	if len(all[0]) == 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Phases:   %10s %10s %10s\n", "p50", "p95", "p99")
+	for i, ds := range all {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Fprintf(&b, "  %-8s", phaseNames[i])
+		for _, p := range []float64{50, 95, 99} {
+			fmt.Fprintf(&b, " %10s", percentile(ds, p).Round(100*time.Microsecond))
+		}
+		b.WriteString("\n")
+	}
+	log.Print(b.String())
+}
+
+// Logs the number of primes, failures and latency percentiles per host and
+// server address
+func reportAddrStats() {
+	type addrStats struct {
+		failed int
+		ds     []time.Duration
+	}
+	addrs := make(map[string]*addrStats)
+	resultsMu.Lock()
+	for _, r := range results {
+		if r.Addr == "" {
+			continue
+		}
+		key := r.Url.Host() + " " + r.Addr
+		s := addrs[key]
+		if s == nil {
+			s = &addrStats{}
+			addrs[key] = s
+		}
+		if r.failed() {
+			s.failed++
+		}
+		s.ds = append(s.ds, r.Duration)
+	}
+	resultsMu.Unlock()
+	if len(addrs) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(addrs))
+	for k := range addrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("Primes by server address:\n")
+	for _, k := range keys {
+		s := addrs[k]
+		sort.Slice(s.ds, func(i, j int) bool { return s.ds[i] < s.ds[j] })
+		fmt.Fprintf(&b, "  %s: %d primes, %d failed, p50 %s, p95 %s\n", k, len(s.ds), s.failed,
+			percentile(s.ds, 50).Round(time.Millisecond), percentile(s.ds, 95).Round(time.Millisecond))
+	}
+	log.Print(b.String())
+}
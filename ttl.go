@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ttlsMu sync.Mutex
+	ttls   = make(map[string]time.Duration) // by URL, or -1 if missing
+)
+
+// Returns how long a shared cache may keep a response with the headers h, per
+// its Cache-Control s-maxage or max-age, and whether that is set. Responses
+// that mustn't be kept have a TTL of 0.
+func cacheTTL(h http.Header) (time.Duration, bool) {
+	var (
+		ttl     time.Duration
+		sMax    bool
+		haveTTL bool
+	)
+	for _, d := range strings.Split(strings.ToLower(h.Get("Cache-Control")), ",") {
+		d = strings.TrimSpace(d)
+		switch {
+		case d == "no-store", d == "no-cache", d == "private":
+			return 0, true
+		case strings.HasPrefix(d, "s-maxage="):
+			if n, err := strconv.Atoi(strings.Trim(d[9:], `"`)); err == nil {
+				ttl, sMax, haveTTL = time.Duration(n)*time.Second, true, true
+			}
+		case strings.HasPrefix(d, "max-age=") && !sMax:
+			if n, err := strconv.Atoi(strings.Trim(d[8:], `"`)); err == nil {
+				ttl, haveTTL = time.Duration(n)*time.Second, true
+			}
+		}
+	}
+	return ttl, haveTTL
+}
+
+// Notes the TTL of the response res to u for -min-ttl, if it was successful
+func auditTTL(u Url, res *http.Response) {
+	if res.StatusCode >= 300 {
+		return
+	}
+	ttl, ok := cacheTTL(res.Header)
+	if !ok {
+		ttl = -1
+	}
+	ttlsMu.Lock()
+	ttls[u.Loc] = ttl
+	ttlsMu.Unlock()
+}
+
+// Logs the sections with pages whose TTL is below -min-ttl or missing, those
+// with the most first, and with -v the pages. Returns the number of pages.
+func reportTTLs() int {
+	type tally struct{ short, missing int }
+	sections := make(map[string]*tally)
+	var pages []string
+	ttlsMu.Lock()
+	for loc, ttl := range ttls {
+		if ttl >= minTTL {
+			continue
+		}
+		s := loc
+		if parsed, err := url.Parse(loc); err == nil {
+			s = section(parsed)
+		}
+		c := sections[s]
+		if c == nil {
+			c = &tally{}
+			sections[s] = c
+		}
+		if ttl < 0 {
+			c.missing++
+			pages = append(pages, loc+" (no max-age)")
+		} else {
+			c.short++
+			pages = append(pages, fmt.Sprintf("%s (%s)", loc, ttl))
+		}
+	}
+	ttlsMu.Unlock()
+	if len(pages) == 0 {
+		if verbose {
+			log.Printf("All pages are cached for at least %s\n", minTTL)
+		}
+		return 0
+	}
+	keys := make([]string, 0, len(sections))
+	for s := range sections {
+		keys = append(keys, s)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := sections[keys[i]], sections[keys[j]]
+		if a.short+a.missing != b.short+b.missing {
+			return a.short+a.missing > b.short+b.missing
+		}
+		return keys[i] < keys[j]
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "Pages cached for less than %s by section:\n", minTTL)
+	fmt.Fprintf(&b, "  %7s  %7s  %s\n", "short", "missing", "section")
+	for _, s := range keys {
+		fmt.Fprintf(&b, "  %7d  %7d  %s\n", sections[s].short, sections[s].missing, s)
+	}
+	if verbose {
+		sort.Strings(pages)
+		b.WriteString("Pages cached for less than -min-ttl:\n")
+		for _, p := range pages {
+			fmt.Fprintf(&b, "  %s\n", p)
+		}
+	}
+	log.Print(b.String())
+	return len(pages)
+}
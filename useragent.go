@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	userAgents []string // read from -ua-file
+	uaMu       sync.Mutex
+	uaNext     int
+)
+
+// Reads the User-Agents in path, one per line, skipping blank lines and
+// comments starting with #
+func loadUserAgents(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var uas []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			uas = append(uas, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(uas) == 0 {
+		return nil, fmt.Errorf("%s lists no User-Agents", path)
+	}
+	return uas, nil
+}
+
+// Returns the next User-Agent from -ua-file, in the -ua-order
+func nextUserAgent() string {
+	if uaOrder == "random" {
+		return userAgents[rand.Intn(len(userAgents))]
+	}
+	uaMu.Lock()
+	defer uaMu.Unlock()
+	ua := userAgents[uaNext]
+	uaNext = (uaNext + 1) % len(userAgents)
+	return ua
+}
+
+type userAgentKey struct{}
+
+// Returns a context whose GET requests made with get send the next
+// User-Agent from -ua-file, and the User-Agent
+func withUserAgent(ctx context.Context) (context.Context, string) {
+	ua := nextUserAgent()
+	return context.WithValue(ctx, userAgentKey{}, ua), ua
+}
+
+// Reads -ua-file and validates -ua-order
+func setupUserAgents() error {
+	if uaOrder != "sequential" && uaOrder != "random" {
+		return fmt.Errorf("invalid -ua-order %q (expected sequential or random)", uaOrder)
+	}
+	var err error
+	userAgents, err = loadUserAgents(uaFile)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// The layouts of the W3C Datetime format used for lastmod
+var lastmodLayouts = []string{
+	"2006-01-02",
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01",
+	"2006",
+}
+
+// Parses a sitemap lastmod value
+func parseLastmod(s string) (time.Time, error) {
+	for _, layout := range lastmodLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid lastmod %q (expected W3C Datetime, e.g. 2012-01-02 or 2012-01-02T15:04:05Z)", s)
+}
+
+// Returns the problems found with the entries in urlset
+func validateUrlset(urlset *Urlset) []string {
+	var (
+		problems []string
+		locs     = make(map[string]bool, len(urlset.Url))
+	)
+	for _, u := range urlset.Url {
+		parsed, err := url.Parse(u.Loc)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid URL: %v", u.Loc, err))
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s: not an absolute HTTP(S) URL", u.Loc))
+		}
+		if len(u.Loc) > 2048 {
+			problems = append(problems, fmt.Sprintf("%s: longer than 2048 characters", u.Loc))
+		}
+		if locs[u.Loc] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate URL", u.Loc))
+		}
+		locs[u.Loc] = true
+		if u.Priority < 0 || u.Priority > 1 {
+			problems = append(problems, fmt.Sprintf("%s: priority %g is not between 0.0 and 1.0", u.Loc, u.Priority))
+		}
+		if u.Lastmod != "" {
+			if _, err := parseLastmod(u.Lastmod); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", u.Loc, err))
+			}
+		}
+	}
+	return problems
+}
+
+func runValidate(args []string) int {
+	if !haveInput(args) {
+		fmt.Println("Error: no sitemap or URLs given")
+		return 2
+	}
+	ctx, err := setupRequests()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	urlset, ok := loadUrlset(ctx, args)
+	if !ok {
+		return 1
+	}
+	problems := validateUrlset(urlset)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d URLs, %d problems\n", len(urlset.Url), len(problems))
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The kinds of variants primed with -also-variants
+var variantKinds = make(map[string]bool)
+
+func parseVariants(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		switch v {
+		case "":
+		case "scheme", "www", "slash":
+			variantKinds[v] = true
+		default:
+			return fmt.Errorf("invalid -also-variants value %q (expected scheme, www or slash)", v)
+		}
+	}
+	return nil
+}
+
+// Returns the other scheme of an http or https URL
+func toggleScheme(u *url.URL) bool {
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "https"
+	case "https":
+		u.Scheme = "http"
+	default:
+		return false
+	}
+	return true
+}
+
+// Adds or removes the www. prefix of the host name
+func toggleWww(u *url.URL) bool {
+	host := u.Hostname()
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return false
+	}
+	if strings.HasPrefix(host, "www.") {
+		host = host[4:]
+	} else {
+		host = "www." + host
+	}
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return true
+}
+
+// Adds or removes the trailing slash of the path, unless it is the root or
+// ends in a file name
+func toggleSlash(u *url.URL) bool {
+	p := u.EscapedPath()
+	switch {
+	case p == "" || p == "/":
+		return false
+	case strings.HasSuffix(p, "/"):
+		p = strings.TrimSuffix(p, "/")
+	case strings.Contains(p[strings.LastIndex(p, "/")+1:], "."):
+		return false
+	default:
+		p += "/"
+	}
+	u.RawPath = p
+	u.Path, _ = url.PathUnescape(p)
+	return true
+}
+
+// Returns every combination of the enabled kinds of variants of loc, except
+// loc itself
+func variants(loc string) []string {
+	if _, err := url.Parse(loc); err != nil {
+		return nil
+	}
+	locs := []string{loc}
+	for _, v := range []struct {
+		kind   string
+		toggle func(*url.URL) bool
+	}{
+		{"scheme", toggleScheme},
+		{"www", toggleWww},
+		{"slash", toggleSlash},
+	} {
+		if !variantKinds[v.kind] {
+			continue
+		}
+		for _, l := range locs {
+			u, _ := url.Parse(l)
+			if v.toggle(u) {
+				locs = append(locs, u.String())
+			}
+		}
+	}
+	return locs[1:]
+}
+
+// Enqueues the variants of each URL from the input, and reports variants that
+// were served without redirecting to the URL they are a variant of
+func primeVariants(ctx context.Context, u Url, res *http.Response, body []byte) {
+	if u.variantOf != "" {
+		if res.StatusCode < 300 && res.Request != nil && res.Request.URL.String() == u.Loc && !nowarn {
+			log.Printf("Variant %s of %s does not redirect\n", u.Loc, u.variantOf)
+		}
+		return
+	}
+	if u.depth > 0 {
+		return
+	}
+	for _, loc := range variants(u.Loc) {
+		if enqueue(ctx, u.Loc, Url{Loc: loc, Priority: u.Priority, depth: 1, variantOf: u.Loc}) && verbose {
+			log.Printf("Priming variant of %s: %s\n", u.Loc, loc)
+		}
+	}
+}
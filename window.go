@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A period of the day, in minutes after midnight; end may be before start if
+// the window spans midnight
+type window struct {
+	start, end int
+}
+
+// The approved windows of the day in which requests may be sent, per -window
+type schedule struct {
+	windows []window
+	days    [7]bool // the weekdays on which the windows start
+	loc     *time.Location
+}
+
+// Parses a -window such as "01:00-06:00", "22:00-02:00,12:00-13:00
+// Europe/Berlin" or "Mon-Fri 22:00-06:00 Europe/London", defaulting to every
+// day and the local time zone
+func parseSchedule(s string) (*schedule, error) {
+	sc := &schedule{loc: time.Local}
+	fields := strings.Fields(s)
+	if n := len(fields); n > 1 && !startsWithDigit(fields[n-1]) {
+		loc, err := time.LoadLocation(fields[n-1])
+		if err != nil {
+			return nil, err
+		}
+		sc.loc = loc
+		fields = fields[:n-1]
+	}
+	if len(fields) > 1 && !startsWithDigit(fields[0]) {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		sc.days = days
+		fields = fields[1:]
+	} else {
+		for i := range sc.days {
+			sc.days[i] = true
+		}
+	}
+	for _, w := range strings.Split(strings.Join(fields, ""), ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(w), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, expected e.g. 01:00-06:00", w)
+		}
+		start, err := minuteOfDay(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := minuteOfDay(to)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("window %q is empty", w)
+		}
+		sc.windows = append(sc.windows, window{start, end})
+	}
+	return sc, nil
+}
+
+func startsWithDigit(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+// Parses weekdays such as "Mon-Fri" or "Sat,Sun"
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, r := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(r, "-")
+		if !ok {
+			to = from
+		}
+		first, err := weekday(from)
+		if err != nil {
+			return days, err
+		}
+		last, err := weekday(to)
+		if err != nil {
+			return days, err
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func weekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if len(s) >= 3 && strings.HasPrefix(strings.ToLower(d.String()), strings.ToLower(s)) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q, expected e.g. Mon-Fri", s)
+}
+
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Whether t is within one of the windows
+func (sc *schedule) open(t time.Time) bool {
+	t = t.In(sc.loc)
+	var (
+		m         = t.Hour()*60 + t.Minute()
+		today     = sc.days[t.Weekday()]
+		yesterday = sc.days[(t.Weekday()+6)%7]
+	)
+	for _, w := range sc.windows {
+		if w.start < w.end && today && m >= w.start && m < w.end ||
+			w.start > w.end && (today && m >= w.start || yesterday && m < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// The first time after t at which a window opens or closes
+func (sc *schedule) next(t time.Time) time.Time {
+	t = t.In(sc.loc)
+	var first time.Time
+	for day := 0; day <= 7; day++ {
+		date := t.AddDate(0, 0, day)
+		y, mo, d := date.Date()
+		for _, w := range sc.windows {
+			// The end of a window spanning midnight is on the next day
+			ends := date
+			if w.start > w.end {
+				ends = date.AddDate(0, 0, -1)
+			}
+			for _, m := range []int{w.start, w.end} {
+				if m == w.start && !sc.days[date.Weekday()] || m == w.end && !sc.days[ends.Weekday()] {
+					continue
+				}
+				b := time.Date(y, mo, d, m/60, m%60, 0, 0, sc.loc)
+				if b.After(t) && (first.IsZero() || b.Before(first)) {
+					first = b
+				}
+			}
+		}
+	}
+	return first
+}
+
+// Pauses requests outside of the windows of sc and resumes them inside, from
+// now on
+func (c *controller) keepWindow(sc *schedule) {
+	next := c.applyWindow(sc, time.Now())
+	go func() {
+		for {
+			time.Sleep(time.Until(next))
+			next = c.applyWindow(sc, time.Now())
+		}
+	}()
+}
+
+// Pauses or resumes requests per whether now is within sc, logging any
+// change, and returns when that is next to be checked
+func (c *controller) applyWindow(sc *schedule, now time.Time) time.Time {
+	open := sc.open(now)
+	next := sc.next(now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if open == c.closed {
+		c.block(c.paused, !open)
+		if open {
+			log.Printf("Within the -window, resuming until %s\n", next.Format("Jan 2 15:04 MST"))
+		} else {
+			log.Printf("Outside the -window, pausing until %s\n", next.Format("Jan 2 15:04 MST"))
+		}
+	}
+	return next
+}